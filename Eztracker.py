@@ -8,13 +8,37 @@ import re
 import shutil
 
 # constants
+EXIT_CODE_NETWORK_ERROR = 102
 EXIT_CODE_CONFIG_PARSE_ERROR = 103
 EXIT_CODE_API_KEY_ERROR = 104
+EXIT_CODE_INVALID_INPUT = 105
+EXIT_CODE_REQUEST_REJECTED = 106
+EXIT_CODE_SERVER_ERROR = 107
 VERSION = "0.0.1"
 HOME_FOLDER = os.path.realpath(os.path.expanduser("~"))
-CONFIG_FILE = os.join.path(HOME_FOLDER, ".eztracker.cfg") 
 PLUGIN_NAME = "eztracker-sublime"
 
+
+def config_file():
+	"""Finds the config like the CLI does: the XDG one (%APPDATA% on
+	Windows), else ~/.eztracker.cfg from before, else a new XDG one."""
+	legacy = os.path.join(HOME_FOLDER, ".eztracker.cfg")
+	if os.name == "nt":
+		base = os.environ.get("APPDATA", "")
+	else:
+		base = os.environ.get("XDG_CONFIG_HOME", "")
+		if not os.path.isabs(base):
+			base = os.path.join(HOME_FOLDER, ".config")
+	if not base:
+		return legacy
+	path = os.path.join(base, "eztracker", "eztracker.cfg")
+	if os.path.exists(path) or not os.path.exists(legacy):
+		return path
+	return legacy
+
+
+CONFIG_FILE = config_file()
+
 class EztrackerConfig:
 	def __init__(self):
 		self.api_key = ""
@@ -70,7 +94,7 @@ class EztrackerConfig:
 		log_debug("LOG API KEY {self.api_key}")
 		if not self.api_key:
 			sublime.message_dialog(
-				"[Eztracker] API key not found. Set API_KEY env var or add to ~/.eztracker.cfg"
+				"[Eztracker] API key not found. Set API_KEY env var or add to " + CONFIG_FILE
 				)
 			return False
 		return True
@@ -224,12 +248,17 @@ def send_heartbeats():
 	try:
 		result = subprocess.run(cmd, capture_output=True, text=True)
 		if result.returncode == EXIT_CODE_API_KEY_ERROR:
-			sublime.message_dialog("[Eztracker] Invalid API Key. Update in ~/.eztracker.cfg")
+			sublime.message_dialog("[Eztracker] Invalid API Key. Update in " + CONFIG_FILE)
 			state.initialized = False
 		elif result.returncode == EXIT_CODE_CONFIG_PARSE_ERROR:
 			sublime.message_dialog(
 				"[Eztracker] CLI error (code {result.returncode}): {result.stderr}"
 			)
+		elif result.returncode == EXIT_CODE_NETWORK_ERROR:
+			log_debug(f"Could not reach the eztracker server: {result.stderr}")
+		elif result.returncode in (EXIT_CODE_INVALID_INPUT,
+				EXIT_CODE_REQUEST_REJECTED, EXIT_CODE_SERVER_ERROR):
+			log_debug(f"CLI error (code {result.returncode}): {result.stderr}")
 		elif state.config.debug:
 			log_debug("CLI output: {result.stdout}")
 	except FileNotFoundError:
@@ -0,0 +1,1165 @@
+// Package client is a Go client for the eztracker server API, for plugins,
+// bots and other tools that want to send heartbeats or read summaries
+// without going through the CLI.
+//
+//	c := client.New("http://localhost:8080", apiKey)
+//	err := c.SendHeartbeats([]client.Heartbeat{{
+//		UserID: "me", Project: "eztracker", Language: "Go",
+//		Entity: "/src/eztracker/main.go", Duration: 30, Timestamp: time.Now().Unix(),
+//	}})
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeartbeatVersion is the heartbeat wire format the client sends. Servers
+// list the versions they accept in Version.HeartbeatVersions.
+const HeartbeatVersion = 2
+
+// DefaultGzipThreshold is the Client.GzipThreshold of New clients.
+const DefaultGzipThreshold = 1024
+
+// Heartbeat is a span of activity in one entity.
+type Heartbeat struct {
+	// Version is set to HeartbeatVersion when sending.
+	Version int    `json:"version"`
+	UserID  string `json:"user_id"`
+	Project string `json:"project"`
+	// ProjectRoot is the directory the project is checked out in, if
+	// known.
+	ProjectRoot string `json:"project_root,omitempty"`
+	Language    string `json:"language"`
+	// Entity is a file path, application or domain depending on
+	// EntityType, which defaults to "file".
+	Entity     string `json:"entity"`
+	EntityType string `json:"entity_type,omitempty"`
+	Category   string `json:"category,omitempty"`
+	Branch     string `json:"branch,omitempty"`
+	// Machine is the host or container the heartbeat is sent from.
+	Machine      string   `json:"machine,omitempty"`
+	Duration     float64  `json:"duration"`
+	Timestamp    int64    `json:"timestamp"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	SessionID    string   `json:"session_id,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// ManualEntry is time logged by hand for work no editor saw, such as
+// meetings.
+type ManualEntry struct {
+	ID        int64    `json:"id,omitempty"`
+	UserID    string   `json:"user_id"`
+	Project   string   `json:"project"`
+	Duration  float64  `json:"duration"`
+	Timestamp int64    `json:"timestamp"`
+	Note      string   `json:"note"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// Bucket is the time tracked for one project, language, tag, etc. Project
+// buckets in stats and reports carry the project's color and description.
+type Bucket struct {
+	Name        string  `json:"name"`
+	Duration    float64 `json:"duration"`
+	Color       string  `json:"color,omitempty"`
+	Description string  `json:"description,omitempty"`
+}
+
+// Stats is the time a user tracked over a range of UTC days, in seconds.
+type Stats struct {
+	From       string      `json:"from"`
+	To         string      `json:"to"`
+	Total      float64     `json:"total"`
+	Projects   []Bucket    `json:"projects"`
+	Workspaces []Bucket    `json:"workspaces"`
+	Languages  []Bucket    `json:"languages"`
+	Categories []Bucket    `json:"categories"`
+	Previous   *Comparison `json:"previous"`
+}
+
+// Comparison is the period of the same length right before a Stats range,
+// with how much the time changed since, in seconds.
+type Comparison struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Total    float64  `json:"total"`
+	Delta    float64  `json:"delta"`
+	Projects []Change `json:"projects"`
+}
+
+// Change is how the time spent in a project changed, biggest gain first.
+type Change struct {
+	Name     string  `json:"name"`
+	Previous float64 `json:"previous"`
+	Delta    float64 `json:"delta"`
+}
+
+// Report is the time a user tracked over a month or a year, in seconds,
+// with the total of every day of the month or month of the year.
+type Report struct {
+	Period     string        `json:"period"`
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Total      float64       `json:"total"`
+	DaysActive int           `json:"days_active"`
+	DaysOff    int           `json:"days_off"`
+	Periods    []Bucket      `json:"periods"`
+	Projects   []Bucket      `json:"projects"`
+	Workspaces []Bucket      `json:"workspaces"`
+	Languages  []Bucket      `json:"languages"`
+	Notes      []Note        `json:"notes"`
+	Review     *YearInReview `json:"review,omitempty"`
+}
+
+// Note explains a day or range of days in reports, such as a conference or
+// a vacation. From and To are UTC dates, both included; To defaults to From.
+type Note struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Text   string `json:"text"`
+}
+
+// TimeOff is a range of days a user is out of office, which neither break
+// nor extend streaks. From and To are UTC dates, both included; To defaults
+// to From.
+type TimeOff struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// Webhook is a URL a user's milestones are POSTed to: "goal.completed",
+// "record.daily" and "streak.milestone", all of them when Events is empty.
+// Secret signs them; it is generated if left empty, and only returned by
+// AddWebhook.
+type Webhook struct {
+	ID        int64    `json:"id"`
+	UserID    string   `json:"user_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// Script is Lua source run over every heartbeat as it comes in, which may
+// change the global heartbeat table's project, language, entity, category,
+// branch and tags, or return false to drop the heartbeat.
+type Script struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// DomainRule sets the category of a user's browsing time on a domain and
+// its subdomains.
+type DomainRule struct {
+	UserID   string `json:"user_id"`
+	Domain   string `json:"domain"`
+	Category string `json:"category"`
+}
+
+// Rule reclassifies heartbeats as the server receives them: those matching
+// every one of its non-empty match fields get its non-empty set fields, and
+// its tags on top of their own. MatchPath is a pattern for the whole path
+// in which * matches any part of it, slashes included.
+type Rule struct {
+	ID            int64    `json:"id,omitempty"`
+	UserID        string   `json:"user_id"`
+	MatchPath     string   `json:"match_path,omitempty"`
+	MatchLanguage string   `json:"match_language,omitempty"`
+	MatchMachine  string   `json:"match_machine,omitempty"`
+	SetProject    string   `json:"set_project,omitempty"`
+	SetCategory   string   `json:"set_category,omitempty"`
+	SetTags       []string `json:"set_tags,omitempty"`
+}
+
+// RulesApplied says how many heartbeats ApplyRules changed.
+type RulesApplied struct {
+	Changed int64 `json:"changed"`
+}
+
+// YearInReview holds the highlights of a yearly report.
+type YearInReview struct {
+	BusiestDay    Bucket `json:"busiest_day"`
+	BusiestMonth  Bucket `json:"busiest_month"`
+	LongestStreak int    `json:"longest_streak"`
+	TopProject    string `json:"top_project"`
+	TopLanguage   string `json:"top_language"`
+}
+
+// Aggregate is the time a user tracked over a range of UTC days, grouped by
+// GroupBy. Each group has one key per dimension plus "duration" in seconds.
+type Aggregate struct {
+	From    string                   `json:"from"`
+	To      string                   `json:"to"`
+	GroupBy []string                 `json:"group_by"`
+	Total   float64                  `json:"total"`
+	Groups  []map[string]interface{} `json:"groups"`
+}
+
+// QueryResult is the table a query returns, with one value per column in
+// each row.
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// NotificationPrefs are when and how a user gets their weekly summary.
+// Weekday and Hour are in Timezone, with Sunday as 0. Channels is currently
+// empty or "email". Alerts turns on messages about unusual days, such as
+// more than AlertHours tracked. Weeks start on WeekStart and days at
+// DayStartHour in UTC, in stats as well as summaries. Locale is the
+// language summaries, alerts and reports are written in, and DurationFormat
+// "human", "hh:mm", "decimal" or "" for the locale's. Webhooks fire on
+// reaching DailyGoalMinutes of coding in a day, unless it is 0.
+type NotificationPrefs struct {
+	UserID           string   `json:"user_id"`
+	Enabled          bool     `json:"enabled"`
+	Weekday          int      `json:"weekday"`
+	Hour             int      `json:"hour"`
+	Timezone         string   `json:"timezone"`
+	Channels         []string `json:"channels"`
+	Alerts           bool     `json:"alerts"`
+	AlertHours       int      `json:"alert_hours"`
+	WeekStart        int      `json:"week_start"`
+	DayStartHour     int      `json:"day_start_hour"`
+	Locale           string   `json:"locale"`
+	DurationFormat   string   `json:"duration_format"`
+	DailyGoalMinutes int      `json:"daily_goal_minutes"`
+}
+
+// Project is a user's project with its settings. Root is where it is
+// checked out, as the CLI last reported it. KeystrokeTimeout, in seconds, is
+// 0 to use the default. Color is "#rrggbb" or "". Workspace groups projects
+// for stats and reports. Archived projects are left out of stats and
+// project lists by default.
+type Project struct {
+	ID               int64   `json:"id"`
+	UserID           string  `json:"user_id"`
+	Name             string  `json:"name"`
+	Root             string  `json:"root"`
+	KeystrokeTimeout int     `json:"keystroke_timeout"`
+	Color            string  `json:"color"`
+	Description      string  `json:"description"`
+	Billable         bool    `json:"billable"`
+	HourlyRate       float64 `json:"hourly_rate"`
+	Workspace        string  `json:"workspace"`
+	Archived         bool    `json:"archived"`
+	// AggregateOnly projects keep only the time and language of
+	// heartbeats, with their category, tags and machine, but no paths or
+	// branches.
+	AggregateOnly bool `json:"aggregate_only"`
+}
+
+// Workspace is a group of a user's projects.
+type Workspace struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects"`
+}
+
+// LiveToday is a user's time today and, while they are active, the project
+// and language they are working on.
+type LiveToday struct {
+	UserID        string  `json:"user_id"`
+	Seconds       float64 `json:"seconds"`
+	Project       string  `json:"project,omitempty"`
+	Language      string  `json:"language,omitempty"`
+	LastHeartbeat int64   `json:"last_heartbeat,omitempty"`
+	Active        bool    `json:"active"`
+}
+
+// Version is the server's release metadata.
+type Version struct {
+	Version           string `json:"version"`
+	MinCLIVersion     string `json:"min_cli_version"`
+	HeartbeatVersions []int  `json:"heartbeat_versions"`
+}
+
+// APIKey describes an API key; Source is "config" for the server key,
+// "database" for user keys and "jwt" for dashboard sessions. Scope is "all",
+// "read" or "write".
+type APIKey struct {
+	ID         int64  `json:"id,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Scope      string `json:"scope"`
+	CreatedAt  int64  `json:"created_at,omitempty"`
+	LastUsedAt int64  `json:"last_used_at,omitempty"`
+}
+
+// KeyUsage is where a user API key was used from, one per source IP. Times
+// are unix seconds.
+type KeyUsage struct {
+	KeyID     int64  `json:"key_id"`
+	IP        string `json:"ip"`
+	Country   string `json:"country"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Requests  int64  `json:"requests"`
+}
+
+// KeyStats counts the requests made with a user API key over the days
+// listed in Days, oldest first, and the ones answered with an error.
+// ErrorRate is the share of those, LastError the method, route and status
+// of the latest. Times are unix seconds.
+type KeyStats struct {
+	KeyID        int64    `json:"key_id"`
+	Requests     int64    `json:"requests"`
+	ClientErrors int64    `json:"client_errors"`
+	ServerErrors int64    `json:"server_errors"`
+	ErrorRate    float64  `json:"error_rate"`
+	LastSeen     int64    `json:"last_seen"`
+	LastStatus   int      `json:"last_status"`
+	LastError    string   `json:"last_error,omitempty"`
+	LastErrorAt  int64    `json:"last_error_at,omitempty"`
+	UserAgent    string   `json:"user_agent"`
+	Days         []KeyDay `json:"days"`
+}
+
+// KeyDay counts the requests made with a user API key on a UTC day.
+type KeyDay struct {
+	Day          string `json:"day"`
+	Requests     int64  `json:"requests"`
+	ClientErrors int64  `json:"client_errors"`
+	ServerErrors int64  `json:"server_errors"`
+}
+
+// TokenPair are the tokens of a dashboard session. AccessToken works as the
+// client key until ExpiresAt, in unix seconds; RefreshToken gets the next
+// pair, once.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+// Job is a background job on the server, such as a backfill. Status is
+// running, done or failed; Processed of Size bytes of input have been read
+// so far.
+type Job struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	UserID     string `json:"user_id"`
+	Status     string `json:"status"`
+	Size       int64  `json:"size"`
+	Processed  int64  `json:"processed"`
+	Stored     int64  `json:"stored"`
+	Rejected   int64  `json:"rejected"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+// Maintenance is the server's maintenance mode, during which it answers
+// heartbeats with 503 and a Retry-After of RetryAfter seconds, 300 unless
+// set, so that clients queue them. Since is when it was turned on.
+type Maintenance struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Since      int64  `json:"since,omitempty"`
+}
+
+// TaskRun is how a scheduled server task has been doing: the scheduled time
+// of its last run in unix seconds, how long it took and why it failed, and
+// how often it ran and failed in total.
+type TaskRun struct {
+	Name       string `json:"name"`
+	LastRun    int64  `json:"last_run"`
+	DurationMS int64  `json:"duration_ms"`
+	LastError  string `json:"last_error,omitempty"`
+	Runs       int64  `json:"runs"`
+	Failures   int64  `json:"failures"`
+}
+
+// Whoami describes the API key the client authenticates with. UserID is
+// empty for the server key.
+type Whoami struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Key    APIKey `json:"key"`
+}
+
+// EmailStatus is a user's email address and whether it was verified;
+// summaries and alerts are only sent to verified addresses.
+type EmailStatus struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// Plugin is an editor plugin install announcing itself to the server.
+type Plugin struct {
+	ID        int64  `json:"id,omitempty"`
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Machine   string `json:"machine"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
+}
+
+// PluginHints are settings the server wants plugins to use, with durations
+// in seconds.
+type PluginHints struct {
+	KeystrokeTimeout  int `json:"keystroke_timeout"`
+	HeartbeatInterval int `json:"heartbeat_interval"`
+	BatchSize         int `json:"batch_size"`
+}
+
+// HeartbeatBatchResult says which heartbeats of a batch the server stored.
+// The rejected ones would be rejected again if resent.
+type HeartbeatBatchResult struct {
+	Accepted int                 `json:"accepted"`
+	Rejected []RejectedHeartbeat `json:"rejected"`
+}
+
+// RejectedHeartbeat is a heartbeat of a batch the server rejected, by its
+// index in the batch.
+type RejectedHeartbeat struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// StreamAck is the server's answer to the heartbeats of a stream. Received
+// counts the lines it has handled since the stream opened; Accepted and
+// Rejected are about those since the previous ack, Rejected indexed by line
+// from 0. Error ends the stream, with RetryAfter in seconds during
+// maintenance.
+type StreamAck struct {
+	Received   int                 `json:"received"`
+	Accepted   int                 `json:"accepted"`
+	Rejected   []RejectedHeartbeat `json:"rejected"`
+	Error      string              `json:"error,omitempty"`
+	RetryAfter int                 `json:"retry_after,omitempty"`
+}
+
+// HeartbeatDeletion says how many heartbeats DeleteHeartbeats removed, or
+// would have for a dry run.
+type HeartbeatDeletion struct {
+	Deleted int64 `json:"deleted"`
+	DryRun  bool  `json:"dry_run"`
+}
+
+// Reclassification is what ReclassifyHeartbeats gives heartbeats: another
+// project, another language or both.
+type Reclassification struct {
+	Project  string `json:"project,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// HeartbeatEdit records a reclassification of heartbeats: the filter that
+// selected them, what they were given, how many there were and the name of
+// the API key that made it.
+type HeartbeatEdit struct {
+	ID            int64  `json:"id"`
+	UserID        string `json:"user_id"`
+	From          string `json:"from,omitempty"`
+	To            string `json:"to,omitempty"`
+	FilterProject string `json:"filter_project,omitempty"`
+	PathPrefix    string `json:"path_prefix,omitempty"`
+	Project       string `json:"project,omitempty"`
+	Language      string `json:"language,omitempty"`
+	Heartbeats    int64  `json:"heartbeats"`
+	EditedBy      string `json:"edited_by"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// NetworkError means a request never got a response from the server.
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string { return "failed to send request: " + e.Err.Error() }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// Retryable reports whether a request may succeed when sent again later:
+// the server couldn't be reached or is down for maintenance (503).
+func Retryable(err error) bool {
+	var netErr *NetworkError
+	var srvErr *Error
+	return errors.As(err, &netErr) || errors.As(err, &srvErr) && srvErr.StatusCode == http.StatusServiceUnavailable
+}
+
+// Error is a non-2xx response from the server. Message and RequestID are
+// set when the server sent a JSON error; the request ID is what to quote
+// to the server's admin.
+type Error struct {
+	StatusCode int
+	Body       string
+	Message    string
+	RequestID  string
+	// RetryAfter is how long the server asked to wait before trying
+	// again, from the Retry-After header of 503 and 429 responses.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Body)
+	}
+	if e.RequestID == "" {
+		return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("server returned %d: %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+}
+
+type Client struct {
+	URL string
+	Key string
+
+	// UserAgent identifies the plugin sending requests.
+	UserAgent string
+
+	// GzipThreshold is the size in bytes above which heartbeat batches are
+	// sent gzipped; they never are when it is 0.
+	GzipThreshold int
+
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at url authenticating with key.
+func New(url, key string) *Client {
+	return &Client{
+		URL:           strings.TrimSuffix(url, "/"),
+		Key:           key,
+		UserAgent:     "eztracker-client",
+		GzipThreshold: DefaultGzipThreshold,
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Do calls a JSON endpoint on the server, sending payload when it is non-nil
+// and decoding the response into out when it is non-nil.
+func (c *Client) Do(method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	return c.do(method, path, "application/json", "", body, out)
+}
+
+// do sends body of contentType, compressed with contentEncoding if not "",
+// and decodes the JSON response into out when it is non-nil.
+func (c *Client) do(method, path, contentType, contentEncoding string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return &NetworkError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+	}
+	return nil
+}
+
+// responseError reads a non-2xx response into an Error.
+func responseError(resp *http.Response) *Error {
+	data, _ := io.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	var body struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		apiErr.Message, apiErr.RequestID = body.Error, body.RequestID
+	}
+	return apiErr
+}
+
+// SendHeartbeats sends heartbeats in order, stopping at the first failure.
+func (c *Client) SendHeartbeats(heartbeats []Heartbeat) error {
+	for _, hb := range heartbeats {
+		hb.Version = HeartbeatVersion
+		if err := c.Do("POST", "/heartbeat", hb, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendHeartbeatBatch sends heartbeats in a single request, gzipped when
+// larger than GzipThreshold. Servers before batches answer 404. Heartbeats
+// the server rejects are listed in the result rather than failing the
+// batch.
+func (c *Client) SendHeartbeatBatch(heartbeats []Heartbeat) (HeartbeatBatchResult, error) {
+	batch := make([]Heartbeat, len(heartbeats))
+	for i, hb := range heartbeats {
+		hb.Version = HeartbeatVersion
+		batch[i] = hb
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return HeartbeatBatchResult{}, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	encoding := ""
+	if c.GzipThreshold > 0 && len(data) > c.GzipThreshold {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return HeartbeatBatchResult{}, fmt.Errorf("failed to compress request: %v", err)
+		}
+		data, encoding = compressed.Bytes(), "gzip"
+	}
+
+	var result HeartbeatBatchResult
+	err = c.do("POST", "/heartbeats", "application/json", encoding, bytes.NewReader(data), &result)
+	return result, err
+}
+
+// HeartbeatStream is a long-lived request sending heartbeats one per line,
+// for agents that send many over a slow link. The server stores them every
+// second or so and answers each time with a StreamAck, which Ack reads.
+type HeartbeatStream struct {
+	body *io.PipeWriter
+	resp *http.Response
+	acks *json.Decoder
+}
+
+// StreamHeartbeats opens a heartbeat stream. Servers before streams answer
+// 404. The stream isn't bound by the HTTP client's timeout; Close it when
+// done.
+func (c *Client) StreamHeartbeats() (*HeartbeatStream, error) {
+	r, w := io.Pipe()
+	req, err := http.NewRequest("POST", c.URL+"/heartbeats/stream", r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", c.UserAgent)
+	// The stream has a connection of its own, and asking to close it lets
+	// the server refuse the stream without first waiting for the body
+	req.Close = true
+
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = 0
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		w.Close()
+		return nil, &NetworkError{Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		w.Close()
+		return nil, responseError(resp)
+	}
+	return &HeartbeatStream{body: w, resp: resp, acks: json.NewDecoder(resp.Body)}, nil
+}
+
+// Send sends a heartbeat on the stream. It blocks until the server reads
+// it, so acks should be read from another goroutine.
+func (s *HeartbeatStream) Send(hb Heartbeat) error {
+	hb.Version = HeartbeatVersion
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %v", err)
+	}
+	if _, err := s.body.Write(append(data, '\n')); err != nil {
+		return &NetworkError{Err: err}
+	}
+	return nil
+}
+
+// Ack reads the server's next ack, returning io.EOF once the server ended
+// the stream. An ack with an Error is the last one; the heartbeats sent
+// after the first Received should be sent again, after RetryAfter seconds
+// if set.
+func (s *HeartbeatStream) Ack() (StreamAck, error) {
+	var ack StreamAck
+	if err := s.acks.Decode(&ack); err != nil {
+		if err == io.EOF {
+			return ack, err
+		}
+		return ack, &NetworkError{Err: err}
+	}
+	return ack, nil
+}
+
+// CloseSend tells the server no more heartbeats are coming; it stores the
+// last ones and acks them before ending the stream.
+func (s *HeartbeatStream) CloseSend() error {
+	return s.body.Close()
+}
+
+// Close ends the stream, dropping acks not read yet.
+func (s *HeartbeatStream) Close() error {
+	s.body.Close()
+	return s.resp.Body.Close()
+}
+
+// LogTime records a manual entry, returning it as stored.
+func (c *Client) LogTime(entry ManualEntry) (ManualEntry, error) {
+	var stored ManualEntry
+	err := c.Do("POST", "/api/v1/manual_entries", entry, &stored)
+	return stored, err
+}
+
+// Stats returns the time a user tracked on the UTC days from from to to,
+// both included.
+func (c *Client) Stats(userID string, from, to time.Time) (Stats, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"from":    {from.UTC().Format("2006-01-02")},
+		"to":      {to.UTC().Format("2006-01-02")},
+	}
+	var stats Stats
+	err := c.Do("GET", "/api/v1/stats?"+query.Encode(), nil, &stats)
+	return stats, err
+}
+
+// MonthlyReport returns a user's time in the UTC month of month, per day.
+func (c *Client) MonthlyReport(userID string, month time.Time) (Report, error) {
+	query := url.Values{"user_id": {userID}, "month": {month.UTC().Format("2006-01")}}
+	var report Report
+	err := c.Do("GET", "/api/v1/reports/monthly?"+query.Encode(), nil, &report)
+	return report, err
+}
+
+// YearlyReport returns a user's time in a UTC year, per month, with the
+// year's highlights in Review.
+func (c *Client) YearlyReport(userID string, year int) (Report, error) {
+	query := url.Values{"user_id": {userID}, "year": {strconv.Itoa(year)}}
+	var report Report
+	err := c.Do("GET", "/api/v1/reports/yearly?"+query.Encode(), nil, &report)
+	return report, err
+}
+
+// AddNote stores a note and returns it with its ID.
+func (c *Client) AddNote(note Note) (Note, error) {
+	var stored Note
+	err := c.Do("POST", "/api/v1/notes", note, &stored)
+	return stored, err
+}
+
+// Notes returns a user's notes overlapping the UTC days from from to to.
+func (c *Client) Notes(userID string, from, to time.Time) ([]Note, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"from":    {from.UTC().Format("2006-01-02")},
+		"to":      {to.UTC().Format("2006-01-02")},
+	}
+	var notes []Note
+	err := c.Do("GET", "/api/v1/notes?"+query.Encode(), nil, &notes)
+	return notes, err
+}
+
+// DeleteNote deletes one of a user's notes.
+func (c *Client) DeleteNote(userID string, id int64) error {
+	query := url.Values{"user_id": {userID}, "id": {strconv.FormatInt(id, 10)}}
+	return c.Do("DELETE", "/api/v1/notes?"+query.Encode(), nil, nil)
+}
+
+// AddTimeOff registers a range of days out of office and returns it with
+// its ID.
+func (c *Client) AddTimeOff(off TimeOff) (TimeOff, error) {
+	var stored TimeOff
+	err := c.Do("POST", "/api/v1/time_off", off, &stored)
+	return stored, err
+}
+
+// TimeOff returns a user's out-of-office ranges overlapping the UTC days
+// from from to to.
+func (c *Client) TimeOff(userID string, from, to time.Time) ([]TimeOff, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"from":    {from.UTC().Format("2006-01-02")},
+		"to":      {to.UTC().Format("2006-01-02")},
+	}
+	var ranges []TimeOff
+	err := c.Do("GET", "/api/v1/time_off?"+query.Encode(), nil, &ranges)
+	return ranges, err
+}
+
+// DeleteTimeOff deletes one of a user's out-of-office ranges.
+func (c *Client) DeleteTimeOff(userID string, id int64) error {
+	query := url.Values{"user_id": {userID}, "id": {strconv.FormatInt(id, 10)}}
+	return c.Do("DELETE", "/api/v1/time_off?"+query.Encode(), nil, nil)
+}
+
+// AddWebhook registers a webhook and returns it with its ID and secret.
+func (c *Client) AddWebhook(hook Webhook) (Webhook, error) {
+	var stored Webhook
+	err := c.Do("POST", "/api/v1/webhooks", hook, &stored)
+	return stored, err
+}
+
+// Webhooks returns a user's webhooks, without their secrets.
+func (c *Client) Webhooks(userID string) ([]Webhook, error) {
+	var hooks []Webhook
+	err := c.Do("GET", "/api/v1/webhooks?"+url.Values{"user_id": {userID}}.Encode(), nil, &hooks)
+	return hooks, err
+}
+
+// DeleteWebhook deletes one of a user's webhooks.
+func (c *Client) DeleteWebhook(userID string, id int64) error {
+	query := url.Values{"user_id": {userID}, "id": {strconv.FormatInt(id, 10)}}
+	return c.Do("DELETE", "/api/v1/webhooks?"+query.Encode(), nil, nil)
+}
+
+// AddScript registers a heartbeat script; the client needs the server key.
+// The server rejects scripts that don't compile.
+func (c *Client) AddScript(name, source string) (Script, error) {
+	var stored Script
+	err := c.Do("POST", "/api/v1/scripts", Script{Name: name, Source: source}, &stored)
+	return stored, err
+}
+
+// Scripts returns the heartbeat scripts in the order they run in.
+func (c *Client) Scripts() ([]Script, error) {
+	var scripts []Script
+	err := c.Do("GET", "/api/v1/scripts", nil, &scripts)
+	return scripts, err
+}
+
+// DeleteScript deletes a heartbeat script.
+func (c *Client) DeleteScript(id int64) error {
+	return c.Do("DELETE", "/api/v1/scripts?id="+strconv.FormatInt(id, 10), nil, nil)
+}
+
+// DeleteHeartbeats deletes the heartbeats a user's editors sent on the UTC
+// days from from to to, both included, only those of project unless it is
+// empty. With dryRun they are only counted.
+func (c *Client) DeleteHeartbeats(userID, project string, from, to time.Time, dryRun bool) (HeartbeatDeletion, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"from":    {from.UTC().Format("2006-01-02")},
+		"to":      {to.UTC().Format("2006-01-02")},
+	}
+	if project != "" {
+		query.Set("project", project)
+	}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	var deletion HeartbeatDeletion
+	err := c.Do("DELETE", "/api/v1/heartbeats?"+query.Encode(), nil, &deletion)
+	return deletion, err
+}
+
+// AddRule adds a rule for heartbeats the server receives afterwards, and
+// returns the stored rule.
+func (c *Client) AddRule(rule Rule) (Rule, error) {
+	var stored Rule
+	err := c.Do("POST", "/api/v1/rules", rule, &stored)
+	return stored, err
+}
+
+// Rules returns a user's rules in the order they apply in.
+func (c *Client) Rules(userID string) ([]Rule, error) {
+	var rules []Rule
+	err := c.Do("GET", "/api/v1/rules?"+url.Values{"user_id": {userID}}.Encode(), nil, &rules)
+	return rules, err
+}
+
+// DeleteRule deletes one of a user's rules.
+func (c *Client) DeleteRule(userID string, id int64) error {
+	query := url.Values{"user_id": {userID}, "id": {strconv.FormatInt(id, 10)}}
+	return c.Do("DELETE", "/api/v1/rules?"+query.Encode(), nil, nil)
+}
+
+// ApplyRules runs a user's rules over the heartbeats they already have, on
+// all days.
+func (c *Client) ApplyRules(userID string) (RulesApplied, error) {
+	var applied RulesApplied
+	err := c.Do("POST", "/api/v1/rules/apply?"+url.Values{"user_id": {userID}}.Encode(), nil, &applied)
+	return applied, err
+}
+
+// ReclassifyHeartbeats moves the heartbeats a user's editors sent with
+// paths under pathPrefix, of project unless it is empty, to another project
+// or language, on all days. The server records the edit and returns it.
+func (c *Client) ReclassifyHeartbeats(userID, project, pathPrefix string, change Reclassification) (HeartbeatEdit, error) {
+	query := url.Values{"user_id": {userID}}
+	if project != "" {
+		query.Set("project", project)
+	}
+	if pathPrefix != "" {
+		query.Set("path_prefix", pathPrefix)
+	}
+	var edit HeartbeatEdit
+	err := c.Do("PATCH", "/api/v1/heartbeats?"+query.Encode(), change, &edit)
+	return edit, err
+}
+
+// HeartbeatEdits returns a user's reclassifications, most recent first.
+func (c *Client) HeartbeatEdits(userID string) ([]HeartbeatEdit, error) {
+	var edits []HeartbeatEdit
+	err := c.Do("GET", "/api/v1/heartbeats/edits?"+url.Values{"user_id": {userID}}.Encode(), nil, &edits)
+	return edits, err
+}
+
+// SetDomainRule sets the category of time on a domain, replacing any
+// earlier rule for it, and returns the stored rule.
+func (c *Client) SetDomainRule(rule DomainRule) (DomainRule, error) {
+	var stored DomainRule
+	err := c.Do("POST", "/api/v1/domain_rules", rule, &stored)
+	return stored, err
+}
+
+// DomainRules returns a user's domain rules.
+func (c *Client) DomainRules(userID string) ([]DomainRule, error) {
+	var rules []DomainRule
+	err := c.Do("GET", "/api/v1/domain_rules?"+url.Values{"user_id": {userID}}.Encode(), nil, &rules)
+	return rules, err
+}
+
+// DeleteDomainRule deletes a user's rule for a domain.
+func (c *Client) DeleteDomainRule(userID, domain string) error {
+	query := url.Values{"user_id": {userID}, "domain": {domain}}
+	return c.Do("DELETE", "/api/v1/domain_rules?"+query.Encode(), nil, nil)
+}
+
+// Aggregate returns the time a user tracked on the UTC days from from to to,
+// both included, grouped by dimensions such as "project", "language" and
+// "day".
+func (c *Client) Aggregate(userID string, groupBy []string, from, to time.Time) (Aggregate, error) {
+	query := url.Values{
+		"user_id":  {userID},
+		"group_by": {strings.Join(groupBy, ",")},
+		"from":     {from.UTC().Format("2006-01-02")},
+		"to":       {to.UTC().Format("2006-01-02")},
+	}
+	var agg Aggregate
+	err := c.Do("GET", "/api/v1/aggregate?"+query.Encode(), nil, &agg)
+	return agg, err
+}
+
+// Query runs an analytics query for a user, e.g.
+//
+//	select project, sum(duration) where language = "Go" order by sum(duration) desc
+//
+// See the /api/v1/query description in the OpenAPI document for the
+// language.
+func (c *Client) Query(userID, query string) (QueryResult, error) {
+	payload := map[string]string{"user_id": userID, "query": query}
+	var result QueryResult
+	err := c.Do("POST", "/api/v1/query", payload, &result)
+	return result, err
+}
+
+// NotificationPrefs returns when and how a user gets their weekly summary.
+func (c *Client) NotificationPrefs(userID string) (NotificationPrefs, error) {
+	var prefs NotificationPrefs
+	err := c.Do("GET", "/api/v1/notifications?"+url.Values{"user_id": {userID}}.Encode(), nil, &prefs)
+	return prefs, err
+}
+
+// SetNotificationPrefs replaces when and how a user gets their weekly
+// summary and returns the stored preferences.
+func (c *Client) SetNotificationPrefs(prefs NotificationPrefs) (NotificationPrefs, error) {
+	var stored NotificationPrefs
+	err := c.Do("PUT", "/api/v1/notifications?"+url.Values{"user_id": {prefs.UserID}}.Encode(), prefs, &stored)
+	return stored, err
+}
+
+// Email returns a user's email address and whether it was verified.
+func (c *Client) Email(userID string) (EmailStatus, error) {
+	var status EmailStatus
+	err := c.Do("GET", "/api/v1/email?"+url.Values{"user_id": {userID}}.Encode(), nil, &status)
+	return status, err
+}
+
+// SetEmail changes a user's email address. The server mails a confirmation
+// link to it, and sends nothing else there until the link is opened.
+func (c *Client) SetEmail(userID, email string) (EmailStatus, error) {
+	var status EmailStatus
+	err := c.Do("PUT", "/api/v1/email", map[string]string{"user_id": userID, "email": email}, &status)
+	return status, err
+}
+
+// Projects returns a user's projects with their settings, except the
+// archived ones.
+func (c *Client) Projects(userID string) ([]Project, error) {
+	var projects []Project
+	err := c.Do("GET", "/api/v1/projects?"+url.Values{"user_id": {userID}}.Encode(), nil, &projects)
+	return projects, err
+}
+
+// UpdateProject saves the settings of the project p.Name of p.UserID and
+// returns the stored project.
+func (c *Client) UpdateProject(p Project) (Project, error) {
+	var stored Project
+	err := c.Do("PUT", "/api/v1/projects/"+url.PathEscape(p.Name)+"?"+
+		url.Values{"user_id": {p.UserID}}.Encode(), p, &stored)
+	return stored, err
+}
+
+// Workspaces returns a user's workspaces with their projects.
+func (c *Client) Workspaces(userID string) ([]Workspace, error) {
+	var workspaces []Workspace
+	err := c.Do("GET", "/api/v1/workspaces?"+url.Values{"user_id": {userID}}.Encode(), nil, &workspaces)
+	return workspaces, err
+}
+
+// LiveToday returns a user's time today, cheap enough to poll every minute.
+// The user "current" is the API key's own.
+func (c *Client) LiveToday(userID string) (LiveToday, error) {
+	var today LiveToday
+	err := c.Do("GET", "/api/v1/users/"+url.PathEscape(userID)+"/today/live", nil, &today)
+	return today, err
+}
+
+// ArchiveProject archives or, if !archived, unarchives a user's project and
+// returns it.
+func (c *Client) ArchiveProject(userID, name string, archived bool) (Project, error) {
+	action := "/archive?"
+	if !archived {
+		action = "/unarchive?"
+	}
+	var project Project
+	err := c.Do("POST", "/api/v1/projects/"+url.PathEscape(name)+action+
+		url.Values{"user_id": {userID}}.Encode(), nil, &project)
+	return project, err
+}
+
+// TodaySummary returns the time a user tracked so far on the current UTC
+// day.
+func (c *Client) TodaySummary(userID string) (Stats, error) {
+	now := time.Now()
+	return c.Stats(userID, now, now)
+}
+
+// Version returns the server's release metadata. It needs no API key.
+func (c *Client) Version() (Version, error) {
+	var v Version
+	err := c.Do("GET", "/api/v1/version", nil, &v)
+	return v, err
+}
+
+// Whoami describes the client's API key and the user it belongs to.
+func (c *Client) Whoami() (Whoami, error) {
+	var w Whoami
+	err := c.Do("GET", "/api/v1/whoami", nil, &w)
+	return w, err
+}
+
+// KeyActivity returns where a user API key was used from, most recent
+// first.
+func (c *Client) KeyActivity(keyID int64) ([]KeyUsage, error) {
+	var usage []KeyUsage
+	err := c.Do("GET", "/api/v1/api_keys/"+strconv.FormatInt(keyID, 10)+"/activity", nil, &usage)
+	return usage, err
+}
+
+// KeyUsage returns the request counts and error rate of a user API key
+// over the last 30 days.
+func (c *Client) KeyUsage(keyID int64) (KeyStats, error) {
+	var stats KeyStats
+	err := c.Do("GET", "/api/v1/api_keys/"+strconv.FormatInt(keyID, 10)+"/usage", nil, &stats)
+	return stats, err
+}
+
+// CreateToken starts a dashboard session for userID, which only the server
+// key needs to give.
+func (c *Client) CreateToken(userID string) (TokenPair, error) {
+	var pair TokenPair
+	err := c.Do("POST", "/api/v1/tokens", map[string]string{"user_id": userID}, &pair)
+	return pair, err
+}
+
+// RefreshToken trades a session's refresh token for its next tokens.
+func (c *Client) RefreshToken(refreshToken string) (TokenPair, error) {
+	var pair TokenPair
+	err := c.Do("POST", "/api/v1/tokens/refresh", map[string]string{"refresh_token": refreshToken}, &pair)
+	return pair, err
+}
+
+// RevokeToken ends the session of a refresh token.
+func (c *Client) RevokeToken(refreshToken string) error {
+	return c.Do("POST", "/api/v1/tokens/revoke", map[string]string{"refresh_token": refreshToken}, nil)
+}
+
+// Backfill uploads historical heartbeats, one JSON heartbeat per line, and
+// returns the job storing them; poll Job until it is no longer running.
+// The upload may take longer than the HTTP client's timeout allows.
+func (c *Client) Backfill(ndjson io.Reader) (Job, error) {
+	var job Job
+	err := c.do("POST", "/api/v1/backfill", "application/x-ndjson", "", ndjson, &job)
+	return job, err
+}
+
+// Job returns the progress of a background job.
+func (c *Client) Job(id string) (Job, error) {
+	var job Job
+	err := c.Do("GET", "/api/v1/jobs/"+url.PathEscape(id), nil, &job)
+	return job, err
+}
+
+// Tasks lists the server's scheduled tasks that ran; it needs the server
+// key.
+func (c *Client) Tasks() ([]TaskRun, error) {
+	var runs []TaskRun
+	err := c.Do("GET", "/api/v1/tasks", nil, &runs)
+	return runs, err
+}
+
+// Maintenance reports whether the server is in maintenance mode; the
+// client needs the server key.
+func (c *Client) Maintenance() (Maintenance, error) {
+	var mode Maintenance
+	err := c.Do("GET", "/api/v1/maintenance", nil, &mode)
+	return mode, err
+}
+
+// SetMaintenance turns maintenance mode on or off; the client needs the
+// server key.
+func (c *Client) SetMaintenance(mode Maintenance) (Maintenance, error) {
+	var set Maintenance
+	err := c.Do("PUT", "/api/v1/maintenance", mode, &set)
+	return set, err
+}
+
+// RegisterPlugin announces a plugin install and returns the settings the
+// server wants it to use.
+func (c *Client) RegisterPlugin(p Plugin) (PluginHints, error) {
+	var resp struct {
+		Hints PluginHints `json:"hints"`
+	}
+	err := c.Do("POST", "/api/v1/plugins/register", p, &resp)
+	return resp.Hints, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/kru/eztracker/internal/sample"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// demoUser owns the sample data of "eztracker-server --demo".
+const demoUser = "demo"
+
+// demoDays is how much sample data a demo server has.
+const demoDays = 90
+
+// demoConfig adapts the .env settings, if there are any, to a demo server:
+// it keeps everything in memory, sends no mail and listens on port 8080
+// with the API key "demo" unless told otherwise.
+func demoConfig(config Config) Config {
+	config.ReadOnly = false
+	if config.ServerPort == "" {
+		config.ServerPort = "8080"
+	}
+	if config.ApiKey == "" {
+		config.ApiKey = "demo"
+	}
+	return config
+}
+
+// seedDemo fills a demo server's store with sample data.
+func seedDemo(st *store.Store) error {
+	n, err := sample.Seed(st, demoUser, demoDays, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Demo: %d sample heartbeats of user %q over %d days", n, demoUser, demoDays)
+	return nil
+}
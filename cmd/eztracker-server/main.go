@@ -0,0 +1,639 @@
+// Command eztracker-server runs the eztracker API and weekly summary emails,
+// configured from a .env file in the working directory.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	// Users pick the timezone of their weekly summary, so don't depend on
+	// the host having a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/kru/eztracker/internal/api"
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/export"
+	"github.com/kru/eztracker/internal/mailer"
+	"github.com/kru/eztracker/internal/milestones"
+	"github.com/kru/eztracker/internal/scheduler"
+	"github.com/kru/eztracker/internal/store"
+	"github.com/kru/eztracker/internal/summary"
+	"github.com/kru/eztracker/internal/webhook"
+)
+
+type Config struct {
+	DBPath     string
+	SMTPHost   string
+	SMTPPort   string
+	SMTPUser   string
+	SMTPPass   string
+	ServerPort string
+	ApiKey     string
+
+	// ServerAddr is the address to listen on, host:port or unix:<path>,
+	// overriding ServerPort.
+	ServerAddr string
+
+	// EmailProvider is EMAIL_PROVIDER when it names an HTTP API rather than
+	// an SMTP relay, sending as EmailFrom; see mailer.NewProvider
+	EmailProvider string
+	EmailFrom     string
+
+	// SMTP auth mechanism and DKIM signing of outgoing mail, see mailer
+	SMTPAuth      string
+	DKIMDomain    string
+	DKIMSelector  string
+	DKIMKeyFile   string
+	EmailAttempts int
+
+	// DBMaxOpenConns caps the SQLite connection pool; idle connections are
+	// kept up to the same size so prepared statements stay warm.
+	DBMaxOpenConns int
+
+	// Buffering incoming heartbeats, flushed every WriteBufferInterval or
+	// once WriteBufferSize are pending. Disabled when the size is 0.
+	WriteBufferSize     int
+	WriteBufferInterval time.Duration
+
+	// Caching of summary responses per user and query. A negative TTL
+	// disables the cache.
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// Settings handed to editor plugins when they register
+	PluginKeystrokeTimeout  time.Duration
+	PluginHeartbeatInterval time.Duration
+	PluginBatchSize         int
+
+	// Signing secret of the Slack app serving /eztracker
+	SlackSigningSecret string
+
+	// Signing links in emails, which point at PublicURL
+	EmailSecret string
+	PublicURL   string
+
+	// Recording where API keys are used from behind a reverse proxy
+	TrustProxy bool
+	GeoHeader  string
+
+	// Browser dashboards allowed to call the API from other origins
+	CORSOrigins []string
+	CORSHeaders []string
+
+	// Dashboard session tokens
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// Oldest and furthest ahead live heartbeats are accepted, 0 for no limit
+	HeartbeatHorizon time.Duration
+	MaxClockSkew     time.Duration
+
+	// Downsampling of heartbeats to one per file per interval, 0 for off
+	HeartbeatSampleInterval time.Duration
+
+	// Serving HTTPS, and requiring client certificates signed by
+	// TLSClientCAFile when it is set
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// Pushing coding time to InfluxDB or Prometheus every ExportInterval,
+	// when ExportURL is set; see export
+	ExportFormat   string
+	ExportURL      string
+	ExportToken    string
+	ExportInterval time.Duration
+
+	// Serving only summaries from a replica or backup of the database,
+	// which is never written to
+	ReadOnly bool
+}
+
+// Load .env manually
+func loadEnv() (Config, error) {
+	data, err := os.ReadFile(".env")
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "DATABASE_PATH":
+			fmt.Printf("DB %s\n", value)
+			config.DBPath = value
+		case "EMAIL_PROVIDER":
+			if !strings.HasPrefix(value, "smtp://") {
+				config.EmailProvider = value
+				continue
+			}
+			config.SMTPHost = strings.Split(value, "@")[1]
+			config.SMTPPort = strings.Split(strings.Split(value, ":")[2], "/")[0]
+			config.SMTPUser = strings.Split(strings.Split(value, "//")[1], ":")[0]
+			config.SMTPPass = strings.Split(
+				strings.Split(strings.Split(value, "//")[1], ":")[1], "@")[0]
+		case "EMAIL_FROM":
+			config.EmailFrom = value
+		case "SMTP_AUTH":
+			config.SMTPAuth = value
+		case "DKIM_DOMAIN":
+			config.DKIMDomain = value
+		case "DKIM_SELECTOR":
+			config.DKIMSelector = value
+		case "DKIM_PRIVATE_KEY":
+			config.DKIMKeyFile = value
+		case "EMAIL_MAX_ATTEMPTS":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid EMAIL_MAX_ATTEMPTS: %v", err)
+			}
+			config.EmailAttempts = n
+		case "SERVER_PORT":
+			config.ServerPort = value
+		case "SERVER_ADDR":
+			config.ServerAddr = value
+		case "DB_MAX_OPEN_CONNS":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid DB_MAX_OPEN_CONNS: %v", err)
+			}
+			config.DBMaxOpenConns = n
+		case "WRITE_BUFFER_SIZE":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid WRITE_BUFFER_SIZE: %v", err)
+			}
+			config.WriteBufferSize = n
+		case "WRITE_BUFFER_INTERVAL":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid WRITE_BUFFER_INTERVAL: %v", err)
+			}
+			config.WriteBufferInterval = d
+		case "EXPORT_FORMAT":
+			config.ExportFormat = value
+		case "EXPORT_URL":
+			config.ExportURL = value
+		case "EXPORT_TOKEN":
+			config.ExportToken = value
+		case "EXPORT_INTERVAL":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return Config{}, fmt.Errorf("invalid EXPORT_INTERVAL: %q", value)
+			}
+			config.ExportInterval = d
+		case "CACHE_TTL":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid CACHE_TTL: %v", err)
+			}
+			config.CacheTTL = d
+		case "CACHE_SIZE":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid CACHE_SIZE: %v", err)
+			}
+			config.CacheSize = n
+		case "PLUGIN_KEYSTROKE_TIMEOUT":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid PLUGIN_KEYSTROKE_TIMEOUT: %v", err)
+			}
+			config.PluginKeystrokeTimeout = d
+		case "PLUGIN_HEARTBEAT_INTERVAL":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid PLUGIN_HEARTBEAT_INTERVAL: %v", err)
+			}
+			config.PluginHeartbeatInterval = d
+		case "PLUGIN_BATCH_SIZE":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid PLUGIN_BATCH_SIZE: %v", err)
+			}
+			config.PluginBatchSize = n
+		case "SLACK_SIGNING_SECRET":
+			config.SlackSigningSecret = value
+		case "TRUST_PROXY":
+			config.TrustProxy = value == "true"
+		case "GEO_HEADER":
+			config.GeoHeader = value
+		case "CORS_ORIGINS":
+			config.CORSOrigins = splitList(value)
+		case "CORS_HEADERS":
+			config.CORSHeaders = splitList(value)
+		case "JWT_SECRET":
+			config.JWTSecret = value
+		case "EMAIL_SECRET":
+			config.EmailSecret = value
+		case "PUBLIC_URL":
+			config.PublicURL = value
+		case "JWT_ACCESS_TTL":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid JWT_ACCESS_TTL: %v", err)
+			}
+			config.AccessTokenTTL = d
+		case "JWT_REFRESH_TTL":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid JWT_REFRESH_TTL: %v", err)
+			}
+			config.RefreshTokenTTL = d
+		case "HEARTBEAT_HORIZON":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid HEARTBEAT_HORIZON: %v", err)
+			}
+			config.HeartbeatHorizon = d
+		case "MAX_CLOCK_SKEW":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid MAX_CLOCK_SKEW: %v", err)
+			}
+			config.MaxClockSkew = d
+		case "HEARTBEAT_SAMPLE_INTERVAL":
+			d, err := time.ParseDuration(value)
+			if err == nil && (d < 0 || d%time.Second != 0) {
+				err = fmt.Errorf("%v is not a whole number of seconds", d)
+			}
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid HEARTBEAT_SAMPLE_INTERVAL: %v", err)
+			}
+			config.HeartbeatSampleInterval = d
+		case "READ_ONLY":
+			config.ReadOnly = value == "true"
+		case "TLS_CERT_FILE":
+			config.TLSCertFile = value
+		case "TLS_KEY_FILE":
+			config.TLSKeyFile = value
+		case "TLS_CLIENT_CA_FILE":
+			config.TLSClientCAFile = value
+		case "API_KEY":
+			fmt.Printf("API KEY: %s\n", value)
+			config.ApiKey = value
+		}
+	}
+	return config, nil
+}
+
+// apiConfig returns the API server's part of config.
+func apiConfig(config Config, bus *events.Bus) api.Config {
+	return api.Config{
+		APIKey:          config.ApiKey,
+		WriteBufferSize: config.WriteBufferSize,
+		CacheTTL:        config.CacheTTL,
+		CacheSize:       config.CacheSize,
+		Plugins: api.PluginHints{
+			KeystrokeTimeout:  config.PluginKeystrokeTimeout,
+			HeartbeatInterval: config.PluginHeartbeatInterval,
+			BatchSize:         config.PluginBatchSize,
+		},
+		SlackSigningSecret: config.SlackSigningSecret,
+		TrustProxy:         config.TrustProxy,
+		GeoHeader:          config.GeoHeader,
+		CORSOrigins:        config.CORSOrigins,
+		CORSHeaders:        config.CORSHeaders,
+		JWTSecret:          config.JWTSecret,
+		AccessTokenTTL:     config.AccessTokenTTL,
+		RefreshTokenTTL:    config.RefreshTokenTTL,
+		EmailSecret:        config.EmailSecret,
+		PublicURL:          config.PublicURL,
+		HeartbeatHorizon:   config.HeartbeatHorizon,
+		MaxClockSkew:       config.MaxClockSkew,
+		SampleInterval:     config.HeartbeatSampleInterval,
+		ReadOnly:           config.ReadOnly,
+		Events:             bus,
+	}
+}
+
+// envPollInterval is how often watchEnv checks .env for changes.
+const envPollInterval = 5 * time.Second
+
+// watchEnv reloads .env when it changes, or on SIGHUP, applying the API
+// server's settings without a restart. Changes to the other settings are
+// logged as needing one.
+func watchEnv(config Config, s *api.Server, bus *events.Bus) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(envPollInterval)
+	defer ticker.Stop()
+
+	modified := func() time.Time {
+		info, err := os.Stat(".env")
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modified()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			t := modified()
+			if t.Equal(last) {
+				continue
+			}
+			last = t
+		}
+		next, err := loadEnv()
+		if err != nil {
+			log.Println("Error reloading .env, keeping the current settings: ", err)
+			continue
+		}
+		s.Reload(apiConfig(next, bus))
+		log.Println("Reloaded .env")
+		if changed := needsRestart(config, next); len(changed) > 0 {
+			log.Printf("Restart the server to apply %s", strings.Join(changed, ", "))
+		}
+		config = next
+	}
+}
+
+// needsRestart returns the .env keys changed from old to next that are
+// only read when the server starts.
+func needsRestart(old, next Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		key       string
+		old, next any
+	}{
+		{"DATABASE_PATH", old.DBPath, next.DBPath},
+		{"DB_MAX_OPEN_CONNS", old.DBMaxOpenConns, next.DBMaxOpenConns},
+		{"SERVER_PORT", old.ServerPort, next.ServerPort},
+		{"SERVER_ADDR", old.ServerAddr, next.ServerAddr},
+		{"READ_ONLY", old.ReadOnly, next.ReadOnly},
+		{"WRITE_BUFFER_SIZE", old.WriteBufferSize, next.WriteBufferSize},
+		{"WRITE_BUFFER_INTERVAL", old.WriteBufferInterval, next.WriteBufferInterval},
+		{"CACHE_TTL", old.CacheTTL, next.CacheTTL},
+		{"CACHE_SIZE", old.CacheSize, next.CacheSize},
+		{"TLS_CERT_FILE", old.TLSCertFile, next.TLSCertFile},
+		{"TLS_KEY_FILE", old.TLSKeyFile, next.TLSKeyFile},
+		{"TLS_CLIENT_CA_FILE", old.TLSClientCAFile, next.TLSClientCAFile},
+		{"EMAIL_PROVIDER", [5]string{old.EmailProvider, old.SMTPHost, old.SMTPPort, old.SMTPUser, old.SMTPPass},
+			[5]string{next.EmailProvider, next.SMTPHost, next.SMTPPort, next.SMTPUser, next.SMTPPass}},
+		{"EMAIL_FROM", old.EmailFrom, next.EmailFrom},
+		{"EMAIL_MAX_ATTEMPTS", old.EmailAttempts, next.EmailAttempts},
+		{"SMTP_AUTH", old.SMTPAuth, next.SMTPAuth},
+		{"DKIM_DOMAIN", old.DKIMDomain, next.DKIMDomain},
+		{"DKIM_SELECTOR", old.DKIMSelector, next.DKIMSelector},
+		{"DKIM_PRIVATE_KEY", old.DKIMKeyFile, next.DKIMKeyFile},
+		{"EXPORT_FORMAT", old.ExportFormat, next.ExportFormat},
+		{"EXPORT_URL", old.ExportURL, next.ExportURL},
+		{"EXPORT_TOKEN", old.ExportToken, next.ExportToken},
+		{"EXPORT_INTERVAL", old.ExportInterval, next.ExportInterval},
+	} {
+		if setting.old != setting.next {
+			changed = append(changed, setting.key)
+		}
+	}
+	return changed
+}
+
+// splitList splits a comma separated setting, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listen opens the listener for addr: a unix socket for "unix:<path>",
+// replacing a socket left behind by a previous run, and otherwise a TCP
+// address such as "127.0.0.1:8080", "[::1]:8080" or ":8080".
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Reachable by the reverse proxy when it shares the server's group
+	if err := os.Chmod(path, 0o660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serverTLS returns the TLS config for HTTPS, verifying client certificates
+// against the client CA bundle when one is configured. Without it any
+// client may connect and authenticates with its API key alone.
+func serverTLS(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_CLIENT_CA_FILE: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid TLS_CLIENT_CA_FILE: no PEM certificates in %s", config.TLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+		case "seed":
+			runSeed(os.Args[2:])
+		}
+	}
+
+	// A throwaway server with sample data, needing no .env
+	demo := len(os.Args) > 1 && os.Args[1] == "--demo"
+
+	// Load .env manually
+	config, err := loadEnv()
+	if err != nil && !(demo && errors.Is(err, fs.ErrNotExist)) {
+		log.Fatal("Error loading .env: ", err)
+	}
+
+	open, newStore := store.Open, store.New
+	if demo {
+		config = demoConfig(config)
+		open = func(string, int) (*sql.DB, error) { return store.OpenMemory() }
+	}
+	if config.ReadOnly {
+		open, newStore = store.OpenReadOnly, store.NewReadOnly
+	}
+	// A second server writing the database would send every email twice;
+	// read-only replicas write nothing and the demo has a database of its own
+	if !config.ReadOnly && !demo {
+		unlock, err := store.Lock(config.DBPath)
+		if errors.Is(err, store.ErrLocked) {
+			log.Fatalf("DB error: %s %v; stop it first, or run this one with READ_ONLY=true", config.DBPath, err)
+		}
+		if err != nil {
+			log.Fatal("DB lock error: ", err)
+		}
+		defer unlock()
+	}
+	db, err := open(config.DBPath, config.DBMaxOpenConns)
+	if err != nil {
+		log.Fatal("DB error: ", err)
+	}
+	defer db.Close()
+
+	st, err := newStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if demo {
+		if err := seedDemo(st); err != nil {
+			log.Fatal("Demo data error: ", err)
+		}
+	}
+	// Background jobs don't survive a restart
+	if !config.ReadOnly {
+		if err := st.FailRunningJobs("Interrupted by a server restart", time.Now().Unix()); err != nil {
+			log.Fatal("Job cleanup error: ", err)
+		}
+	}
+
+	// Optional modules subscribe to what the server and tasks publish
+	bus := events.New()
+	s := api.New(apiConfig(config, bus), st)
+	// The demo has no .env to watch
+	if !demo {
+		go watchEnv(config, s, bus)
+	}
+
+	mailerConfig := mailer.Config{
+		Host: config.SMTPHost,
+		Port: config.SMTPPort,
+		User: config.SMTPUser,
+		Pass: config.SMTPPass,
+		Auth: config.SMTPAuth,
+	}
+	if config.DKIMKeyFile != "" {
+		data, err := os.ReadFile(config.DKIMKeyFile)
+		if err != nil {
+			log.Fatal("DKIM key error: ", err)
+		}
+		key, err := mailer.ParseDKIMKey(data)
+		if err != nil {
+			log.Fatal("DKIM key error: ", err)
+		}
+		mailerConfig.DKIM = &mailer.DKIM{Domain: config.DKIMDomain, Selector: config.DKIMSelector, Key: key}
+	}
+
+	var sender mailer.Sender = mailer.New(mailerConfig)
+	if config.EmailProvider != "" {
+		if sender, err = mailer.NewProvider(config.EmailProvider, config.EmailFrom); err != nil {
+			log.Fatal("Email provider error: ", err)
+		}
+	}
+	// Mail goes through a persistent outbox, retried every minute
+	outbox := mailer.NewOutbox(st, sender, config.EmailAttempts)
+	// Weekly email summaries and alerts, sent at the hour each user prefers
+	reporter := summary.New(st, outbox)
+	reporter.Unsubscribe = s.UnsubscribeURL
+	reporter.Events = bus
+	// Milestones are checked after heartbeats and queued for webhooks
+	detector := milestones.New(st, bus)
+	notifier := webhook.New(st, bus)
+
+	runner := scheduler.New(st)
+	runner.Add(scheduler.Task{Name: "outbox", Schedule: scheduler.Every(time.Minute), Run: outbox.Process})
+	runner.Add(scheduler.Task{Name: "summaries", Schedule: scheduler.Every(time.Hour), Run: reporter.SendDue})
+	runner.Add(scheduler.Task{Name: "alerts", Schedule: scheduler.Every(time.Hour), Run: reporter.SendAlerts})
+	runner.Add(scheduler.Task{Name: "milestones", Schedule: scheduler.Every(time.Minute), Run: detector.Run})
+	runner.Add(scheduler.Task{Name: "webhooks", Schedule: scheduler.Every(time.Minute), Run: notifier.Run})
+	runner.Add(scheduler.Task{Name: "prune", Schedule: scheduler.MustCron("30 3 * * *"), Run: st.Prune})
+	if config.ExportURL != "" {
+		if config.ExportFormat == "" {
+			config.ExportFormat = "influx"
+		}
+		if config.ExportInterval == 0 {
+			config.ExportInterval = time.Minute
+		}
+		exporter, err := export.New(st, export.Config{Format: config.ExportFormat, URL: config.ExportURL, Token: config.ExportToken})
+		if err != nil {
+			log.Fatal("Export error: ", err)
+		}
+		runner.Add(scheduler.Task{Name: "export", Schedule: scheduler.Every(config.ExportInterval), Run: exporter.Run})
+	}
+	// Mail and pruning are left to the server writing the database, and
+	// demos send none
+	if !config.ReadOnly && !demo {
+		runner.Start()
+	}
+
+	if s.Buffered() {
+		if config.WriteBufferInterval <= 0 {
+			config.WriteBufferInterval = 5 * time.Second
+		}
+		go s.RunFlusher(config.WriteBufferInterval)
+	}
+	// Flush what is buffered and counted before exiting
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.FlushBuffer()
+		s.FlushKeyUse()
+		os.Exit(0)
+	}()
+
+	// Start server
+	addr := config.ServerAddr
+	if addr == "" {
+		addr = ":" + config.ServerPort
+	}
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal("Listen error: ", err)
+	}
+	server := &http.Server{Handler: s.Handler()}
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" || config.TLSClientCAFile != "" {
+		server.TLSConfig, err = serverTLS(config)
+		if err != nil {
+			log.Fatal("TLS error: ", err)
+		}
+		log.Printf("Server running on %s with TLS", addr)
+		log.Fatal(server.ServeTLS(l, config.TLSCertFile, config.TLSKeyFile))
+	}
+	log.Printf("Server running on %s", addr)
+	log.Fatal(server.Serve(l))
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// migrateProgress is the table in a migration's destination recording the
+// last row copied of each table, so an interrupted migration resumes where
+// it stopped.
+const migrateProgress = "eztracker_migration"
+
+// database is a migration's source or destination.
+type database struct {
+	*sql.DB
+	postgres bool
+}
+
+// bind returns a query written with ? placeholders in the database's own.
+func (db database) bind(query string) string {
+	if !db.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// migrate runs "eztracker-server migrate", copying every table of one
+// database into another. Running it again after an interruption resumes the
+// copy. The source is only read, and a table whose rows end up differing
+// from its own, such as one changed in place since it was first copied, is
+// copied again in full; --restart copies everything again.
+func migrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "", "database to copy, sqlite:<path>")
+	to := flags.String("to", "", "database to copy into, sqlite:<path> or postgres://...")
+	batch := flags.Int("batch", 1000, "rows copied per transaction")
+	restart := flags.Bool("restart", false, "copy every row again rather than resuming")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("usage: eztracker-server migrate --from sqlite:<path> --to sqlite:<path>|postgres://...")
+	}
+	if *batch <= 0 {
+		return fmt.Errorf("invalid --batch: %d", *batch)
+	}
+
+	src, err := openDatabase(*from, true)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %v", err)
+	}
+	defer src.Close()
+	if src.postgres {
+		return fmt.Errorf("invalid --from: only sqlite:<path> can be copied from")
+	}
+	dst, err := openDatabase(*to, false)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %v", err)
+	}
+	defer dst.Close()
+	// The copy would mix with what a server writes to the destination
+	if !dst.postgres {
+		unlock, err := store.Lock(strings.TrimPrefix(*to, "sqlite:"))
+		if err != nil {
+			return fmt.Errorf("--to: %v", err)
+		}
+		defer unlock()
+	}
+	// The destination's schema is made in line with the source's, so
+	// columns line up, and the source's can't be brought up to date here
+	if err := checkSchema(src); err != nil {
+		return fmt.Errorf("--from: %v", err)
+	}
+	tables, err := tableNames(src)
+	if err != nil {
+		return err
+	}
+	if dst.postgres {
+		err = createPostgresSchema(src, dst, tables)
+	} else {
+		err = createSQLiteSchema(src, dst, tables)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Exec(`CREATE TABLE IF NOT EXISTS ` + migrateProgress + ` (
+		table_name TEXT PRIMARY KEY, last_rowid BIGINT NOT NULL)`); err != nil {
+		return err
+	}
+	if *restart {
+		if _, err := dst.Exec("DELETE FROM " + migrateProgress); err != nil {
+			return err
+		}
+		// Rows copied again replace themselves by rowid in SQLite, which
+		// PostgreSQL doesn't have
+		if dst.postgres {
+			if _, err := dst.Exec(`TRUNCATE "` + strings.Join(tables, `", "`) + `"`); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, table := range tables {
+		if err := copyTable(src, dst, table, *batch, out); err != nil {
+			return fmt.Errorf("copying %s: %v", table, err)
+		}
+	}
+
+	// A resumed copy misses rows changed in place since they were copied,
+	// and a table that differs is copied again once; rows written to the
+	// source during the copy are the only difference left
+	mismatched := 0
+	for _, table := range tables {
+		same, err := sameRows(src, dst, table, out)
+		if err != nil {
+			return err
+		}
+		if same {
+			continue
+		}
+		fmt.Fprintf(out, "%s: copying again\n", table)
+		if _, err := dst.Exec(`DELETE FROM "` + table + `"`); err != nil {
+			return err
+		}
+		if _, err := dst.Exec(dst.bind("DELETE FROM "+migrateProgress+" WHERE table_name = ?"), table); err != nil {
+			return err
+		}
+		if err := copyTable(src, dst, table, *batch, out); err != nil {
+			return fmt.Errorf("copying %s: %v", table, err)
+		}
+		if same, err = sameRows(src, dst, table, out); err != nil {
+			return err
+		}
+		if !same {
+			mismatched++
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%d tables differ; stop the server and run migrate again", mismatched)
+	}
+	fmt.Fprintf(out, "Verified %d tables\n", len(tables))
+	return nil
+}
+
+// openDatabase opens a database URL, sqlite:<path> or a PostgreSQL one,
+// which is connected to right away to report a wrong URL early. A source
+// is opened read-only.
+func openDatabase(url string, readOnly bool) (database, error) {
+	if path, ok := strings.CutPrefix(url, "sqlite:"); ok && path != "" {
+		if readOnly {
+			if _, err := os.Stat(path); err != nil {
+				return database{}, err
+			}
+			db, err := store.OpenReadOnly(path, 1)
+			return database{DB: db}, err
+		}
+		db, err := store.Open(path, 1)
+		return database{DB: db}, err
+	}
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			return database{}, err
+		}
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return database{}, err
+		}
+		return database{DB: db, postgres: true}, nil
+	}
+	return database{}, fmt.Errorf("%q is not sqlite:<path> or postgres://...", url)
+}
+
+// column is a column of a SQLite table.
+type column struct {
+	name, typ string
+	notNull   bool
+	// dflt is the SQL of its default, if it has one
+	dflt sql.NullString
+	// pk is its position in the primary key, from 1, or 0
+	pk int
+}
+
+// tableColumns returns the columns of a table in a SQLite database.
+func tableColumns(db database, table string) ([]column, error) {
+	rows, err := db.Query(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.name, &c.typ, &c.notNull, &c.dflt, &c.pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// rowidAlias returns the column aliasing a table's rowid, its INTEGER
+// PRIMARY KEY, or "" if it has none.
+func rowidAlias(columns []column) string {
+	alias, keys := "", 0
+	for _, c := range columns {
+		if c.pk > 0 {
+			keys++
+			if strings.EqualFold(c.typ, "INTEGER") {
+				alias = c.name
+			}
+		}
+	}
+	if keys != 1 {
+		return ""
+	}
+	return alias
+}
+
+// postgresType returns the PostgreSQL type holding what SQLite stores in a
+// column of a declared type, going by SQLite's rules for its affinity.
+func postgresType(declared string) string {
+	typ := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(typ, "INT"):
+		return "BIGINT"
+	case strings.Contains(typ, "CHAR"), strings.Contains(typ, "CLOB"), strings.Contains(typ, "TEXT"):
+		return "TEXT"
+	case typ == "", strings.Contains(typ, "BLOB"):
+		return "BYTEA"
+	case strings.Contains(typ, "REAL"), strings.Contains(typ, "FLOA"), strings.Contains(typ, "DOUB"):
+		return "DOUBLE PRECISION"
+	}
+	return "NUMERIC"
+}
+
+// createPostgresSchema creates the source's tables that a PostgreSQL
+// database lacks, with their indexes.
+func createPostgresSchema(src, dst database, tables []string) error {
+	for _, table := range tables {
+		statements, err := postgresTable(src, table)
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			if _, err := dst.Exec(statement); err != nil {
+				return fmt.Errorf("creating %s: %v", table, err)
+			}
+		}
+	}
+
+	// Views, such as heartbeats over its months, go after the tables they
+	// read, as the source defines them
+	rows, err := src.Query("SELECT name, sql FROM sqlite_master WHERE type = 'view' ORDER BY name")
+	if err != nil {
+		return err
+	}
+	var views [][2]string
+	for rows.Next() {
+		var view [2]string
+		if err := rows.Scan(&view[0], &view[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		views = append(views, view)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, view := range views {
+		if _, err := dst.Exec(`DROP VIEW IF EXISTS "` + view[0] + `"`); err != nil {
+			return err
+		}
+		if _, err := dst.Exec(view[1]); err != nil {
+			return fmt.Errorf("creating %s: %v", view[0], err)
+		}
+	}
+	return nil
+}
+
+// createSQLiteSchema creates the tables a SQLite destination lacks as the
+// source has them, with their indexes, such as months of heartbeats it
+// hasn't had, then brings its schema up to date, which adds them to its
+// heartbeats view.
+func createSQLiteSchema(src, dst database, tables []string) error {
+	for _, table := range tables {
+		var exists bool
+		if err := dst.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)",
+			table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		rows, err := src.Query(`
+			SELECT sql FROM sqlite_master
+			WHERE tbl_name = ? AND type IN ('table', 'index') AND sql IS NOT NULL
+			ORDER BY type = 'index', name`, table)
+		if err != nil {
+			return err
+		}
+		var statements []string
+		for rows.Next() {
+			var statement string
+			if err := rows.Scan(&statement); err != nil {
+				rows.Close()
+				return err
+			}
+			statements = append(statements, statement)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			if _, err := dst.Exec(statement); err != nil {
+				return fmt.Errorf("creating %s: %v", table, err)
+			}
+		}
+	}
+	_, err := store.New(dst.DB)
+	return err
+}
+
+// postgresTable returns the statements creating a table of the source in
+// PostgreSQL, then its indexes. A rowid alias becomes an identity column,
+// so rows added later still get their ids from the database. Partial and
+// expression indexes are left out.
+func postgresTable(src database, table string) ([]string, error) {
+	columns, err := tableColumns(src, table)
+	if err != nil {
+		return nil, err
+	}
+	alias := rowidAlias(columns)
+	var definitions []string
+	var keys []column
+	for _, c := range columns {
+		definition := `"` + c.name + `" ` + postgresType(c.typ)
+		if c.name == alias {
+			definition += " GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+		} else if c.pk > 0 {
+			keys = append(keys, c)
+		}
+		if c.notNull && c.name != alias {
+			definition += " NOT NULL"
+		}
+		if c.dflt.Valid {
+			definition += " DEFAULT " + c.dflt.String
+		}
+		definitions = append(definitions, definition)
+	}
+	if len(keys) > 0 {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].pk < keys[j].pk })
+		names := make([]string, len(keys))
+		// SQLite lets other primary keys hold NULLs, as distinct values
+		// like in a unique constraint
+		constraint := "PRIMARY KEY"
+		for i, c := range keys {
+			names[i] = c.name
+			if !c.notNull {
+				constraint = "UNIQUE"
+			}
+		}
+		definitions = append(definitions, constraint+` ("`+strings.Join(names, `", "`)+`")`)
+	}
+	statements := []string{`CREATE TABLE IF NOT EXISTS "` + table + `" (` + strings.Join(definitions, ", ") + `)`}
+
+	// Read in full first, as the source has a single connection
+	type index struct {
+		name, origin string
+		unique       bool
+	}
+	rows, err := src.Query(`SELECT name, "unique", origin FROM pragma_index_list(?) WHERE partial = 0 AND origin != 'pk' ORDER BY name`, table)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []index
+	for rows.Next() {
+		var i index
+		if err := rows.Scan(&i.name, &i.unique, &i.origin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexes = append(indexes, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, i := range indexes {
+		rows, err := src.Query(`SELECT name FROM pragma_index_info(?) ORDER BY seqno`, i.name)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		expression := false
+		for rows.Next() {
+			var name sql.NullString
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			expression = expression || !name.Valid
+			names = append(names, name.String)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if expression || len(names) == 0 {
+			continue
+		}
+		// SQLite names the indexes of UNIQUE constraints itself
+		name := i.name
+		if i.origin == "u" {
+			name = table + "_" + strings.Join(names, "_") + "_key"
+		}
+		unique := ""
+		if i.unique {
+			unique = "UNIQUE "
+		}
+		statements = append(statements, `CREATE `+unique+`INDEX IF NOT EXISTS "`+name+`" ON "`+table+`" ("`+strings.Join(names, `", "`)+`")`)
+	}
+	return statements, nil
+}
+
+// checkSchema fails unless a SQLite database has every table and column of
+// this version's schema, which the server adds when it starts.
+func checkSchema(src database) error {
+	db, err := store.OpenMemory()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := store.New(db); err != nil {
+		return err
+	}
+	current := database{DB: db}
+	tables, err := tableNames(current)
+	if err != nil {
+		return err
+	}
+	have, err := tableNames(src)
+	if err != nil {
+		return err
+	}
+	var months []string
+	for _, table := range have {
+		if isMonth(table) {
+			months = append(months, table)
+		}
+	}
+	for _, table := range tables {
+		// Each month has the columns of the one a new database starts with
+		checked := []string{table}
+		if isMonth(table) {
+			checked = months
+		} else if !slices.Contains(have, table) {
+			return fmt.Errorf("the schema has no %s table; start this version of the server on it once first", table)
+		}
+		columns, err := tableColumns(current, table)
+		if err != nil {
+			return err
+		}
+		for _, checked := range checked {
+			got, err := tableColumns(src, checked)
+			if err != nil {
+				return err
+			}
+			for _, c := range columns {
+				if !slices.ContainsFunc(got, func(g column) bool { return g.name == c.name }) {
+					return fmt.Errorf("the schema has no %s.%s column; start this version of the server on it once first",
+						checked, c.name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isMonth reports whether a table holds a month of heartbeats.
+func isMonth(table string) bool {
+	ok, _ := path.Match("heartbeats_[0-9][0-9][0-9][0-9]_[0-9][0-9]", table)
+	return ok
+}
+
+// sameRows reports whether a table holds the same rows in the destination
+// as in the source, in any order, printing how they differ if not.
+func sameRows(src, dst database, table string, out io.Writer) (bool, error) {
+	columns, err := tableColumns(src, table)
+	if err != nil {
+		return false, err
+	}
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = `"` + c.name + `"`
+	}
+	query := `SELECT ` + strings.Join(names, ", ") + ` FROM "` + table + `"`
+	want, wantSum, err := checksum(src, query, len(columns))
+	if err != nil {
+		return false, err
+	}
+	got, gotSum, err := checksum(dst, query, len(columns))
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case got != want:
+		fmt.Fprintf(out, "%s: %d rows, but %d in the source\n", table, got, want)
+	case gotSum != wantSum:
+		fmt.Fprintf(out, "%s: %d rows, but they differ from the source's\n", table, got)
+	default:
+		return true, nil
+	}
+	return false, nil
+}
+
+// checksum counts the rows query reads and sums a hash of each, so the sum
+// doesn't depend on their order. Values hash by their text, as SQLite and
+// PostgreSQL return numbers and text as different types.
+func checksum(db database, query string, width int) (int64, uint64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	var n int64
+	var sum uint64
+	row := make([]interface{}, width)
+	dest := make([]interface{}, width)
+	for i := range row {
+		dest[i] = &row[i]
+	}
+	h := fnv.New64a()
+	var buf []byte
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, 0, err
+		}
+		h.Reset()
+		for _, value := range row {
+			// Lengths go first so values can't run into each other, and
+			// NULL has none
+			text, ok := valueText(value)
+			length := int64(-1)
+			if ok {
+				length = int64(len(text))
+			}
+			buf = binary.AppendVarint(buf[:0], length)
+			h.Write(buf)
+			h.Write([]byte(text))
+		}
+		sum += h.Sum64()
+		n++
+	}
+	return n, sum, rows.Err()
+}
+
+// valueText is a value read from either database as text, or false for
+// NULL.
+func valueText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		return string(v), true
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	return fmt.Sprint(value), true
+}
+
+// tableNames lists the tables of the schema, leaving out SQLite's own.
+func tableNames(db database) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != ?
+		ORDER BY name`, migrateProgress)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// copyTable copies the rows of a table past the last one copied in
+// batches, keeping their rowids so references between tables hold. Each
+// batch commits together with the progress it makes. PostgreSQL has no
+// rowids, so there only rowid aliases keep theirs, and their identity
+// continues after the highest.
+func copyTable(src, dst database, table string, batch int, out io.Writer) error {
+	all, err := tableColumns(src, table)
+	if err != nil {
+		return err
+	}
+	alias := rowidAlias(all)
+	var columns []string
+	for _, c := range all {
+		if c.name != alias {
+			columns = append(columns, c.name)
+		}
+	}
+	var last, total int64
+	err = dst.QueryRow(dst.bind("SELECT last_rowid FROM "+migrateProgress+" WHERE table_name = ?"), table).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := src.QueryRow(`SELECT COUNT(*) FROM "`+table+`" WHERE rowid > ?`, last).Scan(&total); err != nil {
+		return err
+	}
+	if total == 0 {
+		fmt.Fprintf(out, "%s: up to date\n", table)
+		return nil
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = `"` + column + `"`
+	}
+	selectBatch := `SELECT ` + strings.Join(append([]string{"rowid"}, quoted...), ", ") +
+		` FROM "` + table + `" WHERE rowid > ? ORDER BY rowid LIMIT ?`
+	// The rowid read first goes into the rowid, or in PostgreSQL into its
+	// alias if there is one
+	inserted, skip := append([]string{"rowid"}, quoted...), 0
+	if dst.postgres && alias != "" {
+		inserted[0] = `"` + alias + `"`
+	} else if dst.postgres {
+		inserted, skip = quoted, 1
+	}
+	verb := "INSERT OR REPLACE INTO"
+	if dst.postgres {
+		verb = "INSERT INTO"
+	}
+	insert := dst.bind(verb + ` "` + table + `" (` + strings.Join(inserted, ", ") + `) VALUES (?` +
+		strings.Repeat(", ?", len(inserted)-1) + `)`)
+
+	var copied int64
+	for {
+		values, err := readBatch(src, selectBatch, last, batch, len(columns)+1)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			break
+		}
+		tx, err := dst.Begin()
+		if err != nil {
+			return err
+		}
+		for _, row := range values {
+			if _, err := tx.Exec(insert, row[skip:]...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		last = values[len(values)-1][0].(int64)
+		if _, err := tx.Exec(dst.bind(`
+			INSERT INTO `+migrateProgress+` (table_name, last_rowid) VALUES (?, ?)
+			ON CONFLICT (table_name) DO UPDATE SET last_rowid = excluded.last_rowid`), table, last); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		copied += int64(len(values))
+		fmt.Fprintf(out, "%s: %d/%d rows\n", table, copied, total)
+	}
+	if dst.postgres && alias != "" {
+		_, err := dst.Exec(`SELECT setval(pg_get_serial_sequence($1, $2), MAX("`+alias+`")) FROM "`+table+`"`,
+			`"`+table+`"`, alias)
+		return err
+	}
+	return nil
+}
+
+// readBatch reads up to limit rows past rowid after, each as its values.
+func readBatch(db database, query string, after int64, limit, width int) ([][]interface{}, error) {
+	rows, err := db.Query(query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values [][]interface{}
+	for rows.Next() {
+		row := make([]interface{}, width)
+		dest := make([]interface{}, width)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+// runMigrate runs the migrate subcommand and exits.
+func runMigrate(args []string) {
+	if err := migrate(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestPostgresTable(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := store.New(db); err != nil {
+		t.Fatal(err)
+	}
+	// The month's heartbeats a new database starts with
+	month := time.Now().UTC().Format("heartbeats_2006_01")
+	for _, tc := range []struct {
+		table string
+		want  []string
+	}{
+		{month, []string{
+			`CREATE TABLE IF NOT EXISTS "` + month + `" ("id" BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY, "user_id" TEXT,`,
+			`"duration" DOUBLE PRECISION,`,
+			`"entity_type" TEXT NOT NULL DEFAULT 'file',`,
+			`CREATE INDEX IF NOT EXISTS "` + month + `_user_time" ON "` + month + `" ("user_id", "timestamp")`,
+		}},
+		{"daily_summaries", []string{`UNIQUE ("user_id", "day", "project_id", "language", "manual"))`}},
+		{"api_keys", []string{`CREATE UNIQUE INDEX IF NOT EXISTS "api_keys_key_hash_key" ON "api_keys" ("key_hash")`}},
+	} {
+		statements, err := postgresTable(database{DB: db}, tc.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all := strings.Join(statements, "\n")
+		for _, want := range tc.want {
+			if !strings.Contains(all, want) {
+				t.Errorf("%s: no %s in\n%s", tc.table, want, all)
+			}
+		}
+	}
+}
+
+func TestPostgresType(t *testing.T) {
+	for declared, want := range map[string]string{
+		"INTEGER": "BIGINT", "bigint": "BIGINT", "TEXT": "TEXT", "VARCHAR(20)": "TEXT",
+		"REAL": "DOUBLE PRECISION", "DOUBLE": "DOUBLE PRECISION", "BLOB": "BYTEA", "": "BYTEA",
+		"NUMERIC": "NUMERIC", "DATETIME": "NUMERIC",
+	} {
+		if got := postgresType(declared); got != want {
+			t.Errorf("postgresType(%q) = %q, want %q", declared, got, want)
+		}
+	}
+	if got := (database{postgres: true}).bind("a = ? AND b IN (?, ?)"); got != "a = $1 AND b IN ($2, $3)" {
+		t.Errorf("bound %q", got)
+	}
+}
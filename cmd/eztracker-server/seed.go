@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kru/eztracker/internal/sample"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// seed runs "eztracker-server seed", storing made-up heartbeats of a user
+// in the database of the .env, so the dashboard and reports have something
+// to show before any editor is set up. Users that already have projects
+// are left alone, so real data isn't mixed with made-up data.
+func seed(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	days := flags.Int("days", 90, "days of activity to make up, up to today")
+	userID := flags.String("user", demoUser, "user the activity belongs to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 || *days > 3660 {
+		return fmt.Errorf("invalid --days: %d", *days)
+	}
+	if *userID == "" {
+		return fmt.Errorf("invalid --user: empty")
+	}
+
+	config, err := loadEnv()
+	if err != nil {
+		return fmt.Errorf("loading .env: %v", err)
+	}
+	db, err := store.Open(config.DBPath, config.DBMaxOpenConns)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		return err
+	}
+
+	projects, err := st.Projects(*userID, true)
+	if err != nil {
+		return err
+	}
+	if len(projects) > 0 {
+		return fmt.Errorf("user %q already has projects; seed a new user", *userID)
+	}
+	n, err := sample.Seed(st, *userID, *days, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Stored %d heartbeats of user %q over %d days\n", n, *userID, *days)
+	return nil
+}
+
+// runSeed runs the seed subcommand and exits.
+func runSeed(args []string) {
+	if err := seed(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "seed:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
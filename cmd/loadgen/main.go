@@ -0,0 +1,199 @@
+// Command loadgen replays synthetic heartbeat streams against an eztracker
+// server at a fixed rate and reports throughput and latency, so ingestion
+// performance can be compared between changes.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type heartbeat struct {
+	UserID    string   `json:"user_id"`
+	Project   string   `json:"project"`
+	Language  string   `json:"language"`
+	FilePath  string   `json:"file_path"`
+	Duration  float64  `json:"duration"`
+	Timestamp int64    `json:"timestamp"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+var languages = []string{"Go", "Lua", "Python", "TypeScript", "Rust", "Markdown"}
+
+// stream produces the heartbeats of one simulated user: mostly staying on
+// the same file for a while, sometimes switching file or project.
+type stream struct {
+	rng      *rand.Rand
+	userID   string
+	projects int
+	project  int
+	file     int
+	clock    int64
+}
+
+func (s *stream) next() heartbeat {
+	switch r := s.rng.Intn(100); {
+	case r < 5:
+		s.project = s.rng.Intn(s.projects)
+		s.file = s.rng.Intn(40)
+	case r < 25:
+		s.file = s.rng.Intn(40)
+	}
+	s.clock += int64(10 + s.rng.Intn(110))
+
+	return heartbeat{
+		UserID:    s.userID,
+		Project:   fmt.Sprintf("project-%d", s.project),
+		Language:  languages[(s.project+s.file)%len(languages)],
+		FilePath:  fmt.Sprintf("/home/%s/src/project-%d/file-%d", s.userID, s.project, s.file),
+		Duration:  float64(10 + s.rng.Intn(110)),
+		Timestamp: s.clock,
+		Tags:      []string{"loadgen"},
+	}
+}
+
+type result struct {
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "Server URL")
+	apiKey := flag.String("key", os.Getenv("API_KEY"), "API key (defaults to $API_KEY)")
+	rate := flag.Float64("rate", 50, "Heartbeats per second across all users")
+	duration := flag.Duration("duration", 30*time.Second, "How long to generate load")
+	users := flag.Int("users", 10, "Number of simulated users")
+	projects := flag.Int("projects", 5, "Projects per user")
+	workers := flag.Int("concurrency", 16, "Maximum requests in flight")
+	seed := flag.Int64("seed", 1, "Random seed, for repeatable streams")
+	flag.Parse()
+
+	if *apiKey == "" {
+		log.Fatal("an API key is required, pass -key or set API_KEY")
+	}
+	if *rate <= 0 || *users <= 0 || *projects <= 0 || *workers <= 0 {
+		log.Fatal("-rate, -users, -projects and -concurrency must be positive")
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	start := time.Now().Add(-24 * time.Hour).Unix()
+	streams := make([]*stream, *users)
+	for i := range streams {
+		streams[i] = &stream{
+			rng:      rand.New(rand.NewSource(rng.Int63())),
+			userID:   fmt.Sprintf("loadgen-%d", i),
+			projects: *projects,
+			clock:    start,
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	jobs := make(chan heartbeat)
+	results := make(chan result, *workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hb := range jobs {
+				results <- send(client, *url, *apiKey, hb)
+			}
+		}()
+	}
+
+	var latencies []time.Duration
+	errs := make(map[string]int)
+	done := make(chan struct{})
+	go func() {
+		for r := range results {
+			if r.err != nil {
+				errs[r.err.Error()]++
+				continue
+			}
+			latencies = append(latencies, r.latency)
+		}
+		close(done)
+	}()
+
+	// Pace requests on a ticker; when the workers cannot keep up the ticker
+	// drops ticks, which shows up as an achieved rate below the target.
+	began := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	deadline := time.After(*duration)
+	sent := 0
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			jobs <- streams[sent%len(streams)].next()
+			sent++
+		}
+	}
+	ticker.Stop()
+	close(jobs)
+	wg.Wait()
+	close(results)
+	<-done
+	elapsed := time.Since(began)
+
+	failed := 0
+	for _, n := range errs {
+		failed += n
+	}
+	fmt.Printf("sent %d heartbeats in %s (%.1f/s, target %.1f/s)\n",
+		sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(), *rate)
+	fmt.Printf("ok %d, failed %d\n", len(latencies), failed)
+	for msg, n := range errs {
+		fmt.Printf("  %dx %s\n", n, msg)
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		pct := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		fmt.Printf("latency p50 %s, p90 %s, p99 %s, max %s\n",
+			pct(0.50), pct(0.90), pct(0.99), latencies[len(latencies)-1])
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func send(client *http.Client, url, apiKey string, hb heartbeat) result {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return result{err: err}
+	}
+	req, err := http.NewRequest("POST", url+"/heartbeat", bytes.NewReader(data))
+	if err != nil {
+		return result{err: err}
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "eztracker-loadgen")
+
+	began := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: fmt.Errorf("request failed: %v", err)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return result{err: fmt.Errorf("server returned %d", resp.StatusCode)}
+	}
+	return result{latency: time.Since(began)}
+}
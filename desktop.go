@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/client"
+	"github.com/kru/eztracker/pkg/tracker"
+)
+
+// AppConfig holds settings from an [app:<name>] config section, for time
+// desktop tracking records in an application.
+type AppConfig struct {
+	// Project and Category replace those of desktop heartbeats when set.
+	Project  string
+	Category string
+}
+
+// Defaults of desktop heartbeats in apps without an [app:<name>] section.
+const (
+	desktopProject  = "desktop"
+	desktopCategory = "desktop"
+)
+
+// runDesktop samples the focused application every --interval and sends a
+// heartbeat with entity_type app for it, counting the interval as spent in
+// it. It only runs when started, and only applications allowed by the
+// desktop_allow and desktop_deny settings are recorded; window titles are
+// matched against them but never sent.
+func runDesktop(args []string) int {
+	fs := flag.NewFlagSet("desktop", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Minute, "How often to sample the focused application")
+	once := fs.Bool("once", false, "Sample once and exit, e.g. from cron")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if *interval < time.Second {
+		fmt.Fprintf(os.Stderr, "Error: Invalid interval %v\n", *interval)
+		return ExitCodeInvalidInput
+	}
+	config := mustLoadConfig()
+
+	for {
+		if err := sampleDesktop(config, *interval); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if *once {
+				return exitCodeFor(err)
+			}
+		}
+		if *once {
+			return ExitCodeSuccess
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// sampleDesktop sends a heartbeat for the focused application, unless
+// tracking is paused or the settings leave it out.
+func sampleDesktop(config Config, interval time.Duration) error {
+	if _, paused := pausedUntil(); paused {
+		return nil
+	}
+	app, title, err := focusedWindow()
+	if err != nil {
+		return fmt.Errorf("failed to read the focused window: %v", err)
+	}
+	if app == "" || !desktopAllowed(config, app, title) {
+		if config.Debug {
+			fmt.Printf("Debug: Not recording %q\n", app)
+		}
+		return nil
+	}
+
+	settings := config.Apps[strings.ToLower(app)]
+	hb := client.Heartbeat{
+		UserID:     config.UserID,
+		Project:    desktopProject,
+		Entity:     app,
+		EntityType: "app",
+		Category:   desktopCategory,
+		Machine:    tracker.DetectMachine(),
+		Duration:   interval.Seconds(),
+		Timestamp:  time.Now().Unix(),
+	}
+	if settings.Project != "" {
+		hb.Project = settings.Project
+	}
+	if settings.Category != "" {
+		hb.Category = settings.Category
+	}
+	if session, ok := activeFocusSession(); ok {
+		hb.SessionID = session.ID
+	}
+	if config.Debug {
+		fmt.Printf("Debug: Sending heartbeat: %+v\n", hb)
+	}
+
+	c := newClient(config)
+	c.UserAgent = "eztracker-desktop"
+	t := &tracker.Tracker{Client: c, UserID: config.UserID, Queue: newQueue()}
+	return t.Send(hb)
+}
+
+// desktopAllowed reports whether time in an application with a window
+// title may be recorded: neither may match a desktop_deny pattern, and one
+// must match a desktop_allow pattern if there are any. Patterns are
+// path.Match globs, such as "*private browsing*", compared without case.
+func desktopAllowed(config Config, app, title string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			for _, name := range []string{app, title} {
+				if ok, _ := path.Match(pattern, strings.ToLower(name)); ok && name != "" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if matches(config.DesktopDeny) {
+		return false
+	}
+	return len(config.DesktopAllow) == 0 || matches(config.DesktopAllow)
+}
+
+// checkPatterns returns an error for the first malformed glob in a
+// setting.
+func checkPatterns(setting string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s pattern %q", setting, pattern)
+		}
+	}
+	return nil
+}
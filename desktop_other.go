@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// focusedWindow returns the application and window title in focus, asking
+// System Events on macOS and xdotool under X11 elsewhere. Wayland
+// compositors don't tell other programs.
+func focusedWindow() (app, title string, err error) {
+	if runtime.GOOS == "darwin" {
+		app, err = output("osascript", "-e",
+			`tell application "System Events" to get name of first application process whose frontmost is true`)
+		if err != nil {
+			return "", "", err
+		}
+		// Titles need the accessibility permission; the app is enough
+		// without it
+		title, _ = output("osascript", "-e",
+			`tell application "System Events" to get name of front window of (first application process whose frontmost is true)`)
+		return app, title, nil
+	}
+
+	if app, err = output("xdotool", "getactivewindow", "getwindowclassname"); err != nil {
+		return "", "", err
+	}
+	title, _ = output("xdotool", "getactivewindow", "getwindowname")
+	return app, title, nil
+}
+
+// output runs a command and returns its trimmed output.
+func output(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
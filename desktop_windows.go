@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	user32                         = syscall.NewLazyDLL("user32.dll")
+	procGetForegroundWindow        = user32.NewProc("GetForegroundWindow")
+	procGetWindowTextW             = user32.NewProc("GetWindowTextW")
+	procGetWindowThreadProcessId   = user32.NewProc("GetWindowThreadProcessId")
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+// processQueryLimitedInformation is PROCESS_QUERY_LIMITED_INFORMATION.
+const processQueryLimitedInformation = 0x1000
+
+// focusedWindow returns the application, by its executable's name, and
+// the title of the foreground window.
+func focusedWindow() (app, title string, err error) {
+	hwnd, _, _ := procGetForegroundWindow.Call()
+	if hwnd == 0 {
+		return "", "", nil
+	}
+	buf := make([]uint16, 512)
+	n, _, _ := procGetWindowTextW.Call(hwnd, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	title = syscall.UTF16ToString(buf[:n])
+
+	var pid uint32
+	procGetWindowThreadProcessId.Call(hwnd, uintptr(unsafe.Pointer(&pid)))
+	process, err := syscall.OpenProcess(processQueryLimitedInformation, false, pid)
+	if err != nil {
+		return "", "", fmt.Errorf("opening process %d: %v", pid, err)
+	}
+	defer syscall.CloseHandle(process)
+	size := uint32(len(buf))
+	r, _, err := procQueryFullProcessImageNameW.Call(uintptr(process), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", "", fmt.Errorf("reading the executable of process %d: %v", pid, err)
+	}
+	exe := filepath.Base(syscall.UTF16ToString(buf[:size]))
+	return strings.TrimSuffix(exe, filepath.Ext(exe)), title, nil
+}
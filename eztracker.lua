@@ -12,8 +12,12 @@ local json = vim.json
 local VERSION = '0.0.1'
 
 -- Constants
+local EXIT_CODE_NETWORK_ERROR = 102
 local EXIT_CODE_CONFIG_PARSE_ERROR = 103
 local EXIT_CODE_API_KEY_ERROR = 104
+local EXIT_CODE_INVALID_INPUT = 105
+local EXIT_CODE_REQUEST_REJECTED = 106
+local EXIT_CODE_SERVER_ERROR = 107
 
 --- @class eztracker.Config
 --- @field heartbeat_frequency? number # Frequency in minutes to send heartbeats.
@@ -476,6 +480,22 @@ local function neovim_async_exit_handler(job_id, exit_code, event, cmd_args_str)
     error_msg = error_msg .. (error_msg ~= '' and
       '\n' or '') .. 'Error parsing config file: ' .. state.config_file
     is_error = true
+  elseif exit_code == EXIT_CODE_NETWORK_ERROR then
+    error_msg = error_msg .. (error_msg ~= '' and
+      '\n' or '') .. 'Could not reach the eztracker server'
+    is_error = true
+  elseif exit_code == EXIT_CODE_INVALID_INPUT then
+    error_msg = error_msg .. (error_msg ~= '' and
+      '\n' or '') .. 'The CLI rejected the heartbeat arguments'
+    is_error = true
+  elseif exit_code == EXIT_CODE_REQUEST_REJECTED then
+    error_msg = error_msg .. (error_msg ~= '' and
+      '\n' or '') .. 'The eztracker server rejected the heartbeat'
+    is_error = true
+  elseif exit_code == EXIT_CODE_SERVER_ERROR then
+    error_msg = error_msg .. (error_msg ~= '' and
+      '\n' or '') .. 'The eztracker server failed to handle the heartbeat'
+    is_error = true
   elseif exit_code ~= 0 then
     error_msg = error_msg .. (error_msg ~= '' and
       '\n' or '') .. fmt('CLI exited with code %d', exit_code)
@@ -901,8 +921,27 @@ function M.setup(user_config)
   state.plugin_root_folder = fn.fnamemodify(script_path, ':h:h:h')
   state.plugin_root_folder = state.plugin_root_folder:gsub('\\', '/')
 
-  -- Define paths based on home dir
+  -- Define paths based on home dir. The config is found like the CLI does:
+  -- the XDG one (%APPDATA% on Windows), else ~/.eztracker.cfg from before,
+  -- else a new XDG one.
   state.config_file = state.home .. '/.eztracker.cfg'
+  local config_home
+  if state.is_windows then
+    config_home = os.getenv('APPDATA')
+    if config_home == '' then config_home = nil end
+    if config_home then config_home = config_home:gsub('\\', '/') end
+  else
+    config_home = os.getenv('XDG_CONFIG_HOME')
+    if not config_home or config_home:sub(1, 1) ~= '/' then
+      config_home = state.home .. '/.config'
+    end
+  end
+  if config_home then
+    local xdg_config_file = config_home .. '/eztracker/eztracker.cfg'
+    if fn.filereadable(xdg_config_file) == 1 or fn.filereadable(state.config_file) == 0 then
+      state.config_file = xdg_config_file
+    end
+  end
   state.shared_state_parent_dir = state.home .. '/.eztracker'
   -- Use different state file than Vim
   state.shared_state_file = state.shared_state_parent_dir .. '/nvim_shared_state'
@@ -1,75 +1,241 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/kru/eztracker/client"
+	"github.com/kru/eztracker/internal/durationfmt"
+	"github.com/kru/eztracker/pkg/tracker"
+)
+
+// Release metadata compared against the server's /api/v1/version.
+const (
+	cliVersion       = "0.0.1"
+	minServerVersion = "0.2.0"
 )
 
+// Exit codes follow the wakatime-cli convention so editor plugins can tell
+// failures apart and show a useful message:
+//
+//	0   success
+//	1   unexpected error, e.g. the state directory is not writable
+//	102 network failure, the server could not be reached
+//	103 the config file could not be parsed
+//	104 the API key is missing or was rejected by the server
+//	105 malformed input: bad flags, timestamps or heartbeat JSON
+//	106 the server rejected the request (4xx other than auth)
+//	107 the server failed to handle the request (5xx)
 const (
 	ExitCodeSuccess          = 0
+	ExitCodeGenericError     = 1
+	ExitCodeNetworkError     = 102
 	ExitCodeConfigParseError = 103
 	ExitCodeAPIKeyError      = 104
+	ExitCodeInvalidInput     = 105
+	ExitCodeRequestRejected  = 106
+	ExitCodeServerError      = 107
 )
 
+// exitCodeFor maps a request error to its exit code.
+func exitCodeFor(err error) int {
+	var srvErr *client.Error
+	switch {
+	case client.Retryable(err):
+		return ExitCodeNetworkError
+	case errors.As(err, &srvErr):
+		switch {
+		case srvErr.StatusCode == http.StatusUnauthorized || srvErr.StatusCode == http.StatusForbidden:
+			return ExitCodeAPIKeyError
+		case srvErr.StatusCode >= 500:
+			return ExitCodeServerError
+		default:
+			return ExitCodeRequestRejected
+		}
+	}
+	return ExitCodeGenericError
+}
+
 type Config struct {
-	APIKey    string
-	ServerURL string
-	Debug     bool
+	APIKey             string
+	APIKeySource       string
+	ServerURL          string
+	Proxy              string
+	CAFile             string
+	ClientCert         string
+	ClientKey          string
+	Debug              bool
+	DetectDependencies bool
+	Projects           map[string]ProjectConfig
+
+	// Apps holds [app:<name>] sections by lowercased name, and
+	// DesktopAllow and DesktopDeny the patterns of applications and window
+	// titles the desktop command may and may not record.
+	Apps         map[string]AppConfig
+	DesktopAllow []string
+	DesktopDeny  []string
+
+	// UserID, from user_id, is the user heartbeats are sent as and stats
+	// read for; empty for the API key's own, which the server key has none
+	// of.
+	UserID string
+
+	// DurationFormat is how --today, offline-stats and statusline write
+	// durations.
+	DurationFormat durationfmt.Style
+
+	// KeystrokeTimeout is the longest gap between heartbeats for the same
+	// file that still merges them into one before sending.
+	KeystrokeTimeout time.Duration
+
+	// TodayCacheTTL is how long --today reuses the server's last answer,
+	// 0 for not at all.
+	TodayCacheTTL time.Duration
+
+	// GzipThreshold is the size in bytes above which queued heartbeats are
+	// sent gzipped, 0 for never.
+	GzipThreshold int
+
+	// TLS is built from CAFile, ClientCert and ClientKey, nil when they
+	// are not set.
+	TLS *tls.Config
+
+	// PathKey, from path_key, encrypts file paths before they are sent,
+	// nil to send them as they are.
+	PathKey *tracker.PathKey
+}
+
+// ProjectConfig holds settings from a [project:<name>] config section.
+type ProjectConfig struct {
+	Tags []string
+
+	// KeystrokeTimeout overrides Config.KeystrokeTimeout when not 0.
+	KeystrokeTimeout time.Duration
+}
+
+// keystrokeTimeout returns the keystroke timeout for a project.
+func (c Config) keystrokeTimeout(project string) time.Duration {
+	if d := c.Projects[project].KeystrokeTimeout; d > 0 {
+		return d
+	}
+	return c.KeystrokeTimeout
+}
+
+// legacyConfigPath and legacyStateDir are where the CLI kept its config and
+// state, in the home directory, before following the XDG base directories.
+// They are still used when they exist and the new ones don't, until
+// "eztracker migrate" moves them.
+const (
+	legacyConfigPath = ".eztracker.cfg"
+	legacyStateDir   = ".eztracker"
+)
+
+// configPath is eztracker.cfg in $XDG_CONFIG_HOME/eztracker, or
+// %APPDATA%\eztracker on Windows, unless only ~/.eztracker.cfg exists.
+// EZTRACKER_CONFIG_FILE overrides it, e.g. for a config mounted into a
+// container.
+func configPath() (string, error) {
+	if path := os.Getenv("EZTRACKER_CONFIG_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %v", err)
+	}
+	return preferExisting(xdgConfigPath(home), filepath.Join(home, legacyConfigPath)), nil
+}
+
+// xdgConfigPath is the config file following the XDG base directories.
+func xdgConfigPath(home string) string {
+	if runtime.GOOS == "windows" {
+		if appData, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(appData, "eztracker", "eztracker.cfg")
+		}
+	}
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", home, ".config"), "eztracker", "eztracker.cfg")
 }
 
-type Heartbeat struct {
-	Entity            string  `json:"entity"`
-	Timestamp         float64 `json:"timestamp"`
-	Language          string  `json:"language,omitempty"`
-	AlternateLanguage string  `json:"alternate_language,omitempty"`
-	IsWrite           bool    `json:"is_write"`
-	Plugin            string  `json:"plugin"`
-	Duration          float64 `json:"duration"`
+// xdgStateDir is the state directory following the XDG base directories,
+// next to the config on Windows.
+func xdgStateDir(home string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Dir(xdgConfigPath(home))
+	}
+	return filepath.Join(xdgDir("XDG_STATE_HOME", home, filepath.Join(".local", "state")), "eztracker")
 }
 
-type ServerHeartbeat struct {
-	UserID    string  `json:"user_id"`
-	Project   string  `json:"project"`
-	Language  string  `json:"language"`
-	FilePath  string  `json:"file_path"`
-	Duration  float64 `json:"duration"`
-	Timestamp int64   `json:"timestamp"`
+// xdgDir is the base directory in the environment variable name, or
+// fallback in home when it is unset or, against the spec, relative.
+func xdgDir(name, home, fallback string) string {
+	if dir := os.Getenv(name); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(home, fallback)
+}
+
+// preferExisting returns path, or legacy when only legacy exists.
+func preferExisting(path, legacy string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return path
 }
 
 func loadConfig() (Config, error) {
 	config := Config{
-		ServerURL: "http://localhost:8080", // Default server URL
+		ServerURL:        "http://localhost:8080", // Default server URL
+		Projects:         make(map[string]ProjectConfig),
+		Apps:             make(map[string]AppConfig),
+		KeystrokeTimeout: 15 * time.Minute,
+		TodayCacheTTL:    time.Minute,
+		GzipThreshold:    client.DefaultGzipThreshold,
 	}
 
-	// Check environment variables first
+	// Check environment variables first: API_KEY, and any setting as
+	// EZTRACKER_ and its name in upper case, such as EZTRACKER_SERVER_URL
 	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
 		config.APIKey = apiKey
 	}
-	if serverURL := os.Getenv("EZTRACKER_SERVER_URL"); serverURL != "" {
-		config.ServerURL = serverURL
-	}
-	if debug := os.Getenv("EZTRACKER_DEBUG"); debug == "true" {
-		config.Debug = true
+	for key := range knownSettings {
+		name := "EZTRACKER_" + strings.ToUpper(key)
+		if value := os.Getenv(name); value != "" {
+			if err := config.set(key, value); err != nil {
+				return config, fmt.Errorf("%s: %v", name, err)
+			}
+		}
 	}
 
-	// Override with config file if it exists
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return config, fmt.Errorf("failed to get home directory: %v", err)
-	}
-	configPath := filepath.Join(home, ".eztracker.cfg")
-	data, err := os.ReadFile(configPath)
-	if err != nil && !os.IsNotExist(err) {
-		return config, fmt.Errorf("failed to read config file: %v", err)
+	// Override with config file if it exists. One named by
+	// EZTRACKER_CONFIG_FILE has to; without a home directory, as in some
+	// containers, there is none to look for
+	var data []byte
+	path, err := configPath()
+	if err == nil {
+		data, err = os.ReadFile(path)
+		if os.IsNotExist(err) && os.Getenv("EZTRACKER_CONFIG_FILE") != "" {
+			return config, fmt.Errorf("EZTRACKER_CONFIG_FILE %s does not exist", path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return config, fmt.Errorf("failed to read config file: %v", err)
+		}
 	}
 
 	if len(data) > 0 {
@@ -84,22 +250,57 @@ func loadConfig() (Config, error) {
 				currentSection = strings.Trim(line, "[]")
 				continue
 			}
-			if currentSection == "settings" {
-				parts := strings.SplitN(line, "=", 2)
-				if len(parts) != 2 {
-					continue
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+			if name, ok := strings.CutPrefix(currentSection, "project:"); ok {
+				project := config.Projects[name]
+				switch key {
+				case "tags":
+					project.Tags = splitList(value)
+				case "keystroke_timeout":
+					d, err := time.ParseDuration(value)
+					if err != nil || d < 0 {
+						return config, fmt.Errorf("invalid keystroke_timeout %q for project %s", value, name)
+					}
+					project.KeystrokeTimeout = d
 				}
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
+				config.Projects[name] = project
+				continue
+			}
+			if name, ok := strings.CutPrefix(currentSection, "app:"); ok {
+				app := config.Apps[strings.ToLower(name)]
 				switch key {
-				case "api_key":
-					config.APIKey = value
-				case "server_url":
-					config.ServerURL = value
-				case "debug":
-					config.Debug = value == "true"
+				case "project":
+					app.Project = value
+				case "category":
+					app.Category = value
 				}
+				config.Apps[strings.ToLower(name)] = app
+				continue
 			}
+			if currentSection == "settings" {
+				if err := config.set(key, value); err != nil {
+					return config, err
+				}
+			}
+		}
+	}
+
+	if config.TLS, err = clientTLS(config.CAFile, config.ClientCert, config.ClientKey); err != nil {
+		return config, err
+	}
+
+	// The keychain takes precedence, falling back to the file when the
+	// keychain is locked, unavailable or empty
+	if config.APIKeySource == "keychain" {
+		if key, err := keychainGet(); err == nil {
+			config.APIKey = key
+		} else if config.Debug {
+			fmt.Printf("Debug: API key not read from the keychain, using the file: %v\n", err)
 		}
 	}
 
@@ -110,20 +311,82 @@ func loadConfig() (Config, error) {
 	return config, nil
 }
 
-func main() {
-	// Define flags
-	entity := flag.String("entity", "", "File path for the heartbeat")
-	timeStr := flag.String("time", "", "Timestamp for the heartbeat (seconds.micros)")
-	language := flag.String("language", "", "Language of the file")
-	alternateLanguage := flag.String("alternate-language", "", "Alternate language")
-	isWrite := flag.Bool("write", false, "Whether this is a write event")
-	plugin := flag.String("plugin", "eztracker-cli", "Plugin identifier")
-	extraHeartbeats := flag.String("extra-heartbeats", "", "JSON array of additional heartbeats")
-	today := flag.Bool("today", false, "Fetch today's summary")
-	version := flag.Bool("version", false, "Show CLI version")
-	duration := flag.Float64("duration", 0.0, "Duration if same file edited")
-	flag.Parse()
+// set applies a setting of the [settings] section, ignoring the ones only
+// editor plugins read.
+func (c *Config) set(key, value string) error {
+	switch key {
+	case "api_key":
+		c.APIKey = value
+	case "api_key_source":
+		if value != "file" && value != "keychain" {
+			return fmt.Errorf("invalid api_key_source %q, want file or keychain", value)
+		}
+		c.APIKeySource = value
+	case "server_url":
+		c.ServerURL = value
+	case "user_id":
+		c.UserID = value
+	case "proxy":
+		if _, err := parseProxy(value); err != nil {
+			return err
+		}
+		c.Proxy = value
+	case "ca_file":
+		c.CAFile = value
+	case "client_cert":
+		c.ClientCert = value
+	case "client_key":
+		c.ClientKey = value
+	case "debug":
+		c.Debug = value == "true"
+	case "detect_dependencies":
+		c.DetectDependencies = value == "true"
+	case "keystroke_timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid keystroke_timeout %q", value)
+		}
+		c.KeystrokeTimeout = d
+	case "today_cache_ttl":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid today_cache_ttl %q", value)
+		}
+		c.TodayCacheTTL = d
+	case "duration_format":
+		style, err := durationfmt.Parse(value)
+		if err != nil {
+			return err
+		}
+		c.DurationFormat = style
+	case "gzip_threshold":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid gzip_threshold %q, want a number of bytes", value)
+		}
+		c.GzipThreshold = n
+	case "path_key":
+		key, err := tracker.ParsePathKey(value)
+		if err != nil {
+			return fmt.Errorf("invalid path_key: %v", err)
+		}
+		c.PathKey = key
+	case "desktop_allow":
+		c.DesktopAllow = splitList(value)
+		if err := checkPatterns(key, c.DesktopAllow); err != nil {
+			return err
+		}
+	case "desktop_deny":
+		c.DesktopDeny = splitList(value)
+		if err := checkPatterns(key, c.DesktopDeny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// mustLoadConfig loads the config or exits with the matching exit code.
+func mustLoadConfig() Config {
 	config, err := loadConfig()
 	if err != nil {
 		if strings.Contains(err.Error(), "API key not found") {
@@ -138,33 +401,112 @@ func main() {
 		fmt.Printf("Debug: Config loaded: APIKey=%s, ServerURL=%s, Debug=%v\n",
 			config.APIKey, config.ServerURL, config.Debug)
 	}
+	return config
+}
+
+func main() {
+	// Subcommands take precedence over the heartbeat flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pause":
+			os.Exit(runPause(os.Args[2:]))
+		case "resume":
+			os.Exit(runResume(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "statusline":
+			os.Exit(runStatusline(os.Args[2:]))
+		case "tray":
+			os.Exit(runTray(os.Args[2:]))
+		case "desktop":
+			os.Exit(runDesktop(os.Args[2:]))
+		case "focus":
+			os.Exit(runFocus(os.Args[2:]))
+		case "log":
+			os.Exit(runLog(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "rpc":
+			os.Exit(runRPC(os.Args[2:]))
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "offline-stats":
+			os.Exit(runOfflineStats(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "keychain":
+			os.Exit(runKeychain(os.Args[2:]))
+		case "path-key":
+			os.Exit(runPathKey(os.Args[2:]))
+		}
+	}
+
+	// Define flags
+	entity := flag.String("entity", "", "File path for the heartbeat, or the app or domain with --entity-type")
+	entityType := flag.String("entity-type", "file", "Type of the entity: file, app or domain")
+	project := flag.String("project", "", "Project of the heartbeats, detected from the file path by default")
+	timeStr := flag.String("time", "", "Timestamp for the heartbeat (seconds.micros or RFC3339), defaults to now")
+	language := flag.String("language", "", "Language of the file")
+	alternateLanguage := flag.String("alternate-language", "", "Alternate language")
+	isWrite := flag.Bool("write", false, "Whether this is a write event")
+	plugin := flag.String("plugin", "eztracker-cli", "Plugin identifier")
+	extraHeartbeats := flag.String("extra-heartbeats", "", "JSON array of additional heartbeats")
+	today := flag.Bool("today", false, "Fetch today's summary")
+	noCache := flag.Bool("no-cache", false, "Fetch today's summary from the server even if fetched within today_cache_ttl")
+	version := flag.Bool("version", false, "Show CLI version")
+	duration := flag.Float64("duration", 0.0, "Duration if same file edited")
+	tags := flag.String("tags", "", "Comma separated tags for the heartbeats")
+	category := flag.String("category", "", "Activity category of the heartbeats, e.g. building or debugging; the server defaults to coding")
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		os.Exit(parseErrorCode(err))
+	}
+
+	config := mustLoadConfig()
 
 	if *version {
-		fmt.Println("eztracker-cli v0.0.1")
+		fmt.Printf("eztracker-cli v%s\n", cliVersion)
 		os.Exit(ExitCodeSuccess)
 	}
 
 	if *today {
-		// Placeholder for fetching today's summary (requires server endpoint)
-		fmt.Println("Today's summary not implemented")
+		ttl := config.TodayCacheTTL
+		if *noCache {
+			ttl = 0
+		}
+		stats, err := cachedTodaySummary(config, ttl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching today's summary: %v\n", err)
+			os.Exit(exitCodeFor(err))
+		}
+		fmt.Println(durationfmt.Format(stats.Total, config.DurationFormat))
 		os.Exit(ExitCodeSuccess)
 	}
 
-	if *entity == "" || *timeStr == "" {
-		fmt.Fprintln(os.Stderr, "Error: --entity and --time are required")
-		os.Exit(1)
+	if until, paused := pausedUntil(); paused {
+		if config.Debug {
+			fmt.Printf("Debug: Tracking paused %s, not sending heartbeats\n", describePause(until))
+		}
+		os.Exit(ExitCodeSuccess)
+	}
+
+	if *entity == "" {
+		fmt.Fprintln(os.Stderr, "Error: --entity is required")
+		os.Exit(ExitCodeInvalidInput)
 	}
 
 	// Parse timestamp
-	timestamp, err := strconv.ParseFloat(*timeStr, 64)
+	timestamp, err := parseTime(*timeStr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: Invalid timestamp format: %v\n", err)
-		os.Exit(1)
+		os.Exit(ExitCodeInvalidInput)
 	}
 
 	// Create primary heartbeat
-	heartbeat := Heartbeat{
+	heartbeat := tracker.Heartbeat{
 		Entity:            *entity,
+		EntityType:        *entityType,
+		Project:           *project,
 		Timestamp:         timestamp,
 		Language:          *language,
 		AlternateLanguage: *alternateLanguage,
@@ -173,14 +515,14 @@ func main() {
 		Duration:          *duration,
 	}
 
-	heartbeats := []Heartbeat{heartbeat}
+	heartbeats := []tracker.Heartbeat{heartbeat}
 
 	// Process extra heartbeats from JSON input
 	if *extraHeartbeats != "" {
-		var extra []Heartbeat
+		var extra []tracker.Heartbeat
 		if err := json.Unmarshal([]byte(*extraHeartbeats), &extra); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: Invalid extra heartbeats JSON: %v\n", err)
-			os.Exit(1)
+			os.Exit(ExitCodeInvalidInput)
 		}
 
 		if config.Debug {
@@ -190,11 +532,24 @@ func main() {
 		heartbeats = append(heartbeats, extra...)
 	}
 
+	for i := range heartbeats {
+		heartbeats[i].Tags = append(heartbeats[i].Tags, splitList(*tags)...)
+		if heartbeats[i].Category == "" {
+			heartbeats[i].Category = *category
+		}
+		if err := checkEntityType(heartbeats[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(ExitCodeInvalidInput)
+		}
+	}
+
+	checkVersion(config)
+
 	// Send heartbeats
-	for _, hb := range heartbeats {
+	for _, hb := range tracker.Merge(heartbeats, config.keystrokeTimeout) {
 		if err := sendHeartbeat(config, hb); err != nil {
 			fmt.Fprintf(os.Stderr, "Error sending heartbeat: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCodeFor(err))
 		}
 	}
 
@@ -203,60 +558,1086 @@ func main() {
 	}
 }
 
-func sendHeartbeat(config Config, hb Heartbeat) error {
+func sendHeartbeat(config Config, hb tracker.Heartbeat) error {
 	if hb.Duration == 0 {
 		fmt.Printf("duration is 0, not sending it: %+v", hb)
 		return nil
 	}
-	// Extract project name from file path (simplified, assumes last dir is project)
-	project := "unknown"
-	if parts := strings.Split(hb.Entity, string(os.PathSeparator)); len(parts) > 1 {
-		project = parts[len(parts)-2]
+	if hb.IsFile() && tracker.IsIgnored(hb.Entity) {
+		if config.Debug {
+			fmt.Printf("Debug: %s matches .eztrackerignore, not sending it\n", hb.Entity)
+		}
+		return nil
 	}
 
-	// Convert to server heartbeat format
-	serverHB := ServerHeartbeat{
-		UserID:    "krisrp", // Hardcoded for simplicity; should be configurable
-		Project:   project,
-		Language:  hb.Language,
-		FilePath:  hb.Entity,
-		Duration:  hb.Duration,
-		Timestamp: int64(hb.Timestamp),
+	c := newClient(config)
+	c.UserAgent = hb.Plugin
+	t := &tracker.Tracker{
+		Client:             c,
+		UserID:             config.UserID,
+		Queue:              newQueue(),
+		DetectDependencies: config.DetectDependencies,
+		DetectLanguage:     true,
+		Machine:            tracker.DetectMachine(),
+		PathKey:            config.PathKey,
 	}
+	serverHB := t.Build(hb)
+	serverHB.Tags = append(serverHB.Tags, config.Projects[serverHB.Project].Tags...)
 
-	if hb.AlternateLanguage != "" && hb.Language == "" {
-		serverHB.Language = hb.AlternateLanguage
+	if session, ok := activeFocusSession(); ok {
+		serverHB.SessionID = session.ID
 	}
 
-	data, err := json.Marshal(serverHB)
+	if config.Debug {
+		fmt.Printf("Debug: Sending heartbeat: %+v\n", serverHB)
+	}
+
+	return t.Send(serverHB)
+}
+
+// entityTypes are the kinds of entity heartbeats may be for; the server
+// accepts the same.
+var entityTypes = map[string]bool{"": true, "file": true, "app": true, "domain": true}
+
+// checkEntityType returns an error for a heartbeat of an unknown entity
+// type.
+func checkEntityType(hb tracker.Heartbeat) error {
+	if !entityTypes[hb.EntityType] {
+		return fmt.Errorf("invalid entity type %q, want file, app or domain", hb.EntityType)
+	}
+	return nil
+}
+
+// newQueue returns the offline queue in the state directory, nil without
+// one.
+func newQueue() *tracker.Queue {
+	dir, err := stateDir()
 	if err != nil {
-		return fmt.Errorf("failed to marshal heartbeat: %v", err)
+		return nil
 	}
+	return &tracker.Queue{Dir: dir, OnDrop: func(hb client.Heartbeat, err error) {
+		fmt.Fprintf(os.Stderr, "Dropping queued heartbeat for %s: %v\n", hb.Entity, err)
+	}}
+}
 
-	if config.Debug {
-		fmt.Printf("Debug: Sending heartbeat: %s\n", string(data))
+// newClient returns an API client for the configured server.
+func newClient(config Config) *client.Client {
+	c := client.New(config.ServerURL, config.APIKey)
+	c.UserAgent = "eztracker-cli"
+	c.GzipThreshold = config.GzipThreshold
+	c.HTTPClient = httpClient(config)
+	return c
+}
+
+// parseTime accepts epoch seconds (with optional fraction) or an RFC3339
+// string, defaulting to now when empty.
+func parseTime(value string) (float64, error) {
+	if value == "" {
+		return float64(time.Now().UnixNano()) / float64(time.Second), nil
+	}
+	if ts, err := strconv.ParseFloat(value, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither epoch seconds nor RFC3339", value)
+	}
+	return float64(t.UnixNano()) / float64(time.Second), nil
+}
+
+// splitList splits a comma separated setting, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// checkVersion warns on stderr, at most once a day, when the CLI and server
+// are too far apart to work together. Failures are silent so they never get
+// in the way of sending heartbeats.
+func checkVersion(config Config) {
+	dir, err := stateDir()
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, "version_check")
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < 24*time.Hour {
+		return
+	}
+
+	server, err := newClient(config).Version()
+	if err != nil {
+		if config.Debug {
+			fmt.Printf("Debug: Version check failed: %v\n", err)
+		}
+		return
+	}
+	if os.MkdirAll(dir, 0o700) == nil {
+		os.WriteFile(path, []byte(server.Version+"\n"), 0o600)
+	}
+
+	if c, err := compareVersions(cliVersion, server.MinCLIVersion); err == nil && c < 0 {
+		fmt.Fprintf(os.Stderr, "Warning: server v%s requires eztracker-cli v%s or newer, this is v%s\n",
+			server.Version, server.MinCLIVersion, cliVersion)
+	}
+	if c, err := compareVersions(server.Version, minServerVersion); err == nil && c < 0 {
+		fmt.Fprintf(os.Stderr, "Warning: eztracker-cli v%s requires server v%s or newer, the server is v%s\n",
+			cliVersion, minServerVersion, server.Version)
+	}
+}
+
+// compareVersions compares two MAJOR.MINOR.PATCH versions, with an optional
+// "v" prefix. Pre-release versions sort before their release.
+func compareVersions(a, b string) (int, error) {
+	parse := func(v string) ([3]int, string, error) {
+		var parts [3]int
+		v = strings.TrimPrefix(v, "v")
+		v, pre, _ := strings.Cut(v, "-")
+		fields := strings.Split(v, ".")
+		if len(fields) != 3 {
+			return parts, "", fmt.Errorf("invalid version %q", v)
+		}
+		for i, f := range fields {
+			n, err := strconv.Atoi(f)
+			if err != nil {
+				return parts, "", fmt.Errorf("invalid version %q", v)
+			}
+			parts[i] = n
+		}
+		return parts, pre, nil
+	}
+
+	av, apre, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	bv, bpre, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range av {
+		if av[i] != bv[i] {
+			if av[i] < bv[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0, nil
+	case apre == "":
+		return 1, nil
+	case bpre == "":
+		return -1, nil
+	case apre < bpre:
+		return -1, nil
+	}
+	return 1, nil
+}
+
+// parseErrorCode is the exit code for a failed flag parse; asking for help
+// is not an error.
+func parseErrorCode(err error) int {
+	if err == flag.ErrHelp {
+		return ExitCodeSuccess
+	}
+	return ExitCodeInvalidInput
+}
+
+// runLog records time spent away from the editor, such as meetings.
+func runLog(args []string) int {
+	fs := flag.NewFlagSet("log", flag.ContinueOnError)
+	project := fs.String("project", "", "Project the time belongs to")
+	duration := fs.Duration("duration", 0, "Time spent, e.g. 1h30m")
+	note := fs.String("note", "", "What the time was spent on")
+	tags := fs.String("tags", "", "Comma separated tags for the entry")
+	at := fs.String("time", "", "When the work happened (seconds.micros or RFC3339), defaults to now")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	if *project == "" || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: --project and a positive --duration are required")
+		return ExitCodeInvalidInput
+	}
+
+	timestamp, err := parseTime(*at)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid timestamp format: %v\n", err)
+		return ExitCodeInvalidInput
+	}
+
+	config := mustLoadConfig()
+	entry := client.ManualEntry{
+		UserID:    config.UserID,
+		Project:   *project,
+		Duration:  duration.Seconds(),
+		Timestamp: int64(timestamp),
+		Note:      *note,
+		Tags:      append(splitList(*tags), config.Projects[*project].Tags...),
+	}
+	if _, err := newClient(config).LogTime(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Error logging time: %v\n", err)
+		return exitCodeFor(err)
+	}
+
+	fmt.Printf("Logged %s on %s\n", *duration, *project)
+	return ExitCodeSuccess
+}
+
+// runOfflineStats prints today's and the last seven days' totals from the
+// local history, in local time, without contacting the server.
+func runOfflineStats(args []string) int {
+	fs := flag.NewFlagSet("offline-stats", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	if _, err := stateDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitCodeGenericError
+	}
+	queue := newQueue()
+	history, err := queue.History()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history: %v\n", err)
+		return ExitCodeGenericError
+	}
+	queued, _ := queue.Pending()
+	// Only the duration format is needed, which works without an API key
+	config, _ := loadConfig()
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	printOfflineStats("Today", history, today, config.DurationFormat)
+	printOfflineStats("Last 7 days", history, today.AddDate(0, 0, -6), config.DurationFormat)
+	if len(queued) > 0 {
+		fmt.Printf("\n%d heartbeats waiting to be sent\n", len(queued))
+	}
+	return ExitCodeSuccess
+}
+
+// printOfflineStats prints the time per project and language since from.
+func printOfflineStats(title string, heartbeats []client.Heartbeat, from time.Time, format durationfmt.Style) {
+	total := 0.0
+	projects := make(map[string]float64)
+	languages := make(map[string]float64)
+	for _, hb := range heartbeats {
+		if hb.Timestamp < from.Unix() {
+			continue
+		}
+		total += hb.Duration
+		projects[hb.Project] += hb.Duration
+		if hb.Language != "" {
+			languages[hb.Language] += hb.Duration
+		}
+	}
+
+	fmt.Printf("%s: %s\n", title, durationfmt.Format(total, format))
+	for _, name := range byDuration(projects) {
+		fmt.Printf("  %-20s %s\n", name, durationfmt.Format(projects[name], format))
+	}
+	if len(languages) > 0 {
+		var parts []string
+		for _, name := range byDuration(languages) {
+			parts = append(parts, fmt.Sprintf("%s %s", name, durationfmt.Format(languages[name], format)))
+		}
+		fmt.Printf("  languages: %s\n", strings.Join(parts, ", "))
+	}
+}
+
+// byDuration returns the names in totals, largest first.
+func byDuration(totals map[string]float64) []string {
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if totals[names[i]] != totals[names[j]] {
+			return totals[names[i]] > totals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// stateDir is where the CLI keeps state shared between invocations,
+// $XDG_STATE_HOME/eztracker unless only ~/.eztracker exists. Containers
+// without a home directory can still set XDG_STATE_HOME.
+func stateDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+			return filepath.Join(dir, "eztracker"), nil
+		}
+		return "", fmt.Errorf("failed to get home directory: %v", err)
+	}
+	return preferExisting(xdgStateDir(home), filepath.Join(home, legacyStateDir)), nil
+}
+
+// runMigrate moves the config and state from the home directory to the XDG
+// base directories, leaving anything already there alone.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to get home directory: %v\n", err)
+		return ExitCodeGenericError
+	}
+
+	code := ExitCodeSuccess
+	for _, move := range []struct{ from, to string }{
+		{filepath.Join(home, legacyConfigPath), xdgConfigPath(home)},
+		{filepath.Join(home, legacyStateDir), xdgStateDir(home)},
+	} {
+		if _, err := os.Stat(move.from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(move.to); err == nil {
+			fmt.Fprintf(os.Stderr, "Not moving %s: %s already exists\n", move.from, move.to)
+			code = ExitCodeGenericError
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(move.to), 0o700); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitCodeGenericError
+		}
+		if err := os.Rename(move.from, move.to); err != nil {
+			fmt.Fprintf(os.Stderr, "Error moving %s: %v\n", move.from, err)
+			return ExitCodeGenericError
+		}
+		fmt.Printf("Moved %s to %s\n", move.from, move.to)
+	}
+	return code
+}
+
+func pauseFile() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "paused"), nil
+}
+
+// pausedUntil reports whether tracking is paused and until when. A zero time
+// means paused until resumed. Expired pauses are cleaned up.
+func pausedUntil() (time.Time, bool) {
+	path, err := pauseFile()
+	if err != nil {
+		return time.Time{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	unix, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || unix == 0 {
+		return time.Time{}, true
+	}
+	until := time.Unix(unix, 0)
+	if time.Now().After(until) {
+		os.Remove(path)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func describePause(until time.Time) string {
+	if until.IsZero() {
+		return "until resumed"
+	}
+	return "until " + until.Format("15:04 Mon Jan 2")
+}
+
+func runPause(args []string) int {
+	fs := flag.NewFlagSet("pause", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: eztracker pause [duration]")
+		fmt.Fprintln(os.Stderr, "Stops sending heartbeats until resumed or the duration (e.g. 30m, 2h) passes.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
 	}
 
-	req, err := http.NewRequest("POST", config.ServerURL+"/heartbeat", bytes.NewBuffer(data))
+	var until int64
+	if fs.NArg() > 0 {
+		d, err := time.ParseDuration(fs.Arg(0))
+		if err != nil || d <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: Invalid duration %q\n", fs.Arg(0))
+			return ExitCodeInvalidInput
+		}
+		until = time.Now().Add(d).Unix()
+	}
+
+	path, err := pauseFile()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitCodeGenericError
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create state directory: %v\n", err)
+		return ExitCodeGenericError
+	}
+	if err := os.WriteFile(path, []byte(strconv.FormatInt(until, 10)+"\n"), 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write pause state: %v\n", err)
+		return ExitCodeGenericError
 	}
 
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", hb.Plugin)
+	t, _ := pausedUntil()
+	fmt.Printf("Tracking paused %s\n", describePause(t))
+	return ExitCodeSuccess
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func runResume(args []string) int {
+	path, err := pauseFile()
 	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitCodeGenericError
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error: failed to clear pause state: %v\n", err)
+		return ExitCodeGenericError
 	}
-	defer resp.Body.Close()
+	fmt.Println("Tracking resumed")
+	return ExitCodeSuccess
+}
+
+// runStatus prints a one-word indicator suitable for status lines, followed
+// by the pause end when paused.
+func runStatus(args []string) int {
+	if until, paused := pausedUntil(); paused {
+		fmt.Printf("paused %s\n", describePause(until))
+		return ExitCodeSuccess
+	}
+	if session, ok := activeFocusSession(); ok {
+		fmt.Printf("focus %s left\n", time.Until(session.End).Round(time.Minute))
+		return ExitCodeSuccess
+	}
+	fmt.Println("tracking")
+	return ExitCodeSuccess
+}
+
+// focusSession is a timed deep-work session whose ID is attached to every
+// heartbeat sent while it is running.
+type focusSession struct {
+	ID  string
+	End time.Time
+}
 
+func focusFile() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "focus"), nil
+}
+
+// activeFocusSession returns the running focus session, cleaning up the
+// state file once the session has ended.
+func activeFocusSession() (focusSession, bool) {
+	path, err := focusFile()
+	if err != nil {
+		return focusSession{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return focusSession{}, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return focusSession{}, false
+	}
+	end, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return focusSession{}, false
+	}
+	session := focusSession{ID: fields[0], End: time.Unix(end, 0)}
+	if time.Now().After(session.End) {
+		os.Remove(path)
+		return focusSession{}, false
+	}
+	return session, true
+}
+
+func runFocus(args []string) int {
+	fs := flag.NewFlagSet("focus", flag.ContinueOnError)
+	minutes := fs.Int("minutes", 25, "Length of the focus session in minutes")
+	stop := fs.Bool("stop", false, "End the running focus session")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	path, err := focusFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitCodeGenericError
+	}
+
+	if *stop {
+		session, ok := activeFocusSession()
+		if !ok {
+			fmt.Println("No focus session running")
+			return ExitCodeSuccess
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to clear focus state: %v\n", err)
+			return ExitCodeGenericError
+		}
+		fmt.Printf("Focus session %s stopped\n", session.ID)
+		return ExitCodeSuccess
+	}
+
+	if *minutes <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: --minutes must be positive")
+		return ExitCodeInvalidInput
+	}
+	if session, ok := activeFocusSession(); ok {
+		fmt.Fprintf(os.Stderr, "Error: focus session %s is already running until %s\n",
+			session.ID, session.End.Format("15:04"))
+		return ExitCodeGenericError
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to generate session ID: %v\n", err)
+		return ExitCodeGenericError
+	}
+	session := focusSession{
+		ID:  hex.EncodeToString(id),
+		End: time.Now().Add(time.Duration(*minutes) * time.Minute),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create state directory: %v\n", err)
+		return ExitCodeGenericError
+	}
+	content := fmt.Sprintf("%s %d\n", session.ID, session.End.Unix())
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write focus state: %v\n", err)
+		return ExitCodeGenericError
+	}
+
+	fmt.Printf("Focus session %s started, ends at %s\n", session.ID, session.End.Format("15:04"))
+	return ExitCodeSuccess
+}
+
+// Settings the CLI reads from [settings], [project:<name>] and [app:<name>]
+// sections, plus the ones editor plugins keep in the same file. Keep in sync
+// with loadConfig.
+var (
+	knownSettings = map[string]bool{
+		"api_key": true, "server_url": true, "debug": true, "detect_dependencies": true,
+		"keystroke_timeout": true, "apikey": true, "hidefilenames": true, "ignore": true,
+		"vi_redraw": true, "api_key_source": true, "proxy": true,
+		"ca_file": true, "client_cert": true, "client_key": true, "duration_format": true,
+		"gzip_threshold": true, "desktop_allow": true, "desktop_deny": true,
+		"today_cache_ttl": true, "path_key": true, "user_id": true,
+	}
+	knownProjectSettings = map[string]bool{"tags": true, "keystroke_timeout": true}
+	knownAppSettings     = map[string]bool{"project": true, "category": true}
+)
+
+// validateConfigFile lists problems in the config file that loadConfig
+// would silently skip over.
+func validateConfigFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	var section string
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		// Indented lines continue a multi-line value such as ignore
+		if raw[0] == ' ' || raw[0] == '\t' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			if section != "settings" && !strings.HasPrefix(section, "project:") && !strings.HasPrefix(section, "app:") {
+				problems = append(problems, fmt.Sprintf("line %d: unknown section [%s]", i+1, section))
+			}
+			continue
+		}
+		key, _, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("line %d: expected key = value, got %q", i+1, line))
+		case section == "":
+			problems = append(problems, fmt.Sprintf("line %d: %s is outside of a section", i+1, key))
+		case section == "settings" && !knownSettings[key]:
+			problems = append(problems, fmt.Sprintf("line %d: unknown setting %s", i+1, key))
+		case strings.HasPrefix(section, "project:") && !knownProjectSettings[key]:
+			problems = append(problems, fmt.Sprintf("line %d: unknown project setting %s", i+1, key))
+		case strings.HasPrefix(section, "app:") && !knownAppSettings[key]:
+			problems = append(problems, fmt.Sprintf("line %d: unknown app setting %s", i+1, key))
+		}
+	}
+	return problems, nil
+}
+
+// runDoctor checks the setup end to end and prints what to fix. The exit
+// code is the one of the first failed check.
+func runDoctor(args []string) int {
+	code := ExitCodeSuccess
+	fail := func(exitCode int, format string, a ...interface{}) {
+		fmt.Printf("[fail] "+format+"\n", a...)
+		if code == ExitCodeSuccess {
+			code = exitCode
+		}
+	}
+
+	path, err := configPath()
+	if err != nil {
+		fail(ExitCodeConfigParseError, "%v", err)
+		return code
+	}
+	problems, err := validateConfigFile(path)
+	switch {
+	case os.IsNotExist(err):
+		fmt.Printf("[warn] %s does not exist, relying on environment variables\n", path)
+	case err != nil:
+		fail(ExitCodeConfigParseError, "cannot read %s: %v", path, err)
+	case len(problems) > 0:
+		for _, problem := range problems {
+			fmt.Printf("[warn] %s %s\n", path, problem)
+		}
+	default:
+		fmt.Printf("[ok]   %s is valid\n", path)
+	}
+	if filepath.Base(path) == legacyConfigPath {
+		fmt.Printf("[warn] %s is in the home directory; \"eztracker migrate\" moves it and the state to the XDG directories\n", path)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		if strings.Contains(err.Error(), "API key not found") {
+			fail(ExitCodeAPIKeyError, "no API key: set api_key in [settings] of %s or API_KEY", path)
+		} else {
+			fail(ExitCodeConfigParseError, "%v", err)
+		}
+		return code
+	}
+	if config.APIKeySource == "keychain" {
+		if _, err := keychainGet(); err != nil {
+			fmt.Printf("[warn] cannot read the API key from the keychain, using api_key from %s: %v\n", path, err)
+		} else {
+			fmt.Println("[ok]   API key read from the keychain")
+		}
+	}
+	fmt.Printf("[ok]   using server %s\n", config.ServerURL)
+
+	// Reachability and clock skew, from the unauthenticated version endpoint
+	sent := time.Now()
+	resp, err := httpClient(config).Get(config.ServerURL + "/api/v1/version")
+	if err != nil {
+		fail(ExitCodeNetworkError, "cannot reach %s: %v; check server_url and that the server is running",
+			config.ServerURL, err)
+		return code
+	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned %d: %s", resp.StatusCode, string(body))
+		fail(exitCodeFor(&client.Error{StatusCode: resp.StatusCode}),
+			"%s answered %s; is server_url pointing at an eztracker server?", config.ServerURL, resp.Status)
+	} else {
+		fmt.Printf("[ok]   server is reachable (%s)\n", time.Since(sent).Round(time.Millisecond))
 	}
 
-	return nil
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		skew := time.Until(date).Round(time.Second)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > time.Minute {
+			fmt.Printf("[warn] local clock is %s off the server's; sync it (e.g. with NTP) "+
+				"or heartbeats land at the wrong time\n", skew)
+		} else {
+			fmt.Println("[ok]   clock is in sync with the server")
+		}
+	}
+
+	whoami, err := newClient(config).Whoami()
+	if err != nil {
+		if exitCodeFor(err) == ExitCodeAPIKeyError {
+			fail(ExitCodeAPIKeyError, "the server rejected the API key; check api_key in %s", path)
+		} else {
+			fail(exitCodeFor(err), "cannot verify the API key: %v", err)
+		}
+	} else if whoami.UserID == "" {
+		fmt.Printf("[ok]   API key accepted (server key %s)\n", whoami.Key.Name)
+		if config.UserID == "" {
+			fmt.Printf("[warn] the server key has no user of its own; set user_id in %s\n", path)
+		}
+	} else {
+		fmt.Printf("[ok]   API key accepted (user %s <%s>, key %q)\n",
+			whoami.UserID, whoami.Email, whoami.Key.Name)
+		if config.UserID != "" && whoami.UserID != config.UserID {
+			fmt.Printf("[warn] user_id is %s, but the key belongs to %s, so the server rejects heartbeats\n",
+				config.UserID, whoami.UserID)
+		}
+		if whoami.Key.Scope == "read" {
+			fmt.Println("[warn] the key is read-only, so the server rejects heartbeats sent with it")
+		}
+	}
+
+	return code
+}
+
+// rpcProtocolVersion is bumped on incompatible changes to the rpc mode
+// described in PROTOCOL.md.
+const rpcProtocolVersion = 1
+
+// JSON-RPC 2.0 error codes for malformed requests. Failures of a method use
+// the matching CLI exit code as the error code.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// runRPC serves JSON-RPC 2.0 requests, one per line on stdin, so an editor
+// can keep one CLI process running instead of spawning one per heartbeat.
+// Responses go to stdout, one per line; requests without an id are
+// notifications and get none.
+func runRPC(args []string) int {
+	fs := flag.NewFlagSet("rpc", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	// Everything else the CLI prints would corrupt the responses
+	out := json.NewEncoder(os.Stdout)
+	os.Stdout = os.Stderr
+
+	config := mustLoadConfig()
+	checkVersion(config)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var req rpcRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			out.Encode(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+				Error: &rpcError{rpcParseError, err.Error()}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			out.Encode(rpcResponse{JSONRPC: "2.0", ID: idOrNull(req.ID),
+				Error: &rpcError{rpcInvalidRequest, "expected a JSON-RPC 2.0 request"}})
+			continue
+		}
+
+		result, rpcErr := handleRPC(config, req)
+		if rpcErr == nil && result == nil {
+			result = json.RawMessage("null")
+		}
+		if len(req.ID) > 0 {
+			out.Encode(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr})
+		}
+		if req.Method == "shutdown" {
+			return ExitCodeSuccess
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading requests: %v\n", err)
+		return ExitCodeInvalidInput
+	}
+	return ExitCodeSuccess
+}
+
+func idOrNull(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// handleRPC runs one rpc method.
+func handleRPC(config Config, req rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			Plugin struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"plugin"`
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, &rpcError{rpcInvalidParams, err.Error()}
+			}
+		}
+		result := map[string]interface{}{
+			"version":          cliVersion,
+			"protocol_version": rpcProtocolVersion,
+		}
+		if params.Plugin.Name != "" {
+			// Registering only fetches tuning hints, so plugins start
+			// without them when the server cannot be reached
+			hints, err := newClient(config).RegisterPlugin(client.Plugin{
+				UserID:  config.UserID,
+				Name:    params.Plugin.Name,
+				Version: params.Plugin.Version,
+				Machine: tracker.DetectMachine(),
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to register plugin: %v\n", err)
+			} else {
+				result["hints"] = hints
+			}
+		}
+		return result, nil
+
+	case "heartbeat":
+		var params struct {
+			Heartbeats []tracker.Heartbeat `json:"heartbeats"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if _, paused := pausedUntil(); paused {
+			return map[string]bool{"paused": true}, nil
+		}
+		for i, hb := range params.Heartbeats {
+			if hb.Entity == "" {
+				return nil, &rpcError{rpcInvalidParams, "heartbeat entity is required"}
+			}
+			if err := checkEntityType(hb); err != nil {
+				return nil, &rpcError{rpcInvalidParams, err.Error()}
+			}
+			if hb.Timestamp == 0 {
+				params.Heartbeats[i].Timestamp, _ = parseTime("")
+			}
+			if hb.Plugin == "" {
+				params.Heartbeats[i].Plugin = "eztracker-cli"
+			}
+		}
+		for _, hb := range tracker.Merge(params.Heartbeats, config.keystrokeTimeout) {
+			if err := sendHeartbeat(config, hb); err != nil {
+				return nil, &rpcError{exitCodeFor(err), err.Error()}
+			}
+		}
+		return map[string]bool{"paused": false}, nil
+
+	case "status":
+		if until, paused := pausedUntil(); paused {
+			// until is 0 when paused until resumed
+			var untilUnix int64
+			if !until.IsZero() {
+				untilUnix = until.Unix()
+			}
+			return map[string]interface{}{"status": "paused", "until": untilUnix}, nil
+		}
+		if session, ok := activeFocusSession(); ok {
+			return map[string]interface{}{"status": "focus", "session_id": session.ID,
+				"ends_at": session.End.Unix()}, nil
+		}
+		return map[string]string{"status": "tracking"}, nil
+
+	case "today":
+		stats, err := newClient(config).TodaySummary(config.UserID)
+		if err != nil {
+			return nil, &rpcError{exitCodeFor(err), err.Error()}
+		}
+		return stats, nil
+
+	case "shutdown":
+		return nil, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, "unknown method " + req.Method}
+}
+
+// nvimPlugin is written by "eztracker init nvim". It sends a heartbeat on
+// every save, and on cursor activity once heartbeatInterval has passed or
+// the file changed. %[1]s is the CLI path.
+const nvimPlugin = `-- Written by "eztracker init nvim"; rerun it with --force to update.
+local cli = [==[%[1]s]==]
+local heartbeat_interval = 120 -- seconds
+local max_duration = 300 -- seconds of inactivity still counted
+
+local last = { file = '', at = 0 }
+
+local function heartbeat(is_write)
+  local file = vim.api.nvim_buf_get_name(0)
+  if file == '' or vim.bo.buftype ~= '' then
+    return
+  end
+  local now = os.time()
+  if not is_write and file == last.file and now - last.at < heartbeat_interval then
+    return
+  end
+  local duration = 0
+  if file == last.file then
+    duration = math.min(now - last.at, max_duration)
+  end
+  last = { file = file, at = now }
+
+  local args = { cli, '--entity', file, '--time', tostring(now),
+    '--duration', tostring(duration), '--plugin', 'eztracker-init-nvim' }
+  if vim.bo.filetype ~= '' then
+    vim.list_extend(args, { '--alternate-language', vim.bo.filetype })
+  end
+  if is_write then
+    table.insert(args, '--write')
+  end
+  vim.fn.jobstart(args, { detach = true })
+end
+
+local group = vim.api.nvim_create_augroup('eztracker', { clear = true })
+vim.api.nvim_create_autocmd('BufWritePost', {
+  group = group,
+  callback = function() heartbeat(true) end,
+})
+vim.api.nvim_create_autocmd({ 'BufEnter', 'CursorHold', 'CursorHoldI' }, {
+  group = group,
+  callback = function() heartbeat(false) end,
+})
+`
+
+// vimPlugin is the Vimscript equivalent of nvimPlugin for Vim 8 and later.
+const vimPlugin = `" Written by "eztracker init vim"; rerun it with --force to update.
+let s:cli = '%[1]s'
+let s:heartbeat_interval = 120
+let s:max_duration = 300
+let s:last_file = ''
+let s:last_at = 0
+
+function! s:Heartbeat(is_write) abort
+  let l:file = expand('%%:p')
+  if l:file ==# '' || &buftype !=# ''
+    return
+  endif
+  let l:now = localtime()
+  if !a:is_write && l:file ==# s:last_file && l:now - s:last_at < s:heartbeat_interval
+    return
+  endif
+  let l:duration = 0
+  if l:file ==# s:last_file
+    let l:duration = min([l:now - s:last_at, s:max_duration])
+  endif
+  let s:last_file = l:file
+  let s:last_at = l:now
+
+  let l:args = [s:cli, '--entity', l:file, '--time', string(l:now),
+        \ '--duration', string(l:duration), '--plugin', 'eztracker-init-vim']
+  if &filetype !=# ''
+    call extend(l:args, ['--alternate-language', &filetype])
+  endif
+  if a:is_write
+    call add(l:args, '--write')
+  endif
+  call job_start(l:args, {'stoponexit': ''})
+endfunction
+
+augroup eztracker
+  autocmd!
+  autocmd BufWritePost * call s:Heartbeat(1)
+  autocmd BufEnter,CursorHold,CursorHoldI * call s:Heartbeat(0)
+augroup END
+`
+
+// runInit writes a minimal editor plugin that calls this CLI, for editors
+// without a dedicated eztracker plugin.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	output := fs.String("output", "", "Where to write the plugin, defaults to the editor's plugin directory")
+	force := fs.Bool("force", false, "Overwrite an existing plugin file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: eztracker init [flags] nvim|vim")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return ExitCodeInvalidInput
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to get home directory: %v\n", err)
+		return ExitCodeGenericError
+	}
+	cli, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to locate the eztracker binary: %v\n", err)
+		return ExitCodeGenericError
+	}
+
+	var content, path string
+	switch fs.Arg(0) {
+	case "nvim":
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+		path = filepath.Join(configHome, "nvim", "plugin", "eztracker.lua")
+		content = fmt.Sprintf(nvimPlugin, cli)
+	case "vim":
+		path = filepath.Join(home, ".vim", "plugin", "eztracker.vim")
+		content = fmt.Sprintf(vimPlugin, strings.ReplaceAll(cli, "'", "''"))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown editor %q, expected nvim or vim\n", fs.Arg(0))
+		return ExitCodeInvalidInput
+	}
+	if *output != "" {
+		path = *output
+	}
+
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "Error: %s already exists, use --force to overwrite it\n", path)
+		return ExitCodeGenericError
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to create %s: %v\n", filepath.Dir(path), err)
+		return ExitCodeGenericError
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write %s: %v\n", path, err)
+		return ExitCodeGenericError
+	}
+
+	fmt.Printf("Wrote %s; restart %s to start tracking\n", path, fs.Arg(0))
+	return ExitCodeSuccess
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPathWindows(t *testing.T) {
+	home, appData := t.TempDir(), t.TempDir()
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("APPDATA", appData)
+
+	if path, err := configPath(); err != nil || path != filepath.Join(appData, "eztracker", "eztracker.cfg") {
+		t.Errorf("configPath = %q, %v, want it in %%APPDATA%%", path, err)
+	}
+	if dir, err := stateDir(); err != nil || dir != filepath.Join(appData, "eztracker") {
+		t.Errorf("stateDir = %q, %v, want it in %%APPDATA%%", dir, err)
+	}
+
+	// Configs from before Windows support keep working
+	legacy := filepath.Join(home, ".eztracker.cfg")
+	if err := os.WriteFile(legacy, []byte("[settings]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := configPath(); err != nil || path != legacy {
+		t.Errorf("configPath = %q, %v, want %q", path, err, legacy)
+	}
+}
@@ -2,4 +2,8 @@ module github.com/kru/eztracker
 
 go 1.22.3
 
-require github.com/mattn/go-sqlite3 v1.14.28 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/yuin/gopher-lua v1.1.1
+)
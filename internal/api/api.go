@@ -0,0 +1,1320 @@
+// Package api serves the eztracker HTTP API on top of a store.
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kru/eztracker/internal/durationfmt"
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/i18n"
+	"github.com/kru/eztracker/internal/query"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Release metadata served at /api/v1/version. Bump MinCLIVersion when the
+// server stops accepting payloads from older CLIs.
+const (
+	Version       = "0.2.0"
+	MinCLIVersion = "0.0.1"
+)
+
+// openAPISpec documents every route in routes, for plugin authors and code
+// generators. TestOpenAPISpec keeps the two in sync.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+type Config struct {
+	// APIKey is the server key; it may use every endpoint and create user
+	// keys.
+	APIKey string
+
+	// Buffering incoming heartbeats, flushed by RunFlusher or once
+	// WriteBufferSize are pending. Disabled when the size is 0.
+	WriteBufferSize int
+
+	// Caching of summary responses per user and query. A negative TTL
+	// disables the cache; 0 means the default of 30s.
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// Hints returned to plugins when they register
+	Plugins PluginHints
+
+	// SlackSigningSecret verifies requests from the Slack app; its slash
+	// command is disabled when empty.
+	SlackSigningSecret string
+
+	// Where user API keys are used from is recorded per key. Behind a
+	// reverse proxy, TrustProxy takes the client IP from X-Forwarded-For
+	// and GeoHeader names a header the proxy sets to the client's country,
+	// such as CF-IPCountry.
+	TrustProxy bool
+	GeoHeader  string
+
+	// CORSOrigins may call the API from the browser, "*" for any origin.
+	// CORSHeaders are request headers they may send besides Authorization
+	// and Content-Type. CORS is off when there are no origins.
+	CORSOrigins []string
+	CORSHeaders []string
+
+	// JWTSecret signs the short-lived tokens of dashboard sessions, which
+	// are disabled when it is empty. Zero TTLs are replaced by the
+	// defaults in New.
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// EmailSecret signs the links in emails: those confirming users' email
+	// addresses, which can't be changed through the API when it is empty,
+	// and those unsubscribing from summaries and alerts. Links point at
+	// PublicURL; confirmation links fall back to the host the address was
+	// changed through, and emails have no unsubscribe link without it.
+	EmailSecret string
+	PublicURL   string
+
+	// HeartbeatHorizon rejects heartbeats on /heartbeat older than it, and
+	// MaxClockSkew those further ahead of the server's clock, so buggy or
+	// malicious clients can't rewrite history. Older activity comes in
+	// through ingest and manual entries. Both are off when 0.
+	HeartbeatHorizon time.Duration
+	MaxClockSkew     time.Duration
+
+	// SampleInterval downsamples heartbeats as they are stored, keeping one
+	// per file in each interval with the durations of the others added up,
+	// to keep chatty plugins from growing the database. Every heartbeat is
+	// kept when 0.
+	SampleInterval time.Duration
+
+	// ReadOnly serves only the replicaRoutes and only reads from the store,
+	// for reporting from a replica or backup of the database. API key use
+	// isn't recorded, and Last-Modified is left out as changes to the data
+	// can't be seen.
+	ReadOnly bool
+
+	// Events, if set, gets a heartbeat.received event for each user's
+	// heartbeats once they are stored.
+	Events *events.Bus
+}
+
+// PluginHints tune editor plugins from the server. Zero values are replaced
+// by the defaults in New.
+type PluginHints struct {
+	// KeystrokeTimeout is how long without input still counts as coding.
+	KeystrokeTimeout time.Duration
+	// HeartbeatInterval is how often to send a heartbeat for the same file.
+	HeartbeatInterval time.Duration
+	// BatchSize is how many heartbeats to send at once at most.
+	BatchSize int
+}
+
+type Server struct {
+	// settings is the current Config, replaced by Reload
+	settings atomic.Pointer[Config]
+	store    *store.Store
+
+	// buffer is nil unless WriteBufferSize is set
+	buffer *writeBuffer
+
+	// keyUse counts the uses of user keys until they are written
+	keyUse *keyUse
+
+	// cache holds summary responses; nil when CacheTTL is negative
+	cache *responseCache
+
+	// modified answers conditional requests for summaries
+	modified *modTimes
+
+	// scripts holds the compiled heartbeat scripts
+	scripts *scriptCache
+
+	// maintenance is set while heartbeats are refused; nil means off
+	maintenance atomic.Pointer[maintenanceMode]
+}
+
+// New returns a server answering requests from st, setting up the optional
+// write buffer and response cache.
+func New(config Config, st *store.Store) *Server {
+	config = withDefaults(config)
+	s := &Server{store: st, modified: newModTimes(time.Now()), scripts: &scriptCache{}, keyUse: newKeyUse()}
+	if config.WriteBufferSize > 0 {
+		s.buffer = newWriteBuffer(config.WriteBufferSize)
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = 30 * time.Second
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = 256
+	}
+	if config.CacheTTL > 0 {
+		s.cache = newResponseCache(config.CacheTTL, config.CacheSize)
+	}
+	s.settings.Store(&config)
+	return s
+}
+
+// withDefaults replaces the zero plugin hints and token TTLs by their
+// defaults.
+func withDefaults(config Config) Config {
+	if config.Plugins.KeystrokeTimeout <= 0 {
+		config.Plugins.KeystrokeTimeout = 15 * time.Minute
+	}
+	if config.Plugins.HeartbeatInterval <= 0 {
+		config.Plugins.HeartbeatInterval = 2 * time.Minute
+	}
+	if config.Plugins.BatchSize <= 0 {
+		config.Plugins.BatchSize = 25
+	}
+	if config.AccessTokenTTL <= 0 {
+		config.AccessTokenTTL = 15 * time.Minute
+	}
+	if config.RefreshTokenTTL <= 0 {
+		config.RefreshTokenTTL = 30 * 24 * time.Hour
+	}
+	return config
+}
+
+// config returns the current configuration.
+func (s *Server) config() *Config {
+	return s.settings.Load()
+}
+
+// Reload applies a new configuration to the running server, for requests
+// from then on. What New sets up keeps its old settings: the write buffer,
+// the response cache, ReadOnly and Events.
+func (s *Server) Reload(config Config) {
+	config = withDefaults(config)
+	old := s.config()
+	config.WriteBufferSize, config.CacheTTL, config.CacheSize = old.WriteBufferSize, old.CacheTTL, old.CacheSize
+	config.ReadOnly, config.Events = old.ReadOnly, old.Events
+	s.settings.Store(&config)
+}
+
+// routes maps each API path to its handler.
+func (s *Server) routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/heartbeat":                        s.handleHeartbeat,
+		"/heartbeats":                       s.handleHeartbeats,
+		"/heartbeats/stream":                s.handleHeartbeatStream,
+		"/api/v1/heartbeats":                s.handleHeartbeatRange,
+		"/api/v1/heartbeats/edits":          s.handleHeartbeatEdits,
+		"/api/v1/sessions":                  s.handleSessions,
+		"/api/v1/manual_entries":            s.handleManualEntries,
+		"/api/v1/tags":                      s.handleTags,
+		"/api/v1/stats":                     s.handleStats,
+		"/api/v1/aggregate":                 s.handleAggregate,
+		"/api/v1/query":                     s.handleQuery,
+		"/api/v1/grafana/":                  s.handleGrafana,
+		"/api/v1/grafana/search":            s.handleGrafanaSearch,
+		"/api/v1/grafana/query":             s.handleGrafanaQuery,
+		"/api/v1/reports/{period}":          s.handleReport,
+		"/api/v1/notes":                     s.handleNotes,
+		"/api/v1/time_off":                  s.handleTimeOff,
+		"/api/v1/webhooks":                  s.handleWebhooks,
+		"/api/v1/domain_rules":              s.handleDomainRules,
+		"/api/v1/rules":                     s.handleRules,
+		"/api/v1/rules/apply":               s.handleRulesApply,
+		"/api/v1/scripts":                   s.handleScripts,
+		"/api/v1/version":                   s.handleVersion,
+		"/api/v1/whoami":                    s.handleWhoami,
+		"/api/v1/email":                     s.handleEmail,
+		"/api/v1/email/verify":              s.handleEmailVerify,
+		"/api/v1/api_keys":                  s.handleAPIKeys,
+		"/api/v1/api_keys/{id}/activity":    s.handleAPIKeyActivity,
+		"/api/v1/api_keys/{id}/usage":       s.handleAPIKeyUsage,
+		"/api/v1/tokens":                    s.handleTokens,
+		"/api/v1/tokens/refresh":            s.handleTokenRefresh,
+		"/api/v1/tokens/revoke":             s.handleTokenRevoke,
+		"/api/v1/plugins/register":          s.handlePluginRegister,
+		"/api/v1/notifications":             s.handleNotifications,
+		"/api/v1/notifications/unsubscribe": s.handleUnsubscribe,
+		"/api/v1/ingest/{source}":           s.handleIngest,
+		"/api/v1/backfill":                  s.handleBackfill,
+		"/api/v1/jobs/{id}":                 s.handleJob,
+		"/api/v1/tasks":                     s.handleTasks,
+		"/api/v1/maintenance":               s.handleMaintenance,
+		"/api/v1/slack/command":             s.handleSlackCommand,
+		"/api/v1/slack/links":               s.handleSlackLinks,
+		"/api/v1/projects":                  s.handleProjects,
+		"/api/v1/projects/{name}":           s.handleProject,
+		"/api/v1/projects/{name}/archive":   s.handleProjectArchive,
+		"/api/v1/projects/{name}/unarchive": s.handleProjectUnarchive,
+		"/api/v1/workspaces":                s.handleWorkspaces,
+		"/api/v1/users/{id}/today/live":     s.handleLiveToday,
+		"/openapi.json":                     s.handleOpenAPI,
+	}
+}
+
+// Handler routes requests to the API endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for path, handler := range s.routes() {
+		if s.config().ReadOnly {
+			if !replicaRoutes[path] {
+				continue
+			}
+			handler = readOnly(path, handler)
+		}
+		mux.HandleFunc(path, s.scoped(path, s.inMaintenance(path, handler)))
+	}
+	return withRequestID(s.cors(gunzip(mux)))
+}
+
+// authenticate resolves the bearer API key on a request, either the server
+// key, a user key from the store or the access token of a dashboard
+// session.
+func (s *Server) authenticate(r *http.Request) (store.APIKey, bool) {
+	if key, ok := r.Context().Value(keyContextKey{}).(store.APIKey); ok {
+		return key, true
+	}
+	return s.lookupKey(r)
+}
+
+// lookupKey resolves the bearer API key on a request, recording its use.
+func (s *Server) lookupKey(r *http.Request) (store.APIKey, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return store.APIKey{}, false
+	}
+	if token == s.config().APIKey {
+		return store.APIKey{Name: "API_KEY", Source: "config", Scope: store.ScopeAll}, true
+	}
+	if s.config().JWTSecret != "" && strings.Count(token, ".") == 2 {
+		return s.authenticateJWT(token)
+	}
+
+	key, err := s.store.APIKeyByHash(hashKey(token))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("API key lookup error: ", err)
+		}
+		return store.APIKey{}, false
+	}
+	if s.config().ReadOnly {
+		return key, true
+	}
+	var country string
+	if s.config().GeoHeader != "" {
+		country = r.Header.Get(s.config().GeoHeader)
+	}
+	s.keyUse.addIP(key.ID, s.clientIP(r), country, time.Now())
+	return key, true
+}
+
+// clientIP is the address a request came from: the last hop the proxy
+// added to X-Forwarded-For when it is trusted, as earlier ones can be
+// forged, or else the connection's.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.config().TrustProxy {
+		if hops := r.Header.Values("X-Forwarded-For"); len(hops) > 0 {
+			last := strings.Split(hops[len(hops)-1], ",")
+			if ip := strings.TrimSpace(last[len(last)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authorized verifies the bearer API key on a request.
+func (s *Server) authorized(r *http.Request) bool {
+	_, ok := s.authenticate(r)
+	return ok
+}
+
+// errOtherUser refuses a user key the data of another user.
+var errOtherUser = errors.New("User API keys may only access their own user's data")
+
+// keyUser returns the user whose data a request made with key reads or
+// changes: the one it names with requested, or else that of a user key.
+// Only the server key may name another user than its own, so a leaked user
+// key exposes no one else's data.
+func keyUser(key store.APIKey, requested string) (string, error) {
+	if requested == "" {
+		return key.UserID, nil
+	}
+	if key.Source != "config" && requested != key.UserID {
+		return "", errOtherUser
+	}
+	return requested, nil
+}
+
+// errNoUser refuses a heartbeat of the server key that names no user.
+var errNoUser = errors.New("user_id is required with the server key")
+
+// heartbeatUser is keyUser for a heartbeat, which must belong to a user.
+func heartbeatUser(key store.APIKey, requested string) (string, error) {
+	userID, err := keyUser(key, requested)
+	if err == nil && userID == "" {
+		err = errNoUser
+	}
+	return userID, err
+}
+
+// requestUser is keyUser for handlers that need a user, writing the error
+// and returning false when there is none.
+func requestUser(w http.ResponseWriter, key store.APIKey, requested string) (string, bool) {
+	userID, err := keyUser(key, requested)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return "", false
+	}
+	if userID == "" {
+		writeError(w, "user_id is required", http.StatusBadRequest)
+		return "", false
+	}
+	return userID, true
+}
+
+// hashKey is how user API keys are stored, so a leaked database does not
+// leak working keys.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// serveCached answers a conditional request for a user's query with 304
+// if nothing changed since, or writes the cached response, if any.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, userID, key string) bool {
+	if s.notModified(w, r, userID) {
+		return true
+	}
+	body, ok := s.cache.get(userID, key)
+	if !ok {
+		return false
+	}
+	writeConditional(w, r, body)
+	return true
+}
+
+// writeCached writes v as JSON and caches it for the user's query.
+func (s *Server) writeCached(w http.ResponseWriter, r *http.Request, userID, key string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Println("JSON encode error: ", err)
+		writeError(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	s.cache.set(userID, key, body)
+	writeConditional(w, r, body)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("JSON encode error: ", err)
+	}
+}
+
+// HTTP handler exposing release metadata so clients can check compatibility.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"version":            Version,
+		"min_cli_version":    MinCLIVersion,
+		"heartbeat_versions": heartbeatVersions,
+	})
+}
+
+// HTTP handler serving the OpenAPI document. Like the version it needs no
+// API key.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// HTTP handler describing the presented API key and the user it belongs to.
+// The server key has no user.
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	if key.UserID != "" {
+		var err error
+		if email, err = s.store.UserEmail(key.UserID); err != nil {
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, struct {
+		UserID string       `json:"user_id"`
+		Email  string       `json:"email"`
+		Key    store.APIKey `json:"key"`
+	}{key.UserID, email, key})
+}
+
+// HTTP handler creating a user API key. Only the server key may create keys,
+// and the new key is returned once; only its hash is stored.
+func (s *Server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key, ok := s.authenticate(r); !ok || key.Source != "config" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Name   string `json:"name"`
+		Scope  string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		writeError(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	switch req.Scope {
+	case "":
+		req.Scope = store.ScopeAll
+	case store.ScopeAll, store.ScopeRead, store.ScopeWrite:
+	default:
+		writeError(w, "scope must be all, read or write", http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		writeError(w, "Key generation error", http.StatusInternalServerError)
+		return
+	}
+	secret := hex.EncodeToString(raw)
+
+	key := store.APIKey{UserID: req.UserID, Name: req.Name, Source: "database", Scope: req.Scope, CreatedAt: time.Now().Unix()}
+	if err := s.store.CreateAPIKey(&key, hashKey(secret)); err != nil {
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		store.APIKey
+		Key string `json:"key"`
+	}{key, secret})
+}
+
+// HTTP handler listing where a user API key was used from, most recent
+// first, to spot a leaked key. Open to the server key and to keys of the
+// same user.
+func (s *Server) handleAPIKeyActivity(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.userKeyID(w, r)
+	if !ok {
+		return
+	}
+	s.FlushKeyUse()
+	usage, err := s.store.KeyUsage(id, 50)
+	if err != nil {
+		log.Println("API key usage error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, usage)
+}
+
+// HTTP handler for the request counts and error rate of a user API key
+// over the last 30 days, to find the machine whose plugin misbehaves. Open
+// to the server key and to keys of the same user.
+func (s *Server) handleAPIKeyUsage(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.userKeyID(w, r)
+	if !ok {
+		return
+	}
+	s.FlushKeyUse()
+	stats, err := s.store.KeyStats(id, time.Now().AddDate(0, 0, -29))
+	if err != nil {
+		log.Println("API key usage error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// userKeyID returns the ID of the user key a GET request is about, replying
+// with an error when the caller may not see it: only the server key and
+// keys of the same user may.
+func (s *Server) userKeyID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+	caller, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, "Invalid key id", http.StatusBadRequest)
+		return 0, false
+	}
+	key, err := s.store.APIKeyByID(id)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("API key lookup error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return 0, false
+	}
+	// Other users' keys look the same as unknown ones
+	if err == sql.ErrNoRows || caller.Source != "config" && caller.UserID != key.UserID {
+		writeError(w, "Unknown key", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// HTTP handler for heartbeats
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHeartbeatSize))
+	if err != nil {
+		writeError(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	hb, err := decodeHeartbeat(data)
+	if err != nil {
+		log.Printf("decoder error: %+v\n", err)
+		writeError(w, "Invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Verify API key
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if hb.UserID, err = heartbeatUser(key, hb.UserID); err != nil {
+		status := http.StatusForbidden
+		if err == errNoUser {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	if err := s.checkTimestamp(hb.Timestamp, time.Now()); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Buffered heartbeats are written by the flusher; acknowledge right away
+	if s.buffer != nil {
+		s.buffer.add(hb)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "Heartbeat queued")
+		return
+	}
+
+	if err := s.storeHeartbeats([]store.Heartbeat{hb}); err != nil {
+		log.Println("Heartbeat insert error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Heartbeat received")
+}
+
+// maxHeartbeatSize bounds the body of a heartbeat, maxHeartbeatBatch the
+// heartbeats of a batch and maxBatchSize its body, once decompressed.
+const (
+	maxHeartbeatSize  = 1 << 20
+	maxHeartbeatBatch = 1000
+	maxBatchSize      = 16 << 20
+)
+
+// heartbeatBatchResult says which heartbeats of a batch were stored. The
+// rest were rejected and would be rejected again if resent.
+type heartbeatBatchResult struct {
+	Accepted int                 `json:"accepted"`
+	Rejected []rejectedHeartbeat `json:"rejected"`
+}
+
+// rejectedHeartbeat is a heartbeat of a batch that was rejected, by its
+// index in the batch.
+type rejectedHeartbeat struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// HTTP handler for batches of heartbeats, such as offline queues, as a JSON
+// array. Heartbeats are checked one by one, and the valid ones stored even
+// if others are rejected.
+func (s *Server) handleHeartbeats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&batch); err != nil {
+		writeError(w, "Invalid JSON array of heartbeats: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch) > maxHeartbeatBatch {
+		writeError(w, fmt.Sprintf("At most %d heartbeats per batch", maxHeartbeatBatch), http.StatusBadRequest)
+		return
+	}
+
+	result := heartbeatBatchResult{Rejected: []rejectedHeartbeat{}}
+	var heartbeats []store.Heartbeat
+	now := time.Now()
+	for i, data := range batch {
+		hb, err := decodeHeartbeat(data)
+		if err == nil {
+			hb.UserID, err = heartbeatUser(key, hb.UserID)
+		}
+		if err == nil {
+			err = s.checkTimestamp(hb.Timestamp, now)
+		}
+		if err != nil {
+			result.Rejected = append(result.Rejected, rejectedHeartbeat{Index: i, Error: err.Error()})
+			continue
+		}
+		heartbeats = append(heartbeats, hb)
+	}
+	result.Accepted = len(heartbeats)
+
+	if s.buffer != nil {
+		for _, hb := range heartbeats {
+			s.buffer.add(hb)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, result)
+		return
+	}
+	if err := s.storeHeartbeats(heartbeats); err != nil {
+		log.Println("Heartbeat insert error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// checkTimestamp enforces the window the store keeps heartbeats in, and
+// HeartbeatHorizon and MaxClockSkew, on a live heartbeat.
+func (s *Server) checkTimestamp(timestamp int64, now time.Time) error {
+	if err := store.CheckTimestamp(timestamp, now); err != nil {
+		return fmt.Errorf("Heartbeat %v", err)
+	}
+	t := time.Unix(timestamp, 0)
+	if s.config().HeartbeatHorizon > 0 && t.Before(now.Add(-s.config().HeartbeatHorizon)) {
+		return fmt.Errorf("Heartbeat is older than the %v horizon", s.config().HeartbeatHorizon)
+	}
+	if s.config().MaxClockSkew > 0 && t.After(now.Add(s.config().MaxClockSkew)) {
+		return fmt.Errorf("Heartbeat is more than %v in the future, check the client's clock", s.config().MaxClockSkew)
+	}
+	return nil
+}
+
+// storeHeartbeats writes heartbeats once their users' rules and scripts
+// have run on them, sampled if SampleInterval is set. It then drops the
+// cached responses of their users and publishes each user's heartbeats.
+func (s *Server) storeHeartbeats(heartbeats []store.Heartbeat) error {
+	// Rules change heartbeats in place, and the write buffer retries them
+	// as they came when storing fails
+	heartbeats = slices.Clone(heartbeats)
+	if err := s.withRules(heartbeats); err != nil {
+		return err
+	}
+	heartbeats, err := s.withScripts(heartbeats)
+	if err != nil {
+		return err
+	}
+	if len(heartbeats) == 0 {
+		return nil
+	}
+	if s.config().SampleInterval > 0 {
+		err = s.store.StoreSampledHeartbeats(heartbeats, s.config().SampleInterval)
+	} else {
+		err = s.store.StoreHeartbeats(heartbeats)
+	}
+	if err != nil {
+		return err
+	}
+	perUser := make(map[string][]store.Heartbeat)
+	var users []string
+	for _, hb := range heartbeats {
+		if perUser[hb.UserID] == nil {
+			users = append(users, hb.UserID)
+			s.invalidate(hb.UserID)
+		}
+		perUser[hb.UserID] = append(perUser[hb.UserID], hb)
+	}
+	now := time.Now()
+	for _, userID := range users {
+		s.config().Events.Publish(events.Event{Name: events.HeartbeatReceived, UserID: userID, Time: now, Data: perUser[userID]})
+	}
+	return nil
+}
+
+// HTTP handler listing a user's tags with the time tracked under each.
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, ok := requestUser(w, key, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+
+	cacheKey := r.URL.Path + "?" + r.URL.Query().Encode()
+	if s.serveCached(w, r, userID, cacheKey) {
+		return
+	}
+
+	tags, err := s.store.TagTotals(userID)
+	if err != nil {
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	s.writeCached(w, r, userID, cacheKey, tags)
+}
+
+// HTTP handler for manual time entries. POST logs a new entry, GET lists a
+// user's entries, most recent first.
+func (s *Server) handleManualEntries(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var entry store.ManualEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if entry.UserID, ok = requestUser(w, key, entry.UserID); !ok {
+			return
+		}
+		if entry.Project == "" || entry.Duration <= 0 {
+			writeError(w, "project and a positive duration are required",
+				http.StatusBadRequest)
+			return
+		}
+		if entry.Timestamp == 0 {
+			entry.Timestamp = time.Now().Unix()
+		}
+		if err := store.CheckTimestamp(entry.Timestamp, time.Now()); err != nil {
+			writeError(w, "Invalid manual entry: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.store.StoreManualEntry(&entry); err != nil {
+			log.Println("Manual entry error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(entry.UserID)
+
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, entry)
+
+	case "GET":
+		userID, ok := requestUser(w, key, r.URL.Query().Get("user_id"))
+		if !ok {
+			return
+		}
+		entries, err := s.store.ManualEntries(userID, r.URL.Query()["tag"])
+		if err != nil {
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+
+	default:
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HTTP handler listing focus sessions with their project and language
+// breakdown, most recent first. Accepts user_id, an optional limit and tag
+// filters.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, ok := requestUser(w, key, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	cacheKey := r.URL.Path + "?" + r.URL.Query().Encode()
+	if s.serveCached(w, r, userID, cacheKey) {
+		return
+	}
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	sessions, err := s.store.Sessions(userID, limit, r.URL.Query()["tag"])
+	if err != nil {
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	s.writeCached(w, r, userID, cacheKey, sessions)
+}
+
+// HTTP handler summing a user's time per project and language over a range
+// of UTC days. from and to are YYYY-MM-DD and both included; they default to
+// the last seven days.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+	cacheKey := r.URL.Path + "?" + query.Encode()
+	if s.serveCached(w, r, userID, cacheKey) {
+		return
+	}
+
+	from, to, err := dayRange(query)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.store.Stats(userID, from, to, query.Get("include_archived") == "true")
+	if err != nil {
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	s.writeCached(w, r, userID, cacheKey, stats)
+}
+
+// HTTP handler where editor plugins announce themselves when they start. The
+// response carries settings the plugin should use, so clients can be tuned
+// from the server.
+func (s *Server) handlePluginRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var plugin store.Plugin
+	if err := json.NewDecoder(r.Body).Decode(&plugin); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if plugin.UserID, ok = requestUser(w, key, plugin.UserID); !ok {
+		return
+	}
+	if plugin.Name == "" || plugin.Machine == "" {
+		writeError(w, "name and machine are required", http.StatusBadRequest)
+		return
+	}
+	plugin.LastSeen = time.Now().Unix()
+
+	if err := s.store.RegisterPlugin(&plugin); err != nil {
+		log.Println("Plugin register error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	hints := s.config().Plugins
+	writeJSON(w, pluginRegistration{
+		Plugin: plugin,
+		Hints: pluginHintsJSON{
+			KeystrokeTimeout:  int(hints.KeystrokeTimeout.Seconds()),
+			HeartbeatInterval: int(hints.HeartbeatInterval.Seconds()),
+			BatchSize:         hints.BatchSize,
+		},
+	})
+}
+
+// pluginRegistration is the response to a plugin registering, with
+// durations in seconds.
+type pluginRegistration struct {
+	Plugin store.Plugin    `json:"plugin"`
+	Hints  pluginHintsJSON `json:"hints"`
+}
+
+type pluginHintsJSON struct {
+	KeystrokeTimeout  int `json:"keystroke_timeout"`
+	HeartbeatInterval int `json:"heartbeat_interval"`
+	BatchSize         int `json:"batch_size"`
+}
+
+// notificationChannels are the ways a weekly summary can be delivered.
+var notificationChannels = map[string]bool{"email": true}
+
+// HTTP handler reading (GET) or changing (PUT) when and how a user gets their
+// weekly summary. A PUT only changes the fields it contains.
+func (s *Server) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, ok := requestUser(w, key, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+
+	prefs, err := s.store.NotificationPrefs(userID)
+	if err != nil {
+		log.Println("Notification preferences error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, prefs)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	prefs.UserID = userID
+	if prefs.Channels == nil {
+		prefs.Channels = []string{}
+	}
+	if prefs.AlertHours == 0 {
+		prefs.AlertHours = store.DefaultAlertHours
+	}
+	if prefs.Locale == "" {
+		prefs.Locale = i18n.DefaultLocale
+	}
+	if err := validateNotificationPrefs(prefs); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefs.Locale = i18n.Get(prefs.Locale).Tag
+	if err := s.store.SetNotificationPrefs(prefs); err != nil {
+		log.Println("Notification preferences error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	// Summaries depend on the day start hour
+	s.invalidate(prefs.UserID)
+	writeJSON(w, prefs)
+}
+
+func validateNotificationPrefs(p store.NotificationPrefs) error {
+	if p.Weekday < 0 || p.Weekday > 6 {
+		return errors.New("weekday must be 0 (Sunday) to 6")
+	}
+	if p.Hour < 0 || p.Hour > 23 {
+		return errors.New("hour must be 0 to 23")
+	}
+	if p.AlertHours < 1 || p.AlertHours > 24 {
+		return errors.New("alert_hours must be 1 to 24")
+	}
+	if p.WeekStart < 0 || p.WeekStart > 6 {
+		return errors.New("week_start must be 0 (Sunday) to 6")
+	}
+	if p.DayStartHour < 0 || p.DayStartHour > 23 {
+		return errors.New("day_start_hour must be 0 to 23")
+	}
+	if p.DailyGoalMinutes < 0 || p.DailyGoalMinutes > 24*60 {
+		return errors.New("daily_goal_minutes must be 0 to 1440")
+	}
+	if _, ok := i18n.Lookup(p.Locale); !ok {
+		return fmt.Errorf("unknown locale %q, want one of %s", p.Locale, strings.Join(i18n.Tags(), ", "))
+	}
+	if p.DurationFormat != "" {
+		if _, err := durationfmt.Parse(p.DurationFormat); err != nil {
+			return err
+		}
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "" {
+		return fmt.Errorf("unknown timezone %q", p.Timezone)
+	}
+	seen := make(map[string]bool)
+	for _, c := range p.Channels {
+		if !notificationChannels[c] {
+			return fmt.Errorf("unknown channel %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("duplicate channel %q", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// dayRange reads the from and to query parameters, YYYY-MM-DD days that are
+// both included. They default to the seven days up to today.
+func dayRange(query url.Values) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid to date")
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -6)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid from date")
+		}
+		from = t
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from is after to")
+	}
+	return from, to, nil
+}
+
+// HTTP handler summing a user's time grouped by any of the dimensions in
+// store, e.g. group_by=project,language,day, over a range of UTC days. Tag
+// filters restrict the heartbeats counted.
+func (s *Server) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+	cacheKey := r.URL.Path + "?" + query.Encode()
+	if s.serveCached(w, r, userID, cacheKey) {
+		return
+	}
+
+	groupBy := []string{}
+	seen := make(map[string]bool)
+	for _, dim := range strings.Split(query.Get("group_by"), ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" || seen[dim] {
+			continue
+		}
+		if !store.IsDimension(dim) {
+			writeError(w, "Unknown dimension "+dim, http.StatusBadRequest)
+			return
+		}
+		seen[dim] = true
+		groupBy = append(groupBy, dim)
+	}
+
+	from, to, err := dayRange(query)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := s.store.Aggregate(store.AggregateQuery{
+		UserID:  userID,
+		GroupBy: groupBy,
+		From:    from,
+		To:      to,
+		Tags:    query["tag"],
+	})
+	if err != nil {
+		log.Println("Aggregate error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	result := aggregateResult{
+		From:    from.Format("2006-01-02"),
+		To:      to.Format("2006-01-02"),
+		GroupBy: groupBy,
+		Groups:  []map[string]interface{}{},
+	}
+	for _, g := range groups {
+		row := make(map[string]interface{}, len(g.Keys)+1)
+		for k, v := range g.Keys {
+			row[k] = v
+		}
+		row["duration"] = g.Duration
+		result.Groups = append(result.Groups, row)
+		result.Total += g.Duration
+	}
+	s.writeCached(w, r, userID, cacheKey, result)
+}
+
+// Limits on the rows returned by /api/v1/query
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 10000
+)
+
+// HTTP handler running a query in the language of package query for a
+// user, e.g. {"user_id": "me", "query": "select day, sum(duration)"}.
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.UserID, ok = requestUser(w, key, req.UserID); !ok {
+		return
+	}
+	cacheKey := r.URL.Path + "?" + req.Query
+	if s.serveCached(w, r, req.UserID, cacheKey) {
+		return
+	}
+
+	q, err := query.Parse(req.Query)
+	if err != nil {
+		writeError(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, item := range q.Select {
+		if !item.Metric && !store.IsDimension(item.Name) {
+			writeError(w, "Unknown dimension "+item.Name, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, f := range q.Where {
+		if f.Dimension != "tag" && !store.IsDimension(f.Dimension) {
+			writeError(w, "Unknown dimension "+f.Dimension, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if q.To.IsZero() {
+		q.To = time.Now().UTC()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.AddDate(0, 0, -6)
+	}
+	if q.From.After(q.To) {
+		writeError(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultQueryLimit
+	}
+	if q.Limit > maxQueryLimit {
+		q.Limit = maxQueryLimit
+	}
+
+	result, err := s.store.Query(req.UserID, q)
+	if err != nil {
+		log.Println("Query error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	s.writeCached(w, r, req.UserID, cacheKey, result)
+}
+
+type queryRequest struct {
+	UserID string `json:"user_id"`
+	Query  string `json:"query"`
+}
+
+// aggregateResult has one group per combination of dimension values, each
+// with the dimensions as keys plus duration in seconds.
+type aggregateResult struct {
+	From    string                   `json:"from"`
+	To      string                   `json:"to"`
+	GroupBy []string                 `json:"group_by"`
+	Total   float64                  `json:"total"`
+	Groups  []map[string]interface{} `json:"groups"`
+}
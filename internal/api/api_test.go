@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+const benchAPIKey = "bench-key"
+
+// newBenchServer returns a server backed by a fresh SQLite file with the
+// response cache disabled, so every request hits the database.
+func newBenchServer(b *testing.B, config Config) *Server {
+	b.Helper()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	db, err := store.Open(filepath.Join(b.TempDir(), "bench.sqlite"), 8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	st, err := store.New(db)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	config.APIKey = benchAPIKey
+	config.CacheTTL = -1
+	return New(config, st)
+}
+
+// benchHeartbeat spreads heartbeats over a few users, projects and languages
+// like a small team instance would see.
+func benchHeartbeat(i int) heartbeatV2 {
+	languages := []string{"Go", "Lua", "Python", "TypeScript"}
+	return heartbeatV2{
+		Version:   heartbeatVersion,
+		UserID:    fmt.Sprintf("user%d", i%4),
+		Project:   fmt.Sprintf("project%d", i%10),
+		Language:  languages[i%len(languages)],
+		Entity:    fmt.Sprintf("/src/project%d/file%d.go", i%10, i%50),
+		Duration:  30,
+		Timestamp: time.Now().Unix() - int64(i),
+		Tags:      []string{"bench"},
+	}
+}
+
+// postHeartbeat reports failures with Errorf so it is safe in RunParallel.
+func postHeartbeat(b *testing.B, s *Server, hb heartbeatV2) {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	req := httptest.NewRequest("POST", "/heartbeat", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+benchAPIKey)
+	rec := httptest.NewRecorder()
+	s.handleHeartbeat(rec, req)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusAccepted {
+		b.Errorf("status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func BenchmarkHeartbeatHandler(b *testing.B) {
+	s := newBenchServer(b, Config{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		postHeartbeat(b, s, benchHeartbeat(i))
+	}
+}
+
+func BenchmarkHeartbeatHandlerParallel(b *testing.B) {
+	s := newBenchServer(b, Config{})
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			postHeartbeat(b, s, benchHeartbeat(i))
+			i++
+		}
+	})
+}
+
+// BenchmarkHeartbeatHandlerBuffered includes the final flush, so ns/op is the
+// amortized cost of a heartbeat written through the write buffer.
+func BenchmarkHeartbeatHandlerBuffered(b *testing.B) {
+	s := newBenchServer(b, Config{WriteBufferSize: 500})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		postHeartbeat(b, s, benchHeartbeat(i))
+		if i%500 == 499 {
+			s.FlushBuffer()
+		}
+	}
+	s.FlushBuffer()
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+const (
+	// maxBackfillSize caps the NDJSON a backfill may upload.
+	maxBackfillSize = 1 << 30
+
+	// backfillBatch is how many heartbeats a backfill stores per
+	// transaction, and how often it records its progress.
+	backfillBatch = 500
+)
+
+// HTTP handler importing historical heartbeats, one JSON heartbeat per
+// line in any wire format. The upload is spooled to disk and stored by a
+// background job, which GET /api/v1/jobs/{id} reports on. Unlike
+// /heartbeat, there is no horizon; user keys may only backfill their own
+// heartbeats.
+func (s *Server) handleBackfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f, err := os.CreateTemp("", "eztracker-backfill-*.ndjson")
+	if err != nil {
+		log.Println("Backfill spool error: ", err)
+		writeError(w, "Spool error", http.StatusInternalServerError)
+		return
+	}
+	size, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxBackfillSize))
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		writeError(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		os.Remove(f.Name())
+		writeError(w, "Job ID error", http.StatusInternalServerError)
+		return
+	}
+	job := store.Job{
+		ID: id, Kind: "backfill", Status: store.JobRunning, Size: size,
+		CreatedAt: time.Now().Unix(),
+	}
+	if key.Source != "config" {
+		job.UserID = key.UserID
+	}
+	if err := s.store.CreateJob(job); err != nil {
+		os.Remove(f.Name())
+		log.Println("Job create error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	go s.runBackfill(job, f.Name())
+
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job)
+}
+
+// runBackfill stores the heartbeats spooled at path in batches, recording
+// the job's progress after each, and removes the spool when done.
+func (s *Server) runBackfill(job store.Job, path string) {
+	defer os.Remove(path)
+	finish := func(err error) {
+		job.Status, job.FinishedAt = store.JobDone, time.Now().Unix()
+		if err != nil {
+			job.Status, job.Error = store.JobFailed, err.Error()
+		}
+		if err := s.store.UpdateJob(job); err != nil {
+			log.Println("Job update error: ", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		finish(err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var batch []store.Heartbeat
+	var batchBytes int64
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := s.storeHeartbeats(batch); err != nil {
+				return err
+			}
+			job.Stored += int64(len(batch))
+		}
+		job.Processed += batchBytes
+		batch, batchBytes = batch[:0], 0
+		if err := s.store.UpdateJob(job); err != nil {
+			log.Println("Job update error: ", err)
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		batchBytes += int64(len(line)) + 1
+		if len(line) == 0 {
+			continue
+		}
+		hb, err := decodeHeartbeat(line)
+		if err == nil {
+			err = store.CheckTimestamp(hb.Timestamp, time.Now())
+		}
+		if err != nil || job.UserID != "" && hb.UserID != job.UserID {
+			job.Rejected++
+			continue
+		}
+		batch = append(batch, hb)
+		if len(batch) == backfillBatch {
+			if err := flush(); err != nil {
+				log.Println("Backfill insert error: ", err)
+				finish(err)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		finish(err)
+		return
+	}
+	if err := flush(); err != nil {
+		log.Println("Backfill insert error: ", err)
+		finish(err)
+		return
+	}
+	job.Processed = job.Size
+	finish(nil)
+}
+
+// HTTP handler listing the server's scheduled tasks with when they last
+// ran and how often they failed, for monitoring; server key only.
+func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key, ok := s.authenticate(r); !ok || key.Source != "config" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	runs, err := s.store.TaskRuns()
+	if err != nil {
+		log.Println("Task runs error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, runs)
+}
+
+// HTTP handler reporting on a background job. Other users' jobs look the
+// same as unknown ones.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	job, err := s.store.Job(r.PathValue("id"))
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Job lookup error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || key.Source != "config" && job.UserID != key.UserID {
+		writeError(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
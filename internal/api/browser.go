@@ -0,0 +1,186 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Defaults of browser heartbeats that name neither a project nor a
+// category, and match no domain rule.
+const (
+	browserProject  = "browser"
+	browserCategory = "browsing"
+)
+
+// browserVisit is the time a browser extension saw a tab on a domain in
+// focus. The tab's title is accepted but not stored, as titles often hold
+// private data.
+type browserVisit struct {
+	Domain    string  `json:"domain"`
+	Title     string  `json:"title"`
+	Category  string  `json:"category"`
+	Project   string  `json:"project"`
+	Duration  float64 `json:"duration"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// ingestBrowser records the visits a browser extension posts, one object or
+// an array of them, as heartbeats with entity_type domain. A visit's
+// category is the one of the user's most specific domain rule, else the
+// one the extension sent, else "browsing".
+func (s *Server) ingestBrowser(r *http.Request, body []byte, userID string) (ingested, error) {
+	var visits []browserVisit
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &visits); err != nil {
+			return ingested{}, err
+		}
+	} else {
+		var visit browserVisit
+		if err := json.Unmarshal(body, &visit); err != nil {
+			return ingested{}, err
+		}
+		visits = append(visits, visit)
+	}
+
+	rules, err := s.store.DomainRules(userID)
+	if err != nil {
+		return ingested{}, err
+	}
+	var in ingested
+	for i, v := range visits {
+		domain, ok := normalizeDomain(v.Domain)
+		if !ok {
+			return ingested{}, fmt.Errorf("visit %d: invalid domain %q", i, v.Domain)
+		}
+		if v.Timestamp <= 0 || v.Duration < 0 {
+			return ingested{}, fmt.Errorf("visit %d: timestamp is required and duration can't be negative", i)
+		}
+		hb := store.Heartbeat{
+			UserID:     userID,
+			Project:    v.Project,
+			Entity:     domain,
+			EntityType: "domain",
+			Category:   v.Category,
+			Duration:   v.Duration,
+			Timestamp:  int64(v.Timestamp),
+		}
+		if hb.Project == "" {
+			hb.Project = browserProject
+		}
+		if category := domainCategory(rules, domain); category != "" {
+			hb.Category = category
+		}
+		if hb.Category == "" {
+			hb.Category = browserCategory
+		}
+		in.heartbeats = append(in.heartbeats, hb)
+	}
+	return in, nil
+}
+
+// normalizeDomain lowercases a domain and drops a leading "www." and a
+// trailing dot, so rules and visits compare equal. It reports false for
+// anything that isn't a bare host name.
+func normalizeDomain(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	domain = strings.TrimPrefix(domain, "www.")
+	if domain == "" || strings.ContainsAny(domain, "/:?#@ \t") {
+		return "", false
+	}
+	return domain, true
+}
+
+// domainCategory returns the category of the rule for the longest of
+// domain and its parent domains that has one, or "".
+func domainCategory(rules []store.DomainRule, domain string) string {
+	category, longest := "", 0
+	for _, rule := range rules {
+		if (domain == rule.Domain || strings.HasSuffix(domain, "."+rule.Domain)) && len(rule.Domain) > longest {
+			category, longest = rule.Category, len(rule.Domain)
+		}
+	}
+	return category
+}
+
+// HTTP handler for the rules categorizing browsing time by domain: POST
+// sets a domain's category, GET lists them and DELETE removes the one for
+// the domain query parameter. Rules apply to visits ingested afterwards.
+// user_id defaults to the user of a user API key.
+func (s *Server) handleDomainRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "POST":
+		var rule store.DomainRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if rule.UserID, ok = requestUser(w, key, rule.UserID); !ok {
+			return
+		}
+		domain, ok := normalizeDomain(rule.Domain)
+		if !ok || rule.Category == "" {
+			writeError(w, "A domain and a category are required", http.StatusBadRequest)
+			return
+		}
+		rule.Domain = domain
+		if err := s.store.SetDomainRule(rule); err != nil {
+			log.Println("Domain rule error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, rule)
+
+	case "GET":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		rules, err := s.store.DomainRules(userID)
+		if err != nil {
+			log.Println("Domain rule error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rules)
+
+	case "DELETE":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		domain, ok := normalizeDomain(query.Get("domain"))
+		if !ok {
+			writeError(w, "domain is required", http.StatusBadRequest)
+			return
+		}
+		err := s.store.DeleteDomainRule(userID, domain)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown domain rule", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Domain rule delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// writeBuffer holds heartbeats in memory until the next flush. Anything
+// buffered is lost if the process dies before it is flushed.
+type writeBuffer struct {
+	mu      sync.Mutex
+	pending []store.Heartbeat
+	size    int
+	full    chan struct{}
+
+	// flushing serializes flushes so shutdown waits for one in progress
+	flushing sync.Mutex
+	// failures counts the flushes in a row that failed, under flushing
+	failures int
+}
+
+// maxFlushFailures is how many flushes in a row may fail before the
+// heartbeats are written one at a time, dropping those the database still
+// refuses, so that one it never takes doesn't hold back the others for good.
+const maxFlushFailures = 5
+
+func newWriteBuffer(size int) *writeBuffer {
+	return &writeBuffer{size: size, full: make(chan struct{}, 1)}
+}
+
+func (b *writeBuffer) add(hb store.Heartbeat) {
+	b.mu.Lock()
+	b.pending = append(b.pending, hb)
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take empties the buffer, returning what was in it.
+func (b *writeBuffer) take() []store.Heartbeat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending := b.pending
+	b.pending = nil
+	return pending
+}
+
+// requeue puts heartbeats from a failed flush back in front of newer ones.
+func (b *writeBuffer) requeue(heartbeats []store.Heartbeat) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(heartbeats, b.pending...)
+}
+
+// Buffered reports whether heartbeats are buffered and need RunFlusher.
+func (s *Server) Buffered() bool {
+	return s.buffer != nil
+}
+
+// FlushBuffer writes out buffered heartbeats in one transaction. It is a
+// no-op when buffering is off.
+func (s *Server) FlushBuffer() {
+	if s.buffer == nil {
+		return
+	}
+	s.buffer.flushing.Lock()
+	defer s.buffer.flushing.Unlock()
+
+	heartbeats := s.buffer.take()
+	if len(heartbeats) == 0 {
+		return
+	}
+	err := s.storeHeartbeats(heartbeats)
+	if err == nil {
+		s.buffer.failures = 0
+		return
+	}
+	s.buffer.failures++
+	if s.buffer.failures < maxFlushFailures {
+		log.Printf("Buffer flush error, retrying %d heartbeats later: %v", len(heartbeats), err)
+		s.buffer.requeue(heartbeats)
+		return
+	}
+	s.buffer.failures = 0
+	dropped := 0
+	for _, hb := range heartbeats {
+		if storeErr := s.storeHeartbeats([]store.Heartbeat{hb}); storeErr != nil {
+			dropped, err = dropped+1, storeErr
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Buffer flush failed %d times in a row, dropped %d of %d heartbeats: %v",
+			maxFlushFailures, dropped, len(heartbeats), err)
+	}
+}
+
+// RunFlusher flushes the buffer every interval, or sooner once it is full.
+func (s *Server) RunFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.buffer.full:
+		}
+		s.FlushBuffer()
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// responseCache is an LRU cache of encoded summary responses with a TTL.
+// Entries are grouped by user so new heartbeats can drop a user's entries.
+// All methods are no-ops on a nil cache.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	userID  string
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, size int) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(userID, key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[userID+"\x00"+key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, userID+"\x00"+key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.body, true
+}
+
+func (c *responseCache) set(userID, key string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := userID + "\x00" + key
+	if el, ok := c.entries[id]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{
+		userID: userID, key: key, body: body, expires: time.Now().Add(c.ttl),
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*cacheEntry)
+		delete(c.entries, entry.userID+"\x00"+entry.key)
+	}
+}
+
+// invalidate drops every cached response for a user.
+func (c *responseCache) invalidate(userID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, el := range c.entries {
+		if entry := el.Value.(*cacheEntry); entry.userID == userID {
+			c.order.Remove(el)
+			delete(c.entries, id)
+		}
+	}
+}
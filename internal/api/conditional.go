@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modTimes remember when each user's data last changed, so summary
+// endpoints can answer If-Modified-Since without querying. Changes before
+// the server started aren't known, and the start time stands in for them.
+type modTimes struct {
+	mu      sync.Mutex
+	started time.Time
+	users   map[string]time.Time
+}
+
+func newModTimes(now time.Time) *modTimes {
+	return &modTimes{started: now, users: make(map[string]time.Time)}
+}
+
+// touch records a change of a user's data.
+func (m *modTimes) touch(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[userID] = time.Now()
+}
+
+// lastModified returns when a user's summaries last changed. Summaries
+// default to ranges ending today, so they change at midnight UTC too.
+func (m *modTimes) lastModified(userID string, now time.Time) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	modified := m.started
+	if t := m.users[userID]; t.After(modified) {
+		modified = t
+	}
+	if today := now.UTC().Truncate(24 * time.Hour); today.After(modified) {
+		modified = today
+	}
+	return modified
+}
+
+// invalidate drops a user's cached responses and records that their data
+// changed, whenever it does.
+func (s *Server) invalidate(userID string) {
+	s.cache.invalidate(userID)
+	s.modified.touch(userID)
+}
+
+// notModified sets Last-Modified on a GET for a user's summary to their
+// last change, before the summary is queried, and answers 304 if the
+// request's If-Modified-Since is no older. If-None-Match takes precedence,
+// so it is left to writeConditional. Responses must be revalidated, as they
+// change with every heartbeat. A read-only server doesn't see changes, so
+// it only has ETags.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, userID string) bool {
+	if r.Method != "GET" {
+		return false
+	}
+	if s.config().ReadOnly {
+		w.Header().Set("Cache-Control", "no-cache")
+		return false
+	}
+	now := time.Now()
+	modified := s.modified.lastModified(userID, now)
+	w.Header().Set("Last-Modified", httpDate(modified, now))
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// httpDate writes the time of a change as a Last-Modified date. HTTP dates
+// are to the second, so it is rounded up to include the change, but not
+// past now: another change may still come in this second.
+func httpDate(modified, now time.Time) string {
+	if up := modified.Truncate(time.Second); up.Before(modified) {
+		modified = up.Add(time.Second)
+	}
+	if floor := now.Truncate(time.Second); floor.Before(modified) {
+		modified = floor
+	}
+	return modified.UTC().Format(http.TimeFormat)
+}
+
+// writeConditional writes a JSON response body, with an ETag for GETs, or
+// just 304 if the request's If-None-Match has the ETag.
+func writeConditional(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method == "GET" {
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		if matchesETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// matchesETag reports whether an If-None-Match header lists etag, weakly
+// compared as RFC 9110 asks for GETs.
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
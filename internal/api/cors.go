@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsMethods are the methods browsers may use across origins.
+const corsMethods = "GET, POST, PUT, PATCH, DELETE"
+
+// corsHeaders are always allowed on cross-origin requests, on top of
+// Config.CORSHeaders: the bearer token, JSON bodies and conditional
+// requests for summaries. corsExposed are the response headers scripts may
+// read besides the basic ones.
+var (
+	corsHeaders = []string{"Authorization", "Content-Type", "If-None-Match", "If-Modified-Since"}
+	corsExposed = "ETag, Last-Modified"
+)
+
+// allowedOrigin reports whether browsers on origin may call the API.
+func (s *Server) allowedOrigin(origin string) bool {
+	for _, o := range s.config().CORSOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors lets dashboards served from the origins in Config.CORSOrigins call
+// the API from the browser, answering preflight requests itself. Tokens go
+// in the Authorization header, so no cookies are involved and credentials
+// are not allowed.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := s.config()
+		if len(config.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !s.allowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			headers := append(append([]string{}, corsHeaders...), config.CORSHeaders...)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	h := New(Config{
+		CORSOrigins: []string{"https://dash.example.com"},
+		CORSHeaders: []string{"X-Request-ID"},
+	}, nil).Handler()
+
+	for _, tc := range []struct {
+		name, method, origin string
+		preflight            bool
+		wantStatus           int
+		wantOrigin           string
+	}{
+		{"preflight", "OPTIONS", "https://dash.example.com", true, http.StatusNoContent, "https://dash.example.com"},
+		{"request", "GET", "https://dash.example.com", false, http.StatusOK, "https://dash.example.com"},
+		{"other origin", "GET", "https://evil.example.com", false, http.StatusOK, ""},
+		{"other origin preflight", "OPTIONS", "https://evil.example.com", true, http.StatusMethodNotAllowed, ""},
+		{"same origin", "GET", "", false, http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/v1/version", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.preflight {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.wantStatus)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.wantOrigin {
+			t.Errorf("%s: allowed origin %q, want %q", tc.name, got, tc.wantOrigin)
+		}
+		if tc.preflight && tc.wantOrigin != "" {
+			if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type, If-None-Match, If-Modified-Since, X-Request-ID" {
+				t.Errorf("%s: allowed headers %q", tc.name, got)
+			}
+		}
+	}
+
+	// Without origins the API is left alone
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/version", nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	s := New(Config{}, nil)
+	h = s.Handler()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("CORS off: allowed origin %q", got)
+	}
+
+	// Origins added by reloading the configuration apply right away
+	s.Reload(Config{CORSOrigins: []string{"https://dash.example.com"}})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://dash.example.com" {
+		t.Errorf("after reload: allowed origin %q", got)
+	}
+}
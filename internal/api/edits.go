@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// heartbeatDeletion says how many heartbeats a bulk delete removed, or
+// would have for a dry run.
+type heartbeatDeletion struct {
+	Deleted int64 `json:"deleted"`
+	DryRun  bool  `json:"dry_run"`
+}
+
+// HTTP handler for the heartbeats editors sent, selected by from and to,
+// project and path_prefix. DELETE deletes them, such as a day a
+// misconfigured plugin tracked hours against node_modules, and with
+// dry_run=true only counts them. PATCH moves them to the project or gives
+// them the language in the body, as in "everything in ~/old-path belongs to
+// ProjectX", and records the edit. User keys may only change their own
+// user's heartbeats; the server key names the user with user_id. Manual
+// entries are left alone.
+func (s *Server) handleHeartbeatRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" && r.Method != "PATCH" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+	filter := store.HeartbeatFilter{UserID: userID, Project: query.Get("project"), PathPrefix: query.Get("path_prefix")}
+	// No defaults: a forgotten parameter shouldn't change a week
+	if query.Get("from") != "" || query.Get("to") != "" || r.Method == "DELETE" {
+		if query.Get("from") == "" || query.Get("to") == "" {
+			writeError(w, "from and to are required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if filter.From, filter.To, err = dayRange(query); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "DELETE":
+		result := heartbeatDeletion{DryRun: query.Get("dry_run") == "true"}
+		var err error
+		if result.DryRun {
+			result.Deleted, err = s.store.CountHeartbeats(filter)
+		} else {
+			result.Deleted, err = s.store.DeleteHeartbeats(filter)
+		}
+		if err != nil {
+			log.Println("Heartbeat delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if result.Deleted > 0 && !result.DryRun {
+			log.Printf("Deleted %d heartbeats of %s from %s to %s, project %q, path prefix %q", result.Deleted, userID,
+				filter.From.Format("2006-01-02"), filter.To.Format("2006-01-02"), filter.Project, filter.PathPrefix)
+			s.invalidate(userID)
+		}
+		writeJSON(w, result)
+
+	case "PATCH":
+		if filter.From.IsZero() && filter.Project == "" && filter.PathPrefix == "" {
+			writeError(w, "from and to, project or path_prefix is required", http.StatusBadRequest)
+			return
+		}
+		var change store.Reclassification
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if change.Project == "" && change.Language == "" {
+			writeError(w, "project or language is required", http.StatusBadRequest)
+			return
+		}
+		editedBy := key.Name
+		if editedBy == "" {
+			editedBy = key.Source
+		}
+		edit, err := s.store.ReclassifyHeartbeats(filter, change, editedBy)
+		if err != nil {
+			log.Println("Heartbeat edit error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(userID)
+		writeJSON(w, edit)
+	}
+}
+
+// HTTP handler listing a user's reclassifications of heartbeats, most
+// recent first. user_id defaults to the user of a user API key.
+func (s *Server) handleHeartbeatEdits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, ok := requestUser(w, key, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	edits, err := s.store.HeartbeatEdits(userID)
+	if err != nil {
+		log.Println("Heartbeat edits error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, edits)
+}
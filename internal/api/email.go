@@ -0,0 +1,259 @@
+package api
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// emailLinkTTL is how long a confirmation link works, and
+// unsubscribeLinkTTL how long the unsubscribe link of an email does.
+const (
+	emailLinkTTL       = 48 * time.Hour
+	unsubscribeLinkTTL = 365 * 24 * time.Hour
+)
+
+// emailClaims are signed into links in emails. Use is "verify" for
+// confirmation links, which also have the address the link was sent to,
+// which must still be the user's when it is opened. Unsubscribe links have
+// the list they unsubscribe from instead, "summaries" or "alerts".
+type emailClaims struct {
+	UserID    string `json:"sub"`
+	Use       string `json:"use"`
+	Email     string `json:"email,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// emailStatus is a user's email address and whether it was confirmed.
+type emailStatus struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// signEmailLink returns claims as a token for a confirmation link, signed
+// with secret.
+func signEmailLink(secret string, claims emailClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtSignature(secret, unsigned), nil
+}
+
+// parseEmailLink verifies a token signed by signEmailLink for use and
+// returns its claims, failing for expired links.
+func parseEmailLink(secret, token, use string, now time.Time) (emailClaims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(jwtSignature(secret, payload))) {
+		return emailClaims{}, errors.New("bad signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return emailClaims{}, err
+	}
+	var claims emailClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return emailClaims{}, err
+	}
+	if claims.Use != use {
+		return emailClaims{}, fmt.Errorf("not a %s link", use)
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return emailClaims{}, errors.New("link expired")
+	}
+	return claims, nil
+}
+
+// publicURL is where users reach the server, for links in emails: the
+// configured PublicURL, or else the host the request was made to.
+func (s *Server) publicURL(r *http.Request) string {
+	if s.config().PublicURL != "" {
+		return strings.TrimSuffix(s.config().PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// HTTP handler for a user's email address: GET shows it and whether it was
+// verified, and PUT changes it and mails a confirmation link to the new
+// address. Summaries and alerts are only sent once the link is opened, so
+// a typo doesn't send a report to a stranger. user_id defaults to the user
+// of a user API key, and only the server key may change other users'.
+func (s *Server) handleEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Email  string `json:"email"`
+	}
+	if r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.UserID = r.URL.Query().Get("user_id")
+	}
+	userID, ok := requestUser(w, key, req.UserID)
+	if !ok {
+		return
+	}
+
+	if r.Method == "PUT" {
+		if s.config().EmailSecret == "" {
+			writeError(w, "Email verification is not configured", http.StatusNotFound)
+			return
+		}
+		address, err := mail.ParseAddress(req.Email)
+		if err != nil || address.Name != "" {
+			writeError(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		if err := s.store.SetUserEmail(userID, address.Address); err != nil {
+			log.Println("Email error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		token, err := signEmailLink(s.config().EmailSecret, emailClaims{
+			UserID: userID, Use: "verify", Email: address.Address, ExpiresAt: now.Add(emailLinkTTL).Unix(),
+		})
+		if err != nil {
+			writeError(w, "Failed to sign link", http.StatusInternalServerError)
+			return
+		}
+		link := s.publicURL(r) + "/api/v1/email/verify?token=" + url.QueryEscape(token)
+		if err := s.store.EnqueueEmail(&store.Email{
+			To:      address.Address,
+			Subject: "Confirm your eztracker email address",
+			Body: fmt.Sprintf("Open this link within %d hours to get eztracker summaries for %s at this address:\n\n%s\n\n"+
+				"If you didn't ask for them, ignore this email.\n", int(emailLinkTTL.Hours()), userID, link),
+			CreatedAt: now.Unix(),
+		}); err != nil {
+			log.Println("Email error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, emailStatus{UserID: userID, Email: address.Address})
+		return
+	}
+
+	email, verified, err := s.store.UserEmailStatus(userID)
+	if err != nil {
+		log.Println("Email error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, emailStatus{UserID: userID, Email: email, Verified: verified})
+}
+
+// HTTP handler for confirmation links. The signed token in the link
+// authenticates it rather than an API key, as it is opened from an email.
+func (s *Server) handleEmailVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().EmailSecret == "" {
+		writeError(w, "Email verification is not configured", http.StatusNotFound)
+		return
+	}
+	claims, err := parseEmailLink(s.config().EmailSecret, r.URL.Query().Get("token"), "verify", time.Now())
+	if err != nil {
+		writeError(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	verified, err := s.store.VerifyUserEmail(claims.UserID, claims.Email)
+	if err != nil {
+		log.Println("Email error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		writeError(w, "The address was changed since this link was sent", http.StatusConflict)
+		return
+	}
+	writeJSON(w, emailStatus{UserID: claims.UserID, Email: claims.Email, Verified: true})
+}
+
+// UnsubscribeURL returns a signed link turning a user's "summaries" or
+// "alerts" off, for the emails that send them, or "" without an
+// EmailSecret and PublicURL to make one.
+func (s *Server) UnsubscribeURL(userID, list string) string {
+	if s.config().EmailSecret == "" || s.config().PublicURL == "" {
+		return ""
+	}
+	token, err := signEmailLink(s.config().EmailSecret, emailClaims{
+		UserID: userID, Use: list, ExpiresAt: time.Now().Add(unsubscribeLinkTTL).Unix(),
+	})
+	if err != nil {
+		log.Println("Unsubscribe link error: ", err)
+		return ""
+	}
+	return strings.TrimSuffix(s.config().PublicURL, "/") + "/api/v1/notifications/unsubscribe?token=" + url.QueryEscape(token)
+}
+
+// HTTP handler for the unsubscribe links of summaries and alerts. Like
+// confirmation links, the signed token authenticates it. GET is for people
+// opening the link, and POST for mail clients unsubscribing with one click
+// from the List-Unsubscribe header.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().EmailSecret == "" {
+		writeError(w, "Email links are not configured", http.StatusNotFound)
+		return
+	}
+	token, now := r.URL.Query().Get("token"), time.Now()
+	claims, err := parseEmailLink(s.config().EmailSecret, token, "summaries", now)
+	if err != nil {
+		claims, err = parseEmailLink(s.config().EmailSecret, token, "alerts", now)
+	}
+	if err != nil {
+		writeError(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	prefs, err := s.store.NotificationPrefs(claims.UserID)
+	if err != nil {
+		log.Println("Notification preferences error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if claims.Use == "alerts" {
+		prefs.Alerts = false
+	} else {
+		prefs.Enabled = false
+	}
+	if err := s.store.SetNotificationPrefs(prefs); err != nil {
+		log.Println("Notification preferences error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, prefs)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestEmailLinks(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := emailClaims{UserID: "alice", Use: "verify", Email: "alice@example.com", ExpiresAt: now.Add(time.Hour).Unix()}
+	token, err := signEmailLink("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parseEmailLink("secret", token, "verify", now); err != nil || got != claims {
+		t.Errorf("parseEmailLink = %+v, %v, want %+v", got, err, claims)
+	}
+	if _, err := parseEmailLink("secret", token, "summaries", now); err == nil {
+		t.Error("confirmation link accepted as an unsubscribe link")
+	}
+	if _, err := parseEmailLink("other", token, "verify", now); err == nil {
+		t.Error("link verified with another secret")
+	}
+	if _, err := parseEmailLink("secret", token, "verify", now.Add(time.Hour)); err == nil {
+		t.Error("expired link accepted")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs := store.DefaultNotificationPrefs("alice")
+	prefs.Alerts = true
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	if link := New(Config{EmailSecret: "secret"}, st).UnsubscribeURL("alice", "alerts"); link != "" {
+		t.Errorf("link without a public URL: %s", link)
+	}
+	s := New(Config{EmailSecret: "secret", PublicURL: "https://eztracker.example.com/"}, st)
+	unsubscribe := func(method, link string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleUnsubscribe(rec, httptest.NewRequest(method, link, nil))
+		return rec.Code
+	}
+
+	alerts := s.UnsubscribeURL("alice", "alerts")
+	if !strings.HasPrefix(alerts, "https://eztracker.example.com/api/v1/notifications/unsubscribe?token=") {
+		t.Fatalf("link = %s", alerts)
+	}
+	if code := unsubscribe("GET", alerts+"x"); code != http.StatusBadRequest {
+		t.Errorf("tampered link: %d, want 400", code)
+	}
+	// One click from the List-Unsubscribe header
+	if code := unsubscribe("POST", alerts); code != http.StatusOK {
+		t.Fatalf("unsubscribing from alerts: %d", code)
+	}
+	if got, err := st.NotificationPrefs("alice"); err != nil || got.Alerts || !got.Enabled {
+		t.Errorf("after unsubscribing from alerts: %+v, %v", got, err)
+	}
+
+	if code := unsubscribe("GET", s.UnsubscribeURL("alice", "summaries")); code != http.StatusOK {
+		t.Fatalf("unsubscribing from summaries: %d", code)
+	}
+	if got, err := st.NotificationPrefs("alice"); err != nil || got.Enabled {
+		t.Errorf("after unsubscribing from summaries: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// grafanaQuery is a query from Grafana's JSON datasource, which asks for
+// several targets over the dashboard's time range at once. Each target is
+// "total" or a dimension to split the time by, for the user in its payload,
+// or else the user of the API key.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target  string `json:"target"`
+		RefID   string `json:"refId"`
+		Type    string `json:"type"`
+		Payload struct {
+			UserID string `json:"user_id"`
+		} `json:"payload"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a time series in the JSON datasource's format, each
+// datapoint a value and a time in milliseconds.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaColumn and grafanaTable are a table in the JSON datasource's
+// format.
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// grafanaTargets are the targets Grafana offers: the total time and the
+// time split by each dimension but day, which the series are over.
+func grafanaTargets() []string {
+	targets := []string{"total"}
+	for _, dim := range store.Dimensions() {
+		if dim != "day" {
+			targets = append(targets, dim)
+		}
+	}
+	return targets
+}
+
+// HTTP handler for the connection test of Grafana's JSON datasource, whose
+// URL is this path; /search and /query below it are its other endpoints.
+func (s *Server) handleGrafana(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/grafana/" {
+		writeError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// HTTP handler listing the targets a Grafana panel can query.
+func (s *Server) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, grafanaTargets())
+}
+
+// HTTP handler answering a Grafana panel. Targets of type "table" sum the
+// time per value of their dimension over the range, and others are daily
+// time series, one per value, of seconds tracked on each UTC day.
+func (s *Server) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	to := req.Range.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := req.Range.From
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -6)
+	}
+	if from.After(to) {
+		writeError(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+
+	results := []interface{}{}
+	for _, target := range req.Targets {
+		if target.Payload.UserID == "" && key.UserID == "" {
+			writeError(w, "user_id is required in the payload of "+target.RefID, http.StatusBadRequest)
+			return
+		}
+		userID, ok := requestUser(w, key, target.Payload.UserID)
+		if !ok {
+			return
+		}
+		var groupBy []string
+		if target.Target != "total" && target.Target != "" {
+			if target.Target == "day" || !store.IsDimension(target.Target) {
+				writeError(w, "Unknown target "+target.Target, http.StatusBadRequest)
+				return
+			}
+			groupBy = append(groupBy, target.Target)
+		}
+		if target.Type != "table" {
+			groupBy = append(groupBy, "day")
+		}
+
+		groups, err := s.store.Aggregate(store.AggregateQuery{UserID: userID, GroupBy: groupBy, From: from, To: to})
+		if err != nil {
+			log.Println("Grafana query error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if target.Type == "table" {
+			results = append(results, grafanaTableOf(target.Target, groups))
+		} else {
+			results = append(results, grafanaSeriesOf(target.Target, groups)...)
+		}
+	}
+	writeJSON(w, results)
+}
+
+// grafanaTableOf makes a table of groups, largest first, as Aggregate
+// returns them.
+func grafanaTableOf(dim string, groups []store.Group) grafanaTable {
+	table := grafanaTable{Type: "table", Columns: []grafanaColumn{{"seconds", "number"}}, Rows: [][]interface{}{}}
+	if dim != "total" && dim != "" {
+		kind := "string"
+		if dim == "weekday" || dim == "hour" {
+			kind = "number"
+		}
+		table.Columns = append([]grafanaColumn{{dim, kind}}, table.Columns...)
+	}
+	for _, g := range groups {
+		if len(table.Columns) == 1 {
+			table.Rows = append(table.Rows, []interface{}{g.Duration})
+		} else {
+			table.Rows = append(table.Rows, []interface{}{g.Keys[dim], g.Duration})
+		}
+	}
+	return table
+}
+
+// grafanaSeriesOf makes a series per value of dim from groups by dim and
+// day, the largest first, each with its days in order.
+func grafanaSeriesOf(dim string, groups []store.Group) []interface{} {
+	var order []string
+	series := map[string]*grafanaSeries{}
+	totals := map[string]float64{}
+	for _, g := range groups {
+		name := "total"
+		if dim != "total" && dim != "" {
+			name = fmt.Sprint(g.Keys[dim])
+		}
+		day, err := time.Parse("2006-01-02", fmt.Sprint(g.Keys["day"]))
+		if err != nil {
+			continue
+		}
+		if series[name] == nil {
+			series[name] = &grafanaSeries{Target: name, Datapoints: [][2]float64{}}
+			order = append(order, name)
+		}
+		series[name].Datapoints = append(series[name].Datapoints, [2]float64{g.Duration, float64(day.UnixMilli())})
+		totals[name] += g.Duration
+	}
+	sort.SliceStable(order, func(i, j int) bool { return totals[order[i]] > totals[order[j]] })
+
+	results := make([]interface{}, 0, len(order))
+	for _, name := range order {
+		points := series[name].Datapoints
+		sort.Slice(points, func(i, j int) bool { return points[i][1] < points[j][1] })
+		results = append(results, series[name])
+	}
+	return results
+}
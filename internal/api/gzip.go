@@ -0,0 +1,35 @@
+package api
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gunzip decompresses request bodies sent with Content-Encoding: gzip, as
+// the CLI does for large heartbeat batches. Handlers read the decompressed
+// body and bound it as they would an uncompressed one.
+func gunzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+		if encoding == "" || strings.EqualFold(encoding, "identity") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.EqualFold(encoding, "gzip") {
+			writeError(w, "Unsupported Content-Encoding "+encoding, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Heartbeat wire format versions. A payload without a version is v1, which
+// is what CLIs before versioning send. Bump heartbeatVersion when adding a
+// format and keep upgrading the older ones to store.Heartbeat.
+const heartbeatVersion = 2
+
+// heartbeatVersions lists the formats served at /api/v1/version.
+var heartbeatVersions = []int{1, 2}
+
+// heartbeatV1 only knows about files.
+type heartbeatV1 struct {
+	UserID       string   `json:"user_id"`
+	Project      string   `json:"project"`
+	Language     string   `json:"language"`
+	FilePath     string   `json:"file_path"`
+	Duration     float64  `json:"duration"`
+	Timestamp    int64    `json:"timestamp"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	SessionID    string   `json:"session_id,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// heartbeatV2 generalizes the file path to an entity of a given type and
+// adds the category, VCS branch and machine, and optionally the project's
+// root.
+type heartbeatV2 struct {
+	Version      int      `json:"version"`
+	UserID       string   `json:"user_id"`
+	Project      string   `json:"project"`
+	ProjectRoot  string   `json:"project_root,omitempty"`
+	Language     string   `json:"language"`
+	Entity       string   `json:"entity"`
+	EntityType   string   `json:"entity_type,omitempty"`
+	Category     string   `json:"category,omitempty"`
+	Branch       string   `json:"branch,omitempty"`
+	Machine      string   `json:"machine,omitempty"`
+	Duration     float64  `json:"duration"`
+	Timestamp    int64    `json:"timestamp"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	SessionID    string   `json:"session_id,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// entityTypes are the kinds of entity a v2 heartbeat may describe.
+var entityTypes = map[string]bool{"file": true, "app": true, "domain": true}
+
+// decodeHeartbeat reads a heartbeat in any supported wire format.
+func decodeHeartbeat(data []byte) (store.Heartbeat, error) {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return store.Heartbeat{}, err
+	}
+
+	var hb heartbeatV2
+	switch version.Version {
+	case 0, 1:
+		var v1 heartbeatV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return store.Heartbeat{}, err
+		}
+		hb = v1.upgrade()
+	case 2:
+		if err := json.Unmarshal(data, &hb); err != nil {
+			return store.Heartbeat{}, err
+		}
+	default:
+		return store.Heartbeat{}, fmt.Errorf("unsupported heartbeat version %d, this server accepts up to %d",
+			version.Version, heartbeatVersion)
+	}
+
+	if hb.EntityType == "" {
+		hb.EntityType = "file"
+	}
+	if !entityTypes[hb.EntityType] {
+		return store.Heartbeat{}, fmt.Errorf("unknown entity_type %q", hb.EntityType)
+	}
+	if hb.Category == "" {
+		hb.Category = "coding"
+	}
+	return store.Heartbeat{
+		UserID:       hb.UserID,
+		Project:      hb.Project,
+		ProjectRoot:  hb.ProjectRoot,
+		Language:     hb.Language,
+		Entity:       hb.Entity,
+		EntityType:   hb.EntityType,
+		Category:     hb.Category,
+		Branch:       hb.Branch,
+		Machine:      hb.Machine,
+		Duration:     hb.Duration,
+		Timestamp:    hb.Timestamp,
+		Dependencies: hb.Dependencies,
+		SessionID:    hb.SessionID,
+		Tags:         hb.Tags,
+	}, nil
+}
+
+// upgrade converts a v1 heartbeat to v2; every v1 entity is a file.
+func (hb heartbeatV1) upgrade() heartbeatV2 {
+	return heartbeatV2{
+		Version:      2,
+		UserID:       hb.UserID,
+		Project:      hb.Project,
+		Language:     hb.Language,
+		Entity:       hb.FilePath,
+		EntityType:   "file",
+		Duration:     hb.Duration,
+		Timestamp:    hb.Timestamp,
+		Dependencies: hb.Dependencies,
+		SessionID:    hb.SessionID,
+		Tags:         hb.Tags,
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestDecodeHeartbeat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    store.Heartbeat
+		err     string
+	}{
+		{
+			name: "v1 without version",
+			payload: `{"user_id": "u", "project": "p", "language": "Go", "file_path": "/src/p/main.go",
+				"duration": 30, "timestamp": 1700000000, "tags": ["oss"]}`,
+			want: store.Heartbeat{UserID: "u", Project: "p", Language: "Go", Entity: "/src/p/main.go",
+				EntityType: "file", Category: "coding", Duration: 30, Timestamp: 1700000000, Tags: []string{"oss"}},
+		},
+		{
+			name:    "v1 ignores v2 fields",
+			payload: `{"version": 1, "user_id": "u", "file_path": "/a.go", "entity": "/b.go", "entity_type": "app"}`,
+			want:    store.Heartbeat{UserID: "u", Entity: "/a.go", EntityType: "file", Category: "coding"},
+		},
+		{
+			name: "v2",
+			payload: `{"version": 2, "user_id": "u", "project": "p", "entity": "firefox",
+				"entity_type": "app", "category": "browsing", "branch": "main", "duration": 10}`,
+			want: store.Heartbeat{UserID: "u", Project: "p", Entity: "firefox", EntityType: "app",
+				Category: "browsing", Branch: "main", Duration: 10},
+		},
+		{
+			name:    "v2 defaults",
+			payload: `{"version": 2, "user_id": "u", "entity": "/a.go"}`,
+			want:    store.Heartbeat{UserID: "u", Entity: "/a.go", EntityType: "file", Category: "coding"},
+		},
+		{
+			name:    "future version",
+			payload: `{"version": 3, "user_id": "u", "entity": "/a.go"}`,
+			err:     "unsupported heartbeat version 3",
+		},
+		{
+			name:    "unknown entity type",
+			payload: `{"version": 2, "user_id": "u", "entity": "x", "entity_type": "planet"}`,
+			err:     `unknown entity_type "planet"`,
+		},
+		{
+			name:    "not JSON",
+			payload: `heartbeat`,
+			err:     "invalid character",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeHeartbeat([]byte(tc.payload))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFlushBufferDropsRefused(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{APIKey: benchAPIKey, WriteBufferSize: 10}, st)
+
+	// The store refuses the first for good, holding back the second
+	s.buffer.add(store.Heartbeat{UserID: "alice", Project: "p", Timestamp: 1})
+	s.buffer.add(store.Heartbeat{UserID: "alice", Project: "p", Duration: 30, Timestamp: time.Now().Unix()})
+	for i := 1; i < maxFlushFailures; i++ {
+		s.FlushBuffer()
+		if n := len(s.buffer.pending); n != 2 {
+			t.Fatalf("%d heartbeats left after %d failed flushes, want 2", n, i)
+		}
+	}
+	s.FlushBuffer()
+	if n := len(s.buffer.pending); n != 0 {
+		t.Errorf("%d heartbeats left after %d failed flushes", n, maxFlushFailures)
+	}
+	if n, err := st.CountHeartbeats(store.HeartbeatFilter{UserID: "alice"}); err != nil || n != 1 {
+		t.Errorf("stored %d heartbeats, %v; want the one the store takes", n, err)
+	}
+}
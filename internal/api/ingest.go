@@ -0,0 +1,362 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// ingested is what an adapter made of a webhook payload. Both are empty for
+// events that carry no activity, such as pings.
+type ingested struct {
+	heartbeats    []store.Heartbeat
+	manualEntries []store.ManualEntry
+}
+
+// checkTimestamps fails unless the store takes every heartbeat and manual
+// entry at now.
+func (in ingested) checkTimestamps(now time.Time) error {
+	for _, hb := range in.heartbeats {
+		if err := store.CheckTimestamp(hb.Timestamp, now); err != nil {
+			return err
+		}
+	}
+	for _, entry := range in.manualEntries {
+		if err := store.CheckTimestamp(entry.Timestamp, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestAdapter translates the payload an external service posts into
+// activity for userID. Errors are reported to the sender as a 400.
+type ingestAdapter func(r *http.Request, body []byte, userID string) (ingested, error)
+
+// ingestAdapters maps the {source} of /api/v1/ingest/{source} to its
+// adapter.
+func (s *Server) ingestAdapters() map[string]ingestAdapter {
+	return map[string]ingestAdapter{
+		"github":         s.ingestGitHub,
+		"github_actions": ingestGitHubActions,
+		"gitlab":         ingestGitLab,
+		"ci":             ingestCI,
+		"toggl":          ingestToggl,
+		"browser":        s.ingestBrowser,
+	}
+}
+
+// ingestResult counts what a webhook delivery was turned into.
+type ingestResult struct {
+	Source        string `json:"source"`
+	Heartbeats    int    `json:"heartbeats"`
+	ManualEntries int    `json:"manual_entries"`
+}
+
+// HTTP handler turning webhooks from other services into heartbeats and
+// manual entries. Webhook senders can rarely set headers, so the API key may
+// also be passed as the api_key query parameter, and user_id defaults to the
+// user of a user key.
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if key := query.Get("api_key"); key != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	source := r.PathValue("source")
+	adapter, ok := s.ingestAdapters()[source]
+	if !ok {
+		writeError(w, "Unknown source "+source, http.StatusNotFound)
+		return
+	}
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	in, err := adapter(r, body, userID)
+	if err == nil {
+		err = in.checkTimestamps(time.Now())
+	}
+	if err != nil {
+		writeError(w, "Invalid "+source+" payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(in.heartbeats) > 0 {
+		if err := s.storeHeartbeats(in.heartbeats); err != nil {
+			log.Println("Ingest error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	for i := range in.manualEntries {
+		if err := s.store.StoreManualEntry(&in.manualEntries[i]); err != nil {
+			log.Println("Ingest error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(in.manualEntries) > 0 {
+		s.invalidate(userID)
+	}
+
+	writeJSON(w, ingestResult{
+		Source:        source,
+		Heartbeats:    len(in.heartbeats),
+		ManualEntries: len(in.manualEntries),
+	})
+}
+
+type githubPush struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		Name string `json:"name"`
+	} `json:"repository"`
+	Commits []struct {
+		ID        string `json:"id"`
+		Timestamp string `json:"timestamp"`
+	} `json:"commits"`
+}
+
+// ingestGitHub records each commit of a GitHub push event as a heartbeat in
+// the "committing" category. A commit counts the time since the previous
+// one in the push, up to the project's keystroke timeout or else the one
+// given to plugins, so the first commit adds no time. Other events are
+// acknowledged and ignored.
+func (s *Server) ingestGitHub(r *http.Request, body []byte, userID string) (ingested, error) {
+	if event := r.Header.Get("X-GitHub-Event"); event != "push" {
+		return ingested{}, nil
+	}
+	var push githubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return ingested{}, err
+	}
+	if push.Repository.Name == "" {
+		return ingested{}, errors.New("repository.name is missing")
+	}
+
+	timeout := s.config().Plugins.KeystrokeTimeout
+	if p, err := s.store.Project(userID, push.Repository.Name); err == nil && p.KeystrokeTimeout > 0 {
+		timeout = time.Duration(p.KeystrokeTimeout) * time.Second
+	}
+
+	var in ingested
+	var previous time.Time
+	for _, c := range push.Commits {
+		t, err := time.Parse(time.RFC3339, c.Timestamp)
+		if err != nil {
+			return ingested{}, fmt.Errorf("commit %s: %v", c.ID, err)
+		}
+		duration := 0.0
+		if !previous.IsZero() && t.After(previous) {
+			duration = min(t.Sub(previous), timeout).Seconds()
+		}
+		previous = t
+		in.heartbeats = append(in.heartbeats, store.Heartbeat{
+			UserID:     userID,
+			Project:    push.Repository.Name,
+			Entity:     "github.com",
+			EntityType: "domain",
+			Category:   "committing",
+			Branch:     strings.TrimPrefix(push.Ref, "refs/heads/"),
+			Duration:   duration,
+			Timestamp:  t.Unix(),
+		})
+	}
+	return in, nil
+}
+
+// ciJob is a CI job for services without an adapter of their own, times in
+// unix seconds.
+type ciJob struct {
+	Project    string `json:"project"`
+	Job        string `json:"job"`
+	Branch     string `json:"branch"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at"`
+}
+
+// ingestCI records a finished CI job as a heartbeat in the "building"
+// category, for the job's whole run time.
+func ingestCI(r *http.Request, body []byte, userID string) (ingested, error) {
+	var job ciJob
+	if err := json.Unmarshal(body, &job); err != nil {
+		return ingested{}, err
+	}
+	if job.Project == "" || job.Job == "" {
+		return ingested{}, errors.New("project and job are required")
+	}
+	if job.StartedAt <= 0 || job.FinishedAt < job.StartedAt {
+		return ingested{}, errors.New("started_at must be set and not after finished_at")
+	}
+	return ingested{heartbeats: []store.Heartbeat{buildHeartbeat(userID, job.Project,
+		job.Job, job.Branch, time.Unix(job.StartedAt, 0), time.Unix(job.FinishedAt, 0))}}, nil
+}
+
+// buildHeartbeat is how every CI adapter records a pipeline run.
+func buildHeartbeat(userID, project, pipeline, branch string, started, finished time.Time) store.Heartbeat {
+	return store.Heartbeat{
+		UserID:     userID,
+		Project:    project,
+		Entity:     pipeline,
+		EntityType: "app",
+		Category:   "building",
+		Branch:     branch,
+		Duration:   finished.Sub(started).Seconds(),
+		Timestamp:  started.Unix(),
+	}
+}
+
+type githubWorkflowRun struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		Name         string    `json:"name"`
+		HeadBranch   string    `json:"head_branch"`
+		RunStartedAt time.Time `json:"run_started_at"`
+		UpdatedAt    time.Time `json:"updated_at"`
+	} `json:"workflow_run"`
+	Repository struct {
+		Name string `json:"name"`
+	} `json:"repository"`
+}
+
+// ingestGitHubActions records completed GitHub Actions workflow runs
+// (workflow_run events) in the "building" category, from the run's start to
+// its last update. Other events and actions are ignored.
+func ingestGitHubActions(r *http.Request, body []byte, userID string) (ingested, error) {
+	if r.Header.Get("X-GitHub-Event") != "workflow_run" {
+		return ingested{}, nil
+	}
+	var event githubWorkflowRun
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ingested{}, err
+	}
+	if event.Action != "completed" {
+		return ingested{}, nil
+	}
+	run := event.WorkflowRun
+	if event.Repository.Name == "" || run.RunStartedAt.IsZero() || run.UpdatedAt.Before(run.RunStartedAt) {
+		return ingested{}, errors.New("repository.name, workflow_run.run_started_at and updated_at are required")
+	}
+	return ingested{heartbeats: []store.Heartbeat{buildHeartbeat(userID, event.Repository.Name,
+		run.Name, run.HeadBranch, run.RunStartedAt, run.UpdatedAt)}}, nil
+}
+
+type gitlabPipeline struct {
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		Name       string `json:"name"`
+		Ref        string `json:"ref"`
+		Status     string `json:"status"`
+		Duration   int64  `json:"duration"`
+		FinishedAt string `json:"finished_at"`
+	} `json:"object_attributes"`
+	Project struct {
+		Name string `json:"name"`
+	} `json:"project"`
+}
+
+// gitlabFinished are the pipeline statuses after which it no longer runs.
+var gitlabFinished = map[string]bool{"success": true, "failed": true, "canceled": true}
+
+// ingestGitLab records finished GitLab CI pipelines (Pipeline Hook events)
+// in the "building" category, for the duration GitLab reports, which leaves
+// out time spent queued.
+func ingestGitLab(r *http.Request, body []byte, userID string) (ingested, error) {
+	var event gitlabPipeline
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ingested{}, err
+	}
+	attrs := event.ObjectAttributes
+	if event.ObjectKind != "pipeline" || !gitlabFinished[attrs.Status] || attrs.Duration <= 0 {
+		return ingested{}, nil
+	}
+	if event.Project.Name == "" {
+		return ingested{}, errors.New("project.name is missing")
+	}
+	finished, err := time.Parse("2006-01-02 15:04:05 MST", attrs.FinishedAt)
+	if err != nil {
+		return ingested{}, fmt.Errorf("finished_at: %v", err)
+	}
+	name := attrs.Name
+	if name == "" {
+		name = "pipeline"
+	}
+	started := finished.Add(-time.Duration(attrs.Duration) * time.Second)
+	return ingested{heartbeats: []store.Heartbeat{buildHeartbeat(userID, event.Project.Name,
+		name, attrs.Ref, started, finished)}}, nil
+}
+
+type togglEvent struct {
+	Payload  json.RawMessage `json:"payload"`
+	Metadata struct {
+		Action string `json:"action"`
+	} `json:"metadata"`
+}
+
+type togglTimeEntry struct {
+	Description string   `json:"description"`
+	Start       string   `json:"start"`
+	Duration    float64  `json:"duration"`
+	Tags        []string `json:"tags"`
+}
+
+// ingestToggl records a stopped Toggl Track time entry as a manual entry in
+// the project given by the project query parameter, "toggl" by default.
+// Running entries, deletions and pings are ignored.
+func ingestToggl(r *http.Request, body []byte, userID string) (ingested, error) {
+	var event togglEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ingested{}, err
+	}
+	if event.Metadata.Action == "deleted" || len(event.Payload) == 0 || event.Payload[0] != '{' {
+		return ingested{}, nil
+	}
+	var entry togglTimeEntry
+	if err := json.Unmarshal(event.Payload, &entry); err != nil {
+		return ingested{}, err
+	}
+	// Toggl reports running entries with a negative duration
+	if entry.Duration <= 0 {
+		return ingested{}, nil
+	}
+	start, err := time.Parse(time.RFC3339, entry.Start)
+	if err != nil {
+		return ingested{}, fmt.Errorf("start: %v", err)
+	}
+
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		project = "toggl"
+	}
+	return ingested{manualEntries: []store.ManualEntry{{
+		UserID:    userID,
+		Project:   project,
+		Duration:  entry.Duration,
+		Timestamp: start.Unix(),
+		Note:      entry.Description,
+		Tags:      entry.Tags,
+	}}}, nil
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestIngestAdapters(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []store.DomainRule{
+		{UserID: "u", Domain: "go.dev", Category: "researching"},
+		{UserID: "u", Domain: "pkg.go.dev", Category: "reading docs"},
+		{UserID: "u", Domain: "twitter.com", Category: "social"},
+		{UserID: "other", Domain: "github.com", Category: "social"},
+	} {
+		if err := st.SetDomainRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := New(Config{}, st)
+	adapters := s.ingestAdapters()
+	for _, tc := range []struct {
+		name    string
+		source  string
+		target  string
+		headers map[string]string
+		payload string
+		want    ingested
+		err     string
+	}{
+		{
+			name:    "github push",
+			source:  "github",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			payload: `{"ref": "refs/heads/main", "repository": {"name": "eztracker"}, "commits": [
+				{"id": "a", "timestamp": "2024-03-04T10:00:00Z"},
+				{"id": "b", "timestamp": "2024-03-04T10:05:00Z"},
+				{"id": "c", "timestamp": "2024-03-04T14:00:00+02:00"}]}`,
+			want: ingested{heartbeats: []store.Heartbeat{
+				{UserID: "u", Project: "eztracker", Entity: "github.com", EntityType: "domain", Category: "committing",
+					Branch: "main", Timestamp: 1709546400},
+				{UserID: "u", Project: "eztracker", Entity: "github.com", EntityType: "domain", Category: "committing",
+					Branch: "main", Duration: 300, Timestamp: 1709546700},
+				// Capped at the keystroke timeout
+				{UserID: "u", Project: "eztracker", Entity: "github.com", EntityType: "domain", Category: "committing",
+					Branch: "main", Duration: 900, Timestamp: 1709546400 + 7200},
+			}},
+		},
+		{
+			name:    "github ping",
+			source:  "github",
+			headers: map[string]string{"X-GitHub-Event": "ping"},
+			payload: `{"zen": "Keep it logically awesome."}`,
+		},
+		{
+			name:    "github bad timestamp",
+			source:  "github",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			payload: `{"repository": {"name": "p"}, "commits": [{"id": "a", "timestamp": "yesterday"}]}`,
+			err:     "commit a",
+		},
+		{
+			name:    "github actions run",
+			source:  "github_actions",
+			headers: map[string]string{"X-GitHub-Event": "workflow_run"},
+			payload: `{"action": "completed", "repository": {"name": "eztracker"}, "workflow_run": {"name": "CI",
+				"head_branch": "main", "run_started_at": "2024-03-04T10:00:00Z", "updated_at": "2024-03-04T10:04:30Z"}}`,
+			want: ingested{heartbeats: []store.Heartbeat{{UserID: "u", Project: "eztracker", Entity: "CI", EntityType: "app",
+				Category: "building", Branch: "main", Duration: 270, Timestamp: 1709546400}}},
+		},
+		{
+			name:    "github actions run in progress",
+			source:  "github_actions",
+			headers: map[string]string{"X-GitHub-Event": "workflow_run"},
+			payload: `{"action": "in_progress", "repository": {"name": "eztracker"}, "workflow_run": {"name": "CI"}}`,
+		},
+		{
+			name:   "gitlab pipeline",
+			source: "gitlab",
+			payload: `{"object_kind": "pipeline", "project": {"name": "eztracker"}, "object_attributes": {
+				"ref": "dev", "status": "failed", "duration": 120, "finished_at": "2024-03-04 10:02:00 UTC"}}`,
+			want: ingested{heartbeats: []store.Heartbeat{{UserID: "u", Project: "eztracker", Entity: "pipeline", EntityType: "app",
+				Category: "building", Branch: "dev", Duration: 120, Timestamp: 1709546400}}},
+		},
+		{
+			name:    "gitlab pipeline running",
+			source:  "gitlab",
+			payload: `{"object_kind": "pipeline", "project": {"name": "eztracker"}, "object_attributes": {"status": "running"}}`,
+		},
+		{
+			name:    "ci job",
+			source:  "ci",
+			payload: `{"project": "p", "job": "test", "branch": "dev", "started_at": 1700000000, "finished_at": 1700000300}`,
+			want: ingested{heartbeats: []store.Heartbeat{{UserID: "u", Project: "p", Entity: "test", EntityType: "app",
+				Category: "building", Branch: "dev", Duration: 300, Timestamp: 1700000000}}},
+		},
+		{
+			name:    "ci job finishing before it started",
+			source:  "ci",
+			payload: `{"project": "p", "job": "test", "started_at": 1700000000, "finished_at": 1600000000}`,
+			err:     "not after finished_at",
+		},
+		{
+			name:   "toggl entry",
+			source: "toggl",
+			target: "/api/v1/ingest/toggl?project=meetings",
+			payload: `{"payload": {"description": "Planning", "start": "2024-03-04T09:00:00Z",
+				"stop": "2024-03-04T09:30:00Z", "duration": 1800, "tags": ["team"]},
+				"metadata": {"action": "updated"}}`,
+			want: ingested{manualEntries: []store.ManualEntry{{UserID: "u", Project: "meetings", Duration: 1800,
+				Timestamp: 1709542800, Note: "Planning", Tags: []string{"team"}}}},
+		},
+		{
+			name:    "toggl running entry",
+			source:  "toggl",
+			payload: `{"payload": {"start": "2024-03-04T09:00:00Z", "duration": -1709542800}}`,
+		},
+		{
+			name:    "toggl ping",
+			source:  "toggl",
+			payload: `{"payload": "ping", "metadata": {}}`,
+		},
+		{
+			name:   "browser visits",
+			source: "browser",
+			payload: `[{"domain": "pkg.go.dev", "title": "net/http - Go Packages", "duration": 60, "timestamp": 1709546400.5},
+				{"domain": "WWW.Go.Dev", "duration": 30, "timestamp": 1709546460},
+				{"domain": "mobile.twitter.com", "category": "researching", "duration": 90, "timestamp": 1709546490},
+				{"domain": "github.com", "project": "eztracker", "category": "code reviewing", "duration": 120, "timestamp": 1709546580},
+				{"domain": "news.ycombinator.com", "timestamp": 1709546700}]`,
+			want: ingested{heartbeats: []store.Heartbeat{
+				{UserID: "u", Project: "browser", Entity: "pkg.go.dev", EntityType: "domain", Category: "reading docs",
+					Duration: 60, Timestamp: 1709546400},
+				{UserID: "u", Project: "browser", Entity: "go.dev", EntityType: "domain", Category: "researching",
+					Duration: 30, Timestamp: 1709546460},
+				// Rules take precedence over the extension's category
+				{UserID: "u", Project: "browser", Entity: "mobile.twitter.com", EntityType: "domain", Category: "social",
+					Duration: 90, Timestamp: 1709546490},
+				{UserID: "u", Project: "eztracker", Entity: "github.com", EntityType: "domain", Category: "code reviewing",
+					Duration: 120, Timestamp: 1709546580},
+				{UserID: "u", Project: "browser", Entity: "news.ycombinator.com", EntityType: "domain", Category: "browsing",
+					Timestamp: 1709546700},
+			}},
+		},
+		{
+			name:    "browser visit",
+			source:  "browser",
+			payload: `{"domain": "go.dev", "duration": 15, "timestamp": 1709546400}`,
+			want: ingested{heartbeats: []store.Heartbeat{{UserID: "u", Project: "browser", Entity: "go.dev",
+				EntityType: "domain", Category: "researching", Duration: 15, Timestamp: 1709546400}}},
+		},
+		{
+			name:    "browser visit with a URL",
+			source:  "browser",
+			payload: `{"domain": "https://go.dev/doc", "duration": 15, "timestamp": 1709546400}`,
+			err:     "invalid domain",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.target
+			if target == "" {
+				target = "/api/v1/ingest/" + tc.source
+			}
+			r := httptest.NewRequest("POST", target, nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			got, err := adapters[tc.source](r, []byte(tc.payload), "u")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
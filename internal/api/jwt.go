@@ -0,0 +1,78 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// jwtHeader is the only header tokens are signed with, HS256.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// jwtClaims are the claims of dashboard tokens. Type is "access" for tokens
+// that authenticate API requests and "refresh" for those that get new ones.
+// Every token belongs to a session, which revoking ends.
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Session   string `json:"sid"`
+	ID        string `json:"jti"`
+	Type      string `json:"typ"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// signJWT returns claims as a compact JWT signed with secret.
+func signJWT(secret string, claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + jwtSignature(secret, unsigned), nil
+}
+
+// parseJWT verifies a token signed by signJWT and returns its claims,
+// failing for expired tokens.
+func parseJWT(secret, token string, now time.Time) (jwtClaims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return jwtClaims{}, errors.New("not an HS256 token")
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(jwtSignature(secret, header+"."+payload))) {
+		return jwtClaims{}, errors.New("bad signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return jwtClaims{}, err
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return jwtClaims{}, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func jwtSignature(secret, unsigned string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// randomID returns a random hex string for session and token IDs.
+func randomID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
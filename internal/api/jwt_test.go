@@ -0,0 +1,38 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := jwtClaims{Subject: "alice", Session: "s1", ID: "t1", Type: "access",
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()}
+	token, err := signJWT("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := parseJWT("secret", token, now); err != nil || got != claims {
+		t.Errorf("parseJWT = %+v, %v, want %+v", got, err, claims)
+	}
+	if _, err := parseJWT("other", token, now); err == nil {
+		t.Error("token verified with another secret")
+	}
+	if _, err := parseJWT("secret", token, now.Add(time.Minute)); err == nil {
+		t.Error("expired token accepted")
+	}
+
+	// Swap in a payload for another user, keeping the signature
+	parts := strings.Split(token, ".")
+	forged, _ := signJWT("other", jwtClaims{Subject: "bob", Type: "access", ExpiresAt: claims.ExpiresAt})
+	parts[1] = strings.Split(forged, ".")[1]
+	if _, err := parseJWT("secret", strings.Join(parts, "."), now); err == nil {
+		t.Error("tampered token accepted")
+	}
+	if _, err := parseJWT("secret", "not-a-jwt", now); err == nil {
+		t.Error("garbage accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// keyUseInterval is how often the uses of user keys counted in memory are
+// written to the database.
+const keyUseInterval = 10 * time.Second
+
+// keyUse counts the uses of user keys in memory, by IP and by day, so that
+// a keyed request doesn't take the database's write lock, which heartbeats
+// wait on, several times over. Counts are written at most every
+// keyUseInterval in one transaction, before they are read and on shutdown;
+// those of the last interval are lost if the process dies.
+type keyUse struct {
+	mu      sync.Mutex
+	ips     map[keyIP]*store.KeyUsage
+	days    map[keyDay]*store.KeyRequests
+	written time.Time
+
+	// writing serializes writes so that counts reach the database in order
+	writing sync.Mutex
+}
+
+type keyIP struct {
+	key int64
+	ip  string
+}
+
+type keyDay struct {
+	key int64
+	day string
+}
+
+func newKeyUse() *keyUse {
+	return &keyUse{ips: map[keyIP]*store.KeyUsage{}, days: map[keyDay]*store.KeyRequests{},
+		written: time.Now()}
+}
+
+// addIP counts a use of a user key from ip at now. An empty country keeps
+// the one seen before.
+func (u *keyUse) addIP(keyID int64, ip, country string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage, ok := u.ips[keyIP{keyID, ip}]
+	if !ok {
+		usage = &store.KeyUsage{KeyID: keyID, IP: ip, FirstSeen: now.Unix()}
+		u.ips[keyIP{keyID, ip}] = usage
+	}
+	usage.Requests++
+	usage.LastSeen = now.Unix()
+	if country != "" {
+		usage.Country = country
+	}
+}
+
+// addRequest counts a request made with a user key at now, answered with
+// status; request is its method and path, kept when it failed.
+func (u *keyUse) addRequest(keyID int64, request string, status int, userAgent string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	day := now.UTC().Format("2006-01-02")
+	requests, ok := u.days[keyDay{keyID, day}]
+	if !ok {
+		requests = &store.KeyRequests{KeyID: keyID, Day: day}
+		u.days[keyDay{keyID, day}] = requests
+	}
+	requests.Requests++
+	switch {
+	case status >= 500:
+		requests.ServerErrors++
+	case status >= 400:
+		requests.ClientErrors++
+	}
+	if status >= 400 {
+		requests.LastError, requests.LastErrorAt = fmt.Sprintf("%s %d", request, status), now.Unix()
+	}
+	requests.LastSeen, requests.LastStatus, requests.UserAgent = now.Unix(), status, userAgent
+}
+
+// due reports whether the counts were last written keyUseInterval ago.
+func (u *keyUse) due(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.Sub(u.written) >= keyUseInterval
+}
+
+// take empties the counts, returning what was in them.
+func (u *keyUse) take(now time.Time) ([]store.KeyUsage, []store.KeyRequests) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ips := make([]store.KeyUsage, 0, len(u.ips))
+	for _, usage := range u.ips {
+		ips = append(ips, *usage)
+	}
+	days := make([]store.KeyRequests, 0, len(u.days))
+	for _, requests := range u.days {
+		days = append(days, *requests)
+	}
+	u.ips, u.days, u.written = map[keyIP]*store.KeyUsage{}, map[keyDay]*store.KeyRequests{}, now
+	return ips, days
+}
+
+// FlushKeyUse writes the uses of user keys counted in memory to the
+// database.
+func (s *Server) FlushKeyUse() {
+	s.keyUse.writing.Lock()
+	defer s.keyUse.writing.Unlock()
+	ips, days := s.keyUse.take(time.Now())
+	if len(ips) == 0 && len(days) == 0 {
+		return
+	}
+	if err := s.store.RecordKeyUse(ips, days); err != nil {
+		log.Println("API key usage error: ", err)
+	}
+}
+
+// recordKeyRequest counts a request made with a user key once its
+// response is written, writing the counts out when they are due.
+func (s *Server) recordKeyRequest(key store.APIKey, request string, r *http.Request, w *statusWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	now := time.Now()
+	s.keyUse.addRequest(key.ID, request, status, r.UserAgent(), now)
+	if s.keyUse.due(now) {
+		s.FlushKeyUse()
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maintenanceRoutes are the routes heartbeats come in through, refused
+// while the server is in maintenance so that clients queue them for later.
+var maintenanceRoutes = map[string]bool{
+	"/heartbeat":              true,
+	"/heartbeats":             true,
+	"/heartbeats/stream":      true,
+	"/api/v1/ingest/{source}": true,
+	"/api/v1/backfill":        true,
+}
+
+// defaultRetryAfter is how many seconds clients are asked to wait during
+// maintenance unless the admin says otherwise.
+const defaultRetryAfter = 300
+
+// maintenanceMode is whether the server refuses heartbeats for now, as set
+// through /api/v1/maintenance. RetryAfter is in seconds and Since is when
+// it was turned on.
+type maintenanceMode struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Since      int64  `json:"since,omitempty"`
+}
+
+// inMaintenance answers requests to the maintenanceRoutes with 503 and a
+// Retry-After header while the server is in maintenance.
+func (s *Server) inMaintenance(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if !maintenanceRoutes[pattern] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode, on := s.maintenanceOn()
+		if !on {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfter))
+		writeError(w, mode.message(), http.StatusServiceUnavailable)
+	}
+}
+
+// maintenanceOn returns the maintenance mode and whether it is on.
+func (s *Server) maintenanceOn() (*maintenanceMode, bool) {
+	mode := s.maintenance.Load()
+	return mode, mode != nil && mode.Enabled
+}
+
+// message is the error heartbeats get during maintenance.
+func (m *maintenanceMode) message() string {
+	if m.Message == "" {
+		return "The server is down for maintenance"
+	}
+	return m.Message
+}
+
+// HTTP handler for maintenance mode, server key only: GET reports it and
+// PUT turns it on or off. It lasts until turned off or the server restarts.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key, ok := s.authenticate(r); !ok || key.Source != "config" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var mode maintenanceMode
+		if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if mode.RetryAfter < 0 || mode.RetryAfter > 24*60*60 {
+			writeError(w, "retry_after must be between 0 and 86400 seconds", http.StatusBadRequest)
+			return
+		}
+		if mode.Enabled {
+			if mode.RetryAfter == 0 {
+				mode.RetryAfter = defaultRetryAfter
+			}
+			mode.Since = time.Now().Unix()
+			if old := s.maintenance.Load(); old != nil && old.Enabled {
+				mode.Since = old.Since
+			}
+		} else {
+			mode = maintenanceMode{}
+		}
+		s.maintenance.Store(&mode)
+	}
+
+	mode := s.maintenance.Load()
+	if mode == nil {
+		mode = &maintenanceMode{}
+	}
+	writeJSON(w, mode)
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// maxNoteLength bounds the text of a note, in bytes.
+const maxNoteLength = 500
+
+// HTTP handler for notes on days or ranges of days, shown in reports to
+// explain them: POST adds one, GET lists those overlapping from and to, and
+// DELETE removes the one given by id. user_id defaults to the user of a
+// user API key.
+func (s *Server) handleNotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "POST":
+		var note store.Note
+		if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if note.UserID, ok = requestUser(w, key, note.UserID); !ok {
+			return
+		}
+		if note.To == "" {
+			note.To = note.From
+		}
+		if err := validateNote(note); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.store.AddNote(&note); err != nil {
+			log.Println("Note error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(note.UserID)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, note)
+
+	case "GET":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		from, to, err := dayRange(query)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		notes, err := s.store.Notes(userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		if err != nil {
+			log.Println("Notes error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, notes)
+
+	case "DELETE":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "A numeric id is required", http.StatusBadRequest)
+			return
+		}
+		err = s.store.DeleteNote(userID, id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown note", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Note delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func validateNote(n store.Note) error {
+	if n.UserID == "" || n.From == "" || n.Text == "" {
+		return errors.New("user_id, from and text are required")
+	}
+	if len(n.Text) > maxNoteLength {
+		return errors.New("text must be at most 500 bytes")
+	}
+	return validateDays(n.From, n.To)
+}
+
+// validateDays checks a range of UTC dates, both included.
+func validateDays(from, to string) error {
+	first, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return errors.New("Invalid from date")
+	}
+	last, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		return errors.New("Invalid to date")
+	}
+	if first.After(last) {
+		return errors.New("from is after to")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kru/eztracker/client"
+	"github.com/kru/eztracker/internal/store"
+)
+
+type openAPIDoc struct {
+	Info struct {
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// TestOpenAPISpec fails when a route or a field is added without updating
+// openapi.json, or the other way around.
+func TestOpenAPISpec(t *testing.T) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	if doc.Info.Version != Version {
+		t.Errorf("openapi.json is for version %s, the server is %s", doc.Info.Version, Version)
+	}
+
+	var routes, documented []string
+	for path := range (&Server{}).routes() {
+		routes = append(routes, path)
+	}
+	for path := range doc.Paths {
+		documented = append(documented, path)
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if !reflect.DeepEqual(routes, documented) {
+		t.Errorf("routes %v, documented %v", routes, documented)
+	}
+
+	for schema, types := range map[string][]interface{}{
+		"HeartbeatV1":          {heartbeatV1{}},
+		"HeartbeatV2":          {heartbeatV2{}, client.Heartbeat{}},
+		"Bucket":               {store.Bucket{}, client.Bucket{}},
+		"SessionSummary":       {store.SessionSummary{}},
+		"Stats":                {store.Stats{}, client.Stats{}},
+		"Comparison":           {store.Comparison{}, client.Comparison{}},
+		"Change":               {store.Change{}, client.Change{}},
+		"Report":               {store.Report{}, client.Report{}},
+		"YearInReview":         {store.YearInReview{}, client.YearInReview{}},
+		"Note":                 {store.Note{}, client.Note{}},
+		"TimeOff":              {store.TimeOff{}, client.TimeOff{}},
+		"DomainRule":           {store.DomainRule{}, client.DomainRule{}},
+		"Version":              {client.Version{}},
+		"APIKey":               {store.APIKey{}, client.APIKey{}},
+		"KeyUsage":             {store.KeyUsage{}, client.KeyUsage{}},
+		"KeyStats":             {store.KeyStats{}, client.KeyStats{}},
+		"KeyDay":               {store.KeyDay{}, client.KeyDay{}},
+		"TokenPair":            {tokenPair{}, client.TokenPair{}},
+		"Error":                {errorResponse{}},
+		"Job":                  {store.Job{}, client.Job{}},
+		"TaskRun":              {store.TaskRun{}, client.TaskRun{}},
+		"AggregateResult":      {aggregateResult{}, client.Aggregate{}},
+		"Whoami":               {client.Whoami{}},
+		"Plugin":               {store.Plugin{}, client.Plugin{}},
+		"PluginHints":          {pluginHintsJSON{}, client.PluginHints{}},
+		"PluginRegistration":   {pluginRegistration{}},
+		"QueryRequest":         {queryRequest{}},
+		"NotificationPrefs":    {store.NotificationPrefs{}, client.NotificationPrefs{}},
+		"IngestResult":         {ingestResult{}},
+		"SlackMessage":         {slackMessage{}},
+		"SlackLink":            {store.SlackLink{}},
+		"Project":              {store.Project{}, client.Project{}},
+		"Workspace":            {store.Workspace{}, client.Workspace{}},
+		"LiveToday":            {store.LiveToday{}, client.LiveToday{}},
+		"HeartbeatBatchResult": {heartbeatBatchResult{}, client.HeartbeatBatchResult{}},
+		"RejectedHeartbeat":    {rejectedHeartbeat{}, client.RejectedHeartbeat{}},
+		"StreamAck":            {streamAck{}, client.StreamAck{}},
+		"HeartbeatDeletion":    {heartbeatDeletion{}, client.HeartbeatDeletion{}},
+		"Reclassification":     {store.Reclassification{}, client.Reclassification{}},
+		"HeartbeatEdit":        {store.HeartbeatEdit{}, client.HeartbeatEdit{}},
+		"Rule":                 {store.Rule{}, client.Rule{}},
+		"RulesApplied":         {rulesApplied{}, client.RulesApplied{}},
+		"EmailStatus":          {emailStatus{}, client.EmailStatus{}},
+		"QueryResult":          {store.QueryResult{}, client.QueryResult{}},
+		"GrafanaQuery":         {grafanaQuery{}},
+		"Webhook":              {store.Webhook{}, client.Webhook{}},
+		"Script":               {store.Script{}, client.Script{}},
+		"Maintenance":          {maintenanceMode{}, client.Maintenance{}},
+		"GrafanaSeries":        {grafanaSeries{}},
+		"GrafanaTable":         {grafanaTable{}},
+	} {
+		var properties []string
+		for name := range doc.Components.Schemas[schema].Properties {
+			properties = append(properties, name)
+		}
+		sort.Strings(properties)
+		for _, v := range types {
+			if fields := jsonFields(reflect.TypeOf(v)); !reflect.DeepEqual(fields, properties) {
+				t.Errorf("schema %s has %v, %T has %v", schema, properties, v, fields)
+			}
+		}
+	}
+}
+
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// maxKeystrokeTimeout bounds the per project keystroke timeout, in seconds.
+const maxKeystrokeTimeout = 24 * 60 * 60
+
+// maxProjectDescription bounds project descriptions, in bytes.
+const maxProjectDescription = 500
+
+// maxWorkspace bounds workspace names, in bytes.
+const maxWorkspace = 100
+
+// projectUser returns the user_id query parameter, defaulting to the user of
+// a user API key, or "" with an error response written.
+func (s *Server) projectUser(w http.ResponseWriter, r *http.Request) string {
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return ""
+	}
+	userID, _ := requestUser(w, key, r.URL.Query().Get("user_id"))
+	return userID
+}
+
+// HTTP handler listing a user's projects with their settings, with the
+// archived ones only if include_archived is true.
+func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := s.projectUser(w, r)
+	if userID == "" {
+		return
+	}
+	projects, err := s.store.Projects(userID, r.URL.Query().Get("include_archived") == "true")
+	if err != nil {
+		log.Println("Projects error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, projects)
+}
+
+// HTTP handler reading (GET) or changing (PUT) the settings of one project.
+// A PUT only changes the fields it contains.
+func (s *Server) handleProject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := s.projectUser(w, r)
+	if userID == "" {
+		return
+	}
+
+	project, err := s.store.Project(userID, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		writeError(w, "Unknown project", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Project error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, project)
+		return
+	}
+
+	id, name, root, archived := project.ID, project.Name, project.Root, project.Archived
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	project.ID, project.UserID, project.Name, project.Root, project.Archived = id, userID, name, root, archived
+	if err := validateProject(project); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.UpdateProject(project); err != nil {
+		log.Println("Project update error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if project.AggregateOnly {
+		project.Root = ""
+	}
+	s.invalidate(userID)
+	writeJSON(w, project)
+}
+
+// HTTP handler listing a user's workspaces with their projects.
+func (s *Server) handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := s.projectUser(w, r)
+	if userID == "" {
+		return
+	}
+	workspaces, err := s.store.Workspaces(userID)
+	if err != nil {
+		log.Println("Workspaces error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, workspaces)
+}
+
+// HTTP handler archiving a project, hiding it from stats and project lists
+// while keeping its time.
+func (s *Server) handleProjectArchive(w http.ResponseWriter, r *http.Request) {
+	s.archiveProject(w, r, true)
+}
+
+// HTTP handler bringing an archived project back.
+func (s *Server) handleProjectUnarchive(w http.ResponseWriter, r *http.Request) {
+	s.archiveProject(w, r, false)
+}
+
+func (s *Server) archiveProject(w http.ResponseWriter, r *http.Request, archived bool) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := s.projectUser(w, r)
+	if userID == "" {
+		return
+	}
+
+	name := r.PathValue("name")
+	err := s.store.ArchiveProject(userID, name, archived)
+	if err == sql.ErrNoRows {
+		writeError(w, "Unknown project", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Project archive error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	s.invalidate(userID)
+
+	project, err := s.store.Project(userID, name)
+	if err != nil {
+		log.Println("Project error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, project)
+}
+
+// projectColor is a color as projects keep it.
+var projectColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func validateProject(p store.Project) error {
+	if p.KeystrokeTimeout < 0 || p.KeystrokeTimeout > maxKeystrokeTimeout {
+		return errors.New("keystroke_timeout must be 0 to 86400 seconds")
+	}
+	if p.Color != "" && !projectColor.MatchString(p.Color) {
+		return errors.New("color must be #rrggbb")
+	}
+	if len(p.Description) > maxProjectDescription {
+		return errors.New("description must be at most 500 bytes")
+	}
+	if len(p.Workspace) > maxWorkspace || strings.TrimSpace(p.Workspace) != p.Workspace {
+		return errors.New("workspace must be at most 100 bytes without surrounding spaces")
+	}
+	if p.HourlyRate < 0 {
+		return errors.New("hourly_rate must not be negative")
+	}
+	return nil
+}
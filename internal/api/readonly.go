@@ -0,0 +1,44 @@
+package api
+
+import "net/http"
+
+// replicaRoutes are the routes a read-only server serves: the summaries
+// and what dashboards show, none of which write to the store.
+var replicaRoutes = map[string]bool{
+	"/api/v1/sessions":              true,
+	"/api/v1/tags":                  true,
+	"/api/v1/stats":                 true,
+	"/api/v1/aggregate":             true,
+	"/api/v1/query":                 true,
+	"/api/v1/grafana/":              true,
+	"/api/v1/grafana/search":        true,
+	"/api/v1/grafana/query":         true,
+	"/api/v1/reports/{period}":      true,
+	"/api/v1/notes":                 true,
+	"/api/v1/time_off":              true,
+	"/api/v1/webhooks":              true,
+	"/api/v1/domain_rules":          true,
+	"/api/v1/heartbeats/edits":      true,
+	"/api/v1/rules":                 true,
+	"/api/v1/scripts":               true,
+	"/api/v1/version":               true,
+	"/api/v1/whoami":                true,
+	"/api/v1/email":                 true,
+	"/api/v1/projects":              true,
+	"/api/v1/projects/{name}":       true,
+	"/api/v1/workspaces":            true,
+	"/api/v1/users/{id}/today/live": true,
+	"/openapi.json":                 true,
+}
+
+// readOnly rejects requests that would change data on a read-only server.
+// Queries are POSTed but only read, as for read keys.
+func readOnly(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" && !(r.Method == "POST" && readPosts[pattern]) {
+			writeError(w, "This server is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kru/eztracker/internal/i18n"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// reportPage renders a report as a self-contained HTML page, with no
+// scripts or external assets, so it can be saved and shared as is. Its
+// strings come from the locale in L.
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(part, whole float64) string {
+		if whole <= 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%.1f", 100*part/whole)
+	},
+	"busiest": func(buckets []store.Bucket) float64 {
+		busiest := 0.0
+		for _, b := range buckets {
+			busiest = max(busiest, b.Duration)
+		}
+		return busiest
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.L.Tag}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { margin-bottom: 0; }
+.total { font-size: 1.4em; color: #555; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+td { padding: .15em .4em; white-space: nowrap; }
+td.bar { width: 100%; }
+td.bar div { background: #4a7; height: .9em; }
+td.hours { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{$l := .L}}<p class="total">{{$l.T "report.total" ($l.Hours .Report.Total) .Report.DaysActive}}{{with .Report.DaysOff}}{{$l.T "report.days_off" .}}{{end}}</p>
+{{with .Report.Review}}<h2>{{$l.T "report.review"}}</h2>
+<ul>
+{{if .TopProject}}<li>{{$l.T "report.top_project" .TopProject}}</li>{{end}}
+{{if .TopLanguage}}<li>{{$l.T "report.top_language" .TopLanguage}}</li>{{end}}
+{{if .BusiestMonth.Name}}<li>{{$l.T "report.busiest_month" .BusiestMonth.Name ($l.Hours .BusiestMonth.Duration)}}</li>{{end}}
+{{if .BusiestDay.Name}}<li>{{$l.T "report.busiest_day" .BusiestDay.Name ($l.Hours .BusiestDay.Duration)}}</li>{{end}}
+<li>{{$l.T "report.streak" .LongestStreak}}</li>
+</ul>
+{{end}}{{with .Report.Notes}}<h2>{{$l.T "report.notes"}}</h2>
+<ul>
+{{range .}}<li>{{if ne .From .To}}{{$l.T "report.range" .From .To}}{{else}}{{.From}}{{end}}: {{.Text}}</li>
+{{end}}</ul>
+{{end}}{{$busiest := busiest .Report.Periods}}<h2>{{.PeriodsTitle}}</h2>
+<table>
+{{range .Report.Periods}}<tr><td>{{.Name}}</td><td class="bar"><div style="width: {{percent .Duration $busiest}}%"></div></td><td class="hours">{{$l.Hours .Duration}}</td></tr>
+{{end}}</table>
+{{range .Sections}}{{if .Buckets}}<h2>{{.Title}}</h2>
+<table>
+{{$busiest := busiest .Buckets}}{{range .Buckets}}<tr><td{{with .Description}} title="{{.}}"{{end}}>{{.Name}}</td><td class="bar"><div style="width: {{percent .Duration $busiest}}%{{with .Color}}; background: {{.}}{{end}}"></div></td><td class="hours">{{$l.Hours .Duration}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`))
+
+type reportSection struct {
+	Title   string
+	Buckets []store.Bucket
+}
+
+// HTTP handler for monthly (month=YYYY-MM) and yearly (year=YYYY) reports,
+// both defaulting to the current UTC period. format=html returns a page to
+// share instead of JSON, in the user's locale or the one in lang.
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "html" {
+		writeError(w, "format must be json or html", http.StatusBadRequest)
+		return
+	}
+	cacheKey := r.URL.Path + "?" + query.Encode()
+	if format != "html" && s.serveCached(w, r, userID, cacheKey) {
+		return
+	}
+
+	var l *i18n.Locale
+	if format == "html" {
+		prefs, err := s.store.NotificationPrefs(userID)
+		if err != nil {
+			log.Println("Report preferences error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		tag := query.Get("lang")
+		if tag == "" {
+			tag = prefs.Locale
+		}
+		if _, ok := i18n.Lookup(tag); !ok {
+			writeError(w, fmt.Sprintf("Unknown locale %q", tag), http.StatusBadRequest)
+			return
+		}
+		l = i18n.For(tag, prefs.DurationFormat)
+	}
+
+	now := time.Now().UTC()
+	var report store.Report
+	var title, periodsTitle string
+	var err error
+	switch period := r.PathValue("period"); period {
+	case "monthly":
+		month := now
+		if v := query.Get("month"); v != "" {
+			if month, err = time.Parse("2006-01", v); err != nil {
+				writeError(w, "Invalid month, want YYYY-MM", http.StatusBadRequest)
+				return
+			}
+		}
+		report, err = s.store.MonthlyReport(userID, month)
+		if l != nil {
+			title, periodsTitle = l.T("report.monthly", userID, l.Month(month)), l.T("report.days")
+		}
+	case "yearly":
+		year := now.Year()
+		if v := query.Get("year"); v != "" {
+			if year, err = strconv.Atoi(v); err != nil || year < 1970 || year > 9999 {
+				writeError(w, "Invalid year", http.StatusBadRequest)
+				return
+			}
+		}
+		report, err = s.store.YearlyReport(userID, year)
+		if l != nil {
+			title, periodsTitle = l.T("report.yearly", userID, year), l.T("report.months")
+		}
+	default:
+		writeError(w, "Unknown report "+period, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Report error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	if format != "html" {
+		s.writeCached(w, r, userID, cacheKey, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = reportPage.Execute(w, map[string]interface{}{
+		"L":            l,
+		"Title":        title,
+		"PeriodsTitle": periodsTitle,
+		"Report":       report,
+		"Sections": []reportSection{
+			{l.T("report.projects"), report.Projects},
+			{l.T("report.workspaces"), report.Workspaces},
+			{l.T("report.languages"), report.Languages},
+		},
+	})
+	if err != nil {
+		log.Println("Report page error: ", err)
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of a request, taken from the client or a
+// reverse proxy when it sends one and generated otherwise, and echoed in
+// the response.
+const requestIDHeader = "X-Request-ID"
+
+// errorResponse is the body of every error response, with the ID to find
+// the request in the server log by.
+type errorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// validRequestID accepts the IDs proxies and tracing libraries send, but
+// nothing that could forge log lines or bloat them.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withRequestID gives every request an ID and logs failed requests with
+// it.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			if id, err = randomID(); err != nil {
+				log.Println("Request ID error: ", err)
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status >= 400 {
+			log.Printf("Request %s: %s %s returned %d", id, r.Method, r.URL.Path, sw.status)
+		}
+	})
+}
+
+// writeError replies with a JSON error carrying the request ID, which the
+// request ID middleware has set on the response by then.
+func writeError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(errorResponse{Error: message, RequestID: w.Header().Get(requestIDHeader)})
+	if err != nil {
+		log.Println("JSON encode error: ", err)
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// HTTP handler for rules reclassifying heartbeats as they come in: POST
+// adds one, GET lists them in the order they apply in and DELETE removes
+// the one given by id. user_id defaults to the user of a user API key.
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "POST":
+		var rule store.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if rule.UserID, ok = requestUser(w, key, rule.UserID); !ok {
+			return
+		}
+		var tags []string
+		for _, tag := range rule.SetTags {
+			if tag = strings.TrimSpace(tag); tag != "" && !strings.Contains(tag, ",") {
+				tags = append(tags, tag)
+			}
+		}
+		rule.SetTags = tags
+		if rule.MatchPath == "" && rule.MatchLanguage == "" && rule.MatchMachine == "" {
+			writeError(w, "match_path, match_language or match_machine is required", http.StatusBadRequest)
+			return
+		}
+		if rule.SetProject == "" && rule.SetCategory == "" && len(rule.SetTags) == 0 {
+			writeError(w, "set_project, set_category or set_tags is required", http.StatusBadRequest)
+			return
+		}
+		if err := s.store.AddRule(&rule); err != nil {
+			log.Println("Rule error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, rule)
+
+	case "GET":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		rules, err := s.store.Rules(userID)
+		if err != nil {
+			log.Println("Rules error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rules)
+
+	case "DELETE":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "A numeric id is required", http.StatusBadRequest)
+			return
+		}
+		err = s.store.DeleteRule(userID, id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown rule", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Rule delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rulesApplied says how many heartbeats running the rules over history
+// changed.
+type rulesApplied struct {
+	Changed int64 `json:"changed"`
+}
+
+// HTTP handler running a user's rules over the heartbeats they already
+// have, on the days from from to to, or all days without them. Rules only
+// set fields, so heartbeats no rule matches keep what they have.
+func (s *Server) handleRulesApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	userID, ok := requestUser(w, key, query.Get("user_id"))
+	if !ok {
+		return
+	}
+	filter := store.HeartbeatFilter{UserID: userID}
+	if query.Get("from") != "" || query.Get("to") != "" {
+		var err error
+		if filter.From, filter.To, err = dayRange(query); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rules, err := s.store.Rules(userID)
+	if err != nil {
+		log.Println("Rules error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var result rulesApplied
+	if len(rules) > 0 {
+		result.Changed, err = s.store.RewriteHeartbeats(filter, func(hb *store.Heartbeat) bool {
+			return applyRules(rules, hb)
+		})
+		if err != nil {
+			log.Println("Rules apply error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if result.Changed > 0 {
+		s.invalidate(userID)
+	}
+	writeJSON(w, result)
+}
+
+// withRules applies each user's rules to their heartbeats before they are
+// stored.
+func (s *Server) withRules(heartbeats []store.Heartbeat) error {
+	rules := make(map[string][]store.Rule)
+	for i := range heartbeats {
+		userID := heartbeats[i].UserID
+		userRules, ok := rules[userID]
+		if !ok {
+			var err error
+			if userRules, err = s.store.Rules(userID); err != nil {
+				return err
+			}
+			rules[userID] = userRules
+		}
+		applyRules(userRules, &heartbeats[i])
+	}
+	return nil
+}
+
+// applyRules gives a heartbeat what the rules matching it set, later rules
+// overriding earlier ones, and reports whether that changed it.
+func applyRules(rules []store.Rule, hb *store.Heartbeat) bool {
+	changed := false
+	for _, rule := range rules {
+		if !ruleMatches(rule, *hb) {
+			continue
+		}
+		if rule.SetProject != "" && rule.SetProject != hb.Project {
+			hb.Project, hb.ProjectRoot, changed = rule.SetProject, "", true
+		}
+		if rule.SetCategory != "" && rule.SetCategory != hb.Category {
+			hb.Category, changed = rule.SetCategory, true
+		}
+		for _, tag := range rule.SetTags {
+			if !slices.Contains(hb.Tags, tag) {
+				// Clipped, as copies of a heartbeat share its tags
+				hb.Tags, changed = append(slices.Clip(hb.Tags), tag), true
+			}
+		}
+	}
+	return changed
+}
+
+// ruleMatches reports whether a heartbeat matches every condition of a rule.
+func ruleMatches(rule store.Rule, hb store.Heartbeat) bool {
+	return (rule.MatchPath == "" || matchPath(rule.MatchPath, hb.Entity)) &&
+		(rule.MatchLanguage == "" || strings.EqualFold(rule.MatchLanguage, hb.Language)) &&
+		(rule.MatchMachine == "" || strings.EqualFold(rule.MatchMachine, hb.Machine))
+}
+
+// matchPath reports whether a whole path matches a pattern in which *
+// matches any run of characters, slashes included, and ? any one.
+func matchPath(pattern, path string) bool {
+	// Backtracking to the last *, which is enough as a later * can match
+	// anything an earlier one would have
+	p, n, star, mark := 0, 0, -1, 0
+	for n < len(path) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == path[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, n
+			p++
+		case star >= 0:
+			mark++
+			p, n = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
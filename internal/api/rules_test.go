@@ -0,0 +1,58 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/home/me/work/*", "/home/me/work/api/main.go", true},
+		{"/home/me/work/*", "/home/me/workshop/main.go", false},
+		{"*/node_modules/*", "/src/app/node_modules/x/index.js", true},
+		{"*.test.ts", "/src/app/cart.test.ts", true},
+		{"*.test.ts", "/src/app/cart.ts", false},
+		{"/src/?pp/*", "/src/app/main.go", true},
+		{"/src/app", "/src/app/main.go", false},
+		{"*", "", true},
+	} {
+		if got := matchPath(tc.pattern, tc.path); got != tc.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	rules := []store.Rule{
+		{MatchPath: "/home/me/work/*", SetProject: "work", SetTags: []string{"client"}},
+		{MatchLanguage: "markdown", SetCategory: "writing docs"},
+		{MatchPath: "/home/me/work/*", MatchMachine: "laptop", SetProject: "work-laptop"},
+	}
+	hb := store.Heartbeat{Project: "api", ProjectRoot: "/home/me/work/api", Entity: "/home/me/work/api/README.md",
+		Language: "Markdown", Machine: "desktop", Category: "coding", Tags: []string{"oss"}}
+	if !applyRules(rules, &hb) {
+		t.Fatal("applyRules reported no change")
+	}
+	want := store.Heartbeat{Project: "work", Entity: "/home/me/work/api/README.md", Language: "Markdown",
+		Machine: "desktop", Category: "writing docs", Tags: []string{"oss", "client"}}
+	if !reflect.DeepEqual(hb, want) {
+		t.Errorf("applyRules = %+v, want %+v", hb, want)
+	}
+	if applyRules(rules, &hb) {
+		t.Error("applying the rules again changed the heartbeat")
+	}
+
+	tags := make([]string, 1, 2)
+	tags[0] = "oss"
+	original := store.Heartbeat{Entity: "/home/me/work/api/main.go", Tags: tags}
+	copied := original
+	applyRules(rules, &copied)
+	if tags[:2][1] != "" || copied.Tags[1] != "client" {
+		t.Errorf("applyRules wrote %q into the tags of the heartbeat it copied", tags[:2])
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// keyContextKey is the context key under which scoped stores the API key
+// of a request, so handlers don't look it up again.
+type keyContextKey struct{}
+
+// writeRoutes are the routes write keys may use: sending heartbeats and
+// what plugins need around that, including today's time for their status
+// bars.
+var writeRoutes = map[string]bool{
+	"/heartbeat":                    true,
+	"/heartbeats":                   true,
+	"/heartbeats/stream":            true,
+	"/api/v1/plugins/register":      true,
+	"/api/v1/ingest/{source}":       true,
+	"/api/v1/backfill":              true,
+	"/api/v1/jobs/{id}":             true,
+	"/api/v1/whoami":                true,
+	"/api/v1/users/{id}/today/live": true,
+}
+
+// readPosts are the routes read keys may POST to, as the request body is a
+// query or a session for the same scope rather than a change.
+var readPosts = map[string]bool{
+	"/api/v1/query":          true,
+	"/api/v1/grafana/search": true,
+	"/api/v1/grafana/query":  true,
+	"/api/v1/tokens":         true,
+	"/api/v1/tokens/revoke":  true,
+}
+
+// allowedScope reports whether a key with scope may make a request with
+// method to the route pattern.
+func allowedScope(scope, pattern, method string) bool {
+	switch scope {
+	case store.ScopeWrite:
+		return writeRoutes[pattern]
+	case store.ScopeRead:
+		return method == "GET" || method == "HEAD" || method == "POST" && readPosts[pattern]
+	default:
+		return true
+	}
+}
+
+// scoped rejects requests the API key's scope doesn't cover before they
+// reach the handler for pattern, and requests of user keys naming another
+// user in the query; handlers refuse the user_id of bodies the same way. It
+// counts the requests of user keys by the status they got. Requests without
+// a valid key are left to the handler, as some routes need none.
+func (s *Server) scoped(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := s.lookupKey(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+		if key.Source == "database" && !s.config().ReadOnly {
+			sw := &statusWriter{ResponseWriter: w}
+			defer s.recordKeyRequest(key, r.Method+" "+pattern, r, sw)
+			w = sw
+		}
+		if !allowedScope(key.Scope, pattern, r.Method) {
+			writeError(w, "API key scope doesn't allow this request", http.StatusForbidden)
+			return
+		}
+		if _, err := keyUser(key, r.URL.Query().Get("user_id")); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), keyContextKey{}, key)))
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kru/eztracker/internal/script"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// HTTP handler for the Lua scripts run over every heartbeat as it comes
+// in, server key only: POST adds one, rejecting syntax errors, GET lists
+// them in the order they run in and DELETE removes the one given by id.
+func (s *Server) handleScripts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key, ok := s.authenticate(r); !ok || key.Source != "config" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var sc store.Script
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		sc.Name = strings.TrimSpace(sc.Name)
+		if sc.Name == "" || strings.TrimSpace(sc.Source) == "" {
+			writeError(w, "name and source are required", http.StatusBadRequest)
+			return
+		}
+		if _, err := script.Compile(sc.Name, sc.Source); err != nil {
+			writeError(w, "Invalid script: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sc.CreatedAt = time.Now().Unix()
+		if err := s.store.AddScript(&sc); err != nil {
+			log.Println("Script error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, sc)
+
+	case "GET":
+		scripts, err := s.store.Scripts()
+		if err != nil {
+			log.Println("Scripts error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, scripts)
+
+	case "DELETE":
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "A numeric id is required", http.StatusBadRequest)
+			return
+		}
+		err = s.store.DeleteScript(id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown script", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Script delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// scriptCache holds the compiled scripts by ID. Scripts can't be changed,
+// only deleted, so one is compiled once.
+type scriptCache struct {
+	mu       sync.Mutex
+	compiled map[int64]*script.Script
+}
+
+// compile returns the scripts compiled, in order, forgetting deleted ones.
+// Scripts that no longer compile are logged and skipped.
+func (c *scriptCache) compile(scripts []store.Script) []*script.Script {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	compiled := make(map[int64]*script.Script, len(scripts))
+	var ordered []*script.Script
+	for _, sc := range scripts {
+		s, ok := c.compiled[sc.ID]
+		if !ok {
+			var err error
+			if s, err = script.Compile(sc.Name, sc.Source); err != nil {
+				log.Printf("Script %s error: %v", sc.Name, err)
+				continue
+			}
+		}
+		compiled[sc.ID] = s
+		ordered = append(ordered, s)
+	}
+	c.compiled = compiled
+	return ordered
+}
+
+// withScripts runs the scripts over heartbeats before they are stored,
+// returning those the scripts kept.
+func (s *Server) withScripts(heartbeats []store.Heartbeat) ([]store.Heartbeat, error) {
+	scripts, err := s.store.Scripts()
+	if err != nil || len(scripts) == 0 {
+		return heartbeats, err
+	}
+	return script.Run(s.scripts.compile(scripts), heartbeats), nil
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/i18n"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// slackMaxSkew is how old a signed Slack request may be, to limit replays.
+const slackMaxSkew = 5 * time.Minute
+
+// slackMessage is the reply to a slash command, shown only to the user who
+// typed it.
+type slackMessage struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// verifySlack checks the signature Slack puts on every request, an HMAC of
+// the timestamp and body keyed with the app's signing secret.
+func verifySlack(secret string, header http.Header, body []byte, now time.Time) bool {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(header.Get("X-Slack-Signature")), []byte(want))
+}
+
+// HTTP handler for the /eztracker slash command of a Slack app. Requests
+// are authenticated by their Slack signature rather than an API key, and
+// Slack users must first be linked to an eztracker user with
+// /api/v1/slack/links.
+func (s *Server) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().SlackSigningSecret == "" {
+		writeError(w, "Slack is not configured", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	if !verifySlack(s.config().SlackSigningSecret, r.Header, body, time.Now()) {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	reply := func(text string) {
+		writeJSON(w, slackMessage{ResponseType: "ephemeral", Text: text})
+	}
+	teamID, slackUserID := form.Get("team_id"), form.Get("user_id")
+	userID, err := s.store.SlackUser(teamID, slackUserID)
+	if err == sql.ErrNoRows {
+		reply(fmt.Sprintf("Your Slack account is not linked to eztracker yet. Ask your admin to "+
+			"link team_id %s and slack_user_id %s with POST /api/v1/slack/links.", teamID, slackUserID))
+		return
+	}
+	if err != nil {
+		log.Println("Slack user lookup error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	prefs, err := s.store.NotificationPrefs(userID)
+	if err != nil {
+		log.Println("Slack preferences error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	to := prefs.Day(time.Now())
+	var from time.Time
+	var titleKey string
+	switch strings.TrimSpace(strings.ToLower(form.Get("text"))) {
+	case "", "today":
+		from, titleKey = to, "slack.today"
+	case "week":
+		from, titleKey = to.AddDate(0, 0, -6), "slack.week"
+	default:
+		reply("Usage: /eztracker [today|week]")
+		return
+	}
+	stats, err := s.store.Stats(userID, from, to, false)
+	if err != nil {
+		log.Println("Slack stats error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	l := i18n.For(prefs.Locale, prefs.DurationFormat)
+	reply(slackSummary(l, l.T(titleKey), stats))
+}
+
+// slackSummary formats stats as a short Slack message in l.
+func slackSummary(l *i18n.Locale, title string, stats store.Stats) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s:* %s", title, l.Duration(stats.Total))
+	for _, p := range stats.Projects {
+		fmt.Fprintf(&b, "\n• %s: %s", p.Name, l.Duration(p.Duration))
+	}
+	if len(stats.Languages) > 0 {
+		names := make([]string, len(stats.Languages))
+		for i, l := range stats.Languages {
+			names[i] = l.Name
+		}
+		fmt.Fprintf(&b, "\n%s", l.T("slack.languages", strings.Join(names, ", ")))
+	}
+	return b.String()
+}
+
+// HTTP handler linking a Slack user to an eztracker user so their slash
+// commands show that user's stats. user_id defaults to the user of a user
+// API key.
+func (s *Server) handleSlackLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var link store.SlackLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if link.UserID, ok = requestUser(w, key, link.UserID); !ok {
+		return
+	}
+	if link.TeamID == "" || link.SlackUserID == "" {
+		writeError(w, "team_id and slack_user_id are required", http.StatusBadRequest)
+		return
+	}
+	if err := s.store.LinkSlackUser(link); err != nil {
+		log.Println("Slack link error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, link)
+}
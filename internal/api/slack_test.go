@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifySlack(t *testing.T) {
+	// The example from Slack's request verification docs
+	secret := "8f742231b10e8888abcd99yyyzzz85a5"
+	body := []byte("token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c")
+	sent := time.Unix(1531420618, 0)
+	signed := func(ts, signature string) http.Header {
+		h := http.Header{}
+		h.Set("X-Slack-Request-Timestamp", ts)
+		h.Set("X-Slack-Signature", signature)
+		return h
+	}
+	good := signed("1531420618", "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503")
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   []byte
+		now    time.Time
+		want   bool
+	}{
+		{"valid", good, body, sent.Add(time.Minute), true},
+		{"tampered body", good, append(body, 'x'), sent, false},
+		{"replayed", good, body, sent.Add(10 * time.Minute), false},
+		{"wrong signature", signed("1531420618", "v0=00"), body, sent, false},
+		{"no timestamp", signed("", "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"), body, sent, false},
+	} {
+		if got := verifySlack(secret, tc.header, tc.body, tc.now); got != tc.want {
+			t.Errorf("%s: verifySlack = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
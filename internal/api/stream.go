@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+const (
+	// streamAckInterval is how often a heartbeat stream stores what it
+	// received and acknowledges it, and streamBatch how many heartbeats
+	// make it do so sooner.
+	streamAckInterval = time.Second
+	streamBatch       = 100
+)
+
+// streamAck is a line of the response to a heartbeat stream. Received
+// counts the lines handled so far, which the client need not resend;
+// Accepted and Rejected are about the lines since the previous ack, with
+// Rejected indexed by line from 0 and never worth resending. Error ends the
+// stream, Received still being accurate.
+type streamAck struct {
+	Received   int                 `json:"received"`
+	Accepted   int                 `json:"accepted"`
+	Rejected   []rejectedHeartbeat `json:"rejected"`
+	Error      string              `json:"error,omitempty"`
+	RetryAfter int                 `json:"retry_after,omitempty"`
+}
+
+// HTTP handler for a long-lived stream of heartbeats, one JSON heartbeat
+// per line in any wire format, as a busy agent sends them. Heartbeats are
+// stored every streamAckInterval or streamBatch lines, each time answered
+// by a streamAck line, so the request can stay open for as long as the
+// client likes.
+func (s *Server) handleHeartbeatStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Acks are written while the body is still being read, which HTTP/1
+	// servers don't do by default; HTTP/2 always can. The headers go out
+	// right away for clients waiting on them before sending, except to
+	// those waiting for 100 Continue, which the first read sends.
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if r.Header.Get("Expect") == "" {
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+	}
+
+	lines := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxHeartbeatSize)
+		for scanner.Scan() {
+			select {
+			case lines <- bytes.Clone(scanner.Bytes()):
+			case <-done:
+				return
+			}
+		}
+		readErr = scanner.Err()
+	}()
+
+	ticker := time.NewTicker(streamAckInterval)
+	defer ticker.Stop()
+	ack := streamAck{Rejected: []rejectedHeartbeat{}}
+	var heartbeats []store.Heartbeat
+	line := 0
+	// flush stores the heartbeats received since the last ack and writes
+	// the ack, reporting whether the stream goes on
+	flush := func() bool {
+		if mode, on := s.maintenanceOn(); on {
+			// Unacknowledged lines are to be resent after maintenance
+			writeStreamAck(w, rc, streamAck{Received: ack.Received, Rejected: []rejectedHeartbeat{}, Error: mode.message(), RetryAfter: mode.RetryAfter})
+			return false
+		}
+		if err := s.acceptHeartbeats(heartbeats); err != nil {
+			log.Println("Heartbeat stream error: ", err)
+			writeStreamAck(w, rc, streamAck{Received: ack.Received, Rejected: []rejectedHeartbeat{}, Error: "DB error"})
+			return false
+		}
+		ack.Received, ack.Accepted = line, len(heartbeats)
+		writeStreamAck(w, rc, ack)
+		ack.Rejected, heartbeats = []rejectedHeartbeat{}, nil
+		return true
+	}
+
+	for {
+		select {
+		case data, ok := <-lines:
+			if !ok {
+				if line > ack.Received && !flush() {
+					return
+				}
+				if readErr != nil {
+					writeStreamAck(w, rc, streamAck{Received: ack.Received, Rejected: []rejectedHeartbeat{}, Error: "Failed to read body: " + readErr.Error()})
+				}
+				return
+			}
+			line++
+			if len(bytes.TrimSpace(data)) == 0 {
+				continue
+			}
+			hb, err := decodeHeartbeat(data)
+			if err == nil {
+				hb.UserID, err = heartbeatUser(key, hb.UserID)
+			}
+			if err == nil {
+				err = s.checkTimestamp(hb.Timestamp, time.Now())
+			}
+			if err != nil {
+				ack.Rejected = append(ack.Rejected, rejectedHeartbeat{Index: line - 1, Error: err.Error()})
+			} else {
+				heartbeats = append(heartbeats, hb)
+			}
+			if len(heartbeats) >= streamBatch && !flush() {
+				return
+			}
+		case <-ticker.C:
+			if line > ack.Received && !flush() {
+				return
+			}
+		}
+	}
+}
+
+// acceptHeartbeats adds heartbeats to the write buffer, or stores them
+// without one.
+func (s *Server) acceptHeartbeats(heartbeats []store.Heartbeat) error {
+	if len(heartbeats) == 0 {
+		return nil
+	}
+	if s.buffer != nil {
+		for _, hb := range heartbeats {
+			s.buffer.add(hb)
+		}
+		return nil
+	}
+	return s.storeHeartbeats(heartbeats)
+}
+
+// writeStreamAck writes an ack line and sends it right away.
+func writeStreamAck(w http.ResponseWriter, rc *http.ResponseController, ack streamAck) {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		return
+	}
+	w.Write(append(data, '\n'))
+	rc.Flush()
+}
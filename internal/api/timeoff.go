@@ -0,0 +1,100 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// HTTP handler for out-of-office ranges, days that neither break nor extend
+// streaks: POST adds one, GET lists those overlapping from and to, and
+// DELETE removes the one given by id. user_id defaults to the user of a
+// user API key.
+func (s *Server) handleTimeOff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "POST":
+		var off store.TimeOff
+		if err := json.NewDecoder(r.Body).Decode(&off); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if off.UserID, ok = requestUser(w, key, off.UserID); !ok {
+			return
+		}
+		if off.To == "" {
+			off.To = off.From
+		}
+		if off.From == "" {
+			writeError(w, "from is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateDays(off.From, off.To); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.store.AddTimeOff(&off); err != nil {
+			log.Println("Time off error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(off.UserID)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, off)
+
+	case "GET":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		from, to, err := dayRange(query)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ranges, err := s.store.TimeOff(userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		if err != nil {
+			log.Println("Time off error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ranges)
+
+	case "DELETE":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "A numeric id is required", http.StatusBadRequest)
+			return
+		}
+		err = s.store.DeleteTimeOff(userID, id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown time off", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Time off delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		s.invalidate(userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
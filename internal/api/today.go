@@ -0,0 +1,51 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// HTTP handler for status bar widgets: a user's time today and the project
+// and language they are working on, if a heartbeat came in within the
+// keystroke timeout.
+// It is cheap enough to poll every minute. The user "current" is the API
+// key's own.
+func (s *Server) handleLiveToday(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	requested := r.PathValue("id")
+	if requested == "current" {
+		if key.UserID == "" {
+			writeError(w, "The server key has no user of its own", http.StatusBadRequest)
+			return
+		}
+		requested = key.UserID
+	}
+	userID, ok := requestUser(w, key, requested)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	today, err := s.store.LiveToday(userID, now)
+	if err != nil {
+		log.Println("Live today error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	today.Active = today.LastHeartbeat > 0 &&
+		now.Sub(time.Unix(today.LastHeartbeat, 0)) < s.config().Plugins.KeystrokeTimeout
+	if !today.Active {
+		today.Project, today.Language = "", ""
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, today)
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// tokenPair is what dashboards get for a session: an access token to send
+// as the bearer token until ExpiresAt, and a refresh token to get the next
+// pair with. Each refresh token works once.
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+// tokenRequest carries the refresh token to refresh or revoke.
+type tokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// authenticateJWT accepts the access tokens of live dashboard sessions.
+func (s *Server) authenticateJWT(token string) (store.APIKey, bool) {
+	claims, err := parseJWT(s.config().JWTSecret, token, time.Now())
+	if err != nil || claims.Type != "access" {
+		return store.APIKey{}, false
+	}
+	session, err := s.store.TokenSession(claims.Session)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Token session lookup error: ", err)
+		}
+		return store.APIKey{}, false
+	}
+	if session.Revoked || session.UserID != claims.Subject {
+		return store.APIKey{}, false
+	}
+	return store.APIKey{UserID: claims.Subject, Name: "dashboard session", Source: "jwt", Scope: session.Scope}, true
+}
+
+// issueTokens signs a new pair for a session whose current refresh token
+// is refreshID.
+func (s *Server) issueTokens(session store.TokenSession, refreshID string, now time.Time) (tokenPair, error) {
+	accessID, err := randomID()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	access := jwtClaims{
+		Subject: session.UserID, Session: session.ID, ID: accessID, Type: "access",
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(s.config().AccessTokenTTL).Unix(),
+	}
+	refresh := jwtClaims{
+		Subject: session.UserID, Session: session.ID, ID: refreshID, Type: "refresh",
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(s.config().RefreshTokenTTL).Unix(),
+	}
+	pair := tokenPair{TokenType: "Bearer", ExpiresAt: access.ExpiresAt}
+	if pair.AccessToken, err = signJWT(s.config().JWTSecret, access); err != nil {
+		return tokenPair{}, err
+	}
+	if pair.RefreshToken, err = signJWT(s.config().JWTSecret, refresh); err != nil {
+		return tokenPair{}, err
+	}
+	return pair, nil
+}
+
+// HTTP handler starting a dashboard session for the user of a user API key,
+// or for user_id with the server key, with the key's scope. Sessions use
+// short-lived tokens so browsers never hold a long-lived plugin key.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().JWTSecret == "" {
+		writeError(w, "Tokens are not configured", http.StatusNotFound)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok || key.Source == "jwt" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	userID, ok := requestUser(w, key, req.UserID)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	sessionID, err := randomID()
+	if err != nil {
+		writeError(w, "Token generation error", http.StatusInternalServerError)
+		return
+	}
+	refreshID, err := randomID()
+	if err != nil {
+		writeError(w, "Token generation error", http.StatusInternalServerError)
+		return
+	}
+	session := store.TokenSession{
+		ID: sessionID, UserID: userID, Scope: key.Scope, RefreshID: refreshID,
+		CreatedAt: now.Unix(), ExpiresAt: now.Add(s.config().RefreshTokenTTL).Unix(),
+	}
+	if err := s.store.CreateTokenSession(session); err != nil {
+		log.Println("Token session error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	pair, err := s.issueTokens(session, refreshID, now)
+	if err != nil {
+		writeError(w, "Token generation error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, pair)
+}
+
+// HTTP handler trading a refresh token for a new pair. Using a refresh
+// token a second time means it leaked, so the whole session is revoked.
+func (s *Server) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().JWTSecret == "" {
+		writeError(w, "Tokens are not configured", http.StatusNotFound)
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	claims, err := parseJWT(s.config().JWTSecret, req.RefreshToken, now)
+	if err != nil || claims.Type != "refresh" {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	refreshID, err := randomID()
+	if err != nil {
+		writeError(w, "Token generation error", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := now.Add(s.config().RefreshTokenTTL).Unix()
+	ok, err := s.store.RotateRefresh(claims.Session, claims.ID, refreshID, expiresAt)
+	if err != nil {
+		log.Println("Token refresh error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := s.store.RevokeTokenSession(claims.Session); err != nil {
+			log.Println("Token revoke error: ", err)
+		}
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session := store.TokenSession{ID: claims.Session, UserID: claims.Subject}
+	pair, err := s.issueTokens(session, refreshID, now)
+	if err != nil {
+		writeError(w, "Token generation error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, pair)
+}
+
+// HTTP handler ending a dashboard session, e.g. on logout, given its
+// refresh token or one of its access tokens as the bearer token.
+func (s *Server) handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config().JWTSecret == "" {
+		writeError(w, "Tokens are not configured", http.StatusNotFound)
+		return
+	}
+	var req tokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	token, wantType := req.RefreshToken, "refresh"
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		wantType = "access"
+	}
+	claims, err := parseJWT(s.config().JWTSecret, token, time.Now())
+	if err != nil || claims.Type != wantType {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := s.store.RevokeTokenSession(claims.Session); err != nil {
+		log.Println("Token revoke error: ", err)
+		writeError(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+	"github.com/kru/eztracker/internal/webhook"
+)
+
+// HTTP handler for a user's webhooks, URLs their milestones are POSTed to:
+// POST adds one, returning its signing secret, GET lists them without, and
+// DELETE removes the one given by id. user_id defaults to the user of a
+// user API key.
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "POST":
+		var hook store.Webhook
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			writeError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if hook.UserID, ok = requestUser(w, key, hook.UserID); !ok {
+			return
+		}
+		if u, err := url.Parse(hook.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			writeError(w, "url must be an http(s) URL", http.StatusBadRequest)
+			return
+		}
+		if len(hook.Events) == 0 {
+			hook.Events = webhook.Events
+		}
+		for _, event := range hook.Events {
+			if !slices.Contains(webhook.Events, event) {
+				writeError(w, "Unknown event "+event, http.StatusBadRequest)
+				return
+			}
+		}
+		if hook.Secret == "" {
+			secret, err := randomID()
+			if err != nil {
+				writeError(w, "Secret generation error", http.StatusInternalServerError)
+				return
+			}
+			hook.Secret = secret
+		}
+		hook.CreatedAt = time.Now().Unix()
+		if err := s.store.AddWebhook(&hook); err != nil {
+			log.Println("Webhook error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, hook)
+
+	case "GET":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		hooks, err := s.store.Webhooks(userID)
+		if err != nil {
+			log.Println("Webhook error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+
+	case "DELETE":
+		userID, ok := requestUser(w, key, query.Get("user_id"))
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, "A numeric id is required", http.StatusBadRequest)
+			return
+		}
+		err = s.store.DeleteWebhook(userID, id)
+		if err == sql.ErrNoRows {
+			writeError(w, "Unknown webhook", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Webhook delete error: ", err)
+			writeError(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
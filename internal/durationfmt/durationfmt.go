@@ -0,0 +1,81 @@
+// Package durationfmt writes durations the same way everywhere users read
+// them: summary emails, alerts, reports, Slack replies and the CLI.
+package durationfmt
+
+import (
+	"fmt"
+	"math"
+)
+
+// Style is how a duration is written. Its value is what users put in their
+// settings.
+type Style string
+
+const (
+	// Human is hours and minutes, as in "3 h 24 min", "25 min" or "40 s".
+	Human Style = "human"
+	// Clock is hours and minutes as on a clock, as in "3:24".
+	Clock Style = "hh:mm"
+	// Decimal is hours with two decimals, as in "3.40 h".
+	Decimal Style = "decimal"
+)
+
+// Styles lists the styles, the default first.
+var Styles = []Style{Human, Clock, Decimal}
+
+// Parse returns the style named s, Human for "".
+func Parse(s string) (Style, error) {
+	if s == "" {
+		return Human, nil
+	}
+	for _, style := range Styles {
+		if Style(s) == style {
+			return style, nil
+		}
+	}
+	return "", fmt.Errorf("unknown duration format %q, want human, hh:mm or decimal", s)
+}
+
+// Format writes seconds in style, to the minute for Human and Clock except
+// that Human shows durations under a minute in seconds. Unknown styles are
+// Human.
+func Format(seconds float64, style Style) string {
+	sign := ""
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	minutes := int64(math.Round(seconds / 60))
+	switch style {
+	case Clock:
+		return fmt.Sprintf("%s%d:%02d", sign, minutes/60, minutes%60)
+	case Decimal:
+		return fmt.Sprintf("%s%.2f h", sign, seconds/3600)
+	}
+	switch {
+	case seconds > 0 && seconds < 59.5:
+		return fmt.Sprintf("%s%d s", sign, int64(math.Round(seconds)))
+	case minutes < 60:
+		return fmt.Sprintf("%s%d min", sign, minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%s%d h", sign, minutes/60)
+	}
+	return fmt.Sprintf("%s%d h %d min", sign, minutes/60, minutes%60)
+}
+
+// Compact writes seconds as hours and minutes without spaces, as in
+// "2h41m" or "25m", for status lines where space is short.
+func Compact(seconds float64) string {
+	minutes := int64(math.Round(math.Max(seconds, 0) / 60))
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+}
+
+// Signed is Format with a sign even for gains, for changes.
+func Signed(seconds float64, style Style) string {
+	if seconds >= 0 {
+		return "+" + Format(seconds, style)
+	}
+	return Format(seconds, style)
+}
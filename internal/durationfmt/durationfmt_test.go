@@ -0,0 +1,48 @@
+package durationfmt
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		seconds float64
+		style   Style
+		want    string
+	}{
+		{0, Human, "0 min"},
+		{40, Human, "40 s"},
+		{59.6, Human, "1 min"},
+		{120, Human, "2 min"},
+		{3 * 3600, Human, "3 h"},
+		{3*3600 + 24*60, Human, "3 h 24 min"},
+		{-90 * 60, Human, "-1 h 30 min"},
+		{120, Clock, "0:02"},
+		{3*3600 + 24*60, Clock, "3:24"},
+		{26 * 3600, Clock, "26:00"},
+		{120, Decimal, "0.03 h"},
+		{3*3600 + 24*60, Decimal, "3.40 h"},
+		{120, "", "2 min"},
+	} {
+		if got := Format(tc.seconds, tc.style); got != tc.want {
+			t.Errorf("Format(%v, %q) = %q, want %q", tc.seconds, tc.style, got, tc.want)
+		}
+	}
+	if got := Signed(0, Human); got != "+0 min" {
+		t.Errorf("Signed(0) = %q", got)
+	}
+	for seconds, want := range map[float64]string{0: "0m", 25 * 60: "25m", 2*3600 + 41*60: "2h41m", 3 * 3600: "3h00m"} {
+		if got := Compact(seconds); got != want {
+			t.Errorf("Compact(%v) = %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]Style{"": Human, "human": Human, "hh:mm": Clock, "decimal": Decimal} {
+		if got, err := Parse(s); got != want || err != nil {
+			t.Errorf("Parse(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	if _, err := Parse("hours"); err == nil {
+		t.Error("Parse(hours) succeeded")
+	}
+}
@@ -0,0 +1,711 @@
+package e2e
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestFocusSession(t *testing.T) {
+	srv := startServer(t)
+
+	srv.mustCLI(t, "focus", "--minutes", "25")
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "40")
+	srv.mustCLI(t, "focus", "--stop")
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "10")
+
+	var sessions []struct {
+		ID       string  `json:"id"`
+		Duration float64 `json:"duration"`
+	}
+	srv.getJSON(t, "/api/v1/sessions?user_id=krisrp", &sessions)
+	if len(sessions) != 1 || sessions[0].Duration != 40 {
+		t.Errorf("sessions = %+v, want one session of 40s", sessions)
+	}
+}
+
+func TestPausedCLISendsNothing(t *testing.T) {
+	srv := startServer(t)
+
+	srv.mustCLI(t, "pause")
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30")
+	srv.mustCLI(t, "resume")
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30")
+
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1 {
+		t.Errorf("stored %d heartbeats, want 1", n)
+	}
+}
+
+func TestCLIExitCodes(t *testing.T) {
+	srv := startServer(t)
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		args []string
+		want int
+	}{
+		{"rejected key", "wrong-key", []string{"--entity", "/src/a/b.go", "--duration", "5"}, 104},
+		{"bad timestamp", apiKey, []string{"--entity", "/src/a/b.go", "--time", "yesterday"}, 105},
+		{"missing entity", apiKey, []string{"--duration", "5"}, 105},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if out, code := srv.cli(t, tc.key, tc.args...); code != tc.want {
+				t.Errorf("exit code %d, want %d:\n%s", code, tc.want, out)
+			}
+		})
+	}
+}
+
+// TestCLIUserKey checks that the CLI works with a user key, sending
+// heartbeats as and reading the stats of the key's own user.
+func TestCLIUserKey(t *testing.T) {
+	srv := startServer(t)
+	_, key := srv.newKey(t, "alice", "")
+
+	for _, args := range [][]string{
+		{"--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "90"},
+		{"--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "90"},
+		{"--today"},
+		{"statusline", "--max-age", "0s"},
+	} {
+		if out, code := srv.cli(t, key, args...); code != 0 {
+			t.Fatalf("eztracker %s exited with %d:\n%s", strings.Join(args, " "), code, out)
+		}
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE user_id = 'alice'"); n != 2 {
+		t.Errorf("stored %d heartbeats of alice, want 2", n)
+	}
+	if out, _ := srv.cli(t, key, "--today"); out != "3 min\n" {
+		t.Errorf("--today printed %q, want 3 min", out)
+	}
+
+	// Without user_id, the server key has no user to send heartbeats as
+	cmd := exec.Command(cliBin, "--entity", "/src/a/b.go", "--duration", "5")
+	cmd.Env = append(os.Environ(), "HOME="+srv.home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=",
+		"API_KEY="+apiKey, "EZTRACKER_SERVER_URL="+srv.URL)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 106 || !strings.Contains(string(out), "user_id is required") {
+		t.Errorf("heartbeat of the server key without user_id: %v\n%s", err, out)
+	}
+}
+
+func TestClientLibrary(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	err := c.SendHeartbeats([]client.Heartbeat{
+		{UserID: "bot", Project: "eztracker", Language: "Go", Entity: "/src/eztracker/main.go",
+			Duration: 60, Timestamp: day.Unix()},
+		{UserID: "bot", Project: "eztracker", Language: "Lua", Entity: "/src/eztracker/plugin.lua",
+			Duration: 30, Timestamp: day.Unix()},
+		{UserID: "bot", Project: "other", Language: "Go", Entity: "/src/other/main.go",
+			Duration: 10, Timestamp: day.AddDate(0, 0, 1).Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.LogTime(client.ManualEntry{UserID: "bot", Project: "eztracker",
+		Duration: 600, Timestamp: day.Unix()}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := c.Stats("bot", day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 690 || len(stats.Projects) != 1 || len(stats.Languages) != 2 ||
+		stats.Languages[0] != (client.Bucket{Name: "Go", Duration: 60}) {
+		t.Errorf("stats for one day = %+v", stats)
+	}
+
+	stats, err = c.Stats("bot", day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 700 || len(stats.Projects) != 2 {
+		t.Errorf("stats for two days = %+v", stats)
+	}
+
+	// The day after is compared to the day before it
+	stats, err = c.Stats("bot", day.AddDate(0, 0, 1), day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &client.Comparison{From: "2024-03-04", To: "2024-03-04", Total: 690, Delta: -680,
+		Projects: []client.Change{{Name: "other", Delta: 10}, {Name: "eztracker", Previous: 690, Delta: -690}}}
+	if !reflect.DeepEqual(stats.Previous, want) {
+		t.Errorf("comparison with the day before = %+v, want %+v", stats.Previous, want)
+	}
+
+	var clientErr *client.Error
+	if _, err := client.New(srv.URL, "wrong-key").Whoami(); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("whoami with a bad key: %v, want a 401", err)
+	}
+}
+
+func TestRPCMode(t *testing.T) {
+	srv := startServer(t)
+
+	input := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize"}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "heartbeat", "params": {"heartbeats": [` +
+			`{"entity": "/src/eztracker/main.go", "language": "Go", "duration": 30},` +
+			`{"entity": "/src/eztracker/cli.go", "language": "Go", "duration": 20}]}}`,
+		`{"jsonrpc": "2.0", "method": "heartbeat", "params": {"heartbeats": [` +
+			`{"entity": "/src/eztracker/main.go", "language": "Go", "duration": 10}]}}`,
+		`not json`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "frobnicate"}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "heartbeat", "params": {"heartbeats": [{"duration": 5}]}}`,
+		`{"jsonrpc": "2.0", "id": 5, "method": "status"}`,
+		`{"jsonrpc": "2.0", "id": 6, "method": "shutdown"}`,
+		`{"jsonrpc": "2.0", "id": 7, "method": "status"}`,
+	}, "\n")
+	cmd := exec.Command(cliBin, "rpc")
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Env = append(os.Environ(), "HOME="+srv.home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=",
+		"API_KEY="+apiKey, "EZTRACKER_USER_ID="+serverKeyUser, "EZTRACKER_SERVER_URL="+srv.URL, "EZTRACKER_DEBUG=true")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("eztracker rpc: %v", err)
+	}
+
+	want := []string{
+		`{"jsonrpc":"2.0","id":1,"result":{"protocol_version":1,"version":"0.0.1"}}`,
+		`{"jsonrpc":"2.0","id":2,"result":{"paused":false}}`,
+		`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid character 'o' in literal null (expecting 'u')"}}`,
+		`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"unknown method frobnicate"}}`,
+		`{"jsonrpc":"2.0","id":4,"error":{"code":-32602,"message":"heartbeat entity is required"}}`,
+		`{"jsonrpc":"2.0","id":5,"result":{"status":"tracking"}}`,
+		`{"jsonrpc":"2.0","id":6,"result":null}`,
+	}
+	if got := strings.TrimSpace(string(out)); got != strings.Join(want, "\n") {
+		t.Errorf("responses:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 3 {
+		t.Errorf("stored %d heartbeats, want 3", n)
+	}
+}
+
+func TestPluginRegistration(t *testing.T) {
+	srv := startServer(t, "PLUGIN_BATCH_SIZE=10")
+
+	cmd := exec.Command(cliBin, "rpc")
+	cmd.Stdin = strings.NewReader(
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"plugin": {"name": "vscode-eztracker", "version": "1.2.0"}}}` + "\n")
+	cmd.Env = append(os.Environ(), "HOME="+srv.home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=",
+		"API_KEY="+apiKey, "EZTRACKER_USER_ID="+serverKeyUser, "EZTRACKER_SERVER_URL="+srv.URL)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("eztracker rpc: %v", err)
+	}
+	want := `{"jsonrpc":"2.0","id":1,"result":{"hints":{"keystroke_timeout":900,"heartbeat_interval":120,"batch_size":10},"protocol_version":1,"version":"0.0.1"}}`
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("initialize returned\n%s\nwant\n%s", got, want)
+	}
+
+	c := client.New(srv.URL, apiKey)
+	if _, err := c.RegisterPlugin(client.Plugin{UserID: "krisrp", Name: "vscode-eztracker",
+		Version: "1.3.0", Machine: mustHostname(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RegisterPlugin(client.Plugin{UserID: "krisrp", Name: "vscode-eztracker"}); err == nil {
+		t.Error("registering without a machine succeeded")
+	}
+
+	var version string
+	if err := srv.DB.QueryRow("SELECT version FROM plugins").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM plugins"); n != 1 || version != "1.3.0" {
+		t.Errorf("%d plugins registered at version %s, want 1 at 1.3.0", n, version)
+	}
+}
+
+func mustHostname(t *testing.T) string {
+	t.Helper()
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+func TestOfflineQueueAndStats(t *testing.T) {
+	srv := startServer(t)
+	offline := *srv
+	offline.URL = "http://127.0.0.1:1"
+
+	if out, code := offline.cli(t, apiKey, "--entity", "/src/eztracker/main.go", "--language", "Go",
+		"--duration", "600"); code != 102 {
+		t.Fatalf("offline heartbeat exited with %d, want 102:\n%s", code, out)
+	}
+	out, code := offline.cli(t, apiKey, "offline-stats")
+	if code != 0 || !strings.Contains(out, "Today: 10 min") ||
+		!strings.Contains(out, "1 heartbeats waiting to be sent") {
+		t.Errorf("offline-stats while offline exited with %d:\n%s", code, out)
+	}
+
+	// The next heartbeat sends the queued one first
+	srv.mustCLI(t, "--entity", "/src/eztracker/cli.go", "--language", "Go", "--duration", "600")
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 2 {
+		t.Errorf("stored %d heartbeats, want 2", n)
+	}
+
+	out = srv.mustCLI(t, "offline-stats")
+	if !strings.Contains(out, "Today: 20 min") || !strings.Contains(out, "eztracker") ||
+		!strings.Contains(out, "languages: Go 20 min") || strings.Contains(out, "waiting") {
+		t.Errorf("offline-stats after syncing:\n%s", out)
+	}
+}
+
+func TestCLIMergesHeartbeats(t *testing.T) {
+	srv := startServer(t)
+
+	const start = 1700000000
+	extra, err := json.Marshal([]map[string]interface{}{
+		{"entity": "/src/eztracker/main.go", "language": "Go", "timestamp": start + 30, "duration": 30},
+		// Overlaps the previous one by 15 seconds
+		{"entity": "/src/eztracker/main.go", "language": "Go", "timestamp": start + 45, "duration": 30},
+		// An exact duplicate
+		{"entity": "/src/eztracker/main.go", "language": "Go", "timestamp": start + 45, "duration": 30},
+		{"entity": "/src/eztracker/cli.go", "language": "Go", "timestamp": start + 10, "duration": 20},
+		// Past the keystroke timeout
+		{"entity": "/src/eztracker/main.go", "language": "Go", "timestamp": start + 3600, "duration": 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go",
+		"--duration", "30", "--time", fmt.Sprint(start), "--extra-heartbeats", string(extra))
+
+	rows, err := srv.DB.Query("SELECT file_path, timestamp, duration FROM heartbeats ORDER BY timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var entity string
+		var ts int64
+		var duration float64
+		if err := rows.Scan(&entity, &ts, &duration); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s@%d=%v", filepath.Base(entity), ts-start, duration))
+	}
+	if want := "main.go@0=75, cli.go@10=20, main.go@3600=30"; strings.Join(got, ", ") != want {
+		t.Errorf("stored %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+func TestXDGDirectories(t *testing.T) {
+	srv := startServer(t)
+	legacyConfig := filepath.Join(srv.home, ".eztracker.cfg")
+	xdgConfig := filepath.Join(srv.home, ".config", "eztracker", "eztracker.cfg")
+
+	// Configs from before keep working until migrated
+	if err := os.WriteFile(legacyConfig, []byte("[project:eztracker]\ntags = legacy\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(srv.home, ".eztracker"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700000000")
+	if _, err := os.Stat(filepath.Join(srv.home, ".eztracker", "history.jsonl")); err != nil {
+		t.Errorf("history not kept in the legacy state directory: %v", err)
+	}
+
+	out := srv.mustCLI(t, "migrate")
+	if !strings.Contains(out, xdgConfig) {
+		t.Errorf("migrate output:\n%s", out)
+	}
+	if _, err := os.Stat(legacyConfig); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after migrating", legacyConfig)
+	}
+	if _, err := os.Stat(filepath.Join(srv.home, ".local", "state", "eztracker", "history.jsonl")); err != nil {
+		t.Errorf("history not migrated: %v", err)
+	}
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700003600")
+	if n := srv.queryInt(t, `SELECT COUNT(*) FROM heartbeat_tags JOIN tags ON tags.id = tag_id
+		WHERE tags.name = 'legacy'`); n != 2 {
+		t.Errorf("%d heartbeats tagged from the config, want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(srv.home, ".eztracker")); !os.IsNotExist(err) {
+		t.Error("state directory recreated in the home directory after migrating")
+	}
+}
+
+func TestKeychainAPIKey(t *testing.T) {
+	srv := startServer(t)
+
+	// A stand-in for secret-tool keeping the secret in a file next to it
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$1\" in\nlookup) cat \"$(dirname \"$0\")/secret\" 2>/dev/null ;;\nstore) cat > \"$(dirname \"$0\")/secret\" ;;\nesac\n"
+	if err := os.WriteFile(filepath.Join(bin, "secret-tool"), []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	cfg := "[settings]\napi_key = stale-key\napi_key_source = keychain\n"
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(input string, args ...string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(cliBin, args...)
+		cmd.Stdin = strings.NewReader(input)
+		cmd.Env = append(os.Environ(), "HOME="+srv.home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=",
+			"API_KEY=", "EZTRACKER_USER_ID="+serverKeyUser, "EZTRACKER_SERVER_URL="+srv.URL, "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), 0
+	}
+
+	if out, code := run(apiKey+"\n", "keychain", "set"); code != 0 {
+		t.Fatalf("keychain set exited with %d:\n%s", code, out)
+	}
+	if out, code := run("", "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700000000"); code != 0 {
+		t.Errorf("heartbeat with the key from the keychain exited with %d:\n%s", code, out)
+	}
+
+	// An empty keychain falls back to the stale key in the file
+	if err := os.Remove(filepath.Join(bin, "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := run("", "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700003600"); code != 104 {
+		t.Errorf("heartbeat with the key from the file exited with %d, want 104:\n%s", code, out)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1 {
+		t.Errorf("stored %d heartbeats, want 1", n)
+	}
+}
+
+func TestCLIProxy(t *testing.T) {
+	srv := startServer(t)
+
+	// A forward proxy that wants credentials
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("me:secret")) {
+			w.Header().Set("Proxy-Authenticate", "Basic")
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+	takeProxied := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := proxied
+		proxied = nil
+		return taken
+	}
+
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://me:secret@", 1)
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte("[settings]\nproxy = "+proxyURL+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700000000")
+	if got := takeProxied(); !slices.Contains(got, "POST /heartbeat") {
+		t.Errorf("proxied %v, want the heartbeat", got)
+	}
+
+	// Hosts in NO_PROXY are reached directly
+	cmd := exec.Command(cliBin, "--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700003600")
+	cmd.Env = append(os.Environ(), "HOME="+srv.home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=",
+		"API_KEY="+apiKey, "EZTRACKER_USER_ID="+serverKeyUser, "EZTRACKER_SERVER_URL="+srv.URL, "NO_PROXY=127.0.0.1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("eztracker: %v\n%s", err, out)
+	}
+	if got := takeProxied(); len(got) != 0 {
+		t.Errorf("proxied %v despite NO_PROXY", got)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 2 {
+		t.Errorf("stored %d heartbeats, want 2", n)
+	}
+}
+
+// writeCert issues a certificate from tmpl, signed by parent or self-signed
+// when parent is nil, and writes it and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, name string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		name + ".pem":     {Type: "CERTIFICATE", Bytes: der},
+		name + "-key.pem": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "eztracker test CA"},
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "laptop"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	srv := startServer(t,
+		"TLS_CERT_FILE="+filepath.Join(dir, "server.pem"),
+		"TLS_KEY_FILE="+filepath.Join(dir, "server-key.pem"),
+		"TLS_CLIENT_CA_FILE="+filepath.Join(dir, "ca.pem"),
+	)
+	srv.URL = strings.Replace(srv.URL, "http://", "https://", 1)
+	cfg := filepath.Join(srv.home, ".eztracker.cfg")
+	heartbeat := []string{"--entity", "/src/eztracker/main.go", "--duration", "30", "--time", "1700000000"}
+
+	// The server's certificate is only trusted with the CA bundle
+	if out, code := srv.cli(t, apiKey, heartbeat...); code != 102 {
+		t.Errorf("without ca_file: exit %d, want 102:\n%s", code, out)
+	}
+
+	// The server wants a client certificate
+	settings := "[settings]\nca_file = " + filepath.Join(dir, "ca.pem") + "\n"
+	if err := os.WriteFile(cfg, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := srv.cli(t, apiKey, heartbeat...); code != 102 {
+		t.Errorf("without client certificate: exit %d, want 102:\n%s", code, out)
+	}
+
+	settings += "client_cert = " + filepath.Join(dir, "client.pem") + "\n" +
+		"client_key = " + filepath.Join(dir, "client-key.pem") + "\n"
+	if err := os.WriteFile(cfg, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, heartbeat...)
+	// with the two queued by the failed attempts
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 3 {
+		t.Errorf("stored %d heartbeats, want 3", n)
+	}
+
+	// A certificate without its key is a config error
+	settings = "[settings]\nclient_cert = " + filepath.Join(dir, "client.pem") + "\n"
+	if err := os.WriteFile(cfg, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := srv.cli(t, apiKey, heartbeat...); code != 103 {
+		t.Errorf("client_cert without client_key: exit %d, want 103:\n%s", code, out)
+	}
+}
+
+func TestStatusline(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+	send := func(duration float64) {
+		t.Helper()
+		if err := c.SendHeartbeats([]client.Heartbeat{{UserID: "krisrp", Project: "eztracker", Language: "Go",
+			Entity: "/src/eztracker/main.go", Duration: duration, Timestamp: time.Now().Unix()}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(120)
+	if out := srv.mustCLI(t, "statusline"); out != "2m • eztracker • Go\n" {
+		t.Errorf("statusline = %q", out)
+	}
+	// The answer is cached for a minute
+	send(3600)
+	if out := srv.mustCLI(t, "statusline"); out != "2m • eztracker • Go\n" {
+		t.Errorf("cached statusline = %q", out)
+	}
+	if out := srv.mustCLI(t, "statusline", "--max-age", "0s", "--separator", " | "); out != "1h02m | eztracker | Go\n" {
+		t.Errorf("refreshed statusline = %q", out)
+	}
+	srv.mustCLI(t, "pause")
+	if out := srv.mustCLI(t, "statusline"); out != "1h02m • paused\n" {
+		t.Errorf("paused statusline = %q", out)
+	}
+}
+
+func TestTray(t *testing.T) {
+	srv := startServer(t)
+	if err := client.New(srv.URL, apiKey).SendHeartbeats([]client.Heartbeat{{UserID: "krisrp", Project: "eztracker",
+		Language: "Go", Entity: "/src/eztracker/main.go", Duration: 1500, Timestamp: time.Now().Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := srv.mustCLI(t, "tray")
+	lines := strings.Split(out, "\n")
+	if lines[0] != "⏱ 25m" || !strings.Contains(out, "Working on eztracker in Go\n") ||
+		!strings.Contains(out, "Pause for 30 minutes | bash=") || !strings.Contains(out, "param1=pause param2=30m") {
+		t.Errorf("tray:\n%s", out)
+	}
+	srv.mustCLI(t, "pause")
+	out = srv.mustCLI(t, "tray")
+	if !strings.HasPrefix(out, "⏸ 25m\n") || !strings.Contains(out, "Paused until resumed") ||
+		!strings.Contains(out, "Resume tracking | bash=") || strings.Contains(out, "Pause for") {
+		t.Errorf("paused tray:\n%s", out)
+	}
+}
+
+func TestDesktop(t *testing.T) {
+	srv := startServer(t)
+	// A stand-in xdotool reporting the window written to its directory
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$2\" in\ngetwindowclassname) cat " + bin + "/app ;;\ngetwindowname) cat " + bin + "/title ;;\nesac\n"
+	if err := os.WriteFile(filepath.Join(bin, "xdotool"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	focus := func(app, title string) {
+		t.Helper()
+		for name, content := range map[string]string{"app": app, "title": title} {
+			if err := os.WriteFile(filepath.Join(bin, name), []byte(content+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cfg := "[settings]\ndesktop_deny = keepassxc, *private browsing*\n\n[app:zoom]\ncategory = meeting\nproject = standups\n"
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	focus("Zoom", "Daily standup")
+	srv.mustCLI(t, "desktop", "--once", "--interval", "30s")
+	focus("firefox", "Go docs — Mozilla Firefox")
+	srv.mustCLI(t, "desktop", "--once", "--interval", "30s")
+	focus("KeePassXC", "Passwords.kdbx")
+	srv.mustCLI(t, "desktop", "--once")
+	focus("firefox", "Gifts — Mozilla Firefox Private Browsing")
+	srv.mustCLI(t, "desktop", "--once")
+
+	var apps []string
+	rows, err := srv.DB.Query(`SELECT h.file_path || ' ' || p.name || ' ' || h.category || ' ' || CAST(h.duration AS INTEGER)
+		FROM heartbeats h JOIN projects p ON p.id = h.project_id WHERE h.entity_type = 'app' ORDER BY h.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var app string
+		if err := rows.Scan(&app); err != nil {
+			t.Fatal(err)
+		}
+		apps = append(apps, app)
+	}
+	if want := []string{"Zoom standups meeting 30", "firefox desktop desktop 30"}; !reflect.DeepEqual(apps, want) {
+		t.Errorf("recorded %q, want %q", apps, want)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE file_path LIKE '%Mozilla%'"); n != 0 {
+		t.Errorf("%d heartbeats with window titles, want none", n)
+	}
+
+	// Only the allowed apps are recorded once there are any
+	cfg = "[settings]\ndesktop_allow = code, zoom\n"
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	focus("Slack", "general")
+	srv.mustCLI(t, "desktop", "--once")
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE file_path = 'Slack'"); n != 0 {
+		t.Errorf("%d Slack heartbeats, want none outside desktop_allow", n)
+	}
+}
+
+func TestMachine(t *testing.T) {
+	srv := startServer(t)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC).Unix()
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "600", "--time", fmt.Sprint(day))
+	// As in a dev container naming itself in containerEnv
+	t.Setenv("EZTRACKER_MACHINE", "eztracker-devcontainer")
+	srv.mustCLI(t, "--entity", "/src/eztracker/api.go", "--duration", "300", "--time", fmt.Sprint(day+600))
+
+	var agg client.Aggregate
+	srv.getJSON(t, "/api/v1/aggregate?user_id=krisrp&group_by=machine&from=2024-03-04&to=2024-03-04", &agg)
+	var got []string
+	for _, g := range agg.Groups {
+		got = append(got, fmt.Sprintf("%v %v", g["machine"], g["duration"]))
+	}
+	if want := host + " 600, eztracker-devcontainer 300"; strings.Join(got, ", ") != want {
+		t.Errorf("groups %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,5 @@
+// Package e2e holds end-to-end tests that build the eztracker server and CLI,
+// run the server against a temporary SQLite database and drive it through
+// the CLI the way editor plugins do. The harness starting the server is in
+// e2e_test.go and the tests are in a file per feature.
+package e2e
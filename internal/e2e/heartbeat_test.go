@@ -0,0 +1,752 @@
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+	"github.com/kru/eztracker/pkg/tracker"
+)
+
+func TestHeartbeatIngestion(t *testing.T) {
+	srv := startServer(t)
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go",
+		"--duration", "30", "--time", "1700000000")
+	srv.mustCLI(t, "--entity", "/src/eztracker/cli.go", "--language", "Go",
+		"--duration", "45", "--time", "1700000100")
+	srv.mustCLI(t, "--entity", "/src/other/app.py", "--language", "Python",
+		"--duration", "20", "--time", "1700000200")
+
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 3 {
+		t.Errorf("stored %d heartbeats, want 3", n)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM projects"); n != 2 {
+		t.Errorf("created %d projects, want 2", n)
+	}
+	// Outside of a checkout the root is the file's directory
+	if n := srv.queryInt(t,
+		"SELECT COUNT(*) FROM projects WHERE name = ? AND root = ?",
+		"eztracker", "/src/eztracker"); n != 1 {
+		t.Errorf("project eztracker was not created with its root")
+	}
+	if n := srv.queryInt(t, `SELECT COUNT(*) FROM heartbeats
+		WHERE entity_type = 'file' AND category = 'coding'`); n != 3 {
+		t.Errorf("%d heartbeats stored as coding on a file, want 3", n)
+	}
+}
+
+func TestHeartbeatWithoutDurationIsSkipped(t *testing.T) {
+	srv := startServer(t)
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--time", "1700000000")
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 0 {
+		t.Errorf("stored %d heartbeats, want 0", n)
+	}
+}
+
+func TestBufferedIngestion(t *testing.T) {
+	srv := startServer(t, "WRITE_BUFFER_SIZE=2", "WRITE_BUFFER_INTERVAL=1h")
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30")
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 0 {
+		t.Fatalf("stored %d heartbeats before the buffer filled, want 0", n)
+	}
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "30")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("buffer was not flushed once full")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestProjectKeystrokeTimeout(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	// Reading-heavy docs merge across a 20 minute gap, code does not
+	cfg := "[project:docs]\nkeystroke_timeout = 30m\n"
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const start = 1700000000
+	extra, err := json.Marshal([]map[string]interface{}{
+		{"entity": "/src/docs/guide.md", "timestamp": start + 1230, "duration": 30},
+		{"entity": "/src/eztracker/main.go", "timestamp": start, "duration": 30},
+		{"entity": "/src/eztracker/main.go", "timestamp": start + 1230, "duration": 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, "--entity", "/src/docs/guide.md", "--duration", "30",
+		"--time", fmt.Sprint(start), "--extra-heartbeats", string(extra))
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE file_path LIKE '%guide.md'"); n != 1 {
+		t.Errorf("%d docs heartbeats stored, want 1", n)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE file_path LIKE '%main.go'"); n != 2 {
+		t.Errorf("%d code heartbeats stored, want 2", n)
+	}
+
+	projects, err := c.Projects("krisrp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 2 || projects[0].Name != "docs" || projects[0].KeystrokeTimeout != 0 {
+		t.Fatalf("projects %+v, want docs and eztracker with the default timeout", projects)
+	}
+
+	if projects[0].Root != "/src/docs" {
+		t.Errorf("docs root %q, want /src/docs", projects[0].Root)
+	}
+
+	updated, err := c.UpdateProject(client.Project{UserID: "krisrp", Name: "docs", Root: "/elsewhere",
+		KeystrokeTimeout: 1800, Color: "#4a7fb5", Description: "User guide", Billable: true, HourlyRate: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := client.Project{ID: projects[0].ID, UserID: "krisrp", Name: "docs", Root: "/src/docs",
+		KeystrokeTimeout: 1800, Color: "#4a7fb5", Description: "User guide", Billable: true, HourlyRate: 90}
+	if updated != want {
+		t.Errorf("updated project %+v, want %+v", updated, want)
+	}
+	var stored client.Project
+	if err := c.Do("GET", "/api/v1/projects/docs?user_id=krisrp", nil, &stored); err != nil || stored != updated {
+		t.Errorf("stored project %+v, %v; want %+v", stored, err, updated)
+	}
+
+	day := time.Unix(start, 0).UTC()
+	stats, err := c.Stats("krisrp", day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Projects) != 2 {
+		t.Fatalf("project buckets %+v, want docs and eztracker", stats.Projects)
+	}
+	for _, b := range stats.Projects {
+		if b.Name == "docs" && (b.Color != "#4a7fb5" || b.Description != "User guide") ||
+			b.Name == "eztracker" && (b.Color != "" || b.Description != "") {
+			t.Errorf("project bucket %+v", b)
+		}
+	}
+
+	// Archived projects keep their time but leave stats and the project list
+	archived, err := c.ArchiveProject("krisrp", "docs", true)
+	if err != nil || !archived.Archived {
+		t.Fatalf("archived project %+v, %v", archived, err)
+	}
+	if projects, err := c.Projects("krisrp"); err != nil || len(projects) != 1 || projects[0].Name != "eztracker" {
+		t.Errorf("projects after archiving %+v, %v; want eztracker", projects, err)
+	}
+	if stats, err := c.Stats("krisrp", day, day); err != nil || len(stats.Projects) != 1 || stats.Projects[0].Name != "eztracker" {
+		t.Errorf("stats after archiving %+v, %v; want eztracker only", stats.Projects, err)
+	}
+	var all client.Stats
+	path := "/api/v1/stats?user_id=krisrp&include_archived=true&from=" + day.Format("2006-01-02") + "&to=" + day.Format("2006-01-02")
+	if err := c.Do("GET", path, nil, &all); err != nil || len(all.Projects) != 2 {
+		t.Errorf("stats with archived projects %+v, %v; want both", all.Projects, err)
+	}
+	if unarchived, err := c.ArchiveProject("krisrp", "docs", false); err != nil || unarchived.Archived {
+		t.Errorf("unarchived project %+v, %v", unarchived, err)
+	}
+	if projects, err := c.Projects("krisrp"); err != nil || len(projects) != 2 {
+		t.Errorf("projects after unarchiving %+v, %v; want both", projects, err)
+	}
+
+	// Workspaces roll up the time of their projects
+	for _, p := range []client.Project{updated, projects[1]} {
+		p.Workspace = "Client"
+		if _, err := c.UpdateProject(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspaces, err := c.Workspaces("krisrp")
+	wantWorkspaces := []client.Workspace{{Name: "Client", Projects: []string{"docs", "eztracker"}}}
+	if err != nil || !reflect.DeepEqual(workspaces, wantWorkspaces) {
+		t.Errorf("workspaces %+v, %v; want %+v", workspaces, err, wantWorkspaces)
+	}
+	if stats, err := c.Stats("krisrp", day, day); err != nil || len(stats.Workspaces) != 1 ||
+		stats.Workspaces[0].Name != "Client" || stats.Workspaces[0].Duration != stats.Total {
+		t.Errorf("workspace stats %+v, %v; want all time in Client", stats, err)
+	}
+
+	var clientErr *client.Error
+	_, err = c.UpdateProject(client.Project{UserID: "krisrp", Name: "docs", KeystrokeTimeout: -1})
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative timeout: %v, want 400", err)
+	}
+	_, err = c.UpdateProject(client.Project{UserID: "krisrp", Name: "docs", Color: "blue"})
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad color: %v, want 400", err)
+	}
+	_, err = c.UpdateProject(client.Project{UserID: "krisrp", Name: "docs", Description: strings.Repeat("x", 501)})
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("long description: %v, want 400", err)
+	}
+	_, err = c.UpdateProject(client.Project{UserID: "krisrp", Name: "nope", KeystrokeTimeout: 60})
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown project: %v, want 404", err)
+	}
+	_, err = c.ArchiveProject("krisrp", "nope", true)
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("archiving unknown project: %v, want 404", err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	srv := startServer(t)
+
+	post := func(requestID string) (*http.Response, map[string]string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL+"/heartbeat", strings.NewReader("{"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("error body is not JSON: %v", err)
+		}
+		return resp, body
+	}
+
+	// The ID of a reverse proxy is kept
+	resp, body := post("proxy-42")
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s with %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if body["error"] == "" || body["request_id"] != "proxy-42" || resp.Header.Get("X-Request-ID") != "proxy-42" {
+		t.Errorf("got %v, X-Request-ID %q", body, resp.Header.Get("X-Request-ID"))
+	}
+
+	// and one is made up otherwise, or when the client's can't be logged
+	for _, id := range []string{"", "has spaces in it"} {
+		resp, body = post(id)
+		if body["request_id"] == "" || body["request_id"] == id || body["request_id"] != resp.Header.Get("X-Request-ID") {
+			t.Errorf("sent %q, got %v, X-Request-ID %q", id, body, resp.Header.Get("X-Request-ID"))
+		}
+	}
+
+	// The client reports it
+	err := client.New(srv.URL, "wrong-key").SendHeartbeats([]client.Heartbeat{{UserID: "me", Timestamp: 1700000000}})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Message != "Unauthorized" || apiErr.RequestID == "" ||
+		!strings.Contains(err.Error(), apiErr.RequestID) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestHeartbeatHorizon(t *testing.T) {
+	srv := startServer(t, "HEARTBEAT_HORIZON=336h", "MAX_CLOCK_SKEW=1h")
+	c := client.New(srv.URL, apiKey)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"recent", now.Add(-time.Hour), true},
+		{"within the horizon", now.AddDate(0, 0, -13), true},
+		{"past the horizon", now.AddDate(0, 0, -15), false},
+		{"slightly ahead", now.Add(30 * time.Minute), true},
+		{"far ahead", now.Add(2 * time.Hour), false},
+	} {
+		err := c.SendHeartbeats([]client.Heartbeat{{UserID: "me", Project: "eztracker", Duration: 30, Timestamp: tc.at.Unix()}})
+		var apiErr *client.Error
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case !tc.ok && (!errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest):
+			t.Errorf("%s: got %v, want 400", tc.name, err)
+		}
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 3 {
+		t.Errorf("stored %d heartbeats, want 3", n)
+	}
+
+	// Older time is still logged by hand
+	if _, err := c.LogTime(client.ManualEntry{UserID: "me", Project: "eztracker", Duration: 3600,
+		Timestamp: now.AddDate(0, -2, 0).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTripFunc lets tests see and fake the requests of a client.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestHeartbeatBatches(t *testing.T) {
+	srv := startServer(t)
+
+	var requests []string
+	oldServer := false
+	c := client.New(srv.URL, apiKey)
+	c.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, strings.TrimSpace(r.URL.Path+" "+r.Header.Get("Content-Encoding")))
+		if oldServer && r.URL.Path == "/heartbeats" {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("404 page not found")),
+				Request: r}, nil
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	// An offline queue of 150 heartbeats, one of which the server rejects
+	var dropped []string
+	queue := &tracker.Queue{Dir: t.TempDir(), OnDrop: func(hb client.Heartbeat, err error) {
+		dropped = append(dropped, hb.Entity)
+	}}
+	start := time.Now().Add(-time.Hour).Unix()
+	var queued []client.Heartbeat
+	for i := int64(0); i < 150; i++ {
+		queued = append(queued, client.Heartbeat{UserID: "remote", Project: "eztracker", Language: "Go",
+			Entity: fmt.Sprintf("/src/eztracker/file%d.go", i), Duration: 10, Timestamp: start + 10*i})
+	}
+	queued[42].EntityType = "window"
+	if err := queue.Enqueue(queued...); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Flush(c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/heartbeats gzip", "/heartbeats gzip"}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests %q, want %q", requests, want)
+	}
+	if want := []string{"/src/eztracker/file42.go"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped %q, want %q", dropped, want)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 149 {
+		t.Errorf("stored %d heartbeats, want 149", n)
+	}
+
+	// Servers without batches get the queue one heartbeat at a time
+	requests, oldServer = nil, true
+	if err := queue.Enqueue(queued[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Flush(c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/heartbeats", "/heartbeat", "/heartbeat"}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests to an old server %q, want %q", requests, want)
+	}
+
+	for encoding, status := range map[string]int{"br": http.StatusUnsupportedMediaType, "gzip": http.StatusBadRequest} {
+		req, err := http.NewRequest("POST", srv.URL+"/heartbeats", strings.NewReader("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s body that isn't: %s, want %d", encoding, resp.Status, status)
+		}
+	}
+}
+
+func TestHeartbeatSampling(t *testing.T) {
+	srv := startServer(t, "HEARTBEAT_SAMPLE_INTERVAL=60s")
+	c := client.New(srv.URL, apiKey)
+
+	// A heartbeat every 10s on one file, and one on another file
+	start := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC).Unix()
+	var heartbeats []client.Heartbeat
+	for i := int64(0); i < 9; i++ {
+		heartbeats = append(heartbeats, client.Heartbeat{UserID: "chatty", Project: "eztracker", Language: "Go",
+			Entity: "/src/eztracker/main.go", Duration: 10, Timestamp: start + 10*i})
+	}
+	heartbeats[4].Tags = []string{"review"}
+	heartbeats = append(heartbeats, client.Heartbeat{UserID: "chatty", Project: "eztracker", Language: "Go",
+		Entity: "/src/eztracker/api.go", Duration: 10, Timestamp: start + 5})
+	// Sent in two requests, so sampling spans them
+	if err := c.SendHeartbeats(heartbeats[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendHeartbeats(heartbeats[3:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 3 {
+		t.Errorf("stored %d heartbeats, want one per file and minute", n)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeat_tags"); n != 1 {
+		t.Errorf("%d tagged heartbeats, want the tag kept", n)
+	}
+	day := time.Unix(start, 0).UTC()
+	stats, err := c.Stats("chatty", day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 100 {
+		t.Errorf("total %v, want every heartbeat's 10s", stats.Total)
+	}
+	if n := srv.queryInt(t, "SELECT SUM(duration) FROM heartbeats"); n != 100 {
+		t.Errorf("stored heartbeats last %ds, want 100", n)
+	}
+}
+
+func TestLanguageDetection(t *testing.T) {
+	srv := startServer(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "release")
+	if err := os.WriteFile(script, []byte("#!/usr/bin/env python3\nprint('released')\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.mustCLI(t, "--entity", script, "--duration", "30")
+	srv.mustCLI(t, "--entity", filepath.Join(dir, "Dockerfile"), "--duration", "30")
+	// What the editor says wins
+	srv.mustCLI(t, "--entity", script, "--language", "Starlark", "--duration", "30", "--time", "1700000000")
+
+	var languages []string
+	rows, err := srv.DB.Query("SELECT language FROM heartbeats ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var language string
+		if err := rows.Scan(&language); err != nil {
+			t.Fatal(err)
+		}
+		languages = append(languages, language)
+	}
+	if want := []string{"Python", "Dockerfile", "Starlark"}; !reflect.DeepEqual(languages, want) {
+		t.Errorf("languages %q, want %q", languages, want)
+	}
+}
+
+func TestEntityTypes(t *testing.T) {
+	srv := startServer(t)
+	srv.mustCLI(t, "--entity", "Slack", "--entity-type", "app", "--project", "meetings", "--duration", "600")
+	srv.mustCLI(t, "--entity", "github.com", "--entity-type", "domain", "--category", "code reviewing", "--duration", "300")
+
+	var got []string
+	rows, err := srv.DB.Query(`
+		SELECT h.file_path, h.entity_type, p.name FROM heartbeats h
+		JOIN projects p ON p.id = h.project_id ORDER BY h.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entity, entityType, project string
+		if err := rows.Scan(&entity, &entityType, &project); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Join([]string{entity, entityType, project}, " "))
+	}
+	if want := []string{"Slack app meetings", "github.com domain unknown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("heartbeats %q, want %q", got, want)
+	}
+
+	if out, code := srv.cli(t, apiKey, "--entity", "Slack", "--entity-type", "window"); code != 105 || !strings.Contains(out, "invalid entity type") {
+		t.Errorf("unknown entity type: exit %d, %s", code, out)
+	}
+}
+
+func TestDeleteHeartbeats(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+	_, key := srv.newKey(t, "alice", "")
+	alice := client.New(srv.URL, key)
+
+	// A plugin tracked node_modules all day on the 4th
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	var heartbeats []client.Heartbeat
+	for i := 0; i < 10; i++ {
+		heartbeats = append(heartbeats, client.Heartbeat{UserID: "alice", Project: "node_modules", Language: "JavaScript",
+			Entity: "/src/app/node_modules/x/index.js", Duration: 7200, Timestamp: day.Unix() + int64(i)*7200})
+	}
+	heartbeats = append(heartbeats,
+		client.Heartbeat{UserID: "alice", Project: "app", Language: "Go", Entity: "/src/app/main.go",
+			Duration: 600, Timestamp: day.Unix() + 3600},
+		client.Heartbeat{UserID: "alice", Project: "node_modules", Language: "JavaScript",
+			Entity: "/src/app/node_modules/x/index.js", Duration: 60, Timestamp: day.AddDate(0, 0, 1).Unix()})
+	if err := admin.SendHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.LogTime(client.ManualEntry{UserID: "alice", Project: "node_modules", Duration: 900, Timestamp: day.Unix() + 600}); err != nil {
+		t.Fatal(err)
+	}
+
+	dry, err := alice.DeleteHeartbeats("alice", "node_modules", day, day, true)
+	if err != nil || dry != (client.HeartbeatDeletion{Deleted: 10, DryRun: true}) {
+		t.Fatalf("dry run = %+v, %v", dry, err)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 13 {
+		t.Errorf("%d heartbeats after a dry run, want 13", n)
+	}
+
+	var clientErr *client.Error
+	if _, err := alice.DeleteHeartbeats("bob", "", day, day, false); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+		t.Errorf("deleting another user's heartbeats: %v, want 403", err)
+	}
+	if err := alice.Do("DELETE", "/api/v1/heartbeats?project=node_modules", nil, nil); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("deleting without a range: %v, want 400", err)
+	}
+
+	deleted, err := alice.DeleteHeartbeats("alice", "node_modules", day, day, false)
+	if err != nil || deleted.Deleted != 10 {
+		t.Fatalf("delete = %+v, %v", deleted, err)
+	}
+	// The manual entry, other projects and the next day stay, and the totals follow
+	stats, err := alice.Stats("alice", day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 600+900+60 {
+		t.Errorf("total after deleting = %v, want %v", stats.Total, 600+900+60)
+	}
+	if deleted, err := admin.DeleteHeartbeats("alice", "", day, day, true); err != nil || deleted.Deleted != 1 {
+		t.Errorf("heartbeats left on the day = %+v, %v, want 1", deleted, err)
+	}
+}
+
+func TestReclassifyHeartbeats(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	// The checkout moved from ~/old-path, and its old time went to "old-path"
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	if err := admin.SendHeartbeats([]client.Heartbeat{
+		{UserID: "alice", Project: "old-path", Language: "Go", Entity: "/home/alice/old-path/main.go", Duration: 600, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "old-path", Language: "", Entity: "/home/alice/old-path/Jenkinsfile", Duration: 300, Timestamp: day.AddDate(0, 0, 1).Unix()},
+		{UserID: "alice", Project: "old-path", Language: "Go", Entity: "/home/alice/old-path-2/main.go", Duration: 60, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "projectx", Language: "Go", Entity: "/home/alice/projectx/main.go", Duration: 120, Timestamp: day.Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	edit, err := admin.ReclassifyHeartbeats("alice", "", "/home/alice/old-path/", client.Reclassification{Project: "projectx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edit.Heartbeats != 2 || edit.EditedBy != "API_KEY" || edit.Project != "projectx" {
+		t.Errorf("edit = %+v", edit)
+	}
+	stats, err := admin.Stats("alice", day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range stats.Projects {
+		got = append(got, fmt.Sprintf("%s %v", b.Name, b.Duration))
+	}
+	if want := "projectx 1020, old-path 60"; strings.Join(got, ", ") != want {
+		t.Errorf("projects %s, want %s", strings.Join(got, ", "), want)
+	}
+
+	// Only on a day, and only the language
+	query := url.Values{"user_id": {"alice"}, "from": {"2024-03-05"}, "to": {"2024-03-05"}, "project": {"projectx"}}
+	if err := admin.Do("PATCH", "/api/v1/heartbeats?"+query.Encode(), client.Reclassification{Language: "Groovy"}, &edit); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE language = 'Groovy' AND file_path LIKE '%Jenkinsfile'"); n != 1 || edit.Heartbeats != 1 {
+		t.Errorf("%d heartbeats in Groovy, edit %+v", n, edit)
+	}
+
+	var clientErr *client.Error
+	if err := admin.Do("PATCH", "/api/v1/heartbeats?user_id=alice", client.Reclassification{Project: "x"}, nil); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("editing every heartbeat: %v, want 400", err)
+	}
+
+	edits, err := admin.HeartbeatEdits("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 2 || edits[0].Language != "Groovy" || edits[0].From != "2024-03-05" || edits[1].PathPrefix != "/home/alice/old-path/" {
+		t.Errorf("edits = %+v", edits)
+	}
+}
+
+func TestHeartbeatStream(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	stream, err := admin.StreamHeartbeats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	now := time.Now().Unix()
+	for _, hb := range []client.Heartbeat{
+		{UserID: "alice", Project: "api", Entity: "/src/api/main.go", Duration: 60, Timestamp: now},
+		{UserID: "alice", Project: "api", Entity: "/src/api/main.go", EntityType: "spreadsheet", Duration: 60, Timestamp: now},
+	} {
+		if err := stream.Send(hb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Acked while the stream is still open
+	ack, err := stream.Ack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Received != 2 || ack.Accepted != 1 || len(ack.Rejected) != 1 || ack.Rejected[0].Index != 1 {
+		t.Errorf("ack = %+v, want 1 accepted and line 1 rejected", ack)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1 {
+		t.Errorf("stored %d heartbeats before the stream closed, want 1", n)
+	}
+
+	if err := stream.Send(client.Heartbeat{UserID: "alice", Project: "api", Entity: "/src/api/cli.go", Duration: 60, Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var acks []client.StreamAck
+	for {
+		ack, err := stream.Ack()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}
+	if len(acks) != 1 || acks[0].Received != 3 || acks[0].Accepted != 1 || acks[0].Error != "" {
+		t.Errorf("acks after closing = %+v, want the last heartbeat accepted", acks)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 2 {
+		t.Errorf("stored %d heartbeats, want 2", n)
+	}
+
+	// Maintenance ends streams, asking for the unacked lines again later
+	stream, err = admin.StreamHeartbeats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := admin.SetMaintenance(client.Maintenance{Enabled: true, RetryAfter: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(client.Heartbeat{UserID: "alice", Project: "api", Entity: "/src/api/db.go", Duration: 60, Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := stream.Ack(); err != nil || ack.Error == "" || ack.Received != 0 || ack.RetryAfter != 60 {
+		t.Errorf("ack during maintenance = %+v, %v", ack, err)
+	}
+	if _, err := admin.StreamHeartbeats(); !client.Retryable(err) {
+		t.Errorf("opening a stream during maintenance: %v, want 503", err)
+	}
+}
+
+func TestPathEncryption(t *testing.T) {
+	srv := startServer(t)
+
+	key := strings.Fields(srv.mustCLI(t, "path-key", "new"))[0]
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte("[settings]\npath_key = "+key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv.mustCLI(t, "--entity", "/src/secret-client/billing.go", "--language", "Go", "--duration", "60")
+	srv.mustCLI(t, "--entity", "/src/secret-client/billing.go", "--language", "Go", "--duration", "60", "--time", "1700000000")
+
+	var entity, root, project, language string
+	if err := srv.DB.QueryRow(`SELECT h.file_path, p.root, p.name, h.language
+		FROM heartbeats h JOIN projects p ON p.id = h.project_id LIMIT 1`).Scan(&entity, &root, &project, &language); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(entity, "enc:v1:") || !strings.HasPrefix(root, "enc:v1:") || strings.Contains(entity, "billing") {
+		t.Errorf("stored entity %q and project root %q, want them encrypted", entity, root)
+	}
+	// Detected before encrypting, and the same file stays one file
+	if project != "secret-client" || language != "Go" {
+		t.Errorf("stored project %q and language %q", project, language)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(DISTINCT file_path) FROM heartbeats"); n != 1 {
+		t.Errorf("%d distinct entities, want 1", n)
+	}
+
+	if out := srv.mustCLI(t, "path-key", "decrypt", entity); out != "/src/secret-client/billing.go\n" {
+		t.Errorf("path-key decrypt = %q", out)
+	}
+	out, code := srv.cliWithInput(t, apiKey, `{"entity":"`+entity+`","project":"secret-client"}`+"\n", "path-key", "decrypt")
+	if code != 0 || out != `{"entity":"/src/secret-client/billing.go","project":"secret-client"}`+"\n" {
+		t.Errorf("path-key decrypt of stdin exited with %d: %q", code, out)
+	}
+}
+
+func TestAggregateOnlyProject(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	now := time.Now().Unix()
+	send := func(project, entity string) {
+		t.Helper()
+		err := c.SendHeartbeats([]client.Heartbeat{{UserID: "alice", Project: project, ProjectRoot: "/src/" + project,
+			Language: "Go", Entity: entity, Branch: "feature/acme-merger", Dependencies: []string{"acme-sdk"},
+			Duration: 60, Timestamp: now}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	scrubbed := func(project string) int {
+		return srv.queryInt(t, `SELECT COUNT(*) FROM heartbeats h JOIN projects p ON p.id = h.project_id
+			WHERE p.name = ? AND h.file_path = '' AND COALESCE(h.branch, '') = '' AND COALESCE(h.dependencies, '') = ''
+				AND h.language = 'Go'`, project)
+	}
+	send("nda", "/src/nda/merger.go")
+
+	updated, err := c.UpdateProject(client.Project{UserID: "alice", Name: "nda", AggregateOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.AggregateOnly || updated.Root != "" {
+		t.Errorf("updated project %+v, want aggregate only without a root", updated)
+	}
+	// Turning it on scrubs what was already stored
+	if n := scrubbed("nda"); n != 1 {
+		t.Errorf("%d scrubbed heartbeats after turning aggregate only on, want 1", n)
+	}
+
+	// New heartbeats are stored without paths, and the project keeps no root
+	send("nda", "/src/nda/due-diligence.go")
+	if n := scrubbed("nda"); n != 2 {
+		t.Errorf("%d scrubbed heartbeats, want 2", n)
+	}
+	if p, err := c.Projects("alice"); err != nil || len(p) != 1 || p[0].Root != "" || !p[0].AggregateOnly {
+		t.Errorf("projects %+v, %v", p, err)
+	}
+	stats, err := c.Stats("alice", time.Unix(now, 0), time.Unix(now, 0))
+	if err != nil || stats.Total != 120 {
+		t.Errorf("stats %+v, %v; want the time kept", stats, err)
+	}
+
+	// So are heartbeats moved into the project
+	send("scratch", "/src/scratch/acme.go")
+	if _, err := c.ReclassifyHeartbeats("alice", "scratch", "", client.Reclassification{Project: "nda"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := scrubbed("nda"); n != 3 {
+		t.Errorf("%d scrubbed heartbeats after moving one in, want 3", n)
+	}
+}
@@ -0,0 +1,269 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestIngestWebhooks(t *testing.T) {
+	srv := startServer(t)
+
+	post := func(path, event, payload string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL+path, strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event != "" {
+			req.Header.Set("X-GitHub-Event", event)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Webhook senders pass the key in the URL
+	for _, tc := range []struct{ path, event, payload string }{
+		{"/api/v1/ingest/github?user_id=bot&api_key=" + apiKey, "push",
+			`{"ref": "refs/heads/main", "repository": {"name": "eztracker"}, "commits": [
+				{"id": "a", "timestamp": "2024-03-04T10:00:00Z"}, {"id": "b", "timestamp": "2024-03-04T10:10:00Z"}]}`},
+		{"/api/v1/ingest/ci?user_id=bot&api_key=" + apiKey, "",
+			`{"project": "eztracker", "job": "test", "started_at": 1709550000, "finished_at": 1709550120}`},
+		{"/api/v1/ingest/toggl?user_id=bot&project=meetings&api_key=" + apiKey, "",
+			`{"payload": {"description": "Planning", "start": "2024-03-04T09:00:00Z", "duration": 1800}}`},
+	} {
+		if resp := post(tc.path, tc.event, tc.payload); resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s: %s", tc.path, resp.Status)
+		}
+	}
+
+	var agg client.Aggregate
+	srv.getJSON(t, "/api/v1/aggregate?user_id=bot&group_by=category&from=2024-03-04&to=2024-03-04", &agg)
+	var got []string
+	for _, g := range agg.Groups {
+		got = append(got, fmt.Sprintf("%v %v", g["category"], g["duration"]))
+	}
+	if want := "coding 1800, committing 600, building 120"; strings.Join(got, ", ") != want {
+		t.Errorf("groups %v, want %s", got, want)
+	}
+
+	if resp := post("/api/v1/ingest/ci?user_id=bot", "", `{}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a key: %s, want 401", resp.Status)
+	}
+	if resp := post("/api/v1/ingest/jira?user_id=bot&api_key="+apiKey, "", `{}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown source: %s, want 404", resp.Status)
+	}
+	if resp := post("/api/v1/ingest/ci?user_id=bot&api_key="+apiKey, "", `{"project": "p"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("incomplete job: %s, want 400", resp.Status)
+	}
+}
+
+func TestBrowserIngest(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	for domain, category := range map[string]string{"go.dev": "researching", "reddit.com": "social"} {
+		if _, err := c.SetDomainRule(client.DomainRule{UserID: "reader", Domain: domain, Category: category}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rule, err := c.SetDomainRule(client.DomainRule{UserID: "reader", Domain: "WWW.Reddit.com", Category: "distracted"}); err != nil || rule.Domain != "reddit.com" {
+		t.Fatalf("replacing a rule: %+v, %v", rule, err)
+	}
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC).Unix()
+	visits := fmt.Sprintf(`[{"domain": "pkg.go.dev", "title": "net/http", "duration": 600, "timestamp": %d},
+		{"domain": "old.reddit.com", "duration": 300, "timestamp": %d},
+		{"domain": "example.com", "duration": 60, "timestamp": %d}]`, day, day+600, day+900)
+	var result struct{ Heartbeats int }
+	if err := c.Do("POST", "/api/v1/ingest/browser?user_id=reader", json.RawMessage(visits), &result); err != nil || result.Heartbeats != 3 {
+		t.Fatalf("ingesting visits: %+v, %v", result, err)
+	}
+
+	var stats client.Stats
+	srv.getJSON(t, "/api/v1/stats?user_id=reader&from=2024-03-04&to=2024-03-04", &stats)
+	want := []client.Bucket{{Name: "researching", Duration: 600}, {Name: "distracted", Duration: 300}, {Name: "browsing", Duration: 60}}
+	if !reflect.DeepEqual(stats.Categories, want) {
+		t.Errorf("categories %+v, want %+v", stats.Categories, want)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE entity_type = 'domain' AND file_path LIKE '%http%'"); n != 0 {
+		t.Errorf("%d heartbeats with tab titles, want none", n)
+	}
+
+	if err := c.DeleteDomainRule("reader", "go.dev"); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := c.DomainRules("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Domain != "reddit.com" {
+		t.Errorf("rules %+v, want only reddit.com's", rules)
+	}
+	if err := c.DeleteDomainRule("reader", "go.dev"); err == nil {
+		t.Error("deleted a missing rule")
+	}
+}
+
+func TestBuildCategory(t *testing.T) {
+	srv := startServer(t)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC).Unix()
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go",
+		"--duration", "600", "--time", fmt.Sprint(day))
+	srv.mustCLI(t, "--entity", "/src/eztracker/make", "--category", "building",
+		"--duration", "120", "--time", fmt.Sprint(day+600))
+
+	req, err := http.NewRequest("POST", srv.URL+"/api/v1/ingest/gitlab?user_id=krisrp", strings.NewReader(
+		`{"object_kind": "pipeline", "project": {"name": "eztracker"}, "object_attributes": {
+			"ref": "main", "status": "success", "duration": 300, "finished_at": "2024-03-04 12:00:00 UTC"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GitLab pipeline: %s", resp.Status)
+	}
+
+	var stats client.Stats
+	srv.getJSON(t, "/api/v1/stats?user_id=krisrp&from=2024-03-04&to=2024-03-04", &stats)
+	want := []client.Bucket{{Name: "coding", Duration: 600}, {Name: "building", Duration: 420}}
+	if !reflect.DeepEqual(stats.Categories, want) {
+		t.Errorf("categories %+v, want %+v", stats.Categories, want)
+	}
+}
+
+func TestSlackCommand(t *testing.T) {
+	const secret = "slack-secret"
+	srv := startServer(t, "SLACK_SIGNING_SECRET="+secret)
+	c := client.New(srv.URL, apiKey)
+
+	now := time.Now()
+	if err := c.SendHeartbeats([]client.Heartbeat{
+		{UserID: "bot", Project: "eztracker", Language: "Go", Entity: "/a.go", Duration: 5400, Timestamp: now.Unix()},
+		{UserID: "bot", Project: "eztracker", Language: "Go", Entity: "/a.go", Duration: 3600, Timestamp: now.AddDate(0, 0, -3).Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	command := func(text string, sign func(ts, body string) string) (int, string) {
+		t.Helper()
+		body := url.Values{"team_id": {"T1"}, "user_id": {"U1"}, "command": {"/eztracker"}, "text": {text}}.Encode()
+		ts := fmt.Sprint(time.Now().Unix())
+		req, err := http.NewRequest("POST", srv.URL+"/api/v1/slack/command", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Slack-Request-Timestamp", ts)
+		req.Header.Set("X-Slack-Signature", sign(ts, body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var msg struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return resp.StatusCode, msg.Text
+	}
+	sign := func(ts, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	if code, _ := command("today", func(string, string) string { return "v0=forged" }); code != http.StatusUnauthorized {
+		t.Errorf("forged signature: %d, want 401", code)
+	}
+	if code, text := command("today", sign); code != http.StatusOK || !strings.Contains(text, "not linked") {
+		t.Errorf("unlinked user: %d %q", code, text)
+	}
+
+	var link map[string]string
+	if err := c.Do("POST", "/api/v1/slack/links",
+		map[string]string{"team_id": "T1", "slack_user_id": "U1", "user_id": "bot"}, &link); err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]string{
+		"today": "*Today:* 1 h 30 min\n• eztracker: 1 h 30 min\nLanguages: Go",
+		"week":  "*Last 7 days:* 2 h 30 min",
+		"help":  "Usage:",
+	} {
+		if code, got := command(text, sign); code != http.StatusOK || !strings.HasPrefix(got, want) {
+			t.Errorf("/eztracker %s: %d %q, want %q", text, code, got, want)
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	srv := startServer(t, "HEARTBEAT_HORIZON=336h")
+	admin := client.New(srv.URL, apiKey)
+	newKey := func(userID string) *client.Client {
+		t.Helper()
+		_, key := srv.newKey(t, userID, "write")
+		return client.New(srv.URL, key)
+	}
+	plugin := newKey("me")
+
+	// Old heartbeats, past the horizon /heartbeat enforces, a bad line and
+	// one of another user
+	var ndjson bytes.Buffer
+	for i := 0; i < 1200; i++ {
+		line, _ := json.Marshal(client.Heartbeat{Version: 2, UserID: "me", Project: "eztracker",
+			Entity: "/src/eztracker/main.go", Duration: 30, Timestamp: 1600000000 + int64(i)*60})
+		ndjson.Write(append(line, '\n'))
+	}
+	ndjson.WriteString("{not json\n")
+	ndjson.WriteString(`{"version": 2, "user_id": "someone", "entity": "/src/x.go", "duration": 30, "timestamp": 1600000000}` + "\n")
+
+	job, err := plugin.Backfill(&ndjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status == "running" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if job, err = plugin.Job(job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Status != "done" || job.Stored != 1200 || job.Rejected != 2 || job.Processed != job.Size {
+		t.Errorf("got %+v", job)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1200 {
+		t.Errorf("stored %d heartbeats, want 1200", n)
+	}
+
+	// Users don't see each other's jobs, the server key sees all
+	_, err = newKey("someone").Job(job.ID)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("another user's job: %v", err)
+	}
+	if _, err := admin.Job(job.ID); err != nil {
+		t.Errorf("job with the server key: %v", err)
+	}
+}
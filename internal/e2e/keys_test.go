@@ -0,0 +1,295 @@
+package e2e
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestAPIKeyActivity(t *testing.T) {
+	srv := startServer(t, "TRUST_PROXY=true", "GEO_HEADER=CF-IPCountry")
+	admin := client.New(srv.URL, apiKey)
+
+	aliceID, aliceKey := srv.newKey(t, "alice", "")
+	_, bobKey := srv.newKey(t, "bob", "")
+
+	whoami := func(key string, header http.Header) {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"/api/v1/whoami", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header.Clone()
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The first X-Forwarded-For entry is up to the client, the last one is
+	// what the proxy saw
+	proxied := http.Header{"X-Forwarded-For": {"10.0.0.1, 203.0.113.9"}, "Cf-Ipcountry": {"NL"}}
+	whoami(aliceKey, proxied)
+	whoami(aliceKey, proxied)
+	time.Sleep(1100 * time.Millisecond)
+	whoami(aliceKey, http.Header{})
+
+	usage, err := client.New(srv.URL, aliceKey).KeyActivity(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Also counts the request for the activity itself
+	if len(usage) != 2 || usage[0].IP != "127.0.0.1" || usage[0].Requests != 2 ||
+		usage[1].IP != "203.0.113.9" || usage[1].Country != "NL" || usage[1].Requests != 2 {
+		t.Errorf("activity = %+v", usage)
+	}
+	if _, err := admin.KeyActivity(aliceID); err != nil {
+		t.Errorf("activity with the server key: %v", err)
+	}
+
+	var clientErr *client.Error
+	if _, err := client.New(srv.URL, bobKey).KeyActivity(aliceID); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("activity of another user's key: %v, want 404", err)
+	}
+}
+
+func TestAPIKeyUsage(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	id, key := srv.newKey(t, "alice", "write")
+	alice := client.New(srv.URL, key)
+	alice.UserAgent = "laptop-plugin/1.0"
+
+	hb := client.Heartbeat{UserID: "alice", Project: "app", Entity: "/src/app/main.go", Duration: 30, Timestamp: time.Now().Unix()}
+	if err := alice.SendHeartbeats([]client.Heartbeat{hb}); err != nil {
+		t.Fatal(err)
+	}
+	// Out of the write scope, and an invalid heartbeat
+	if _, err := alice.Stats("alice", time.Time{}, time.Time{}); err == nil {
+		t.Error("stats with a write key: no error")
+	}
+	hb.EntityType = "spreadsheet"
+	if err := alice.SendHeartbeats([]client.Heartbeat{hb}); err == nil {
+		t.Error("invalid heartbeat: no error")
+	}
+
+	stats, err := admin.KeyUsage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Requests != 3 || stats.ClientErrors != 2 || stats.ServerErrors != 0 ||
+		stats.ErrorRate < 0.66 || stats.ErrorRate > 0.67 || stats.LastStatus != http.StatusBadRequest ||
+		stats.LastError != "POST /heartbeat 400" || stats.UserAgent != "laptop-plugin/1.0" ||
+		len(stats.Days) != 1 || stats.Days[0].Requests != 3 || stats.Days[0].Day != time.Now().UTC().Format("2006-01-02") {
+		t.Errorf("usage = %+v", stats)
+	}
+
+	// The server key isn't counted, and other keys can't see it
+	if _, err := admin.Version(); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := admin.KeyUsage(id); err != nil || after.Requests != 3 {
+		t.Errorf("usage after server key requests = %+v, %v", after, err)
+	}
+	_, other := srv.newKey(t, "bob", "")
+	var clientErr *client.Error
+	if _, err := client.New(srv.URL, other).KeyUsage(id); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("usage of another user's key: %v, want 404", err)
+	}
+}
+
+func TestDashboardTokens(t *testing.T) {
+	srv := startServer(t, "JWT_SECRET=e2e-secret")
+	admin := client.New(srv.URL, apiKey)
+
+	pair, err := admin.CreateToken("krisrp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.TokenType != "Bearer" || pair.ExpiresAt <= time.Now().Unix() {
+		t.Errorf("token pair = %+v", pair)
+	}
+	whoami, err := client.New(srv.URL, pair.AccessToken).Whoami()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whoami.UserID != "krisrp" || whoami.Key.Source != "jwt" {
+		t.Errorf("whoami with an access token = %+v", whoami)
+	}
+	var clientErr *client.Error
+	if _, err := client.New(srv.URL, pair.AccessToken).CreateToken(""); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("session from an access token: %v, want 401", err)
+	}
+
+	next, err := admin.RefreshToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, next.AccessToken).Whoami(); err != nil {
+		t.Errorf("refreshed access token: %v", err)
+	}
+	// Replaying a used refresh token ends the session, locking out whoever
+	// holds the newer tokens too
+	if _, err := admin.RefreshToken(pair.RefreshToken); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed refresh token: %v, want 401", err)
+	}
+	if _, err := client.New(srv.URL, next.AccessToken).Whoami(); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("access token after replay: %v, want 401", err)
+	}
+
+	pair, err = admin.CreateToken("krisrp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.RevokeToken(pair.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, pair.AccessToken).Whoami(); err == nil {
+		t.Error("access token works after revoking")
+	}
+	if _, err := admin.RefreshToken(pair.RefreshToken); err == nil {
+		t.Error("refresh token works after revoking")
+	}
+}
+
+func TestScopedKeys(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	newKey := func(scope string) *client.Client {
+		t.Helper()
+		_, key := srv.newKey(t, "alice", scope)
+		return client.New(srv.URL, key)
+	}
+	plugin, dashboard := newKey("write"), newKey("read")
+
+	day := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	heartbeats := []client.Heartbeat{{UserID: "alice", Project: "eztracker", Language: "Go",
+		Entity: "/src/eztracker/main.go", Duration: 60, Timestamp: day.Unix()}}
+	if err := plugin.SendHeartbeats(heartbeats); err != nil {
+		t.Fatalf("heartbeats with a write key: %v", err)
+	}
+	if whoami, err := plugin.Whoami(); err != nil || whoami.Key.Scope != "write" {
+		t.Errorf("whoami with a write key = %+v, %v", whoami, err)
+	}
+	stats, err := dashboard.Stats("alice", day, day)
+	if err != nil {
+		t.Fatalf("stats with a read key: %v", err)
+	}
+	if stats.Total != 60 {
+		t.Errorf("stats with a read key = %+v", stats)
+	}
+
+	forbidden := func(what string, err error) {
+		t.Helper()
+		var clientErr *client.Error
+		if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: %v, want 403", what, err)
+		}
+	}
+	_, err = plugin.Stats("alice", day, day)
+	forbidden("stats with a write key", err)
+	// Read keys only read their own user
+	if err := admin.SendHeartbeats([]client.Heartbeat{{UserID: "bob", Project: "secret", Language: "Go",
+		Entity: "/src/secret/main.go", Duration: 60, Timestamp: day.Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = dashboard.Stats("bob", day, day)
+	forbidden("another user's stats with a read key", err)
+	_, err = dashboard.Query("bob", "select sum(duration)")
+	forbidden("another user's query with a read key", err)
+	forbidden("heartbeats with a read key", dashboard.SendHeartbeats(heartbeats))
+	_, err = dashboard.LogTime(client.ManualEntry{UserID: "alice", Project: "eztracker", Duration: 600, Timestamp: day.Unix()})
+	forbidden("manual entry with a read key", err)
+
+	var clientErr *client.Error
+	err = admin.Do("POST", "/api/v1/api_keys", map[string]string{"user_id": "alice", "scope": "admin"}, nil)
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("key with an unknown scope: %v, want 400", err)
+	}
+}
+
+func TestUserKeysOwnUser(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	_, key := srv.newKey(t, "alice", "")
+	alice := client.New(srv.URL, key)
+
+	day := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	if err := admin.SendHeartbeats([]client.Heartbeat{{UserID: "bob", Project: "secret", Language: "Go",
+		Entity: "/src/secret/main.go", Duration: 60, Timestamp: day.Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request naming bob is refused alice's key, reads and writes alike
+	bob := map[string]string{"user_id": "bob", "project": "secret", "from": "2024-03-04", "text": "mine now"}
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "/api/v1/stats?user_id=bob", nil},
+		{"GET", "/api/v1/aggregate?user_id=bob&group_by=project", nil},
+		{"POST", "/api/v1/query", map[string]string{"user_id": "bob", "query": "select sum(duration)"}},
+		{"GET", "/api/v1/tags?user_id=bob", nil},
+		{"GET", "/api/v1/sessions?user_id=bob", nil},
+		{"GET", "/api/v1/reports/month?user_id=bob", nil},
+		{"GET", "/api/v1/users/bob/today/live", nil},
+		{"GET", "/api/v1/projects?user_id=bob", nil},
+		{"GET", "/api/v1/heartbeats/edits?user_id=bob", nil},
+		{"DELETE", "/api/v1/heartbeats?user_id=bob&from=2024-03-04&to=2024-03-04", nil},
+		{"GET", "/api/v1/manual_entries?user_id=bob", nil},
+		{"POST", "/api/v1/manual_entries", map[string]interface{}{"user_id": "bob", "project": "secret", "duration": 600}},
+		{"GET", "/api/v1/notes?user_id=bob", nil},
+		{"POST", "/api/v1/notes", bob},
+		{"DELETE", "/api/v1/notes?user_id=bob&id=1", nil},
+		{"GET", "/api/v1/time_off?user_id=bob", nil},
+		{"POST", "/api/v1/time_off", bob},
+		{"GET", "/api/v1/rules?user_id=bob", nil},
+		{"POST", "/api/v1/rules", map[string]string{"user_id": "bob", "match_language": "Go", "set_project": "other"}},
+		{"GET", "/api/v1/domain_rules?user_id=bob", nil},
+		{"GET", "/api/v1/notifications?user_id=bob", nil},
+		{"GET", "/api/v1/email?user_id=bob", nil},
+		{"POST", "/api/v1/plugins/register", map[string]string{"user_id": "bob", "name": "vim", "machine": "laptop"}},
+		{"POST", "/api/v1/ingest/ci?user_id=bob", map[string]string{}},
+		{"POST", "/heartbeat", map[string]interface{}{"user_id": "bob", "project": "secret", "entity": "/x.go", "duration": 60, "timestamp": day.Unix()}},
+	} {
+		var clientErr *client.Error
+		if err := alice.Do(req.method, req.path, req.body, nil); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s with alice's key: %v, want 403", req.method, req.path, err)
+		}
+	}
+	// In a batch, bob's heartbeat is rejected and one without a user is alice's
+	result, err := alice.SendHeartbeatBatch([]client.Heartbeat{
+		{UserID: "bob", Project: "secret", Entity: "/x.go", Duration: 60, Timestamp: day.Unix()},
+		{Project: "mine", Entity: "/y.go", Duration: 60, Timestamp: day.Unix()},
+	})
+	if err != nil || result.Accepted != 1 || len(result.Rejected) != 1 || result.Rejected[0].Index != 0 {
+		t.Errorf("batch with bob's heartbeat = %+v, %v", result, err)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE user_id = 'alice'"); n != 1 {
+		t.Errorf("alice has %d heartbeats, want 1", n)
+	}
+
+	// Bob's data is untouched, and the server key still reads it
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE user_id = 'bob'"); n != 1 {
+		t.Errorf("bob has %d heartbeats, want 1", n)
+	}
+	if stats, err := admin.Stats("bob", day, day); err != nil || stats.Total != 60 {
+		t.Errorf("bob's stats with the server key = %+v, %v", stats, err)
+	}
+	// Naming one's own user still works
+	if _, err := alice.Stats("alice", day, day); err != nil {
+		t.Errorf("alice's stats with alice's key: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package e2e
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+	_ "github.com/lib/pq"
+)
+
+func TestMigrate(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+	// Heartbeats are copied with the table of their month
+	month := time.Now().UTC().Format("heartbeats_2006_01")
+	send := func(n int) {
+		t.Helper()
+		var heartbeats []client.Heartbeat
+		for i := 0; i < n; i++ {
+			heartbeats = append(heartbeats, client.Heartbeat{UserID: "mover", Project: "eztracker", Language: "Go",
+				Entity: fmt.Sprintf("/src/eztracker/file%d.go", i), Duration: 30,
+				Timestamp: time.Now().Unix() - int64(i), Tags: []string{"move"}})
+		}
+		if err := c.SendHeartbeats(heartbeats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate := func(args ...string) (string, int) {
+		t.Helper()
+		out, err := exec.Command(serverBin, append([]string{"migrate"}, args...)...).CombinedOutput()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), 0
+	}
+	count := func(db *sql.DB, table string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	send(5)
+	dstPath := filepath.Join(t.TempDir(), "copy.sqlite")
+	out, code := migrate("--from", "sqlite:"+srv.dbPath, "--to", "sqlite:"+dstPath, "--batch", "2")
+	if code != 0 || !strings.Contains(out, month+": 5/5 rows") || !strings.Contains(out, "Verified") {
+		t.Fatalf("migrate exited %d:\n%s", code, out)
+	}
+	dst, err := sql.Open("sqlite3", dstPath+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	for _, table := range []string{"heartbeats", "heartbeat_tags", "projects", "daily_summaries"} {
+		if got, want := count(dst, table), count(srv.DB, table); got != want || want == 0 {
+			t.Errorf("%s: copied %d rows of %d", table, got, want)
+		}
+	}
+	var file string
+	if err := dst.QueryRow(`
+		SELECT h.file_path FROM heartbeats h JOIN projects p ON p.id = h.project_id
+		WHERE p.name = 'eztracker' ORDER BY h.id LIMIT 1`).Scan(&file); err != nil || file != "/src/eztracker/file0.go" {
+		t.Errorf("first copied heartbeat %q, %v", file, err)
+	}
+
+	// Running it again resumes after the rows already copied
+	send(3)
+	out, code = migrate("--from", "sqlite:"+srv.dbPath, "--to", "sqlite:"+dstPath)
+	if code != 0 || !strings.Contains(out, month+": 3/3 rows") {
+		t.Fatalf("resumed migrate exited %d:\n%s", code, out)
+	}
+	if n := count(dst, "heartbeats"); n != 8 {
+		t.Errorf("%d heartbeats after resuming, want 8", n)
+	}
+	out, code = migrate("--from", "sqlite:"+srv.dbPath, "--to", "sqlite:"+dstPath, "--restart")
+	if code != 0 || !strings.Contains(out, month+": 8/8 rows") || count(dst, "heartbeats") != 8 {
+		t.Errorf("restarted migrate exited %d:\n%s", code, out)
+	}
+
+	// Rows changed in place since they were copied are caught by their
+	// checksum and their table copied again
+	if _, err := srv.DB.Exec("UPDATE projects SET path = '/moved' WHERE name = 'eztracker'"); err != nil {
+		t.Fatal(err)
+	}
+	out, code = migrate("--from", "sqlite:"+srv.dbPath, "--to", "sqlite:"+dstPath)
+	if code != 0 || !strings.Contains(out, "projects: copying again") || !strings.Contains(out, "Verified") {
+		t.Errorf("migrate after an update exited %d:\n%s", code, out)
+	}
+	var path string
+	if err := dst.QueryRow("SELECT path FROM projects WHERE name = 'eztracker'").Scan(&path); err != nil || path != "/moved" {
+		t.Errorf("copied project path %q, %v", path, err)
+	}
+
+	// A source whose schema is behind is refused rather than changed
+	oldPath := filepath.Join(t.TempDir(), "old.sqlite")
+	old, err := sql.Open("sqlite3", oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if _, err := old.Exec("CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	out, code = migrate("--from", "sqlite:"+oldPath, "--to", "sqlite:"+filepath.Join(t.TempDir(), "new.sqlite"))
+	if code != 1 || !strings.Contains(out, "start this version of the server on it once first") {
+		t.Errorf("migrating an old schema exited %d:\n%s", code, out)
+	}
+	if n := count(old, "sqlite_master"); n != 2 {
+		t.Errorf("the old source has %d schema entries, want its table and key index", n)
+	}
+
+	if out, code := migrate("--from", "sqlite:"+srv.dbPath, "--to", "postgres://127.0.0.1:1/eztracker?sslmode=disable"); code != 1 ||
+		!strings.Contains(out, "invalid --to") {
+		t.Errorf("migrating to an unreachable PostgreSQL exited %d:\n%s", code, out)
+	}
+}
+
+func TestMigratePostgres(t *testing.T) {
+	// A URL of an empty database, dropped and created again by the test
+	url := os.Getenv("EZTRACKER_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("EZTRACKER_TEST_POSTGRES is not set")
+	}
+	dst, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if _, err := dst.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+	// Heartbeats are copied with the table of their month
+	month := time.Now().UTC().Format("heartbeats_2006_01")
+	send := func(n int) {
+		t.Helper()
+		var heartbeats []client.Heartbeat
+		for i := 0; i < n; i++ {
+			heartbeats = append(heartbeats, client.Heartbeat{UserID: "mover", Project: "eztracker", Language: "Go",
+				Entity: fmt.Sprintf("/src/eztracker/file%d.go", i), Duration: 30,
+				Timestamp: time.Now().Unix() - int64(i), Tags: []string{"move"}})
+		}
+		if err := c.SendHeartbeats(heartbeats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(serverBin, append([]string{"migrate", "--from", "sqlite:" + srv.dbPath, "--to", url}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("migrate: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+	count := func(db *sql.DB, table string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	send(5)
+	if out := migrate("--batch", "2"); !strings.Contains(out, month+": 5/5 rows") || !strings.Contains(out, "Verified") {
+		t.Fatalf("migrate:\n%s", out)
+	}
+	for _, table := range []string{"heartbeats", "heartbeat_tags", "projects", "daily_summaries"} {
+		if got, want := count(dst, table), count(srv.DB, table); got != want || want == 0 {
+			t.Errorf("%s: copied %d rows of %d", table, got, want)
+		}
+	}
+	var file string
+	if err := dst.QueryRow(`
+		SELECT h.file_path FROM heartbeats h JOIN projects p ON p.id = h.project_id
+		WHERE p.name = 'eztracker' ORDER BY h.id LIMIT 1`).Scan(&file); err != nil || file != "/src/eztracker/file0.go" {
+		t.Errorf("first copied heartbeat %q, %v", file, err)
+	}
+
+	// Resumed, then copied again from scratch
+	send(3)
+	if out := migrate(); !strings.Contains(out, month+": 3/3 rows") || count(dst, "heartbeats") != 8 {
+		t.Errorf("resumed migrate:\n%s", out)
+	}
+	if out := migrate("--restart"); !strings.Contains(out, month+": 8/8 rows") || count(dst, "heartbeats") != 8 {
+		t.Errorf("restarted migrate:\n%s", out)
+	}
+
+	// Ids given by PostgreSQL follow the copied ones
+	var maxID, id int64
+	if err := dst.QueryRow("SELECT MAX(id) FROM projects").Scan(&maxID); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.QueryRow("INSERT INTO projects (user_id, name) VALUES ('mover', 'new') RETURNING id").Scan(&id); err != nil || id <= maxID {
+		t.Errorf("new project id %d after %d, %v", id, maxID, err)
+	}
+}
@@ -0,0 +1,184 @@
+package e2e
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestNotificationPrefs(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	prefs, err := c.NotificationPrefs("bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := client.NotificationPrefs{UserID: "bot", Enabled: true, Timezone: "UTC", Channels: []string{"email"}, AlertHours: 14, Locale: "en"}
+	if !reflect.DeepEqual(prefs, want) {
+		t.Errorf("default preferences %+v, want %+v", prefs, want)
+	}
+
+	// A PUT only changes the fields it contains
+	var updated client.NotificationPrefs
+	err = c.Do("PUT", "/api/v1/notifications?user_id=bot",
+		map[string]interface{}{"weekday": 1, "hour": 9, "timezone": "Europe/Berlin"}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = client.NotificationPrefs{UserID: "bot", Enabled: true, Weekday: 1, Hour: 9, Timezone: "Europe/Berlin", Channels: []string{"email"}, AlertHours: 14, Locale: "en"}
+	if !reflect.DeepEqual(updated, want) {
+		t.Errorf("updated preferences %+v, want %+v", updated, want)
+	}
+
+	want.Enabled, want.Channels = false, []string{}
+	if _, err := c.SetNotificationPrefs(want); err != nil {
+		t.Fatal(err)
+	}
+	if prefs, err := c.NotificationPrefs("bot"); err != nil || !reflect.DeepEqual(prefs, want) {
+		t.Errorf("stored preferences %+v, %v; want %+v", prefs, err, want)
+	}
+
+	var clientErr *client.Error
+	for _, bad := range []client.NotificationPrefs{
+		{UserID: "bot", Weekday: 7, Timezone: "UTC"},
+		{UserID: "bot", Hour: 24, Timezone: "UTC"},
+		{UserID: "bot", Timezone: "Mars/Olympus"},
+		{UserID: "bot", Timezone: "UTC", Channels: []string{"pager"}},
+		{UserID: "bot", Timezone: "UTC", AlertHours: 25},
+	} {
+		if _, err := c.SetNotificationPrefs(bad); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+v: %v, want a 400", bad, err)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	hook, err := c.AddWebhook(client.Webhook{UserID: "bot", URL: "https://hooks.example.com/bulb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.ID == 0 || len(hook.Secret) != 32 || strings.Join(hook.Events, ",") != "goal.completed,record.daily,streak.milestone" {
+		t.Errorf("created webhook %+v", hook)
+	}
+	hooks, err := c.Webhooks("bot")
+	if err != nil || len(hooks) != 1 || hooks[0].Secret != "" || hooks[0].URL != hook.URL {
+		t.Errorf("webhooks = %+v, %v; want one without its secret", hooks, err)
+	}
+
+	// Another user's key can't subscribe to bot's milestones or touch its hooks
+	_, key := srv.newKey(t, "eve", "")
+	eve := client.New(srv.URL, key)
+	var clientErr *client.Error
+	if _, err := eve.AddWebhook(client.Webhook{UserID: "bot", URL: "https://eve.example.com"}); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+		t.Errorf("adding a webhook for another user: %v, want 403", err)
+	}
+	if _, err := eve.Webhooks("bot"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+		t.Errorf("listing another user's webhooks: %v, want 403", err)
+	}
+	if err := eve.DeleteWebhook("bot", hook.ID); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+		t.Errorf("deleting another user's webhook: %v, want 403", err)
+	}
+	if hooks, err := eve.Webhooks(""); err != nil || len(hooks) != 0 {
+		t.Errorf("eve's own webhooks = %+v, %v", hooks, err)
+	}
+
+	for _, bad := range []client.Webhook{
+		{UserID: "bot", URL: "ftp://hooks.example.com"},
+		{UserID: "bot", URL: "https://hooks.example.com", Events: []string{"heartbeat.received"}},
+	} {
+		if _, err := c.AddWebhook(bad); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+v: %v, want 400", bad, err)
+		}
+	}
+	prefs, err := c.NotificationPrefs("bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs.DailyGoalMinutes = 24*60 + 1
+	if _, err := c.SetNotificationPrefs(prefs); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("goal over a day: %v, want 400", err)
+	}
+
+	if err := c.DeleteWebhook("bot", hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteWebhook("bot", hook.ID); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting it again: %v, want 404", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	if _, err := client.New(startServer(t).URL, apiKey).SetEmail("alice", "alice@example.com"); err == nil {
+		t.Error("changing an address without EMAIL_SECRET succeeded")
+	}
+
+	srv := startServer(t, "EMAIL_SECRET=e2e-email-secret")
+	admin := client.New(srv.URL, apiKey)
+	_, key := srv.newKey(t, "alice", "")
+	alice := client.New(srv.URL, key)
+
+	var clientErr *client.Error
+	if _, err := alice.SetEmail("bob", "alice@example.com"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusForbidden {
+		t.Errorf("changing bob's address with alice's key: %v, want 403", err)
+	}
+	if _, err := alice.SetEmail("", "not an address"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid address: %v, want 400", err)
+	}
+	if status, err := alice.SetEmail("", "alice@example.com"); err != nil || status.Verified {
+		t.Fatalf("changing the address = %+v, %v", status, err)
+	}
+	if status, err := alice.Email(""); err != nil || status.Email != "alice@example.com" || status.Verified {
+		t.Errorf("address before confirming = %+v, %v", status, err)
+	}
+
+	var body string
+	if err := srv.DB.QueryRow("SELECT body FROM outbox WHERE recipient = 'alice@example.com'").Scan(&body); err != nil {
+		t.Fatal(err)
+	}
+	start := strings.Index(body, srv.URL+"/api/v1/email/verify?token=")
+	if start < 0 {
+		t.Fatalf("no confirmation link in:\n%s", body)
+	}
+	link := strings.Fields(body[start:])[0]
+
+	open := func(link string) int {
+		t.Helper()
+		resp, err := http.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := open(link + "x"); code != http.StatusBadRequest {
+		t.Errorf("tampered link: %d, want 400", code)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM users WHERE id = 'alice' AND email_verified = 1"); n != 0 {
+		t.Fatal("address verified before the link was opened")
+	}
+	if code := open(link); code != http.StatusOK {
+		t.Fatalf("confirmation link: %d", code)
+	}
+	if status, err := alice.Email(""); err != nil || !status.Verified {
+		t.Errorf("address after confirming = %+v, %v", status, err)
+	}
+
+	// A link to an address since replaced confirms nothing
+	if _, err := admin.SetEmail("alice", "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if code := open(link); code != http.StatusConflict {
+		t.Errorf("link to the old address: %d, want 409", code)
+	}
+	if status, err := admin.Email("alice"); err != nil || status.Email != "alice@example.org" || status.Verified {
+		t.Errorf("new address = %+v, %v", status, err)
+	}
+}
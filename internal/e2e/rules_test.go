@@ -0,0 +1,126 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestRules(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	// Sent before there were rules
+	if err := admin.SendHeartbeats([]client.Heartbeat{
+		{UserID: "alice", Project: "api", Language: "Go", Entity: "/home/alice/work/api/main.go", Duration: 600, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "blog", Language: "Markdown", Entity: "/home/alice/blog/post.md", Duration: 300, Timestamp: day.Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	work, err := admin.AddRule(client.Rule{UserID: "alice", MatchPath: "/home/alice/work/*", SetProject: "acme", SetTags: []string{"billable"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.AddRule(client.Rule{UserID: "alice", MatchLanguage: "markdown", SetCategory: "writing docs"}); err != nil {
+		t.Fatal(err)
+	}
+	var clientErr *client.Error
+	if _, err := admin.AddRule(client.Rule{UserID: "alice", SetProject: "everything"}); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("rule matching everything: %v, want 400", err)
+	}
+
+	// Applied on ingest
+	if err := admin.SendHeartbeats([]client.Heartbeat{
+		{UserID: "alice", Project: "web", Language: "Markdown", Entity: "/home/alice/work/web/README.md", Duration: 120, Timestamp: day.Unix() + 600},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var project, category string
+	if err := srv.DB.QueryRow(`SELECT p.name, h.category FROM heartbeats h JOIN projects p ON p.id = h.project_id
+		WHERE h.file_path LIKE '%README.md'`).Scan(&project, &category); err != nil {
+		t.Fatal(err)
+	}
+	if project != "acme" || category != "writing docs" {
+		t.Errorf("ingested heartbeat in %s, %s, want acme, writing docs", project, category)
+	}
+
+	// And over history
+	applied, err := admin.ApplyRules("alice")
+	if err != nil || applied.Changed != 2 {
+		t.Fatalf("applying rules = %+v, %v, want 2 changed", applied, err)
+	}
+	stats, err := admin.Stats("alice", day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range stats.Projects {
+		got = append(got, fmt.Sprintf("%s %v", b.Name, b.Duration))
+	}
+	if want := "acme 720, blog 300"; strings.Join(got, ", ") != want {
+		t.Errorf("projects %s, want %s", strings.Join(got, ", "), want)
+	}
+	if n := srv.queryInt(t, `SELECT COUNT(*) FROM heartbeat_tags ht JOIN tags t ON t.id = ht.tag_id WHERE t.name = 'billable'`); n != 2 {
+		t.Errorf("%d heartbeats tagged billable, want 2", n)
+	}
+	if applied, err := admin.ApplyRules("alice"); err != nil || applied.Changed != 0 {
+		t.Errorf("applying rules again = %+v, %v, want nothing changed", applied, err)
+	}
+
+	if err := admin.DeleteRule("alice", work.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := admin.Rules("alice"); err != nil || len(rules) != 1 || rules[0].SetCategory != "writing docs" {
+		t.Errorf("rules = %+v, %v", rules, err)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	tickets, err := admin.AddScript("tickets", `
+		local ticket = heartbeat.branch:match("^(%u+%-%d+)")
+		if ticket then table.insert(heartbeat.tags, ticket) end
+		if heartbeat.entity:find("/vendor/", 1, true) then return false end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientErr *client.Error
+	if _, err := admin.AddScript("broken", "if then"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("script with a syntax error: %v, want 400", err)
+	}
+	_, key := srv.newKey(t, "alice", "")
+	if _, err := client.New(srv.URL, key).Scripts(); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("listing scripts with a user key: %v, want 401", err)
+	}
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	if err := admin.SendHeartbeats([]client.Heartbeat{
+		{UserID: "alice", Project: "api", Language: "Go", Entity: "/src/api/main.go", Branch: "ENG-42-fix", Duration: 600, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "api", Language: "Go", Entity: "/src/api/vendor/lib.go", Branch: "ENG-42-fix", Duration: 300, Timestamp: day.Unix() + 600},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.queryInt(t, `SELECT COUNT(*) FROM heartbeats`); n != 1 {
+		t.Errorf("%d heartbeats stored, want the vendored one dropped", n)
+	}
+	if n := srv.queryInt(t, `SELECT COUNT(*) FROM heartbeat_tags ht JOIN tags t ON t.id = ht.tag_id WHERE t.name = 'ENG-42'`); n != 1 {
+		t.Errorf("%d heartbeats tagged ENG-42, want 1", n)
+	}
+
+	if err := admin.DeleteScript(tickets.ID); err != nil {
+		t.Fatal(err)
+	}
+	if scripts, err := admin.Scripts(); err != nil || len(scripts) != 0 {
+		t.Errorf("scripts = %+v, %v, want none", scripts, err)
+	}
+}
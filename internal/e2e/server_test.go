@@ -0,0 +1,337 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestServerAddr(t *testing.T) {
+	hb := []client.Heartbeat{{UserID: "me", Project: "eztracker", Language: "Go", Duration: 30, Timestamp: 1700000000}}
+
+	t.Run("unix socket", func(t *testing.T) {
+		sock := filepath.Join(t.TempDir(), "eztracker.sock")
+		srv := startServer(t, "SERVER_ADDR=unix:"+sock)
+		info, err := os.Stat(sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o660 {
+			t.Errorf("socket mode %v, want 0660", info.Mode().Perm())
+		}
+		c := client.New(srv.URL, apiKey)
+		c.HTTPClient = srv.client
+		if err := c.SendHeartbeats(hb); err != nil {
+			t.Fatal(err)
+		}
+		if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1 {
+			t.Errorf("stored %d heartbeats, want 1", n)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		l, err := net.Listen("tcp6", "[::1]:0")
+		if err != nil {
+			t.Skip("no IPv6 loopback:", err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+		srv := startServer(t, "SERVER_ADDR="+addr)
+		if err := client.New(srv.URL, apiKey).SendHeartbeats(hb); err != nil {
+			t.Fatal(err)
+		}
+		if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 1 {
+			t.Errorf("stored %d heartbeats, want 1", n)
+		}
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	primary := startServer(t)
+	admin := client.New(primary.URL, apiKey)
+	if err := admin.SendHeartbeats([]client.Heartbeat{{UserID: "reader", Project: "eztracker",
+		Language: "Go", Entity: "/src/eztracker/main.go", Duration: 30, Timestamp: time.Now().Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+	_, key := primary.newKey(t, "reader", "read")
+	before := primary.queryInt(t, "SELECT COUNT(*) FROM key_usage")
+
+	replica := startServer(t, "DATABASE_PATH="+primary.dbPath, "READ_ONLY=true")
+	c := client.New(replica.URL, key)
+	today := time.Now().UTC()
+	stats, err := c.Stats("reader", today, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 30 || len(stats.Projects) != 1 {
+		t.Errorf("replica stats %+v, want the primary's heartbeat", stats)
+	}
+	if _, err := c.Query("reader", "select project, sum(duration) from 2024-03-04"); err != nil {
+		t.Errorf("replica query: %v", err)
+	}
+	if after := primary.queryInt(t, "SELECT COUNT(*) FROM key_usage"); after != before {
+		t.Errorf("replica recorded key usage: %d rows, had %d", after, before)
+	}
+
+	request := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, replica.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	if resp := request("GET", "/api/v1/stats?user_id=reader", ""); resp.Header.Get("ETag") == "" || resp.Header.Get("Last-Modified") != "" {
+		t.Errorf("replica stats headers %v, want an ETag only", resp.Header)
+	}
+	if resp := request("POST", "/heartbeat", `{"user_id": "reader"}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("replica heartbeat: %s, want 404", resp.Status)
+	}
+	if resp := request("POST", "/api/v1/projects/eztracker/archive?user_id=reader", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("replica archive: %s, want 404", resp.Status)
+	}
+	if resp := request("PUT", "/api/v1/projects/eztracker?user_id=reader", `{"color": "#ff0000"}`); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("replica project update: %s, want 405", resp.Status)
+	}
+}
+
+func TestDemo(t *testing.T) {
+	srv := startServerArgs(t, []string{"--demo"})
+	c := client.New(srv.URL, apiKey)
+
+	to := time.Now().UTC()
+	stats, err := c.Stats("demo", to.AddDate(0, 0, -89), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total < 100*3600 || len(stats.Projects) < 3 || len(stats.Languages) < 5 {
+		t.Errorf("demo stats: %v total, %d projects, %d languages", stats.Total, len(stats.Projects), len(stats.Languages))
+	}
+	for _, p := range stats.Projects {
+		if p.Color == "" || p.Description == "" {
+			t.Errorf("demo project %+v has no color or description", p)
+		}
+	}
+	// Nothing is written to the database in the working directory
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM sqlite_master"); n != 0 {
+		t.Errorf("demo created %d tables on disk", n)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	srv := startServer(t)
+	seed := func(args ...string) (string, error) {
+		cmd := exec.Command(serverBin, append([]string{"seed"}, args...)...)
+		cmd.Dir = filepath.Dir(srv.dbPath)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	if out, err := seed("--days", "30", "--user", "sampler"); err != nil {
+		t.Fatalf("seed: %v\n%s", err, out)
+	}
+	to := time.Now().UTC()
+	stats, err := client.New(srv.URL, apiKey).Stats("sampler", to.AddDate(0, 0, -29), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total == 0 || len(stats.Projects) == 0 {
+		t.Errorf("seeded stats %+v, want made-up activity", stats)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats WHERE user_id = 'sampler' AND timestamp < ?",
+		to.AddDate(0, 0, -30).Unix()); n != 0 {
+		t.Errorf("%d heartbeats older than 30 days", n)
+	}
+
+	if out, err := seed("--user", "sampler"); err == nil || !strings.Contains(out, "already has projects") {
+		t.Errorf("seeding a user with data again: %v\n%s", err, out)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	srv := startServer(t)
+
+	// Nothing has run on a fresh server
+	runs, err := client.New(srv.URL, apiKey).Tasks()
+	if err != nil || len(runs) != 0 {
+		t.Errorf("got %v, %v", runs, err)
+	}
+	if _, err := srv.DB.Exec("INSERT INTO task_runs (name, last_run, duration_ms, runs) VALUES ('prune', 1700000000, 12, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	runs, err = client.New(srv.URL, apiKey).Tasks()
+	if err != nil || len(runs) != 1 || runs[0] != (client.TaskRun{Name: "prune", LastRun: 1700000000, DurationMS: 12, Runs: 1}) {
+		t.Errorf("got %v, %v", runs, err)
+	}
+
+	_, key := srv.newKey(t, "me", "")
+	_, err = client.New(srv.URL, key).Tasks()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("with a user key: %v", err)
+	}
+}
+
+func TestConfigFromEnvironment(t *testing.T) {
+	srv := startServer(t)
+	// A container's read-only home directory, a mounted config and a
+	// state directory of its own
+	home, state := t.TempDir(), t.TempDir()
+	mounted := filepath.Join(t.TempDir(), "eztracker.cfg")
+	if err := os.WriteFile(mounted, []byte("[settings]\napi_key = "+apiKey+"\nuser_id = "+serverKeyUser+"\nserver_url = "+srv.URL+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(env ...string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(cliBin, "--entity", "/src/eztracker/main.go", "--duration", "30")
+		cmd.Env = append([]string{"HOME=" + home, "XDG_CONFIG_HOME=", "XDG_STATE_HOME=" + state, "PATH=" + os.Getenv("PATH")}, env...)
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), 0
+	}
+
+	if out, code := run("EZTRACKER_CONFIG_FILE=" + mounted); code != 0 {
+		t.Fatalf("with a mounted config: exit %d\n%s", code, out)
+	}
+	if out, code := run("EZTRACKER_API_KEY="+apiKey, "EZTRACKER_USER_ID="+serverKeyUser, "EZTRACKER_SERVER_URL="+srv.URL, "EZTRACKER_GZIP_THRESHOLD=0"); code != 0 {
+		t.Fatalf("with only environment variables: exit %d\n%s", code, out)
+	}
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 2 {
+		t.Errorf("%d heartbeats stored, want 2", n)
+	}
+	if entries, err := os.ReadDir(home); err != nil || len(entries) != 0 {
+		t.Errorf("home directory has %v, %v; want nothing written", entries, err)
+	}
+
+	if out, code := run("EZTRACKER_CONFIG_FILE=" + filepath.Join(home, "missing.cfg")); code != 103 || !strings.Contains(out, "does not exist") {
+		t.Errorf("with a missing mounted config: exit %d\n%s", code, out)
+	}
+	if out, code := run("EZTRACKER_CONFIG_FILE="+mounted, "EZTRACKER_KEYSTROKE_TIMEOUT=soon"); code != 103 || !strings.Contains(out, "EZTRACKER_KEYSTROKE_TIMEOUT") {
+		t.Errorf("with an invalid setting: exit %d\n%s", code, out)
+	}
+}
+
+func TestReloadEnv(t *testing.T) {
+	srv := startServer(t)
+	allowed := func() string {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"/api/v1/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "https://dash.example.com")
+		resp, err := srv.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin")
+	}
+	if got := allowed(); got != "" {
+		t.Fatalf("allowed origin %q before reloading", got)
+	}
+
+	dotenv := filepath.Join(srv.dir, ".env")
+	data, err := os.ReadFile(dotenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "CORS_ORIGINS=https://dash.example.com\nCACHE_SIZE=10\n"...)
+	if err := os.WriteFile(dotenv, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for allowed() != "https://dash.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("CORS_ORIGINS not applied after SIGHUP")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	out, err := os.ReadFile(filepath.Join(srv.dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Restart the server to apply CACHE_SIZE") {
+		t.Errorf("server log doesn't ask for a restart for CACHE_SIZE:\n%s", out)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	mode, err := admin.SetMaintenance(client.Maintenance{Enabled: true, Message: "Backing up", RetryAfter: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mode.Enabled || mode.Since == 0 || mode.RetryAfter != 60 {
+		t.Errorf("maintenance = %+v", mode)
+	}
+
+	err = admin.SendHeartbeats([]client.Heartbeat{{UserID: "alice", Project: "api", Entity: "/src/api/main.go", Duration: 60, Timestamp: time.Now().Unix()}})
+	var clientErr *client.Error
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusServiceUnavailable ||
+		clientErr.RetryAfter != time.Minute || clientErr.Message != "Backing up" || !client.Retryable(err) {
+		t.Errorf("heartbeat during maintenance: %v, want 503 with Retry-After", err)
+	}
+	// The CLI queues heartbeats as if offline
+	if out, code := srv.cli(t, apiKey, "--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "600"); code != 102 {
+		t.Errorf("CLI heartbeat during maintenance exited with %d, want 102:\n%s", code, out)
+	}
+	// Everything else keeps working
+	if _, err := admin.Stats("alice", time.Now(), time.Now()); err != nil {
+		t.Errorf("stats during maintenance: %v", err)
+	}
+
+	if mode, err := admin.SetMaintenance(client.Maintenance{}); err != nil || mode.Enabled {
+		t.Fatalf("turning maintenance off = %+v, %v", mode, err)
+	}
+	srv.mustCLI(t, "--entity", "/src/eztracker/cli.go", "--language", "Go", "--duration", "600")
+	if n := srv.queryInt(t, "SELECT COUNT(*) FROM heartbeats"); n != 2 {
+		t.Errorf("stored %d heartbeats after maintenance, want the queued one and the new one", n)
+	}
+}
+
+func TestSecondServerRefused(t *testing.T) {
+	srv := startServer(t)
+
+	// Same .env and database
+	cmd := exec.Command(serverBin)
+	cmd.Dir = srv.dir
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "in use by another server") ||
+		!strings.Contains(string(out), fmt.Sprintf("process %d", srv.process.Pid)) {
+		t.Errorf("second server: %v\n%s", err, out)
+	}
+	// The first one keeps running
+	if _, err := client.New(srv.URL, apiKey).Version(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,680 @@
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestSummaryAggregation(t *testing.T) {
+	srv := startServer(t)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	for i, hb := range []struct {
+		entity, language string
+		duration         int
+	}{
+		{"/src/eztracker/main.go", "Go", 60},
+		{"/src/eztracker/main.go", "Go", 30},
+		{"/src/eztracker/plugin.lua", "Lua", 15},
+	} {
+		srv.mustCLI(t, "--entity", hb.entity, "--language", hb.language,
+			"--duration", fmt.Sprint(hb.duration),
+			"--time", day.Add(time.Duration(i)*time.Minute).Format(time.RFC3339),
+			"--tags", "oss")
+	}
+	srv.mustCLI(t, "log", "--project", "eztracker", "--duration", "1h",
+		"--note", "design review", "--time", day.Format(time.RFC3339))
+
+	rows, err := srv.DB.Query(`
+		SELECT d.day, p.name, d.language, d.manual, d.seconds
+		FROM daily_summaries d JOIN projects p ON p.id = d.project_id
+		ORDER BY d.manual, d.language`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var day, project, language string
+		var manual bool
+		var seconds float64
+		if err := rows.Scan(&day, &project, &language, &manual, &seconds); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %q manual=%v %.0f", day, project, language, manual, seconds))
+	}
+	want := []string{
+		`2024-03-04 eztracker "Go" manual=false 90`,
+		`2024-03-04 eztracker "Lua" manual=false 15`,
+		`2024-03-04 eztracker "" manual=true 3600`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("daily summaries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	var tags []struct {
+		Name     string  `json:"name"`
+		Duration float64 `json:"duration"`
+	}
+	srv.getJSON(t, "/api/v1/tags?user_id=krisrp", &tags)
+	if len(tags) != 1 || tags[0].Name != "oss" || tags[0].Duration != 105 {
+		t.Errorf("tags = %+v, want oss with 105s", tags)
+	}
+}
+
+func TestTodaySummary(t *testing.T) {
+	srv := startServer(t)
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "90")
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--language", "Go", "--duration", "90")
+
+	if out := srv.mustCLI(t, "--today"); out != "3 min\n" {
+		t.Errorf("--today printed %q, want 3 min", out)
+	}
+
+	for format, want := range map[string]string{"hh:mm": "0:03\n", "decimal": "0.05 h\n"} {
+		cfg := "[settings]\nduration_format = " + format + "\n"
+		if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte(cfg), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if out := srv.mustCLI(t, "--today"); out != want {
+			t.Errorf("--today with duration_format = %s printed %q, want %q", format, out, want)
+		}
+	}
+}
+
+func TestTodayCache(t *testing.T) {
+	srv := startServer(t)
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "120")
+	if out := srv.mustCLI(t, "--today"); out != "2 min\n" {
+		t.Fatalf("--today printed %q, want 2 min", out)
+	}
+
+	// Reused for a minute, unless asked not to
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "60")
+	if out := srv.mustCLI(t, "--today"); out != "2 min\n" {
+		t.Errorf("cached --today printed %q, want 2 min", out)
+	}
+	if out := srv.mustCLI(t, "--today", "--no-cache"); out != "3 min\n" {
+		t.Errorf("--today --no-cache printed %q, want 3 min", out)
+	}
+
+	srv.mustCLI(t, "--entity", "/src/eztracker/main.go", "--duration", "60")
+	if err := os.WriteFile(filepath.Join(srv.home, ".eztracker.cfg"), []byte("[settings]\ntoday_cache_ttl = 0s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out := srv.mustCLI(t, "--today"); out != "4 min\n" {
+		t.Errorf("--today without a cache printed %q, want 4 min", out)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+	err := c.SendHeartbeats([]client.Heartbeat{
+		{UserID: "bot", Project: "a", Language: "Go", Entity: "/a/x.go", Branch: "main", Duration: 60, Timestamp: day.Unix()},
+		{UserID: "bot", Project: "a", Language: "Lua", Entity: "/a/x.lua", Branch: "main", Duration: 30, Timestamp: day.Unix()},
+		{UserID: "bot", Project: "b", Language: "Go", Entity: "/b/x.go", Branch: "dev", Duration: 20, Timestamp: next.Unix()},
+		{UserID: "bot", Project: "b", Language: "Go", Entity: "/b/x.go", Duration: 5, Timestamp: next.AddDate(0, 0, 1).Unix()},
+		{UserID: "someone", Project: "a", Language: "Go", Entity: "/a/x.go", Duration: 99, Timestamp: day.Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg, err := c.Aggregate("bot", []string{"language", "day"}, day, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range agg.Groups {
+		got = append(got, fmt.Sprintf("%v %v %v", g["language"], g["day"], g["duration"]))
+	}
+	want := []string{"Go 2024-03-04 60", "Lua 2024-03-04 30", "Go 2024-03-05 20"}
+	if agg.Total != 110 || strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("total %v, groups %v; want 110, %v", agg.Total, got, want)
+	}
+
+	agg, err = c.Aggregate("bot", nil, day, next.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agg.Total != 115 || len(agg.Groups) != 1 {
+		t.Errorf("ungrouped aggregate = %+v, want a single group of 115", agg)
+	}
+
+	// Heatmap buckets
+	agg, err = c.Aggregate("bot", []string{"weekday", "hour"}, day, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, g := range agg.Groups {
+		got = append(got, fmt.Sprintf("%v %v %v", g["weekday"], g["hour"], g["duration"]))
+	}
+	if want := []string{"1 10 90", "2 10 20"}; strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("weekday and hour groups %v, want %v", got, want)
+	}
+
+	var clientErr *client.Error
+	if _, err := c.Aggregate("bot", []string{"project; DROP TABLE heartbeats"}, day, day); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown dimension: %v, want a 400", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+	err := c.SendHeartbeats([]client.Heartbeat{
+		{UserID: "bot", Project: "a", Language: "Go", Entity: "/a/x.go", Duration: 60, Timestamp: day.Unix(), Tags: []string{"oss"}},
+		{UserID: "bot", Project: "a", Language: "Lua", Entity: "/a/x.lua", Duration: 30, Timestamp: day.Unix()},
+		{UserID: "bot", Project: "b", Language: "Go", Entity: "/b/x.go", Duration: 20, Timestamp: next.Unix()},
+		{UserID: "bot", Project: "b", Language: "Go", Entity: "/b/x.go", Duration: 10, Timestamp: next.Unix()},
+		{UserID: "someone", Project: "a", Language: "Go", Entity: "/a/x.go", Duration: 99, Timestamp: day.Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{
+			query: "select project, sum(duration), count(), days() from 2024-03-04 to 2024-03-05",
+			want:  "[a 90 2 1] [b 30 2 1]",
+		},
+		{
+			query: `select language, max(duration) where project in ("a", "b") and language != "Lua"
+				from 2024-03-04 to 2024-03-05`,
+			want: "[Go 60]",
+		},
+		{
+			query: `select day, sum(duration) where tag = "oss" from 2024-03-01 to 2024-03-31`,
+			want:  "[2024-03-04 60]",
+		},
+		{
+			query: `select project, sum(duration) from 2024-03-04 to 2024-03-05 order by project desc limit 1`,
+			want:  "[b 30]",
+		},
+		{
+			query: `select hour, sum(duration) where weekday = 2 from 2024-03-04 to 2024-03-05`,
+			want:  "[10 30]",
+		},
+		{
+			query: `select project where project = "a'; DROP TABLE heartbeats; --" from 2024-03-04`,
+			want:  "",
+		},
+	} {
+		result, err := c.Query("bot", tc.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		var rows []string
+		for _, row := range result.Rows {
+			rows = append(rows, fmt.Sprint(row))
+		}
+		if got := strings.Join(rows, " "); got != tc.want {
+			t.Errorf("%s: rows %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	var clientErr *client.Error
+	for _, query := range []string{
+		"select secret",
+		"select project where password = 'x'",
+		"select project; DROP TABLE heartbeats",
+	} {
+		if _, err := c.Query("bot", query); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %v, want a 400", query, err)
+		}
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+
+	day := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+	err := admin.SendHeartbeats([]client.Heartbeat{
+		{UserID: "alice", Project: "a", Language: "Go", Entity: "/a/x.go", Duration: 60, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "b", Language: "Go", Entity: "/b/x.go", Duration: 30, Timestamp: day.Unix()},
+		{UserID: "alice", Project: "a", Language: "Lua", Entity: "/a/x.lua", Duration: 20, Timestamp: next.Unix()},
+		{UserID: "someone", Project: "a", Language: "Go", Entity: "/a/x.go", Duration: 99, Timestamp: day.Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key := srv.newKey(t, "alice", "read")
+	grafana := client.New(srv.URL, key)
+
+	// Grafana's connection test and the targets it offers
+	if err := grafana.Do("GET", "/api/v1/grafana/", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	if err := grafana.Do("POST", "/api/v1/grafana/search", map[string]string{"target": ""}, &targets); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(targets, ",") != "total,branch,category,entity,entity_type,hour,language,machine,manual,project,session,weekday" {
+		t.Errorf("targets %v", targets)
+	}
+
+	type target struct {
+		Target  string            `json:"target"`
+		RefID   string            `json:"refId"`
+		Type    string            `json:"type,omitempty"`
+		Payload map[string]string `json:"payload,omitempty"`
+	}
+	query := func(c *client.Client, targets ...target) (string, error) {
+		t.Helper()
+		var req struct {
+			Range struct {
+				From string `json:"from"`
+				To   string `json:"to"`
+			} `json:"range"`
+			Targets []target `json:"targets"`
+		}
+		req.Range.From, req.Range.To = "2024-03-04T00:00:00.000Z", "2024-03-05T23:59:59.999Z"
+		req.Targets = targets
+		var result json.RawMessage
+		err := c.Do("POST", "/api/v1/grafana/query", req, &result)
+		return string(result), err
+	}
+
+	got, err := query(grafana, target{Target: "project", RefID: "A"}, target{Target: "total", RefID: "B", Type: "table"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"target":"a","datapoints":[[60,1709510400000],[20,1709596800000]]},` +
+		`{"target":"b","datapoints":[[30,1709510400000]]},` +
+		`{"type":"table","columns":[{"text":"seconds","type":"number"}],"rows":[[110]]}]`
+	if got != want {
+		t.Errorf("query = %s\nwant %s", got, want)
+	}
+
+	got, err = query(admin, target{Target: "language", RefID: "A", Type: "table", Payload: map[string]string{"user_id": "someone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"type":"table","columns":[{"text":"language","type":"string"},{"text":"seconds","type":"number"}],"rows":[["Go",99]]}]`; got != want {
+		t.Errorf("query for another user = %s\nwant %s", got, want)
+	}
+
+	var clientErr *client.Error
+	for _, c := range []struct {
+		client *client.Client
+		target target
+	}{
+		{grafana, target{Target: "day", RefID: "A"}},
+		{grafana, target{Target: "secret", RefID: "A"}},
+		// The server key has no user of its own
+		{admin, target{Target: "total", RefID: "A"}},
+	} {
+		if _, err := query(c.client, c.target); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+v: %v, want a 400", c.target, err)
+		}
+	}
+}
+
+func TestReports(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	var heartbeats []client.Heartbeat
+	for _, day := range []time.Time{
+		time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 2, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 3, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 7, 14, 10, 0, 0, 0, time.UTC),
+	} {
+		heartbeats = append(heartbeats, client.Heartbeat{UserID: "bot", Project: "eztracker",
+			Language: "Go", Entity: "/src/eztracker/main.go", Duration: 3600, Timestamp: day.Unix()})
+	}
+	heartbeats = append(heartbeats, client.Heartbeat{UserID: "bot", Project: "docs", Language: "Markdown",
+		Entity: "/src/docs/guide.md", Duration: 7200, Timestamp: time.Date(2023, 7, 14, 12, 0, 0, 0, time.UTC).Unix()})
+	if err := c.SendHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+
+	month, err := c.MonthlyReport("bot", time.Date(2023, 3, 15, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if month.Period != "2023-03" || month.Total != 3*3600 || month.DaysActive != 3 || len(month.Periods) != 31 ||
+		month.Periods[1] != (client.Bucket{Name: "2023-03-02", Duration: 3600}) || month.Review != nil {
+		t.Errorf("monthly report = %+v", month)
+	}
+
+	year, err := c.YearlyReport("bot", 2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if year.Period != "2023" || year.Total != 6*3600 || year.DaysActive != 4 || len(year.Periods) != 12 ||
+		year.Periods[6] != (client.Bucket{Name: "2023-07", Duration: 3 * 3600}) {
+		t.Errorf("yearly report = %+v", year)
+	}
+	want := &client.YearInReview{
+		BusiestDay:    client.Bucket{Name: "2023-07-14", Duration: 3 * 3600},
+		BusiestMonth:  client.Bucket{Name: "2023-03", Duration: 3 * 3600},
+		LongestStreak: 3,
+		TopProject:    "eztracker",
+		TopLanguage:   "Go",
+	}
+	if !reflect.DeepEqual(year.Review, want) {
+		t.Errorf("year in review = %+v, want %+v", year.Review, want)
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/v1/reports/yearly?user_id=bot&year=2023&format=html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(string(page), "bot&#39;s 2023 in review") || !strings.Contains(string(page), "Longest streak: 3 days") {
+		t.Errorf("HTML report: %s %s\n%s", resp.Status, resp.Header.Get("Content-Type"), page)
+	}
+
+	// In the user's language
+	if err := c.Do("PUT", "/api/v1/notifications?user_id=bot", map[string]string{"locale": "de"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), `<html lang="de">`) || !strings.Contains(string(page), "Längste Serie: 3 Tage") {
+		t.Errorf("German HTML report: %s\n%s", resp.Status, page)
+	}
+
+	var clientErr *client.Error
+	for path, status := range map[string]int{
+		"/api/v1/reports/weekly?user_id=bot":                     http.StatusNotFound,
+		"/api/v1/reports/monthly?user_id=bot&month=3":            http.StatusBadRequest,
+		"/api/v1/reports/yearly?user_id=bot&year=x":              http.StatusBadRequest,
+		"/api/v1/reports/yearly?user_id=bot&format=html&lang=xx": http.StatusBadRequest,
+	} {
+		if err := c.Do("GET", path, nil, nil); !errors.As(err, &clientErr) || clientErr.StatusCode != status {
+			t.Errorf("GET %s: %v, want %d", path, err, status)
+		}
+	}
+}
+
+func TestNotes(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	conference, err := c.AddNote(client.Note{UserID: "bot", From: "2024-03-04", To: "2024-03-06", Text: "conference"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sick, err := c.AddNote(client.Note{UserID: "bot", From: "2024-03-20", Text: "sick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sick.ID == 0 || sick.To != "2024-03-20" {
+		t.Errorf("note without to = %+v, want it to end the day it starts", sick)
+	}
+
+	notes, err := c.Notes("bot", time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 19, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0] != conference {
+		t.Errorf("notes overlapping March 6 to 19 = %+v, want %+v", notes, conference)
+	}
+
+	report, err := c.MonthlyReport("bot", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Notes, []client.Note{conference, sick}) {
+		t.Errorf("report notes = %+v", report.Notes)
+	}
+
+	if err := c.DeleteNote("bot", sick.ID); err != nil {
+		t.Fatal(err)
+	}
+	var clientErr *client.Error
+	if err := c.DeleteNote("bot", sick.ID); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting a deleted note: %v, want 404", err)
+	}
+	for _, bad := range []client.Note{
+		{UserID: "bot", From: "2024-03-04"},
+		{UserID: "bot", From: "March 4", Text: "conference"},
+		{UserID: "bot", From: "2024-03-06", To: "2024-03-04", Text: "conference"},
+	} {
+		if _, err := c.AddNote(bad); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("note %+v: %v, want 400", bad, err)
+		}
+	}
+}
+
+func TestTimeOffKeepsStreaks(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	var heartbeats []client.Heartbeat
+	for _, day := range []int{1, 2, 6, 9} {
+		heartbeats = append(heartbeats, client.Heartbeat{UserID: "bot", Project: "eztracker", Language: "Go",
+			Entity: "/src/eztracker/main.go", Duration: 3600,
+			Timestamp: time.Date(2023, 3, day, 10, 0, 0, 0, time.UTC).Unix()})
+	}
+	if err := c.SendHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+
+	streak := func() int {
+		t.Helper()
+		report, err := c.YearlyReport("bot", 2023)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.Review.LongestStreak
+	}
+	if got := streak(); got != 2 {
+		t.Errorf("streak without time off = %d, want 2", got)
+	}
+
+	// March 3 to 5 off join the first days with March 6, but the active
+	// March 9 still starts over after the 7th and 8th
+	vacation, err := c.AddTimeOff(client.TimeOff{UserID: "bot", From: "2023-03-03", To: "2023-03-05", Reason: "vacation"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streak(); got != 3 {
+		t.Errorf("streak with time off = %d, want 3", got)
+	}
+	report, err := c.MonthlyReport("bot", time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DaysOff != 3 || report.DaysActive != 4 {
+		t.Errorf("monthly report has %d days off and %d active, want 3 and 4", report.DaysOff, report.DaysActive)
+	}
+
+	ranges, err := c.TimeOff("bot", time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(ranges) != 1 || ranges[0] != vacation {
+		t.Errorf("time off in March = %+v, %v; want %+v", ranges, err, vacation)
+	}
+	if err := c.DeleteTimeOff("bot", vacation.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := streak(); got != 2 {
+		t.Errorf("streak after deleting the time off = %d, want 2", got)
+	}
+	var clientErr *client.Error
+	if _, err := c.AddTimeOff(client.TimeOff{UserID: "bot", From: "2023-03-05", To: "2023-03-03"}); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("time off ending before it starts: %v, want 400", err)
+	}
+}
+
+func TestConditionalStats(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+	send := func() {
+		t.Helper()
+		if err := c.SendHeartbeats([]client.Heartbeat{{UserID: "poller", Project: "eztracker", Language: "Go",
+			Entity: "/src/eztracker/main.go", Duration: 30, Timestamp: time.Now().Unix()}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(header, value string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"/api/v1/stats?user_id=poller", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	send()
+	// Last-Modified is to the second, so let the change's second pass
+	time.Sleep(1100 * time.Millisecond)
+	first := get("", "")
+	etag, modified := first.Header.Get("ETag"), first.Header.Get("Last-Modified")
+	if first.StatusCode != http.StatusOK || etag == "" || modified == "" || first.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("stats: %s, headers %v", first.Status, first.Header)
+	}
+	if resp := get("If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged with If-None-Match: %s, want 304", resp.Status)
+	}
+	if resp := get("If-Modified-Since", modified); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged with If-Modified-Since: %s, want 304", resp.Status)
+	}
+
+	send()
+	if resp := get("If-None-Match", etag); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("changed with If-None-Match: %s with ETag %s, want 200 with a new one", resp.Status, resp.Header.Get("ETag"))
+	}
+	if resp := get("If-Modified-Since", modified); resp.StatusCode != http.StatusOK {
+		t.Errorf("changed with If-Modified-Since: %s, want 200", resp.Status)
+	}
+}
+
+func TestLiveToday(t *testing.T) {
+	srv := startServer(t)
+	admin := client.New(srv.URL, apiKey)
+	_, key := srv.newKey(t, "widget", "write")
+	c := client.New(srv.URL, key)
+
+	// Yesterday's time doesn't count, and an hour-old heartbeat isn't active
+	now := time.Now()
+	if err := c.SendHeartbeats([]client.Heartbeat{
+		{UserID: "widget", Project: "old", Language: "Go", Entity: "/old/main.go", Duration: 600, Timestamp: now.Add(-25 * time.Hour).Unix()},
+		{UserID: "widget", Project: "eztracker", Language: "Go", Entity: "/src/main.go", Duration: 120, Timestamp: now.Add(-time.Hour).Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	today, err := c.LiveToday("current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSeconds := 120.0
+	if now.UTC().Add(-time.Hour).Day() != now.UTC().Day() {
+		wantSeconds = 0
+	}
+	if today.UserID != "widget" || today.Seconds != wantSeconds || today.Active || today.Project != "" {
+		t.Errorf("inactive today: %+v", today)
+	}
+
+	if err := c.SendHeartbeats([]client.Heartbeat{{UserID: "widget", Project: "eztracker", Language: "Go",
+		Entity: "/src/api.go", Duration: 30, Timestamp: now.Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+	today, err = admin.LiveToday("widget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if today.Seconds != wantSeconds+30 || !today.Active || today.Project != "eztracker" || today.Language != "Go" ||
+		today.LastHeartbeat != now.Unix() {
+		t.Errorf("active today: %+v", today)
+	}
+
+	var clientErr *client.Error
+	if _, err := admin.LiveToday("current"); !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("server key's own today: %v, want 400", err)
+	}
+}
+
+func TestDayStart(t *testing.T) {
+	srv := startServer(t)
+	c := client.New(srv.URL, apiKey)
+
+	// Two in the morning, late on Monday for a night owl
+	late := time.Date(2024, 3, 5, 2, 0, 0, 0, time.UTC)
+	if err := c.SendHeartbeats([]client.Heartbeat{{UserID: "owl", Project: "eztracker", Language: "Go",
+		Entity: "/src/eztracker/main.go", Duration: 3600, Timestamp: late.Unix()}}); err != nil {
+		t.Fatal(err)
+	}
+	var prefs client.NotificationPrefs
+	if err := c.Do("PUT", "/api/v1/notifications?user_id=owl",
+		map[string]interface{}{"week_start": 1, "day_start_hour": 4}, &prefs); err != nil {
+		t.Fatal(err)
+	}
+	if prefs.WeekStart != 1 || prefs.DayStartHour != 4 {
+		t.Errorf("preferences %+v", prefs)
+	}
+
+	monday := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		day  time.Time
+		want float64
+	}{
+		{monday, 3600},
+		{monday.AddDate(0, 0, 1), 0},
+	} {
+		stats, err := c.Stats("owl", tc.day, tc.day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Total != tc.want || len(stats.Categories) != int(tc.want/3600) {
+			t.Errorf("%s: total %v with categories %+v, want %v", tc.day.Format("2006-01-02"), stats.Total, stats.Categories, tc.want)
+		}
+	}
+
+	err := c.Do("PUT", "/api/v1/notifications?user_id=owl", map[string]interface{}{"day_start_hour": 24}, nil)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("day_start_hour 24: got %v, want 400", err)
+	}
+}
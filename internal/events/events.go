@@ -0,0 +1,87 @@
+// Package events is the server's event bus. The core publishes what
+// happens, such as heartbeats arriving or a weekly summary being sent, and
+// optional modules such as webhooks subscribe to what they need rather
+// than being called from the handlers.
+package events
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// The events published, with the Data each carries.
+const (
+	// HeartbeatReceived is published for each user's heartbeats once they
+	// are stored, with the []store.Heartbeat.
+	HeartbeatReceived = "heartbeat.received"
+	// SummaryGenerated is published when a weekly summary is sent to a
+	// user, with its text as a string.
+	SummaryGenerated = "summary.generated"
+	// GoalCompleted, DailyRecord and StreakMilestone are published when a
+	// user reaches their daily goal, beats their best day or reaches a
+	// streak milestone, once per day, with the milestones.Milestone.
+	GoalCompleted   = "goal.completed"
+	DailyRecord     = "record.daily"
+	StreakMilestone = "streak.milestone"
+)
+
+// All subscribes to every event.
+const All = "*"
+
+// Event is something that happened to a user at Time.
+type Event struct {
+	Name   string
+	UserID string
+	Time   time.Time
+	Data   interface{}
+}
+
+// Handler is called with the events it subscribed to.
+type Handler func(Event)
+
+// Bus passes published events to the handlers subscribed to them.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// New returns a bus without subscribers.
+func New() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe calls handler for each event published with name, or with any
+// name for All.
+func (b *Bus) Subscribe(name string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[name] = append(b.handlers[name], handler)
+}
+
+// Publish calls the handlers subscribed to e in the order they subscribed,
+// in the publishing goroutine, so handlers must return quickly and queue
+// slow work such as network calls for later. A handler that panics is
+// logged and doesn't keep the others from running. Publishing on a nil
+// bus does nothing.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	handlers := append(append([]Handler(nil), b.handlers[e.Name]...), b.handlers[All]...)
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		call(handler, e)
+	}
+}
+
+func call(handler Handler, e Event) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Event handler for %s panicked: %v\n%s", e.Name, p, debug.Stack())
+		}
+	}()
+	handler(e)
+}
@@ -0,0 +1,26 @@
+package events
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	bus := New()
+	var got []string
+	bus.Subscribe(HeartbeatReceived, func(e Event) { got = append(got, "first "+e.UserID) })
+	bus.Subscribe(HeartbeatReceived, func(e Event) { panic("broken module") })
+	bus.Subscribe(HeartbeatReceived, func(e Event) { got = append(got, "second "+e.UserID) })
+	bus.Subscribe(All, func(e Event) { got = append(got, "all "+e.Name) })
+
+	bus.Publish(Event{Name: HeartbeatReceived, UserID: "alice"})
+	bus.Publish(Event{Name: GoalCompleted, UserID: "alice"})
+	want := "first alice, second alice, all heartbeat.received, all goal.completed"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("handled %v, want %s", got, want)
+	}
+
+	// Publishing without a bus does nothing
+	var none *Bus
+	none.Publish(Event{Name: HeartbeatReceived})
+}
@@ -0,0 +1,168 @@
+// Package export pushes the time each user tracked per project to a time
+// series database, InfluxDB or Prometheus through remote write, so setups
+// that already chart everything in Grafana can chart coding time too.
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Metric is the name of the exported series: a counter of the seconds a
+// user tracked on a project, labeled user and project. Deleting heartbeats
+// lowers it, which Prometheus and Flux read as a counter reset.
+const Metric = "eztracker_coding_seconds_total"
+
+// Config says where to push. Format is "influx" for InfluxDB's line
+// protocol, which both the v1 /write and the v2 /api/v2/write endpoints
+// take, or "prometheus" for remote write. Token is sent as an InfluxDB
+// token or a bearer token; basic auth goes in the URL.
+type Config struct {
+	Format string
+	URL    string
+	Token  string
+}
+
+// Exporter pushes the totals of every user and project on each Run.
+type Exporter struct {
+	store  *store.Store
+	config Config
+	client *http.Client
+}
+
+// New returns an exporter pushing the totals in st as configured.
+func New(st *store.Store, config Config) (*Exporter, error) {
+	if config.Format != "influx" && config.Format != "prometheus" {
+		return nil, fmt.Errorf("unknown export format %q, want influx or prometheus", config.Format)
+	}
+	if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+		return nil, fmt.Errorf("export URL %q is not http(s)", config.URL)
+	}
+	return &Exporter{store: st, config: config, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Run pushes the totals as of now, as a scheduled task.
+func (e *Exporter) Run(now time.Time) error {
+	totals, err := e.store.ProjectSeconds()
+	if err != nil {
+		return fmt.Errorf("totals query error: %v", err)
+	}
+	if len(totals) == 0 {
+		return nil
+	}
+
+	var body []byte
+	req, err := http.NewRequest("POST", e.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	switch e.config.Format {
+	case "influx":
+		body = influxLines(totals, now)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if e.config.Token != "" {
+			req.Header.Set("Authorization", "Token "+e.config.Token)
+		}
+	case "prometheus":
+		body = snappyEncode(writeRequest(totals, now))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if e.config.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.config.Token)
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s export: %s %s", e.config.Format, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// influxLines writes totals in InfluxDB's line protocol, one point per
+// user and project with nanosecond timestamps.
+func influxLines(totals []store.ProjectTotal, now time.Time) []byte {
+	escape := strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	var b bytes.Buffer
+	for _, t := range totals {
+		project := t.Project
+		if project == "" {
+			// Tag values can't be empty
+			project = "(none)"
+		}
+		fmt.Fprintf(&b, "%s,project=%s,user=%s value=%g %d\n", Metric,
+			escape.Replace(project), escape.Replace(t.UserID), t.Seconds, now.UnixNano())
+	}
+	return b.Bytes()
+}
+
+// writeRequest encodes totals as a Prometheus remote write WriteRequest
+// protobuf, one series per user and project with labels sorted by name.
+func writeRequest(totals []store.ProjectTotal, now time.Time) []byte {
+	var req []byte
+	for _, t := range totals {
+		labels := [][2]string{{"__name__", Metric}, {"project", t.Project}, {"user", t.UserID}}
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+		var series []byte
+		for _, l := range labels {
+			var label []byte
+			label = appendBytes(label, 1, []byte(l[0]))
+			label = appendBytes(label, 2, []byte(l[1]))
+			series = appendBytes(series, 1, label)
+		}
+		var sample []byte
+		sample = binary.AppendUvarint(sample, 1<<3|1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(t.Seconds))
+		sample = binary.AppendUvarint(sample, 2<<3)
+		sample = binary.AppendUvarint(sample, uint64(now.UnixMilli()))
+		series = appendBytes(series, 2, sample)
+		req = appendBytes(req, 1, series)
+	}
+	return req
+}
+
+// appendBytes appends a length-delimited protobuf field.
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// snappyEncode frames data as a snappy block of literals, which remote
+// write requires. It doesn't compress, but every decoder reads it, and
+// the series are small.
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		if n <= 60 {
+			out = append(out, byte(n-1)<<2)
+		} else {
+			// Tag 61: the length less one in the next two bytes
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
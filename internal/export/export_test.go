@@ -0,0 +1,184 @@
+package export
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestInfluxLines(t *testing.T) {
+	totals := []store.ProjectTotal{
+		{UserID: "alice", Project: "my app,v2", Seconds: 5400},
+		{UserID: "bob=1", Project: "", Seconds: 0.5},
+	}
+	got := string(influxLines(totals, time.Unix(1700000000, 0)))
+	want := `eztracker_coding_seconds_total,project=my\ app\,v2,user=alice value=5400 1700000000000000000` + "\n" +
+		`eztracker_coding_seconds_total,project=(none),user=bob\=1 value=0.5 1700000000000000000` + "\n"
+	if got != want {
+		t.Errorf("influxLines =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// fields decodes a protobuf message into its fields by number, as raw bytes
+// for length-delimited fields and as the value for others.
+func fields(t *testing.T, b []byte) map[uint64][][]byte {
+	t.Helper()
+	m := map[uint64][][]byte{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			m[key>>3] = append(m[key>>3], b[:n])
+			b = b[n:]
+		case 1:
+			m[key>>3] = append(m[key>>3], b[:8])
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			m[key>>3] = append(m[key>>3], b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("wire type %d", key&7)
+		}
+	}
+	return m
+}
+
+func TestWriteRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	req := fields(t, writeRequest([]store.ProjectTotal{{UserID: "alice", Project: "app", Seconds: 5400}}, now))
+	if len(req[1]) != 1 {
+		t.Fatalf("%d series, want 1", len(req[1]))
+	}
+	series := fields(t, req[1][0])
+	var labels []string
+	for _, l := range series[1] {
+		label := fields(t, l)
+		labels = append(labels, string(label[1][0])+"="+string(label[2][0]))
+	}
+	if got := strings.Join(labels, ","); got != "__name__="+Metric+",project=app,user=alice" {
+		t.Errorf("labels %s", got)
+	}
+	sample := fields(t, series[2][0])
+	value := math.Float64frombits(binary.LittleEndian.Uint64(sample[1][0]))
+	ts, _ := binary.Uvarint(sample[2][0])
+	if value != 5400 || int64(ts) != now.UnixMilli() {
+		t.Errorf("sample %v at %d", value, ts)
+	}
+}
+
+// snappyDecode decodes a block of literals, as snappyEncode writes them.
+func snappyDecode(t *testing.T, b []byte) []byte {
+	t.Helper()
+	size, n := binary.Uvarint(b)
+	b = b[n:]
+	var out []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&3 != 0 {
+			t.Fatalf("tag %x is not a literal", tag)
+		}
+		length, skip := int(tag>>2)+1, 1
+		switch tag >> 2 {
+		case 60:
+			length, skip = int(b[1])+1, 2
+		case 61:
+			length, skip = int(binary.LittleEndian.Uint16(b[1:]))+1, 3
+		}
+		out = append(out, b[skip:skip+length]...)
+		b = b[skip+length:]
+	}
+	if len(out) != int(size) {
+		t.Fatalf("decoded %d bytes, preamble says %d", len(out), size)
+	}
+	return out
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, size := range []int{0, 1, 60, 61, 1 << 16, 1<<16 + 1, 200000} {
+		data := []byte(strings.Repeat("eztracker", size/9+1)[:size])
+		if got := snappyDecode(t, snappyEncode(data)); string(got) != string(data) {
+			t.Errorf("%d bytes don't round trip", size)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	now := time.Unix(1700000000, 0)
+
+	influx, err := New(st, Config{Format: "influx", URL: srv.URL + "/api/v2/write?bucket=eztracker", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing tracked, nothing to push
+	if err := influx.Run(now); err != nil || got != nil {
+		t.Fatalf("empty push: %v, %v", got, err)
+	}
+
+	if err := st.StoreHeartbeats([]store.Heartbeat{
+		{UserID: "alice", Project: "app", Language: "Go", Entity: "/app/main.go", Duration: 3600, Timestamp: now.Unix() - 7200},
+		{UserID: "alice", Project: "app", Language: "Go", Entity: "/app/main.go", Duration: 1800, Timestamp: now.Unix() - 86400},
+		{UserID: "bob", Project: "lib", Language: "Go", Entity: "/lib/lib.go", Duration: 600, Timestamp: now.Unix() - 3600},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := influx.Run(now); err != nil {
+		t.Fatal(err)
+	}
+	want := Metric + ",project=app,user=alice value=5400 1700000000000000000\n" +
+		Metric + ",project=lib,user=bob value=600 1700000000000000000\n"
+	if got.Header.Get("Authorization") != "Token secret" || got.URL.Query().Get("bucket") != "eztracker" || string(body) != want {
+		t.Errorf("influx push %v:\n%s", got.Header, body)
+	}
+
+	prometheus, err := New(st, Config{Format: "prometheus", URL: srv.URL + "/api/v1/write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prometheus.Run(now); err != nil {
+		t.Fatal(err)
+	}
+	if got.Header.Get("Content-Encoding") != "snappy" || got.Header.Get("Authorization") != "" ||
+		len(fields(t, snappyDecode(t, body))[1]) != 2 {
+		t.Errorf("remote write push %v: %x", got.Header, body)
+	}
+
+	status = http.StatusBadRequest
+	if err := prometheus.Run(now); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("rejected push: %v", err)
+	}
+
+	for _, config := range []Config{{Format: "graphite", URL: srv.URL}, {Format: "influx", URL: "udp://localhost:8089"}} {
+		if _, err := New(st, config); err == nil {
+			t.Errorf("New(%+v) succeeded", config)
+		}
+	}
+}
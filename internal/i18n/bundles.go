@@ -0,0 +1,161 @@
+package i18n
+
+import "github.com/kru/eztracker/internal/durationfmt"
+
+// locales are the supported locales by tag. English has every message;
+// the others may leave some out.
+var locales = map[string]*Locale{
+	"en": {
+		Tag:     "en",
+		Decimal: ".",
+		Style:   durationfmt.Human,
+		Months: [12]string{"January", "February", "March", "April", "May", "June",
+			"July", "August", "September", "October", "November", "December"},
+		Weekdays: [7]string{"Sundays", "Mondays", "Tuesdays", "Wednesdays", "Thursdays", "Fridays", "Saturdays"},
+		Days:     [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		Messages: map[string]string{
+			"summary.subject":    "Eztracker Weekly Summary",
+			"summary.intro":      "Your coding activity:",
+			"summary.project":    "Project: %s, Language: %s, Time: %s",
+			"summary.manual":     "Project: %s, Manual entries, Time: %s",
+			"summary.total":      "Total: %s, %s vs last week",
+			"summary.gaining":    "Top gaining project: %s, %s",
+			"summary.losing":     "Top losing project: %s, %s",
+			"summary.category":   "Category: %s, Time: %s",
+			"summary.dependency": "Dependency: %s, Time: %s",
+			"summary.best_day":   "Most productive day: %s, %s",
+			"summary.best_hour":  "Most productive hour: %s, %s",
+
+			"alert.subject": "Eztracker Alert",
+			"alert.intro":   "Something looks unusual in your tracked time:",
+			"alert.runaway": "%s: %s hours tracked, more than %d. An editor plugin may be sending heartbeats while you are away.",
+			"alert.missing": "%s: nothing tracked, though the last %d %s had time. Check that your editor plugins are still running.",
+
+			"email.unsubscribe": "To stop these emails, open %s",
+
+			"report.monthly":       "%s in %s",
+			"report.yearly":        "%s's %d in review",
+			"report.total":         "%s hours on %d days",
+			"report.days_off":      ", %d days off",
+			"report.review":        "Year in review",
+			"report.top_project":   "Top project: %s",
+			"report.top_language":  "Top language: %s",
+			"report.busiest_month": "Busiest month: %s, %s hours",
+			"report.busiest_day":   "Busiest day: %s, %s hours",
+			"report.streak":        "Longest streak: %d days",
+			"report.notes":         "Notes",
+			"report.range":         "%s to %s",
+			"report.days":          "Days",
+			"report.months":        "Months",
+			"report.projects":      "Projects",
+			"report.workspaces":    "Workspaces",
+			"report.languages":     "Languages",
+
+			"slack.today":     "Today",
+			"slack.week":      "Last 7 days",
+			"slack.languages": "Languages: %s",
+		},
+	},
+	"de": {
+		Tag:     "de",
+		Decimal: ",",
+		Style:   durationfmt.Clock,
+		Months: [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni",
+			"Juli", "August", "September", "Oktober", "November", "Dezember"},
+		Weekdays: [7]string{"Sonntage", "Montage", "Dienstage", "Mittwoche", "Donnerstage", "Freitage", "Samstage"},
+		Days:     [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		Messages: map[string]string{
+			"summary.subject":    "Eztracker: Wochenübersicht",
+			"summary.intro":      "Deine Aktivität:",
+			"summary.project":    "Projekt: %s, Sprache: %s, Zeit: %s",
+			"summary.manual":     "Projekt: %s, Manuelle Einträge, Zeit: %s",
+			"summary.total":      "Gesamt: %s, %s gegenüber der Vorwoche",
+			"summary.gaining":    "Größter Zuwachs: %s, %s",
+			"summary.losing":     "Größter Rückgang: %s, %s",
+			"summary.category":   "Kategorie: %s, Zeit: %s",
+			"summary.dependency": "Abhängigkeit: %s, Zeit: %s",
+			"summary.best_day":   "Produktivster Tag: %s, %s",
+			"summary.best_hour":  "Produktivste Stunde: %s, %s",
+
+			"alert.subject": "Eztracker: Auffälligkeit",
+			"alert.intro":   "In deiner erfassten Zeit sieht etwas ungewöhnlich aus:",
+			"alert.runaway": "%s: %s Stunden erfasst, mehr als %d. Vielleicht sendet ein Editor-Plugin Heartbeats, während du weg bist.",
+			"alert.missing": "%s: nichts erfasst, obwohl die letzten %d %s Zeit hatten. Prüfe, ob deine Editor-Plugins noch laufen.",
+
+			"email.unsubscribe": "Keine solchen E-Mails mehr: %s",
+
+			"report.monthly":       "%s im %s",
+			"report.yearly":        "Das Jahr %[2]d von %[1]s im Rückblick",
+			"report.total":         "%s Stunden an %d Tagen",
+			"report.days_off":      ", %d freie Tage",
+			"report.review":        "Jahresrückblick",
+			"report.top_project":   "Top-Projekt: %s",
+			"report.top_language":  "Top-Sprache: %s",
+			"report.busiest_month": "Aktivster Monat: %s, %s Stunden",
+			"report.busiest_day":   "Aktivster Tag: %s, %s Stunden",
+			"report.streak":        "Längste Serie: %d Tage",
+			"report.notes":         "Notizen",
+			"report.range":         "%s bis %s",
+			"report.days":          "Tage",
+			"report.months":        "Monate",
+			"report.projects":      "Projekte",
+			"report.workspaces":    "Arbeitsbereiche",
+			"report.languages":     "Sprachen",
+
+			"slack.today":     "Heute",
+			"slack.week":      "Letzte 7 Tage",
+			"slack.languages": "Sprachen: %s",
+		},
+	},
+	"fr": {
+		Tag:     "fr",
+		Decimal: ",",
+		Style:   durationfmt.Human,
+		Months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin",
+			"juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		Weekdays: [7]string{"dimanches", "lundis", "mardis", "mercredis", "jeudis", "vendredis", "samedis"},
+		Days:     [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		Messages: map[string]string{
+			"summary.subject":    "Eztracker : résumé de la semaine",
+			"summary.intro":      "Votre activité :",
+			"summary.project":    "Projet : %s, Langage : %s, Temps : %s",
+			"summary.manual":     "Projet : %s, Saisies manuelles, Temps : %s",
+			"summary.total":      "Total : %s, %s par rapport à la semaine dernière",
+			"summary.gaining":    "Projet en plus forte hausse : %s, %s",
+			"summary.losing":     "Projet en plus forte baisse : %s, %s",
+			"summary.category":   "Catégorie : %s, Temps : %s",
+			"summary.dependency": "Dépendance : %s, Temps : %s",
+			"summary.best_day":   "Jour le plus productif : %s, %s",
+			"summary.best_hour":  "Heure la plus productive : %s, %s",
+
+			"alert.subject": "Eztracker : alerte",
+			"alert.intro":   "Quelque chose semble inhabituel dans votre temps suivi :",
+			"alert.runaway": "%s : %s heures suivies, plus de %d. Un plugin d'éditeur envoie peut-être des heartbeats en votre absence.",
+			"alert.missing": "%s : rien de suivi, alors que les %d derniers %s avaient du temps. Vérifiez que vos plugins d'éditeur fonctionnent encore.",
+
+			"email.unsubscribe": "Pour ne plus recevoir ces e-mails : %s",
+
+			"report.monthly":       "%s en %s",
+			"report.yearly":        "L'année %[2]d de %[1]s",
+			"report.total":         "%s heures sur %d jours",
+			"report.days_off":      ", %d jours de congé",
+			"report.review":        "Bilan de l'année",
+			"report.top_project":   "Projet principal : %s",
+			"report.top_language":  "Langage principal : %s",
+			"report.busiest_month": "Mois le plus chargé : %s, %s heures",
+			"report.busiest_day":   "Jour le plus chargé : %s, %s heures",
+			"report.streak":        "Plus longue série : %d jours",
+			"report.notes":         "Notes",
+			"report.range":         "%s au %s",
+			"report.days":          "Jours",
+			"report.months":        "Mois",
+			"report.projects":      "Projets",
+			"report.workspaces":    "Espaces de travail",
+			"report.languages":     "Langages",
+
+			"slack.today":     "Aujourd'hui",
+			"slack.week":      "7 derniers jours",
+			"slack.languages": "Langages : %s",
+		},
+	},
+}
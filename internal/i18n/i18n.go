@@ -0,0 +1,119 @@
+// Package i18n holds the strings users read in summary emails, alerts,
+// reports and Slack replies, per locale, and formats numbers and durations
+// the way each locale writes them.
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/durationfmt"
+)
+
+// DefaultLocale is the locale of users who haven't chosen one.
+const DefaultLocale = "en"
+
+// Locale is a bundle of messages with the conventions for writing numbers,
+// durations and dates in a language.
+type Locale struct {
+	Tag      string
+	Decimal  string
+	Style    durationfmt.Style
+	Messages map[string]string
+
+	// Months are the month names, and Weekdays the plural weekday names
+	// starting with Sunday, as in "the last 4 Saturdays", and Days the
+	// singular ones.
+	Months   [12]string
+	Weekdays [7]string
+	Days     [7]string
+}
+
+// T formats the message key with args. Keys a locale lacks fall back to
+// English, and unknown keys are returned as is.
+func (l *Locale) T(key string, args ...interface{}) string {
+	format, ok := l.Messages[key]
+	if !ok {
+		if format, ok = locales[DefaultLocale].Messages[key]; !ok {
+			return key
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Number formats v with the given number of decimals.
+func (l *Locale) Number(v float64, decimals int) string {
+	return strings.Replace(strconv.FormatFloat(v, 'f', decimals, 64), ".", l.Decimal, 1)
+}
+
+// Hours formats seconds as a number of hours with one decimal, for tables
+// whose heading already says they are hours.
+func (l *Locale) Hours(seconds float64) string {
+	return l.Number(seconds/3600, 1)
+}
+
+// Duration formats seconds in the locale's Style, with its decimal mark.
+func (l *Locale) Duration(seconds float64) string {
+	return strings.Replace(durationfmt.Format(seconds, l.Style), ".", l.Decimal, 1)
+}
+
+// SignedDuration is Duration with a sign even for gains, for changes.
+func (l *Locale) SignedDuration(seconds float64) string {
+	return strings.Replace(durationfmt.Signed(seconds, l.Style), ".", l.Decimal, 1)
+}
+
+// WithStyle returns the locale writing durations in style instead, or l
+// itself for "".
+func (l *Locale) WithStyle(style durationfmt.Style) *Locale {
+	if style == "" {
+		return l
+	}
+	with := *l
+	with.Style = style
+	return &with
+}
+
+// Month formats the month of t with its year, as in "March 2024".
+func (l *Locale) Month(t time.Time) string {
+	return fmt.Sprintf("%s %d", l.Months[t.Month()-1], t.Year())
+}
+
+// Lookup returns the locale for a tag such as "de" or "fr-CA", falling back
+// from a regional tag to its language. ok is false for unsupported ones.
+func Lookup(tag string) (l *Locale, ok bool) {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	if l, ok := locales[tag]; ok {
+		return l, true
+	}
+	language, _, _ := strings.Cut(tag, "-")
+	l, ok = locales[language]
+	return l, ok
+}
+
+// Get returns the locale for a tag, or the default one for unsupported
+// tags and "".
+func Get(tag string) *Locale {
+	if l, ok := Lookup(tag); ok {
+		return l
+	}
+	return locales[DefaultLocale]
+}
+
+// For returns the locale for a tag like Get, writing durations in a user's
+// chosen format, if any.
+func For(tag, durationFormat string) *Locale {
+	return Get(tag).WithStyle(durationfmt.Style(durationFormat))
+}
+
+// Tags lists the supported locales.
+func Tags() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
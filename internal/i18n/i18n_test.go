@@ -0,0 +1,83 @@
+package i18n
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/durationfmt"
+)
+
+func TestDuration(t *testing.T) {
+	for _, tc := range []struct {
+		tag     string
+		seconds float64
+		want    string
+	}{
+		{"en", 3*3600 + 24*60, "3 h 24 min"},
+		{"de", 3*3600 + 24*60, "3:24"},
+		{"de", 5 * 60, "0:05"},
+		{"fr", 25 * 60, "25 min"},
+		{"fr", -90 * 60, "-1 h 30 min"},
+	} {
+		if got := Get(tc.tag).Duration(tc.seconds); got != tc.want {
+			t.Errorf("%s: Duration(%v) = %q, want %q", tc.tag, tc.seconds, got, tc.want)
+		}
+	}
+	if got := Get("de").WithStyle(durationfmt.Decimal).SignedDuration(1800); got != "+0,50 h" {
+		t.Errorf("SignedDuration(1800) = %q", got)
+	}
+	if got := Get("de").Hours(5400); got != "1,5" {
+		t.Errorf("Hours(5400) = %q", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, tc := range []struct {
+		tag  string
+		want string
+		ok   bool
+	}{
+		{"en", "en", true},
+		{"fr-CA", "fr", true},
+		{"de_AT", "de", true},
+		{"xx", "en", false},
+		{"", "en", false},
+	} {
+		_, ok := Lookup(tc.tag)
+		if got := Get(tc.tag).Tag; got != tc.want || ok != tc.ok {
+			t.Errorf("%q: got %s, %v; want %s, %v", tc.tag, got, ok, tc.want, tc.ok)
+		}
+	}
+	if got := Get("de").Month(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); got != "März 2024" {
+		t.Errorf("Month = %q", got)
+	}
+}
+
+// TestBundles checks that every message of every locale takes the English
+// one's arguments.
+func TestBundles(t *testing.T) {
+	en := locales[DefaultLocale]
+	for _, tag := range Tags() {
+		l := locales[tag]
+		for key, format := range l.Messages {
+			english, ok := en.Messages[key]
+			if !ok {
+				t.Errorf("%s: %s is not an English message", tag, key)
+				continue
+			}
+			if verbs(format) != verbs(english) {
+				t.Errorf("%s: %s has %d arguments, English %d", tag, key, verbs(format), verbs(english))
+			}
+		}
+		for _, name := range append(append(l.Months[:], l.Weekdays[:]...), l.Days[:]...) {
+			if name == "" {
+				t.Errorf("%s: missing month or weekday name", tag)
+			}
+		}
+	}
+}
+
+func verbs(format string) int {
+	return strings.Count(format, "%") - 2*strings.Count(format, "%%")
+}
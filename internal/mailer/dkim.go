@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DKIM signs messages for Domain with the key published in DNS at
+// Selector._domainkey.Domain, using rsa-sha256 and relaxed/relaxed
+// canonicalization (RFC 6376).
+type DKIM struct {
+	Domain   string
+	Selector string
+	Key      *rsa.PrivateKey
+}
+
+// ParseDKIMKey reads an RSA private key in PKCS #1 or PKCS #8 PEM form.
+func ParseDKIMKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T, need RSA", key)
+	}
+	return rsaKey, nil
+}
+
+// Sign returns the DKIM-Signature header for a message with the given
+// headers, each "Name: value", and CRLF separated body. Every header is
+// signed.
+func (d *DKIM) Sign(headers []string, body string, date time.Time) (string, error) {
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+
+	names := make([]string, len(headers))
+	for i, h := range headers {
+		names[i] = strings.ToLower(strings.TrimSpace(strings.SplitN(h, ":", 2)[0]))
+	}
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.Domain, d.Selector, date.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	hash := sha256.New()
+	for _, h := range headers {
+		hash.Write([]byte(relaxedHeader(h) + "\r\n"))
+	}
+	hash.Write([]byte(relaxedHeader(signature)))
+	b, err := rsa.SignPKCS1v15(nil, d.Key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	return signature + base64.StdEncoding.EncodeToString(b), nil
+}
+
+var whitespace = regexp.MustCompile(`[ \t]+`)
+
+// relaxedHeader canonicalizes a header for signing: lower case name,
+// unfolded, runs of whitespace as one space and none around the colon or at
+// the end.
+func relaxedHeader(h string) string {
+	name, value, _ := strings.Cut(h, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = whitespace.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.TrimSpace(value)
+}
+
+// relaxedBody canonicalizes a CRLF separated body for signing: runs of
+// whitespace as one space, none at line ends, no empty lines at the end and
+// a final CRLF unless the body is empty.
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(whitespace.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
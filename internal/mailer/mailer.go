@@ -0,0 +1,141 @@
+// Package mailer sends plain text email through an SMTP relay, optionally
+// DKIM signed, or the HTTP API of a transactional email service, and queues
+// it in a persistent outbox so transient failures are retried.
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Host string
+	Port string
+	User string
+	Pass string
+
+	// Auth is the SMTP auth mechanism: "plain" (the default), "login",
+	// "cram-md5" or "none".
+	Auth string
+
+	// DKIM signs outgoing mail when set.
+	DKIM *DKIM
+}
+
+// Mailer sends mail as Config.User.
+type Mailer struct {
+	config Config
+}
+
+func New(config Config) *Mailer {
+	return &Mailer{config: config}
+}
+
+// Send mails a plain text message to a single recipient.
+func (m *Mailer) Send(to, subject, body string, headers ...string) error {
+	msg, err := m.message(to, subject, body, headers, time.Now())
+	if err != nil {
+		return err
+	}
+	auth, err := m.auth()
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.config.Host+":"+m.config.Port, auth,
+		m.config.User, []string{to}, msg)
+}
+
+// message builds the message with CRLF line endings and the extra headers,
+// signed if DKIM is configured.
+func (m *Mailer) message(to, subject, body string, extra []string, date time.Time) ([]byte, error) {
+	return message(m.config.User, m.config.Host, to, subject, body, extra, m.config.DKIM, date)
+}
+
+// message builds a message from from with CRLF line endings and the extra
+// headers, signed if dkim isn't nil. Message IDs are on the domain of from,
+// or host if it has none.
+func message(from, host, to, subject, body string, extra []string, dkim *DKIM, date time.Time) ([]byte, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := host
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + date.Format(time.RFC1123Z),
+		"Message-ID: <" + hex.EncodeToString(id) + "@" + domain + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	for _, h := range extra {
+		if strings.ContainsAny(h, "\r\n") || !strings.Contains(h, ":") {
+			return nil, fmt.Errorf("invalid header %q", h)
+		}
+		headers = append(headers, h)
+	}
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	if dkim != nil {
+		signature, err := dkim.Sign(headers, body, date)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM signing error: %v", err)
+		}
+		headers = append([]string{signature}, headers...)
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body), nil
+}
+
+func (m *Mailer) auth() (smtp.Auth, error) {
+	c := m.config
+	switch strings.ToLower(c.Auth) {
+	case "", "plain":
+		return smtp.PlainAuth("", c.User, c.Pass, c.Host), nil
+	case "login":
+		return &loginAuth{user: c.User, pass: c.Pass, host: c.Host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(c.User, c.Pass), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown SMTP auth mechanism %q", c.Auth)
+}
+
+// loginAuth is the LOGIN mechanism, which some relays offer instead of
+// PLAIN. Like smtp.PlainAuth it only sends the password over TLS or to
+// localhost.
+type loginAuth struct {
+	user, pass, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	// The example from RFC 6376 section 3.4.5
+	if got := relaxedHeader("A: X"); got != "a:X" {
+		t.Errorf("header A = %q", got)
+	}
+	if got := relaxedHeader("B : Y\t\r\n\tZ  "); got != "b:Y Z" {
+		t.Errorf("header B = %q", got)
+	}
+	if got := relaxedBody(" C \r\nD \t E\r\n\r\n\r\n"); got != " C\r\nD E\r\n" {
+		t.Errorf("body = %q", got)
+	}
+	if got := relaxedBody(""); got != "" {
+		t.Errorf("empty body = %q", got)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(Config{User: "bot@example.com", DKIM: &DKIM{Domain: "example.com", Selector: "s1", Key: key}})
+	msg, err := m.message("me@example.org", "Weekly", "Line one  \nLine two\n",
+		[]string{"List-Unsubscribe: <https://example.com/unsubscribe>"}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, body, ok := strings.Cut(string(msg), "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header/body separator in %q", msg)
+	}
+	headers := strings.Split(head, "\r\n")
+	signature, ok := strings.CutPrefix(headers[0], "DKIM-Signature: ")
+	if !ok {
+		t.Fatalf("first header %q is not the signature", headers[0])
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(signature, "; ") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[name] = value
+	}
+	if tags["d"] != "example.com" || tags["s"] != "s1" || tags["h"] != "from:to:subject:date:message-id:mime-version:content-type:list-unsubscribe" {
+		t.Errorf("signature tags %v", tags)
+	}
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("body hash %s does not match the body", tags["bh"])
+	}
+
+	// Verify as a receiver would
+	hash := sha256.New()
+	for _, h := range headers[1:] {
+		hash.Write([]byte(relaxedHeader(h) + "\r\n"))
+	}
+	unsigned := headers[0][:strings.LastIndex(headers[0], "b=")+2]
+	hash.Write([]byte(relaxedHeader(unsigned)))
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash.Sum(nil), b); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	m := New(Config{User: "bot@example.com"})
+	if _, err := m.message("me@example.org", "Weekly", "", []string{"X-Evil: a\r\nBcc: x@example.net"}, time.Now()); err == nil {
+		t.Error("header with a line break accepted")
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	a := &loginAuth{user: "u", pass: "p", host: "smtp.example.com"}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); err == nil {
+		t.Error("LOGIN started without TLS")
+	}
+	mech, _, err := a.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	if err != nil || mech != "LOGIN" {
+		t.Fatalf("Start = %q, %v", mech, err)
+	}
+	for challenge, want := range map[string]string{"Username:": "u", "Password:": "p"} {
+		if got, err := a.Next([]byte(challenge), true); err != nil || string(got) != want {
+			t.Errorf("Next(%q) = %q, %v; want %q", challenge, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Sender delivers a single message with extra headers, each "Name: value",
+// such as List-Unsubscribe; *Mailer satisfies it.
+type Sender interface {
+	Send(to, subject, body string, headers ...string) error
+}
+
+// Outbox queues messages in the store and delivers them with a Sender,
+// retrying failures with exponential backoff so a relay outage does not
+// lose them.
+type Outbox struct {
+	store       *store.Store
+	sender      Sender
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// NewOutbox returns an outbox giving up on a message after maxAttempts
+// failures, 8 when 0. Retries wait a minute, doubling up to six hours.
+func NewOutbox(st *store.Store, sender Sender, maxAttempts int) *Outbox {
+	if maxAttempts <= 0 {
+		maxAttempts = 8
+	}
+	return &Outbox{store: st, sender: sender, maxAttempts: maxAttempts, backoff: time.Minute}
+}
+
+// maxBackoff caps the wait between two attempts.
+const maxBackoff = 6 * time.Hour
+
+// Send queues a message to be delivered by the next Process.
+func (o *Outbox) Send(to, subject, body string, headers ...string) error {
+	return o.store.EnqueueEmail(&store.Email{
+		To: to, Subject: subject, Body: body, Headers: headers, CreatedAt: time.Now().Unix(),
+	})
+}
+
+// Process tries to deliver the messages due at now. Messages the relay
+// rejects permanently, or that failed too often, are marked failed.
+func (o *Outbox) Process(now time.Time) error {
+	for {
+		emails, err := o.store.DueEmails(now.Unix(), 100)
+		if err != nil {
+			return err
+		}
+		for _, e := range emails {
+			e.Attempts++
+			sentAt := int64(0)
+			if err := o.sender.Send(e.To, e.Subject, e.Body, e.Headers...); err != nil {
+				e.LastError = err.Error()
+				if permanent(err) || e.Attempts >= o.maxAttempts {
+					log.Printf("Email %d to %s failed for good: %v", e.ID, e.To, err)
+					e.Status = "failed"
+				} else {
+					log.Printf("Email %d to %s failed, retrying: %v", e.ID, e.To, err)
+					e.NextAttemptAt = now.Add(o.retryAfter(e.Attempts)).Unix()
+				}
+			} else {
+				e.Status = "sent"
+				e.LastError = ""
+				sentAt = now.Unix()
+			}
+			if err := o.store.UpdateEmail(e, sentAt); err != nil {
+				return err
+			}
+		}
+		if len(emails) < 100 {
+			return nil
+		}
+	}
+}
+
+// retryAfter is the wait after the given number of failed attempts.
+func (o *Outbox) retryAfter(attempts int) time.Duration {
+	d := o.backoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// permanent reports whether the relay rejected a message with a 5xx reply,
+// or an email API with a 4xx status other than 429, which retrying will
+// not fix.
+func permanent(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500
+	}
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 &&
+		httpErr.StatusCode != http.StatusTooManyRequests
+}
@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// flakySender fails with the queued errors before succeeding, keeping the
+// headers of the last message sent.
+type flakySender struct {
+	errs    []error
+	sent    []string
+	headers []string
+}
+
+func (f *flakySender) Send(to, subject, body string, headers ...string) error {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	f.sent = append(f.sent, to)
+	f.headers = headers
+	return nil
+}
+
+func newStore(t *testing.T) *store.Store {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestOutboxRetries(t *testing.T) {
+	st := newStore(t)
+	sender := &flakySender{errs: []error{errors.New("connection refused"), errors.New("timeout")}}
+	o := NewOutbox(st, sender, 3)
+	if err := o.Send("me@example.org", "Weekly", "body", "List-Unsubscribe: <https://example.com/u>", "X-Test: 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, step := range []struct {
+		after time.Duration
+		sent  int
+	}{
+		{0, 0},                           // fails, retry in a minute
+		{30 * time.Second, 0},            // not due yet
+		{time.Minute, 0},                 // fails, retry in two minutes
+		{2*time.Minute + time.Second, 1}, // sent
+		{time.Hour, 1},                   // nothing left
+	} {
+		now = now.Add(step.after)
+		if err := o.Process(now); err != nil {
+			t.Fatal(err)
+		}
+		if len(sender.sent) != step.sent {
+			t.Fatalf("after %v: sent %d, want %d", step.after, len(sender.sent), step.sent)
+		}
+	}
+	if len(sender.headers) != 2 || sender.headers[1] != "X-Test: 1" {
+		t.Errorf("headers after queueing = %q", sender.headers)
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	st := newStore(t)
+	rejected := &textproto.Error{Code: 550, Msg: "no such user"}
+	sender := &flakySender{errs: []error{rejected, errors.New("timeout"), errors.New("timeout")}}
+	o := NewOutbox(st, sender, 2)
+	for _, to := range []string{"nobody@example.org", "me@example.org"} {
+		if err := o.Send(to, "Weekly", "body"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := o.Process(now); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(maxBackoff)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("sent %v, want nothing", sender.sent)
+	}
+	if due, err := st.DueEmails(now.Unix(), 10); err != nil || len(due) != 0 {
+		t.Errorf("due emails %v, %v; want none", due, err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	o := NewOutbox(nil, nil, 0)
+	for attempts, want := range map[int]time.Duration{
+		1: time.Minute, 2: 2 * time.Minute, 3: 4 * time.Minute, 20: maxBackoff,
+	} {
+		if got := o.retryAfter(attempts); got != want {
+			t.Errorf("retryAfter(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
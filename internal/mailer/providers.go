@@ -0,0 +1,280 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HTTPError is a transactional email API refusing a message. Like SMTP 5xx
+// replies, 4xx statuses other than 429 are permanent.
+type HTTPError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// NewProvider returns the sender for an EMAIL_PROVIDER URL naming an HTTP
+// API, sending as from:
+//
+//	sendgrid://apikey:<api key>@api.sendgrid.com
+//	mailgun://api:<api key>@api.mailgun.net/<domain>
+//	ses://<access key id>:<secret access key>@email.<region>.amazonaws.com
+//
+// Many home ISPs block outbound SMTP, which these get around. The host may
+// be left out for the default, except for SES, whose host has the region.
+func NewProvider(rawURL, from string) (Sender, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" {
+		return nil, fmt.Errorf("%s needs EMAIL_FROM", u.Scheme)
+	}
+	secret, _ := u.User.Password()
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch u.Scheme {
+	case "sendgrid":
+		host := u.Host
+		if host == "" {
+			host = "api.sendgrid.com"
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("sendgrid needs an API key, sendgrid://apikey:<key>@%s", host)
+		}
+		return &SendGrid{APIKey: secret, From: from, Endpoint: "https://" + host + "/v3/mail/send", Client: client}, nil
+	case "mailgun":
+		host := u.Host
+		if host == "" {
+			host = "api.mailgun.net"
+		}
+		domain := strings.Trim(u.Path, "/")
+		if secret == "" || domain == "" {
+			return nil, fmt.Errorf("mailgun needs an API key and domain, mailgun://api:<key>@%s/<domain>", host)
+		}
+		return &Mailgun{APIKey: secret, From: from, Endpoint: "https://" + host + "/v3/" + domain + "/messages", Client: client}, nil
+	case "ses":
+		parts := strings.Split(u.Host, ".")
+		if len(parts) != 4 || parts[0] != "email" || parts[2] != "amazonaws" || parts[3] != "com" {
+			return nil, fmt.Errorf("ses needs the API host of a region, email.<region>.amazonaws.com, not %q", u.Host)
+		}
+		if u.User.Username() == "" || secret == "" {
+			return nil, fmt.Errorf("ses needs an access key, ses://<key id>:<secret>@%s", u.Host)
+		}
+		return &SES{AccessKeyID: u.User.Username(), SecretAccessKey: secret, Region: parts[1], From: from,
+			Endpoint: "https://" + u.Host + "/v2/email/outbound-emails", Client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown email provider %q, want smtp, sendgrid, mailgun or ses", u.Scheme)
+}
+
+// SendGrid sends mail with SendGrid's v3 mail send API.
+type SendGrid struct {
+	APIKey   string
+	From     string
+	Endpoint string
+	Client   *http.Client
+}
+
+// Send mails a plain text message to a single recipient.
+func (p *SendGrid) Send(to, subject, body string, headers ...string) error {
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type personalization struct {
+		To []address `json:"to"`
+	}
+	extra, err := headerMap(headers)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(struct {
+		Personalizations []personalization `json:"personalizations"`
+		From             address           `json:"from"`
+		Subject          string            `json:"subject"`
+		Content          []content         `json:"content"`
+		Headers          map[string]string `json:"headers,omitempty"`
+	}{
+		Personalizations: []personalization{{To: []address{{to}}}},
+		From:             address{p.From},
+		Subject:          subject,
+		Content:          []content{{"text/plain", body}},
+		Headers:          extra,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	return do(p.Client, "sendgrid", req)
+}
+
+// Mailgun sends mail with Mailgun's messages API for a domain.
+type Mailgun struct {
+	APIKey   string
+	From     string
+	Endpoint string
+	Client   *http.Client
+}
+
+// Send mails a plain text message to a single recipient.
+func (p *Mailgun) Send(to, subject, body string, headers ...string) error {
+	extra, err := headerMap(headers)
+	if err != nil {
+		return err
+	}
+	form := url.Values{"from": {p.From}, "to": {to}, "subject": {subject}, "text": {body}}
+	for name, value := range extra {
+		form.Set("h:"+name, value)
+	}
+	req, err := http.NewRequest("POST", p.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", p.APIKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do(p.Client, "mailgun", req)
+}
+
+// SES sends mail with Amazon SES's v2 SendEmail API as a raw message, so
+// extra headers survive, signing requests with AWS Signature Version 4.
+type SES struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	From            string
+	Endpoint        string
+	Client          *http.Client
+}
+
+// Send mails a plain text message to a single recipient.
+func (p *SES) Send(to, subject, body string, headers ...string) error {
+	now := time.Now()
+	msg, err := message(p.From, "amazonses.com", to, subject, body, headers, nil, now)
+	if err != nil {
+		return err
+	}
+	// Raw data is base64 in JSON, as Go marshals a []byte
+	var payload struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct{ Raw struct{ Data []byte } }
+	}
+	payload.FromEmailAddress = p.From
+	payload.Destination.ToAddresses = []string{to}
+	payload.Content.Raw.Data = msg
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, data, p.AccessKeyID, p.SecretAccessKey, p.Region, "ses", now)
+	return do(p.Client, "ses", req)
+}
+
+// headerMap splits headers, each "Name: value", for APIs that take them as
+// fields.
+func headerMap(headers []string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.ContainsAny(h, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", h)
+		}
+		m[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+// do sends an API request, turning statuses other than 2xx into an
+// *HTTPError.
+func do(client *http.Client, provider string, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &HTTPError{Provider: provider, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+// signV4 signs req, with the given body, for an AWS service in region,
+// adding the X-Amz-Date and Authorization headers. The host, X-Amz-Date
+// and Content-Type, if set, are signed.
+func signV4(req *http.Request, body []byte, keyID, secret, region, service string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": stamp}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, path, req.URL.Query().Encode(),
+		canonicalHeaders.String(), signed, hex.EncodeToString(bodyHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,144 @@
+// Package milestones watches for users reaching their daily goal, beating
+// their best day or reaching a streak of days with time tracked, and
+// publishes them on the event bus for webhooks and other subscribers.
+package milestones
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// streaks are the streak lengths, in days, that are milestones. Days off
+// neither break nor extend streaks.
+var streaks = []int{7, 30, 100, 365}
+
+// Milestone is what a user reached on Day, the event's Data. Seconds is
+// the time tracked on Day so far; GoalMinutes, PreviousRecord and Streak
+// are set for the events they are about.
+type Milestone struct {
+	Event          string  `json:"event"`
+	UserID         string  `json:"user_id"`
+	Day            string  `json:"day"`
+	Seconds        float64 `json:"seconds"`
+	GoalMinutes    int     `json:"goal_minutes,omitempty"`
+	PreviousRecord float64 `json:"previous_record,omitempty"`
+	Streak         int     `json:"streak,omitempty"`
+}
+
+// Detector checks the users who sent heartbeats for new milestones.
+type Detector struct {
+	store *store.Store
+	bus   *events.Bus
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// New returns a detector publishing on bus, to which it subscribes for
+// the heartbeats of users to check.
+func New(st *store.Store, bus *events.Bus) *Detector {
+	d := &Detector{store: st, bus: bus, pending: make(map[string]bool)}
+	bus.Subscribe(events.HeartbeatReceived, func(e events.Event) {
+		d.mu.Lock()
+		d.pending[e.UserID] = true
+		d.mu.Unlock()
+	})
+	return d
+}
+
+// Run checks the users who sent heartbeats since the last run, as a
+// scheduled task, publishing each milestone the first time it is reached
+// on a day.
+func (d *Detector) Run(now time.Time) error {
+	d.mu.Lock()
+	users := d.pending
+	d.pending = make(map[string]bool)
+	d.mu.Unlock()
+
+	for userID := range users {
+		reached, err := d.Check(userID, now)
+		if err != nil {
+			// Check them again on the next run
+			d.mu.Lock()
+			for userID := range users {
+				d.pending[userID] = true
+			}
+			d.mu.Unlock()
+			return err
+		}
+		for _, m := range reached {
+			first, err := d.store.RecordMilestone(m.UserID, m.Event, m.Day, now)
+			if err != nil {
+				return fmt.Errorf("milestone error: %v", err)
+			}
+			if first {
+				d.bus.Publish(events.Event{Name: m.Event, UserID: m.UserID, Time: now, Data: m})
+			}
+		}
+	}
+	return nil
+}
+
+// Check returns the milestones a user reached on their day at now so far.
+func (d *Detector) Check(userID string, now time.Time) ([]Milestone, error) {
+	prefs, err := d.store.NotificationPrefs(userID)
+	if err != nil {
+		return nil, fmt.Errorf("notification preferences query error: %v", err)
+	}
+	day := prefs.Day(now)
+	first := day.AddDate(0, 0, -streaks[len(streaks)-1])
+	days, err := d.store.DailyTotals(userID, first, day)
+	if err != nil {
+		return nil, fmt.Errorf("daily totals query error: %v", err)
+	}
+	date := day.Format("2006-01-02")
+	seconds := days[date]
+	if seconds <= 0 {
+		return nil, nil
+	}
+	milestone := func(event string) Milestone {
+		return Milestone{Event: event, UserID: userID, Day: date, Seconds: seconds}
+	}
+
+	var reached []Milestone
+	if goal := prefs.DailyGoalMinutes; goal > 0 && seconds >= float64(goal)*60 {
+		m := milestone(events.GoalCompleted)
+		m.GoalMinutes = goal
+		reached = append(reached, m)
+	}
+
+	best, err := d.store.BestDay(userID, day)
+	if err != nil {
+		return nil, fmt.Errorf("best day query error: %v", err)
+	}
+	if best > 0 && seconds > best {
+		m := milestone(events.DailyRecord)
+		m.PreviousRecord = best
+		reached = append(reached, m)
+	}
+
+	off, err := d.store.DaysOff(userID, first, day)
+	if err != nil {
+		return nil, fmt.Errorf("time off query error: %v", err)
+	}
+	streak := 0
+	for t := day; !t.Before(first); t = t.AddDate(0, 0, -1) {
+		key := t.Format("2006-01-02")
+		if days[key] > 0 {
+			streak++
+		} else if !off[key] {
+			break
+		}
+	}
+	if slices.Contains(streaks, streak) {
+		m := milestone(events.StreakMilestone)
+		m.Streak = streak
+		reached = append(reached, m)
+	}
+	return reached, nil
+}
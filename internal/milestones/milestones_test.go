@@ -0,0 +1,115 @@
+package milestones
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/store"
+)
+
+func newStore(t *testing.T) *store.Store {
+	t.Helper()
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// track stores a heartbeat of seconds for user at noon on each of days,
+// publishing them as the API does.
+func track(t *testing.T, st *store.Store, bus *events.Bus, user string, seconds float64, days ...time.Time) {
+	t.Helper()
+	var heartbeats []store.Heartbeat
+	for _, day := range days {
+		heartbeats = append(heartbeats, store.Heartbeat{
+			UserID: user, Project: "p", Language: "Go", Entity: "/p/main.go",
+			Duration: seconds, Timestamp: day.Add(12 * time.Hour).Unix(),
+		})
+	}
+	if err := st.StoreHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(events.Event{Name: events.HeartbeatReceived, UserID: user, Data: heartbeats})
+}
+
+func TestCheck(t *testing.T) {
+	st := newStore(t)
+	bus := events.New()
+	d := New(st, bus)
+	today := time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)
+	now := today.Add(18 * time.Hour)
+
+	// Six days with time, then a day off, so today is the seventh day of
+	// the streak
+	for i := 1; i <= 7; i++ {
+		if i != 3 {
+			track(t, st, bus, "alice", 3600, today.AddDate(0, 0, -i))
+		}
+	}
+	off := store.TimeOff{UserID: "alice", From: today.AddDate(0, 0, -3).Format("2006-01-02")}
+	off.To = off.From
+	if err := st.AddTimeOff(&off); err != nil {
+		t.Fatal(err)
+	}
+	if reached, err := d.Check("alice", now); err != nil || len(reached) != 0 {
+		t.Fatalf("milestones before tracking today: %+v, %v", reached, err)
+	}
+
+	prefs := store.DefaultNotificationPrefs("alice")
+	prefs.DailyGoalMinutes = 90
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+	track(t, st, bus, "alice", 3600, today)
+	reached, err := d.Check("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reached) != 1 || reached[0].Event != events.StreakMilestone || reached[0].Streak != 7 {
+		t.Errorf("milestones after an hour: %+v, want a streak of 7", reached)
+	}
+
+	track(t, st, bus, "alice", 1800, today.Add(time.Hour))
+	reached, err = d.Check("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reached) != 3 || reached[0].GoalMinutes != 90 || reached[1].PreviousRecord != 3600 || reached[0].Seconds != 5400 {
+		t.Errorf("milestones after 90 minutes: %+v", reached)
+	}
+}
+
+func TestRun(t *testing.T) {
+	st := newStore(t)
+	bus := events.New()
+	d := New(st, bus)
+	var published []events.Event
+	bus.Subscribe(events.DailyRecord, func(e events.Event) { published = append(published, e) })
+
+	today := time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)
+	now := today.Add(18 * time.Hour)
+	track(t, st, bus, "alice", 3600, today.AddDate(0, 0, -1))
+	track(t, st, bus, "alice", 7200, today)
+	if err := d.Run(now); err != nil {
+		t.Fatal(err)
+	}
+	// More heartbeats on the same day don't publish the record again
+	track(t, st, bus, "alice", 60, today.Add(time.Hour))
+	if err := d.Run(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 {
+		t.Fatalf("published %+v, want one record", published)
+	}
+	m, ok := published[0].Data.(Milestone)
+	if !ok || published[0].UserID != "alice" || m.Day != "2024-03-11" || m.Seconds != 7200 || m.PreviousRecord != 3600 {
+		t.Errorf("published %+v", published[0])
+	}
+}
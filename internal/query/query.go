@@ -0,0 +1,334 @@
+// Package query parses the small analytics language accepted by
+// /api/v1/query, e.g.
+//
+//	select project, language, sum(duration)
+//	where language in ("Go", "Lua") and tag = "oss"
+//	from 2024-03-01 to 2024-03-31
+//	order by sum(duration) desc
+//	limit 10
+//
+// Parsing only builds a Query; the store compiles it to parameterized SQL,
+// so values never end up in the SQL text.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Metrics that may be selected, with what they compute.
+var Metrics = map[string]string{
+	"sum(duration)": "total seconds",
+	"avg(duration)": "average heartbeat length in seconds",
+	"min(duration)": "shortest heartbeat in seconds",
+	"max(duration)": "longest heartbeat in seconds",
+	"count()":       "number of heartbeats",
+	"days()":        "number of distinct UTC days",
+}
+
+// Item is a selected dimension or metric, written as in the query.
+type Item struct {
+	Name   string
+	Metric bool
+}
+
+// Filter keeps heartbeats whose dimension matches one of Values, or none of
+// them when Negate is set. The dimension "tag" matches heartbeat tags.
+type Filter struct {
+	Dimension string
+	Negate    bool
+	Values    []string
+}
+
+// Query is a parsed query.
+type Query struct {
+	Select  []Item
+	Where   []Filter
+	From    time.Time // zero when not given
+	To      time.Time // zero when not given, included
+	OrderBy *Item
+	Desc    bool
+	Limit   int // 0 when not given
+}
+
+// Parse parses a query. Dimension names are not checked against the store.
+func Parse(text string) (Query, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return Query{}, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.query()
+	if err != nil {
+		return Query{}, err
+	}
+	return q, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(text string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], byte(c))
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, text[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '!' && i+1 < len(text) && text[i+1] == '=':
+			tokens = append(tokens, token{tokPunct, "!=", i})
+			i += 2
+		case strings.ContainsRune("(),=", c):
+			tokens = append(tokens, token{tokPunct, string(c), i})
+			i++
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(text) && (unicode.IsDigit(rune(text[i])) || text[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, text[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(text) && (unicode.IsLetter(rune(text[i])) || unicode.IsDigit(rune(text[i])) || text[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, strings.ToLower(text[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(text)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given word or punctuation.
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokWord || t.kind == tokPunct) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	found := "end of query"
+	if t.kind != tokEOF {
+		found = strconv.Quote(t.text)
+	}
+	return fmt.Errorf(format+", found %s at %d", append(args, found, t.pos)...)
+}
+
+func (p *parser) query() (Query, error) {
+	var q Query
+	if err := p.expect("select"); err != nil {
+		return q, err
+	}
+	for {
+		item, err := p.item()
+		if err != nil {
+			return q, err
+		}
+		q.Select = append(q.Select, item)
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if p.accept("where") {
+		for {
+			filter, err := p.filter()
+			if err != nil {
+				return q, err
+			}
+			q.Where = append(q.Where, filter)
+			if !p.accept("and") {
+				break
+			}
+		}
+	}
+
+	if p.accept("from") {
+		day, err := p.day()
+		if err != nil {
+			return q, err
+		}
+		q.From = day
+	}
+	if p.accept("to") {
+		day, err := p.day()
+		if err != nil {
+			return q, err
+		}
+		q.To = day
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.From.After(q.To) {
+		return q, fmt.Errorf("from %s is after to %s", q.From.Format("2006-01-02"), q.To.Format("2006-01-02"))
+	}
+
+	if p.accept("order") {
+		if err := p.expect("by"); err != nil {
+			return q, err
+		}
+		item, err := p.item()
+		if err != nil {
+			return q, err
+		}
+		selected := false
+		for _, s := range q.Select {
+			selected = selected || s == item
+		}
+		if !selected {
+			return q, fmt.Errorf("can only order by a selected column, not %s", item.Name)
+		}
+		q.OrderBy = &item
+		if p.accept("desc") {
+			q.Desc = true
+		} else {
+			p.accept("asc")
+		}
+	}
+
+	if p.accept("limit") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n <= 0 {
+			return q, p.errorf("expected a positive limit")
+		}
+		p.next()
+		q.Limit = n
+	}
+
+	if p.peek().kind != tokEOF {
+		return q, p.errorf("unexpected input")
+	}
+	return q, nil
+}
+
+// item is a dimension name or a metric call such as sum(duration).
+func (p *parser) item() (Item, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return Item{}, p.errorf("expected a dimension or metric")
+	}
+	p.next()
+	if !p.accept("(") {
+		return Item{Name: t.text}, nil
+	}
+	name := t.text + "("
+	if arg := p.peek(); arg.kind == tokWord {
+		name += p.next().text
+	}
+	if err := p.expect(")"); err != nil {
+		return Item{}, err
+	}
+	name += ")"
+	if _, ok := Metrics[name]; !ok {
+		return Item{}, fmt.Errorf("unknown metric %s", name)
+	}
+	return Item{Name: name, Metric: true}, nil
+}
+
+// filter is dimension = value, dimension != value or
+// dimension [not] in (value, ...).
+func (p *parser) filter() (Filter, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return Filter{}, p.errorf("expected a dimension to filter on")
+	}
+	p.next()
+	f := Filter{Dimension: t.text}
+	switch {
+	case p.accept("="):
+	case p.accept("!="):
+		f.Negate = true
+	default:
+		f.Negate = p.accept("not")
+		if err := p.expect("in"); err != nil {
+			return f, err
+		}
+		if err := p.expect("("); err != nil {
+			return f, err
+		}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return f, err
+			}
+			f.Values = append(f.Values, v)
+			if !p.accept(",") {
+				break
+			}
+		}
+		return f, p.expect(")")
+	}
+	v, err := p.value()
+	if err != nil {
+		return f, err
+	}
+	f.Values = []string{v}
+	return f, nil
+}
+
+func (p *parser) value() (string, error) {
+	t := p.peek()
+	if t.kind != tokString && t.kind != tokNumber {
+		return "", p.errorf("expected a quoted value or a number")
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *parser) day() (time.Time, error) {
+	t := p.peek()
+	day, err := time.Parse("2006-01-02", t.text)
+	if (t.kind != tokNumber && t.kind != tokString) || err != nil {
+		return time.Time{}, p.errorf("expected a YYYY-MM-DD day")
+	}
+	p.next()
+	return day, nil
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	sum := Item{Name: "sum(duration)", Metric: true}
+
+	for _, tc := range []struct {
+		name string
+		text string
+		want Query
+		err  string
+	}{
+		{
+			name: "dimension and metric",
+			text: "select project, sum(duration)",
+			want: Query{Select: []Item{{Name: "project"}, sum}},
+		},
+		{
+			name: "everything",
+			text: `SELECT language, count() WHERE tag = "oss" AND project NOT IN ('a', "b")
+				FROM 2024-03-01 TO 2024-03-31 ORDER BY count() DESC LIMIT 5`,
+			want: Query{
+				Select: []Item{{Name: "language"}, {Name: "count()", Metric: true}},
+				Where: []Filter{
+					{Dimension: "tag", Values: []string{"oss"}},
+					{Dimension: "project", Negate: true, Values: []string{"a", "b"}},
+				},
+				From:    day("2024-03-01"),
+				To:      day("2024-03-31"),
+				OrderBy: &Item{Name: "count()", Metric: true},
+				Desc:    true,
+				Limit:   5,
+			},
+		},
+		{
+			name: "not equal and numbers",
+			text: "select day, sum(duration) where manual != 1 order by day asc",
+			want: Query{
+				Select:  []Item{{Name: "day"}, sum},
+				Where:   []Filter{{Dimension: "manual", Negate: true, Values: []string{"1"}}},
+				OrderBy: &Item{Name: "day"},
+			},
+		},
+		{
+			name: "quote in value",
+			text: `select project where project = "it's"`,
+			want: Query{
+				Select: []Item{{Name: "project"}},
+				Where:  []Filter{{Dimension: "project", Values: []string{"it's"}}},
+			},
+		},
+		{name: "empty", text: "", err: `expected "select", found end of query`},
+		{name: "unknown metric", text: "select drop(table)", err: "unknown metric drop(table)"},
+		{name: "unquoted value", text: "select project where project = a", err: "expected a quoted value"},
+		{name: "unterminated string", text: `select project where project = "a`, err: "unterminated string"},
+		{name: "order by unselected", text: "select project order by language", err: "can only order by a selected column"},
+		{name: "zero limit", text: "select project limit 0", err: "expected a positive limit"},
+		{name: "bad day", text: "select project from 2024-13-01", err: "expected a YYYY-MM-DD day"},
+		{name: "from after to", text: "select project from 2024-03-02 to 2024-03-01", err: "is after to"},
+		{name: "stray character", text: "select project; drop table heartbeats", err: "unexpected ';'"},
+		{name: "trailing input", text: "select project limit 1 2", err: "unexpected input"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Parse(tc.text)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
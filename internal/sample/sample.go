@@ -0,0 +1,172 @@
+// Package sample generates made-up but plausible coding activity, for
+// exploring the dashboard and reports before any editor sends heartbeats
+// and for demo servers.
+package sample
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"path"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Interval is how often the generated editors send a heartbeat.
+const Interval = 2 * time.Minute
+
+// project is a made-up project: its files and how much of the time it
+// gets.
+type project struct {
+	name        string
+	workspace   string
+	color       string
+	description string
+	weight      int
+	files       []string
+	branches    []string
+}
+
+var projects = []project{
+	{
+		name: "eztracker", workspace: "oss", color: "#00add8", weight: 5,
+		description: "Coding time tracker",
+		files: []string{"cmd/eztracker/main.go", "internal/store/store.go", "internal/api/api.go",
+			"internal/api/report.go", "README.md", "Makefile"},
+		branches: []string{"main", "fix-timezones", "workspaces"},
+	},
+	{
+		name: "storefront", workspace: "work", color: "#3178c6", weight: 4,
+		description: "Customer-facing web shop",
+		files: []string{"src/App.tsx", "src/cart/Cart.tsx", "src/api/client.ts",
+			"src/styles/main.css", "public/index.html", "package.json"},
+		branches: []string{"main", "checkout-redesign"},
+	},
+	{
+		name: "infra", workspace: "work", color: "#844fba", weight: 2,
+		description: "Deployment and CI configuration",
+		files: []string{"deploy/values.yaml", "deploy/ingress.yaml", "scripts/release.sh",
+			"terraform/main.tf", "Dockerfile"},
+		branches: []string{"main"},
+	},
+	{
+		name: "notes", color: "#083fa1", weight: 1,
+		description: "Personal notes and drafts",
+		files:       []string{"ideas.md", "talks/gophercon.md", "reading.md"},
+		branches:    []string{"main"},
+	},
+}
+
+// languages maps file extensions and names to languages.
+var languages = map[string]string{
+	".go": "Go", ".md": "Markdown", ".tsx": "TSX", ".ts": "TypeScript", ".css": "CSS",
+	".html": "HTML", ".json": "JSON", ".yaml": "YAML", ".sh": "Bash", ".tf": "HCL",
+	"Makefile": "Makefile", "Dockerfile": "Dockerfile",
+}
+
+// categories weight what the time is spent on.
+var categories = []string{"coding", "coding", "coding", "coding", "debugging", "code reviewing", "writing tests"}
+
+// Heartbeats makes up a user's heartbeats over the days before now, in
+// sessions of work on one project at a time, mostly on weekdays during
+// office hours. The same seed makes up the same heartbeats.
+func Heartbeats(userID string, days int, now time.Time, seed int64) []store.Heartbeat {
+	rnd := rand.New(rand.NewSource(seed))
+	today := now.UTC().Truncate(24 * time.Hour)
+	var heartbeats []store.Heartbeat
+	for d := days - 1; d >= 0; d-- {
+		day := today.AddDate(0, 0, -d)
+		sessions := 2 + rnd.Intn(3)
+		if weekday := day.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+			if rnd.Intn(4) != 0 {
+				continue
+			}
+			sessions = 1
+		}
+		// One day in twelve off
+		if rnd.Intn(12) == 0 {
+			continue
+		}
+
+		start := day.Add(time.Duration(8*60+rnd.Intn(120)) * time.Minute)
+		for s := 0; s < sessions; s++ {
+			p := pick(rnd)
+			branch := p.branches[rnd.Intn(len(p.branches))]
+			category := categories[rnd.Intn(len(categories))]
+			session := fmt.Sprintf("sample-%s-%d", day.Format("20060102"), s)
+			length := time.Duration(30+rnd.Intn(120)) * time.Minute
+			file := p.files[rnd.Intn(len(p.files))]
+			for t := start; t.Before(start.Add(length)) && t.Before(now); t = t.Add(Interval) {
+				// Moving on to another file now and then
+				if rnd.Intn(5) == 0 {
+					file = p.files[rnd.Intn(len(p.files))]
+				}
+				heartbeats = append(heartbeats, store.Heartbeat{
+					UserID:      userID,
+					Project:     p.name,
+					ProjectRoot: "/home/" + userID + "/src/" + p.name,
+					Language:    language(file),
+					Entity:      "/home/" + userID + "/src/" + p.name + "/" + file,
+					EntityType:  "file",
+					Category:    category,
+					Branch:      branch,
+					Duration:    Interval.Seconds(),
+					Timestamp:   t.Unix(),
+					SessionID:   session,
+				})
+			}
+			// A break before the next session
+			start = start.Add(length + time.Duration(15+rnd.Intn(90))*time.Minute)
+		}
+	}
+	return heartbeats
+}
+
+// Seed stores made-up heartbeats of a user over the days before now, and
+// gives their projects colors, descriptions and workspaces. It returns how
+// many heartbeats were stored.
+func Seed(st *store.Store, userID string, days int, now time.Time) (int, error) {
+	heartbeats := Heartbeats(userID, days, now, now.Unix())
+	if err := st.StoreHeartbeats(heartbeats); err != nil {
+		return 0, err
+	}
+	for _, p := range projects {
+		stored, err := st.Project(userID, p.name)
+		if err == sql.ErrNoRows {
+			// Not worked on in so few days
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		stored.Color, stored.Description, stored.Workspace = p.color, p.description, p.workspace
+		if err := st.UpdateProject(stored); err != nil {
+			return 0, err
+		}
+	}
+	return len(heartbeats), nil
+}
+
+// pick picks a project by weight.
+func pick(rnd *rand.Rand) project {
+	total := 0
+	for _, p := range projects {
+		total += p.weight
+	}
+	n := rnd.Intn(total)
+	for _, p := range projects {
+		if n < p.weight {
+			return p
+		}
+		n -= p.weight
+	}
+	return projects[0]
+}
+
+func language(file string) string {
+	if l, ok := languages[path.Base(file)]; ok {
+		return l
+	}
+	return languages[path.Ext(file)]
+}
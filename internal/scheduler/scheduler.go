@@ -0,0 +1,112 @@
+// Package scheduler runs the server's periodic tasks, such as sending the
+// weekly summaries and pruning old data, on interval or cron schedules.
+// Each run is recorded in the store, so a run missed while the server was
+// down is caught up on at startup and task failures can be monitored, and a
+// task that panics doesn't take the server or its other tasks down.
+package scheduler
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Task is work to do on a schedule. Run is given the scheduled time, which
+// is in the past when catching up on a missed run.
+type Task struct {
+	Name     string
+	Schedule Schedule
+	Run      func(at time.Time) error
+}
+
+// Runner runs tasks on their schedules.
+type Runner struct {
+	store *store.Store
+	tasks []Task
+}
+
+// New returns a runner recording task runs in st.
+func New(st *store.Store) *Runner {
+	return &Runner{store: st}
+}
+
+// Add registers a task to be run once Start is called.
+func (r *Runner) Add(t Task) {
+	r.tasks = append(r.tasks, t)
+}
+
+// Start runs every task on its schedule, each in its own goroutine.
+func (r *Runner) Start() {
+	for _, t := range r.tasks {
+		go r.loop(t, time.Now())
+	}
+}
+
+// loop catches up on the last run of t missed before now, then runs it on
+// its schedule. It never returns unless the schedule ends.
+func (r *Runner) loop(t Task, now time.Time) {
+	if missed := r.missed(t, now); !missed.IsZero() {
+		r.RunTask(t, missed)
+	}
+	for next := t.Schedule.Next(now); !next.IsZero(); {
+		time.Sleep(time.Until(next))
+		r.RunTask(t, next)
+		// Skip the runs a slow one overlapped
+		if now := time.Now(); now.After(next) {
+			next = t.Schedule.Next(now)
+		} else {
+			next = t.Schedule.Next(next)
+		}
+	}
+	log.Printf("Task %s has no next run", t.Name)
+}
+
+// catchUpWindow is how far back runs missed while the server was down are
+// looked for, enough for monthly tasks.
+const catchUpWindow = 32 * 24 * time.Hour
+
+// missed returns the latest scheduled time of t after its last recorded
+// run and up to now, or the zero time when it didn't miss any or never ran.
+func (r *Runner) missed(t Task, now time.Time) time.Time {
+	last, err := r.store.TaskRun(t.Name)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Task run lookup error: ", err)
+		}
+		return time.Time{}
+	}
+	from := time.Unix(last.LastRun, 0).In(now.Location())
+	if windowStart := now.Add(-catchUpWindow); from.Before(windowStart) {
+		from = windowStart
+	}
+	var missed time.Time
+	for at := t.Schedule.Next(from); !at.IsZero() && !at.After(now); at = t.Schedule.Next(at) {
+		missed = at
+	}
+	return missed
+}
+
+// RunTask runs t for the scheduled time at and records the run, turning a
+// panic into a failed run.
+func (r *Runner) RunTask(t Task, at time.Time) (err error) {
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+			log.Printf("Task %s panicked: %v\n%s", t.Name, p, debug.Stack())
+		}
+		var errMsg string
+		if err != nil {
+			errMsg = err.Error()
+			log.Printf("Task %s error: %v", t.Name, err)
+		}
+		if rerr := r.store.RecordTaskRun(t.Name, at.Unix(), time.Since(start).Milliseconds(), errMsg); rerr != nil {
+			log.Println("Task run record error: ", rerr)
+		}
+	}()
+	return t.Run(at)
+}
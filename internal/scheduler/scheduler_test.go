@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestCron(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2024, 3, 13, 10, 17, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 13, 10, 18, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, 3, 13, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 13, 10, 30, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2024, 3, 14, 3, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 3, 14, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week
+		{"0 0 1 * 5", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Cron(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(now); !got.Equal(tc.want) {
+			t.Errorf("%s: Next = %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := Cron(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestRunner(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(st)
+
+	var ran []time.Time
+	hourly := Task{Name: "hourly", Schedule: Every(time.Hour), Run: func(at time.Time) error {
+		ran = append(ran, at)
+		return nil
+	}}
+	now := time.Date(2024, 3, 13, 10, 17, 0, 0, time.UTC)
+	if missed := r.missed(hourly, now); !missed.IsZero() {
+		t.Errorf("never ran, missed %v", missed)
+	}
+	if err := r.RunTask(hourly, time.Date(2024, 3, 13, 7, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the latest of the runs missed while down is caught up on
+	if missed := r.missed(hourly, now); !missed.Equal(time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("missed %v, want 10:00", missed)
+	}
+	if missed := r.missed(hourly, time.Date(2024, 3, 13, 7, 30, 0, 0, time.UTC)); !missed.IsZero() {
+		t.Errorf("missed %v before the next run", missed)
+	}
+
+	// Failures and panics are recorded, not fatal
+	failing := Task{Name: "failing", Schedule: Every(time.Hour), Run: func(time.Time) error {
+		return errors.New("relay down")
+	}}
+	panicking := Task{Name: "panicking", Schedule: Every(time.Hour), Run: func(time.Time) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	}}
+	for _, task := range []Task{failing, failing, panicking} {
+		if err := r.RunTask(task, now); err == nil {
+			t.Errorf("%s: no error", task.Name)
+		}
+	}
+
+	runs, err := st.TaskRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []store.TaskRun{
+		{Name: "failing", LastRun: now.Unix(), LastError: "relay down", Runs: 2, Failures: 2},
+		{Name: "hourly", LastRun: time.Date(2024, 3, 13, 7, 0, 0, 0, time.UTC).Unix(), Runs: 1},
+		{Name: "panicking", LastRun: now.Unix(), LastError: "panic: assignment to entry in nil map", Runs: 1, Failures: 1},
+	}
+	for i := range runs {
+		runs[i].DurationMS = 0
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("got %+v, want %+v", runs, want)
+	}
+	for i := range want {
+		if runs[i] != want[i] {
+			t.Errorf("got %+v, want %+v", runs[i], want[i])
+		}
+	}
+	if len(ran) != 1 {
+		t.Errorf("ran %v", ran)
+	}
+}
@@ -0,0 +1,437 @@
+// Package script runs the Lua scripts admins register over heartbeats as
+// they come in, for tagging and filtering that rules can't express. Each
+// script sees the heartbeat as the global table heartbeat, may change its
+// project, language, entity, category, branch and tags, and drops it by
+// returning false.
+//
+// Each run of a script, on one heartbeat, gets a Lua state of its own, so
+// nothing a script sets is left for the next heartbeat or script to see.
+//
+// Scripts are sandboxed: they get the base, string, table and math
+// libraries without anything that loads code, touches files or prints,
+// their stack is capped, and each run is stopped after Timeout. The
+// strings a run builds, with .. or the string and table libraries, are
+// charged to it before they are built, and it fails once they would pass
+// maxAlloc bytes; tables grow at most a value per instruction, so Timeout
+// bounds them.
+package script
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Timeout is how long a script may run on one heartbeat.
+const Timeout = 10 * time.Millisecond
+
+// maxAlloc is how many bytes of strings a script may build on one
+// heartbeat.
+var maxAlloc = 32 << 20
+
+const (
+	// callStackSize caps the depth of Lua calls, and registrySize and
+	// registryMaxSize the values on the stack.
+	callStackSize   = 64
+	registrySize    = 1024
+	registryMaxSize = 64 * 1024
+	// maxRep is the longest string string.rep builds.
+	maxRep = 64 * 1024
+)
+
+// unsafe are the base functions scripts don't get, as they load code,
+// print to the server's output or reach outside the sandbox.
+var unsafe = []string{
+	"collectgarbage", "dofile", "getfenv", "load", "loadfile", "loadstring",
+	"module", "newproxy", "print", "_printregs", "require", "setfenv",
+}
+
+// concatName is the global scripts call for .., which no script can name.
+const concatName = "(concat)"
+
+// Script is a compiled script.
+type Script struct {
+	Name  string
+	proto *lua.FunctionProto
+}
+
+// Compile parses and compiles a script's source, returning syntax errors.
+func Compile(name, source string) (*Script, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	chargeConcat(reflect.ValueOf(chunk))
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{Name: name, proto: proto}, nil
+}
+
+// Run runs each script in order over each heartbeat, returning the
+// heartbeats none of them dropped in a new slice and leaving heartbeats as
+// they were. A script that fails or runs out of time or memory is logged
+// and leaves the heartbeat as it found it.
+func Run(scripts []*Script, heartbeats []store.Heartbeat) []store.Heartbeat {
+	if len(scripts) == 0 {
+		return heartbeats
+	}
+	kept := make([]store.Heartbeat, 0, len(heartbeats))
+	for _, hb := range heartbeats {
+		keep := true
+		for _, s := range scripts {
+			L := newState()
+			var err error
+			keep, err = s.run(L, &hb)
+			L.Close()
+			if err != nil {
+				log.Printf("Script %s error: %v", s.Name, err)
+				keep = true
+			}
+			if !keep {
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, hb)
+		}
+	}
+	return kept
+}
+
+// newState returns a Lua state with only the sandboxed libraries.
+func newState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		CallStackSize:   callStackSize,
+		RegistrySize:    registrySize,
+		RegistryMaxSize: registryMaxSize,
+		SkipOpenLibs:    true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafe {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("dump", lua.LNil)
+		str.RawSetString("rep", L.NewFunction(rep))
+		for name, size := range map[string]func(*lua.LState) int{
+			"char":    func(L *lua.LState) int { return L.GetTop() },
+			"format":  formatSize,
+			"lower":   argSize,
+			"reverse": argSize,
+			"upper":   argSize,
+		} {
+			str.RawSetString(name, L.NewFunction(charged(str.RawGetString(name).(*lua.LFunction).GFunction, size)))
+		}
+		str.RawSetString("gsub", L.NewFunction(gsub(str.RawGetString("gsub").(*lua.LFunction).GFunction)))
+	}
+	if tab, ok := L.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		tab.RawSetString("concat", L.NewFunction(charged(tab.RawGetString("concat").(*lua.LFunction).GFunction, tableConcatSize)))
+	}
+	L.SetGlobal(concatName, L.NewFunction(concat))
+	return L
+}
+
+// chargeConcat rewrites each a .. b under v into a call to concat, which
+// charges the string it builds, as the VM builds it without calling out.
+func chargeConcat(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			chargeConcat(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				chargeConcat(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			chargeConcat(v.Index(i))
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		chargeConcat(v.Elem())
+		if op, ok := v.Interface().(*ast.StringConcatOpExpr); ok {
+			fn := &ast.IdentExpr{Value: concatName}
+			fn.SetLine(op.Line())
+			call := &ast.FuncCallExpr{Func: fn, Args: []ast.Expr{op.Lhs, op.Rhs}}
+			call.SetLine(op.Line())
+			call.SetLastLine(op.LastLine())
+			v.Set(reflect.ValueOf(call))
+		}
+	}
+}
+
+// budgetKey holds a run's *budget in its context.
+type budgetKey struct{}
+
+// budget is how many bytes of strings a run built.
+type budget struct {
+	used int
+}
+
+// charge charges n bytes to L's run, failing it past maxAlloc.
+func charge(L *lua.LState, n int) {
+	ctx := L.Context()
+	if ctx == nil {
+		return
+	}
+	if b, ok := ctx.Value(budgetKey{}).(*budget); ok {
+		if n > maxAlloc-b.used {
+			L.RaiseError("building more than %d MB of strings", maxAlloc>>20)
+		}
+		b.used += n
+	}
+}
+
+// charged returns fn charging the size of what it builds, at most size,
+// before it runs.
+func charged(fn lua.LGFunction, size func(*lua.LState) int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		charge(L, size(L))
+		return fn(L)
+	}
+}
+
+// argSize is the size of the string in the first argument.
+func argSize(L *lua.LState) int {
+	return len(L.CheckString(1))
+}
+
+// formatSize bounds what string.format builds: the format, each argument
+// ten times over, as %q escapes bytes, and each width and precision.
+func formatSize(L *lua.LState) int {
+	format := L.CheckString(1)
+	n := len(format)
+	for i := 2; i <= L.GetTop(); i++ {
+		n += 10 * len(L.Get(i).String())
+	}
+	width := 0
+	for _, c := range format {
+		if c >= '0' && c <= '9' {
+			// fmt refuses widths past a million
+			width = min(width*10+int(c-'0'), 1e6)
+			continue
+		}
+		n += width
+		width = 0
+	}
+	return n + width
+}
+
+// tableConcatSize is what table.concat builds.
+func tableConcatSize(L *lua.LState) int {
+	t := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	n := 0
+	for i := max(L.OptInt(3, 1), 1); i <= min(L.OptInt(4, t.Len()), t.Len()); i++ {
+		value := t.RawGetInt(i)
+		if !lua.LVCanConvToString(value) {
+			break
+		}
+		n += len(lua.LVAsString(value)) + len(sep)
+	}
+	return n
+}
+
+// gsub returns string.gsub charging what it builds. A replacement string
+// is charged for every match it could make and its captures for all of
+// the subject, which can't be more than they add; a replacement table or
+// function is charged for each value it gives.
+func gsub(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		str := L.CheckString(1)
+		switch repl := L.Get(3).(type) {
+		case lua.LString:
+			matches := len(str) + 1
+			if limit := L.OptInt(4, -1); limit >= 0 {
+				matches = min(matches, limit)
+			}
+			// A position capture is a number of up to 20 digits
+			refs := strings.Count(string(repl), "%")
+			charge(L, len(str)+matches*(len(repl)+20*refs)+refs*len(str))
+		case *lua.LTable, *lua.LFunction:
+			charge(L, len(str))
+			L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+				var value lua.LValue
+				if t, ok := repl.(*lua.LTable); ok {
+					value = L.GetTable(t, L.Get(1))
+				} else {
+					args := make([]lua.LValue, L.GetTop())
+					for i := range args {
+						args[i] = L.Get(i + 1)
+					}
+					L.Push(repl)
+					for _, arg := range args {
+						L.Push(arg)
+					}
+					L.Call(len(args), 1)
+					value = L.Get(-1)
+				}
+				if lua.LVCanConvToString(value) {
+					charge(L, len(lua.LVAsString(value)))
+				}
+				L.Push(value)
+				return 1
+			}))
+		}
+		return fn(L)
+	}
+}
+
+// concat is a .. b, charging the string it builds.
+func concat(L *lua.LState) int {
+	lhs, rhs := L.Get(1), L.Get(2)
+	if !lua.LVCanConvToString(lhs) || !lua.LVCanConvToString(rhs) {
+		op := L.GetMetaField(lhs, "__concat")
+		if op == lua.LNil {
+			op = L.GetMetaField(rhs, "__concat")
+		}
+		if op.Type() != lua.LTFunction {
+			L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type(), rhs.Type())
+		}
+		L.Push(op)
+		L.Push(lhs)
+		L.Push(rhs)
+		L.Call(2, 1)
+		return 1
+	}
+	l, r := lua.LVAsString(lhs), lua.LVAsString(rhs)
+	charge(L, len(l)+len(r))
+	L.Push(lua.LString(l + r))
+	return 1
+}
+
+// rep is string.rep refusing to build strings longer than maxRep.
+func rep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if len(str) > 0 && n > maxRep/len(str) {
+		L.RaiseError("string.rep result longer than %d bytes", maxRep)
+	}
+	if n < 0 {
+		n = 0
+	}
+	charge(L, n*len(str))
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// run runs the script over one heartbeat in L, updating it from what the
+// script set, and reports whether to keep it.
+func (s *Script) run(L *lua.LState, hb *store.Heartbeat) (bool, error) {
+	table := toTable(L, *hb)
+	L.SetGlobal("heartbeat", table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	L.SetContext(context.WithValue(ctx, budgetKey{}, &budget{}))
+	defer L.RemoveContext()
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if ctx.Err() != nil {
+			return true, fmt.Errorf("stopped after %v", Timeout)
+		}
+		// Without the stack trace, which is a log line per call
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return true, fmt.Errorf("%s", apiErr.Object.String())
+		}
+		return true, err
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	if result == lua.LFalse {
+		return false, nil
+	}
+	return true, fromTable(table, hb)
+}
+
+// toTable returns a heartbeat as a Lua table.
+func toTable(L *lua.LState, hb store.Heartbeat) *lua.LTable {
+	t := L.NewTable()
+	for name, value := range map[string]string{
+		"user_id":     hb.UserID,
+		"project":     hb.Project,
+		"language":    hb.Language,
+		"entity":      hb.Entity,
+		"entity_type": hb.EntityType,
+		"category":    hb.Category,
+		"branch":      hb.Branch,
+		"machine":     hb.Machine,
+	} {
+		t.RawSetString(name, lua.LString(value))
+	}
+	t.RawSetString("duration", lua.LNumber(hb.Duration))
+	t.RawSetString("timestamp", lua.LNumber(hb.Timestamp))
+	tags := L.NewTable()
+	for _, tag := range hb.Tags {
+		tags.Append(lua.LString(tag))
+	}
+	t.RawSetString("tags", tags)
+	return t
+}
+
+// fromTable copies the fields scripts may change back to the heartbeat,
+// leaving it unchanged when one has the wrong type.
+func fromTable(t *lua.LTable, hb *store.Heartbeat) error {
+	updated := *hb
+	for name, field := range map[string]*string{
+		"project":  &updated.Project,
+		"language": &updated.Language,
+		"entity":   &updated.Entity,
+		"category": &updated.Category,
+		"branch":   &updated.Branch,
+	} {
+		value, ok := t.RawGetString(name).(lua.LString)
+		if !ok {
+			return fmt.Errorf("heartbeat.%s must be a string", name)
+		}
+		*field = string(value)
+	}
+	tags, ok := t.RawGetString("tags").(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("heartbeat.tags must be a table")
+	}
+	updated.Tags = nil
+	for i := 1; i <= tags.Len(); i++ {
+		tag, ok := tags.RawGetInt(i).(lua.LString)
+		if !ok {
+			return fmt.Errorf("heartbeat.tags must hold strings")
+		}
+		if tag := strings.TrimSpace(string(tag)); tag != "" && !strings.Contains(tag, ",") {
+			updated.Tags = append(updated.Tags, tag)
+		}
+	}
+	if updated.Project != hb.Project {
+		updated.ProjectRoot = ""
+	}
+	*hb = updated
+	return nil
+}
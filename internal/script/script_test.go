@@ -0,0 +1,146 @@
+package script
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kru/eztracker/internal/store"
+)
+
+func compile(t *testing.T, source string) *Script {
+	t.Helper()
+	s, err := Compile("test", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRun(t *testing.T) {
+	tag := compile(t, `
+		local ticket = heartbeat.branch:match("^(%u+%-%d+)")
+		if ticket then table.insert(heartbeat.tags, ticket) end
+		if heartbeat.entity:find("/vendor/", 1, true) then return false end
+		if heartbeat.language == "Markdown" then heartbeat.category = "writing docs" end
+	`)
+	move := compile(t, `if #heartbeat.tags > 0 then heartbeat.project = "tickets" end`)
+	heartbeats := []store.Heartbeat{
+		{Project: "api", ProjectRoot: "/src/api", Language: "Go", Entity: "/src/api/main.go", Branch: "ENG-42-fix", Tags: []string{"billable"}},
+		{Project: "api", Language: "Go", Entity: "/src/api/vendor/lib.go", Branch: "main"},
+		{Project: "api", Language: "Markdown", Entity: "/src/api/README.md", Branch: "main"},
+	}
+	kept := Run([]*Script{tag, move}, heartbeats)
+	if len(kept) != 2 {
+		t.Fatalf("kept %+v, want the vendored file dropped", kept)
+	}
+	if hb := kept[0]; hb.Project != "tickets" || hb.ProjectRoot != "" || strings.Join(hb.Tags, ",") != "billable,ENG-42" {
+		t.Errorf("tagged heartbeat %+v", hb)
+	}
+	if hb := kept[1]; hb.Project != "api" || hb.Category != "writing docs" || len(hb.Tags) != 0 {
+		t.Errorf("docs heartbeat %+v", hb)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if _, err := Compile("broken", "if then"); err == nil {
+		t.Error("compiled a syntax error")
+	}
+	for _, source := range []string{
+		`while true do end`,
+		`heartbeat.project = "changed"; error("failed")`,
+		`heartbeat.project = 42`,
+		`heartbeat.project = string.rep("x", 1e9)`,
+		`heartbeat.project = string.rep("xxxx", 2^62)`,
+		`io.open("/etc/passwd")`,
+		`os.exit(1)`,
+		`if load or loadstring or dofile then heartbeat.project = "escaped" end`,
+		`require("os")`,
+		`local function f() return f() + 1 end f()`,
+	} {
+		hb := store.Heartbeat{Project: "api", Language: "Go"}
+		kept := Run([]*Script{compile(t, source)}, []store.Heartbeat{hb})
+		if len(kept) != 1 || kept[0].Project != "api" {
+			t.Errorf("%s: kept %+v, want the heartbeat unchanged", source, kept)
+		}
+	}
+}
+
+func TestAllocLimit(t *testing.T) {
+	defer func(old int) { maxAlloc = old }(maxAlloc)
+	maxAlloc = 1 << 20
+
+	for _, source := range []string{
+		`local s = "x" while true do s = s .. s end`,
+		`local s = "x" while true do s = s .. s .. 1 end`,
+		`local s, t = string.rep("x", 1000), {} for i = 1, 1e9 do t[i] = s .. i end`,
+		`local s = string.rep("x", 60000) s = s:gsub("", s)`,
+		`local s = string.rep("x", 30000) s = s:gsub(".", "%0%0")`,
+		`local s = string.rep("x", 60000) s = ("x"):rep(100):gsub(".", function() return s end)`,
+		`local s = string.rep("x", 60000) s = ("x"):rep(100):gsub(".", {x = s})`,
+		`local s = "x" while true do s = string.format("%s%s", s, s) end`,
+		`local s = string.format("%999999s%999999s", "", "")`,
+		`local t = {"x"} while true do t[#t + 1] = table.concat(t) end`,
+		`local s = string.rep("x", 60000) local t = {} for i = 1, 1e9 do t[i] = s:upper() end`,
+	} {
+		L := newState()
+		hb := store.Heartbeat{Project: "api"}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := compile(t, source).run(L, &hb)
+		runtime.ReadMemStats(&after)
+		L.Close()
+		if err == nil || !strings.Contains(err.Error(), "building more than 1 MB of strings") {
+			t.Errorf("%s: %v, want stopped for building strings", source, err)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 8<<20 {
+			t.Errorf("%s: allocated %d bytes, want about %d", source, n, maxAlloc)
+		}
+	}
+}
+
+func TestConcat(t *testing.T) {
+	s := compile(t, `
+		local mt = {__concat = function(a, b) return "meta" end}
+		heartbeat.project = heartbeat.project .. "-" .. 2 .. (setmetatable({}, mt) .. "x")
+		heartbeat.branch = table.concat({"a", "b"}, "/") .. string.format("%03d", 7) .. ("ab"):gsub("b", "%0%0")
+	`)
+	kept := Run([]*Script{s}, []store.Heartbeat{{Project: "api"}})
+	if hb := kept[0]; hb.Project != "api-2meta" || hb.Branch != "a/b007abb" {
+		t.Errorf("concatenated %+v", hb)
+	}
+	if _, err := compile(t, `return 1 .. {}`).run(newState(), &store.Heartbeat{}); err == nil || !strings.Contains(err.Error(), "concat") {
+		t.Errorf("concatenating a table: %v", err)
+	}
+}
+
+func TestRunKeepsInput(t *testing.T) {
+	drop := compile(t, `if heartbeat.language == "Markdown" then return false end heartbeat.project = "moved"`)
+	heartbeats := []store.Heartbeat{
+		{Project: "api", Language: "Markdown"},
+		{Project: "api", Language: "Go"},
+	}
+	kept := Run([]*Script{drop}, heartbeats)
+	if len(kept) != 1 || kept[0].Project != "moved" {
+		t.Errorf("kept %+v", kept)
+	}
+	// The write buffer retries heartbeats as they came when storing fails
+	if heartbeats[0].Language != "Markdown" || heartbeats[0].Project != "api" || heartbeats[1].Project != "api" {
+		t.Errorf("Run changed its input to %+v", heartbeats)
+	}
+}
+
+func TestRunIsolatesHeartbeats(t *testing.T) {
+	// Globals and changes to the libraries don't outlive a heartbeat
+	count := compile(t, `
+		seen = (seen or 0) + 1
+		heartbeat.branch = tostring(seen) .. (string.mark or "")
+		string.mark = "!"
+	`)
+	kept := Run([]*Script{count, count}, []store.Heartbeat{{Project: "api"}, {Project: "api"}})
+	for _, hb := range kept {
+		if hb.Branch != "1" {
+			t.Errorf("branch %q, want each run to start afresh", hb.Branch)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/query"
+)
+
+// Dimensions heartbeats can be grouped by, mapped to SQL over heartbeats
+// aliased as h joined with projects aliased as p. Only these names may reach
+// a query. The weekday of a day is 0 for Sunday, and hours are UTC, 0 to
+// 23, for heatmaps of when someone works.
+var dimensions = map[string]string{
+	"project":     "p.name",
+	"language":    "h.language",
+	"day":         dayOf("h.timestamp", "h.user_id"),
+	"weekday":     "CAST(strftime('%w', h.timestamp - " + dayStart("h.user_id") + ", 'unixepoch') AS INTEGER)",
+	"hour":        "CAST(strftime('%H', h.timestamp, 'unixepoch') AS INTEGER)",
+	"entity":      "h.file_path",
+	"entity_type": "COALESCE(h.entity_type, 'file')",
+	"category":    "COALESCE(h.category, 'coding')",
+	"branch":      "COALESCE(h.branch, '')",
+	"machine":     "COALESCE(h.machine, '')",
+	"session":     "COALESCE(h.session_id, '')",
+	"manual":      "h.manual",
+}
+
+// numericDimensions are the dimensions computed as integers, which filters
+// compare with numbers rather than the strings queries have.
+var numericDimensions = map[string]bool{"weekday": true, "hour": true}
+
+// IsDimension reports whether heartbeats can be grouped by name.
+func IsDimension(name string) bool {
+	_, ok := dimensions[name]
+	return ok
+}
+
+// Dimensions returns the names heartbeats can be grouped by, sorted.
+func Dimensions() []string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AggregateQuery selects a user's heartbeats on the UTC days from From to
+// To, both included, carrying all of Tags, grouped by GroupBy.
+type AggregateQuery struct {
+	UserID  string
+	GroupBy []string
+	From    time.Time
+	To      time.Time
+	Tags    []string
+}
+
+// Group is the time tracked for one combination of dimension values.
+type Group struct {
+	Keys     map[string]interface{}
+	Duration float64
+}
+
+// Aggregate sums heartbeat durations per group, largest first.
+func (s *Store) Aggregate(q AggregateQuery) ([]Group, error) {
+	var columns []string
+	for _, dim := range q.GroupBy {
+		column, ok := dimensions[dim]
+		if !ok {
+			return nil, fmt.Errorf("unknown dimension %q", dim)
+		}
+		columns = append(columns, column)
+	}
+
+	from := q.From.UTC().Truncate(24 * time.Hour)
+	to := q.To.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	heartbeats, err := heartbeatsIn(s.db, from.Unix(), to.Unix()+86400)
+	if err != nil {
+		return nil, err
+	}
+	filter, args := tagFilter(q.Tags)
+	query := "SELECT "
+	for _, column := range columns {
+		query += column + ", "
+	}
+	query += `SUM(h.duration)
+		FROM ` + heartbeats + ` h
+		JOIN projects p ON h.project_id = p.id
+		WHERE h.user_id = ?1 AND ` + inDays("h.timestamp", "h.user_id", "?2", "?3") + filter
+	if len(columns) > 0 {
+		query += " GROUP BY " + strings.Join(columns, ", ")
+	}
+	query += " ORDER BY SUM(h.duration) DESC"
+
+	rows, err := s.db.Query(query,
+		append([]interface{}{q.UserID, from.Unix(), to.Unix()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		var duration sql.NullFloat64
+		dest := make([]interface{}, 0, len(columns)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(append(dest, &duration)...); err != nil {
+			return nil, err
+		}
+		if !duration.Valid {
+			// No heartbeats matched an ungrouped query
+			continue
+		}
+		g := Group{Keys: make(map[string]interface{}, len(columns)), Duration: duration.Float64}
+		for i, dim := range q.GroupBy {
+			switch v := values[i].(type) {
+			case []byte:
+				values[i] = string(v)
+			case int64:
+				if dim == "manual" {
+					values[i] = v != 0
+				}
+			}
+			g.Keys[dim] = values[i]
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// metricColumns compiles the metrics in query.Metrics to SQL over
+// heartbeats aliased as h.
+var metricColumns = map[string]string{
+	"sum(duration)": "SUM(h.duration)",
+	"avg(duration)": "AVG(h.duration)",
+	"min(duration)": "MIN(h.duration)",
+	"max(duration)": "MAX(h.duration)",
+	"count()":       "COUNT(*)",
+	"days()":        "COUNT(DISTINCT " + dayOf("h.timestamp", "h.user_id") + ")",
+}
+
+// QueryResult is a table with one column per selected item.
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Query runs an analytics query over a user's heartbeats. From, To and
+// Limit must be set. Only names from dimensions and metricColumns reach the
+// SQL text; every value is a parameter.
+func (s *Store) Query(userID string, q query.Query) (QueryResult, error) {
+	column := func(item query.Item) (string, error) {
+		if item.Metric {
+			if c, ok := metricColumns[item.Name]; ok {
+				return c, nil
+			}
+			return "", fmt.Errorf("unknown metric %s", item.Name)
+		}
+		if c, ok := dimensions[item.Name]; ok {
+			return c, nil
+		}
+		return "", fmt.Errorf("unknown dimension %q", item.Name)
+	}
+
+	result := QueryResult{Rows: [][]interface{}{}}
+	var columns, groupBy []string
+	hasMetric := false
+	for _, item := range q.Select {
+		c, err := column(item)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		columns = append(columns, c)
+		result.Columns = append(result.Columns, item.Name)
+		if item.Metric {
+			hasMetric = true
+		} else {
+			groupBy = append(groupBy, c)
+		}
+	}
+
+	from := q.From.UTC().Truncate(24 * time.Hour)
+	to := q.To.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	where := "h.user_id = ?1 AND " + inDays("h.timestamp", "h.user_id", "?2", "?3")
+	args := []interface{}{userID, from.Unix(), to.Unix()}
+	for _, f := range q.Where {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(f.Values)), ", ")
+		not := ""
+		if f.Negate {
+			not = "NOT "
+		}
+		if f.Dimension == "tag" {
+			where += ` AND h.id ` + not + `IN (
+				SELECT ht.heartbeat_id FROM heartbeat_tags ht
+				JOIN tags t ON t.id = ht.tag_id WHERE t.name IN (` + placeholders + `))`
+		} else {
+			c, ok := dimensions[f.Dimension]
+			if !ok {
+				return QueryResult{}, fmt.Errorf("unknown dimension %q", f.Dimension)
+			}
+			where += " AND " + c + " " + not + "IN (" + placeholders + ")"
+		}
+		for _, v := range f.Values {
+			if n, err := strconv.Atoi(v); err == nil && numericDimensions[f.Dimension] {
+				args = append(args, n)
+				continue
+			}
+			args = append(args, v)
+		}
+	}
+
+	heartbeats, err := heartbeatsIn(s.db, from.Unix(), to.Unix()+86400)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	sqlQuery := "SELECT " + strings.Join(columns, ", ") + `
+		FROM ` + heartbeats + ` h
+		JOIN projects p ON h.project_id = p.id
+		WHERE ` + where
+	if len(groupBy) > 0 {
+		sqlQuery += " GROUP BY " + strings.Join(groupBy, ", ")
+	}
+	if q.OrderBy != nil {
+		c, err := column(*q.OrderBy)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		sqlQuery += " ORDER BY " + c
+		if q.Desc {
+			sqlQuery += " DESC"
+		}
+	} else if !hasMetric {
+		sqlQuery += " ORDER BY " + columns[0]
+	} else {
+		for i, item := range q.Select {
+			if item.Metric {
+				sqlQuery += " ORDER BY " + columns[i] + " DESC"
+				break
+			}
+		}
+	}
+	sqlQuery += " LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return QueryResult{}, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeartbeatFilter selects the heartbeats a user's editors sent, on a range
+// of their days, both included, unless From and To are zero, and optionally
+// only those of one project or with paths starting with PathPrefix. Manual
+// entries are left out.
+type HeartbeatFilter struct {
+	UserID     string
+	Project    string
+	PathPrefix string
+	From       time.Time
+	To         time.Time
+}
+
+// span is the range of timestamps of the heartbeats a filter selects, from
+// the first up to the second, excluded.
+func (f HeartbeatFilter) span() (int64, int64) {
+	if f.From.IsZero() && f.To.IsZero() {
+		return math.MinInt64, math.MaxInt64
+	}
+	return f.From.UTC().Truncate(24 * time.Hour).Unix(), f.To.UTC().Truncate(24*time.Hour).AddDate(0, 0, 2).Unix()
+}
+
+// heartbeats returns what to read the heartbeats a filter selects from, as
+// heartbeatsIn does.
+func (f HeartbeatFilter) heartbeats(db execer) (string, error) {
+	from, to := f.span()
+	return heartbeatsIn(db, from, to)
+}
+
+// where returns the SQL condition on heartbeats h and its arguments.
+func (f HeartbeatFilter) where() (string, []interface{}) {
+	where := "h.user_id = ?1 AND h.manual = 0"
+	args := []interface{}{f.UserID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "?" + strconv.Itoa(len(args))
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		from := f.From.UTC().Truncate(24 * time.Hour)
+		to := f.To.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+		where += " AND " + inDays("h.timestamp", "?1", arg(from.Unix()), arg(to.Unix()))
+	}
+	if f.Project != "" {
+		where += " AND h.project_id IN (SELECT id FROM projects WHERE user_id = ?1 AND name = " + arg(f.Project) + ")"
+	}
+	if f.PathPrefix != "" {
+		prefix := arg(f.PathPrefix)
+		where += " AND substr(h.file_path, 1, length(" + prefix + ")) = " + prefix
+	}
+	return where, args
+}
+
+// CountHeartbeats returns how many heartbeats a filter selects.
+func (s *Store) CountHeartbeats(f HeartbeatFilter) (int64, error) {
+	heartbeats, err := f.heartbeats(s.db)
+	if err != nil {
+		return 0, err
+	}
+	where, args := f.where()
+	var n int64
+	err = s.db.QueryRow("SELECT COUNT(*) FROM "+heartbeats+" h WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+// DeleteHeartbeats deletes the heartbeats a filter selects, with their tags,
+// and rebuilds the user's daily summaries of the days they were on. It
+// returns how many were deleted.
+func (s *Store) DeleteHeartbeats(f HeartbeatFilter) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where, args := f.where()
+	first, last, err := filteredDays(tx, f)
+	if err != nil {
+		return 0, err
+	}
+	heartbeats, err := f.heartbeats(tx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM heartbeat_tags WHERE heartbeat_id IN (SELECT h.id FROM "+heartbeats+" h WHERE "+where+")", args...); err != nil {
+		return 0, err
+	}
+	from, to := f.span()
+	n, err := eachPartition(tx, from, to, "DELETE FROM %[1]s AS h WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if err := rebuildDailySummaries(tx, f.UserID, first, last); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// Reclassification is what ReclassifyHeartbeats gives the heartbeats it
+// selects: another project, another language or both.
+type Reclassification struct {
+	Project  string `json:"project,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// HeartbeatEdit records a reclassification of heartbeats: the filter that
+// selected them, what they were given, how many there were and who made
+// it. From and To are empty for all time.
+type HeartbeatEdit struct {
+	ID            int64  `json:"id"`
+	UserID        string `json:"user_id"`
+	From          string `json:"from,omitempty"`
+	To            string `json:"to,omitempty"`
+	FilterProject string `json:"filter_project,omitempty"`
+	PathPrefix    string `json:"path_prefix,omitempty"`
+	Project       string `json:"project,omitempty"`
+	Language      string `json:"language,omitempty"`
+	Heartbeats    int64  `json:"heartbeats"`
+	EditedBy      string `json:"edited_by"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// ReclassifyHeartbeats moves the heartbeats a filter selects to another
+// project, creating it if needed, and gives them another language, then
+// rebuilds the user's daily summaries of the days they were on. The edit is
+// recorded with editedBy; it is returned with how many heartbeats changed.
+func (s *Store) ReclassifyHeartbeats(f HeartbeatFilter, change Reclassification, editedBy string) (HeartbeatEdit, error) {
+	edit := HeartbeatEdit{UserID: f.UserID, FilterProject: f.Project, PathPrefix: f.PathPrefix,
+		Project: change.Project, Language: change.Language, EditedBy: editedBy, CreatedAt: time.Now().Unix()}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		edit.From, edit.To = f.From.Format("2006-01-02"), f.To.Format("2006-01-02")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return HeartbeatEdit{}, err
+	}
+	defer tx.Rollback()
+
+	where, args := f.where()
+	first, last, err := filteredDays(tx, f)
+	if err != nil {
+		return HeartbeatEdit{}, err
+	}
+	// SET's arguments are numbered after the filter's
+	var set []string
+	if change.Project != "" {
+		projectID, err := s.projectID(tx, f.UserID, change.Project, "")
+		if err != nil {
+			return HeartbeatEdit{}, err
+		}
+		args = append(args, projectID)
+		set = append(set, "project_id = ?"+strconv.Itoa(len(args)))
+	}
+	if change.Language != "" {
+		args = append(args, change.Language)
+		set = append(set, "language = ?"+strconv.Itoa(len(args)))
+	}
+	if len(set) == 0 {
+		return HeartbeatEdit{}, fmt.Errorf("nothing to change")
+	}
+	from, to := f.span()
+	edit.Heartbeats, err = eachPartition(tx, from, to, "UPDATE %[1]s SET "+strings.Join(set, ", ")+
+		" WHERE id IN (SELECT h.id FROM %[1]s h WHERE "+where+")", args...)
+	if err != nil {
+		return HeartbeatEdit{}, err
+	}
+	if edit.Heartbeats > 0 {
+		if err := rebuildDailySummaries(tx, f.UserID, first, last); err != nil {
+			return HeartbeatEdit{}, err
+		}
+		if err := scrubAggregateOnly(tx, f.UserID); err != nil {
+			return HeartbeatEdit{}, err
+		}
+	}
+	res, err := tx.Exec(`
+		INSERT INTO heartbeat_edits (user_id, from_day, to_day, filter_project, path_prefix, project, language,
+			heartbeats, edited_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, edit.UserID, edit.From, edit.To, edit.FilterProject, edit.PathPrefix, edit.Project, edit.Language,
+		edit.Heartbeats, edit.EditedBy, edit.CreatedAt)
+	if err != nil {
+		return HeartbeatEdit{}, err
+	}
+	edit.ID, _ = res.LastInsertId()
+	return edit, tx.Commit()
+}
+
+// HeartbeatEdits returns a user's reclassifications, most recent first.
+func (s *Store) HeartbeatEdits(userID string) ([]HeartbeatEdit, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, from_day, to_day, filter_project, path_prefix, project, language,
+			heartbeats, edited_by, created_at
+		FROM heartbeat_edits WHERE user_id = ? ORDER BY id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	edits := []HeartbeatEdit{}
+	for rows.Next() {
+		var e HeartbeatEdit
+		if err := rows.Scan(&e.ID, &e.UserID, &e.From, &e.To, &e.FilterProject, &e.PathPrefix, &e.Project,
+			&e.Language, &e.Heartbeats, &e.EditedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// filteredDays returns the first and last of the user's days with
+// heartbeats a filter selects, empty when there are none.
+func filteredDays(tx *sql.Tx, f HeartbeatFilter) (string, string, error) {
+	heartbeats, err := f.heartbeats(tx)
+	if err != nil {
+		return "", "", err
+	}
+	where, args := f.where()
+	var first, last sql.NullString
+	err = tx.QueryRow("SELECT MIN("+dayOf("h.timestamp", "?1")+"), MAX("+dayOf("h.timestamp", "?1")+
+		") FROM "+heartbeats+" h WHERE "+where, args...).Scan(&first, &last)
+	return first.String, last.String, err
+}
+
+// rebuildDailySummaries recomputes a user's daily summaries of the days
+// from first to last, both included, after their heartbeats changed.
+func rebuildDailySummaries(tx *sql.Tx, userID, first, last string) error {
+	from, err := time.Parse("2006-01-02", first)
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse("2006-01-02", last)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM daily_summaries WHERE user_id = ? AND day >= ? AND day <= ?",
+		userID, first, last); err != nil {
+		return err
+	}
+	// Manual entries count towards the summaries too
+	to = to.AddDate(0, 0, 1)
+	heartbeats, err := heartbeatsIn(tx, from.Unix(), to.Unix()+86400)
+	if err != nil {
+		return err
+	}
+	where := "WHERE h.user_id = ?1 AND " + inDays("h.timestamp", "?1", "?2", "?3")
+	_, err = tx.Exec(fmt.Sprintf(aggregateDailySummaries, heartbeats, where), userID, from.Unix(), to.Unix())
+	return err
+}
+
+// RewriteHeartbeats calls rewrite with each heartbeat a filter selects, in
+// time order, and stores the project, category and tags it leaves them
+// with, for those it reports changed. Tags are only added, and other fields
+// are not stored back. The user's daily summaries of the days the
+// heartbeats were on are then rebuilt. It returns how many changed.
+func (s *Store) RewriteHeartbeats(f HeartbeatFilter, rewrite func(*Heartbeat) bool) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	heartbeats, err := f.heartbeats(tx)
+	if err != nil {
+		return 0, err
+	}
+	where, args := f.where()
+	rows, err := tx.Query(`
+		SELECT h.id, p.name, IFNULL(h.language, ''), IFNULL(h.file_path, ''), IFNULL(h.entity_type, 'file'),
+			IFNULL(h.category, ''), IFNULL(h.branch, ''), IFNULL(h.machine, ''), h.duration, h.timestamp,
+			(SELECT IFNULL(GROUP_CONCAT(t.name), '') FROM heartbeat_tags ht JOIN tags t ON t.id = ht.tag_id
+				WHERE ht.heartbeat_id = h.id)
+		FROM `+heartbeats+` h JOIN projects p ON p.id = h.project_id
+		WHERE `+where+` ORDER BY h.timestamp, h.id`, args...)
+	if err != nil {
+		return 0, err
+	}
+	type change struct {
+		id int64
+		hb Heartbeat
+	}
+	var changes []change
+	for rows.Next() {
+		var id int64
+		var tags string
+		hb := Heartbeat{UserID: f.UserID}
+		if err := rows.Scan(&id, &hb.Project, &hb.Language, &hb.Entity, &hb.EntityType, &hb.Category,
+			&hb.Branch, &hb.Machine, &hb.Duration, &hb.Timestamp, &tags); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if tags != "" {
+			hb.Tags = strings.Split(tags, ",")
+		}
+		if rewrite(&hb) {
+			changes = append(changes, change{id, hb})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	first, last, err := filteredDays(tx, f)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range changes {
+		projectID, err := s.projectID(tx, f.UserID, c.hb.Project, "")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE "+partitionName(c.hb.Timestamp)+" SET project_id = ?, category = ? WHERE id = ?",
+			projectID, c.hb.Category, c.id); err != nil {
+			return 0, err
+		}
+		if err := s.tagHeartbeat(tx, f.UserID, c.id, c.hb.Tags); err != nil {
+			return 0, err
+		}
+	}
+	if err := rebuildDailySummaries(tx, f.UserID, first, last); err != nil {
+		return 0, err
+	}
+	if err := scrubAggregateOnly(tx, f.UserID); err != nil {
+		return 0, err
+	}
+	return int64(len(changes)), tx.Commit()
+}
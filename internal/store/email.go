@@ -0,0 +1,308 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NotificationPrefs are when and how a user wants their weekly summary.
+// Weekday and Hour are in Timezone, with Sunday as 0. Alerts turns on
+// messages about unusual days, such as more than AlertHours tracked.
+//
+// They also hold the user's period boundaries: weeks start on WeekStart,
+// and days at DayStartHour rather than midnight, so night owls' late hours
+// count towards the day before. Days are UTC days, so DayStartHour is an
+// hour in UTC. Locale is the language summaries, alerts and reports are
+// written in, such as "en" or "de", and DurationFormat how they write
+// durations, "" for the locale's way. DailyGoalMinutes is how long they
+// mean to code a day, 0 for no goal, which webhooks fire on reaching.
+type NotificationPrefs struct {
+	UserID           string   `json:"user_id"`
+	Enabled          bool     `json:"enabled"`
+	Weekday          int      `json:"weekday"`
+	Hour             int      `json:"hour"`
+	Timezone         string   `json:"timezone"`
+	Channels         []string `json:"channels"`
+	Alerts           bool     `json:"alerts"`
+	AlertHours       int      `json:"alert_hours"`
+	WeekStart        int      `json:"week_start"`
+	DayStartHour     int      `json:"day_start_hour"`
+	Locale           string   `json:"locale"`
+	DurationFormat   string   `json:"duration_format"`
+	DailyGoalMinutes int      `json:"daily_goal_minutes"`
+}
+
+// Day returns the day t falls in, as the date at UTC midnight.
+func (p NotificationPrefs) Day(t time.Time) time.Time {
+	y, m, d := t.UTC().Add(-time.Duration(p.DayStartHour) * time.Hour).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// WeekOf returns the first day of the week day is in.
+func (p NotificationPrefs) WeekOf(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) - p.WeekStart + 7) % 7))
+}
+
+// DefaultAlertHours is the AlertHours of users who never set it.
+const DefaultAlertHours = 14
+
+// DefaultNotificationPrefs are the preferences of users who never set any:
+// an email every Sunday at midnight UTC, and no alerts.
+func DefaultNotificationPrefs(userID string) NotificationPrefs {
+	return NotificationPrefs{
+		UserID: userID, Enabled: true, Timezone: "UTC", Channels: []string{"email"},
+		AlertHours: DefaultAlertHours, Locale: "en",
+	}
+}
+
+// Subscriber is a user with an email address and summaries or alerts
+// enabled.
+type Subscriber struct {
+	Email string
+	Prefs NotificationPrefs
+}
+
+// Email is a message in the outbox. Status is "pending" until it is sent or
+// given up on, then "sent" or "failed".
+type Email struct {
+	ID            int64
+	To            string
+	Subject       string
+	Body          string
+	Headers       []string
+	Status        string
+	Attempts      int
+	NextAttemptAt int64
+	LastError     string
+	CreatedAt     int64
+}
+
+// UserEmail returns the email address of a user, or "" if the user is
+// unknown or has none.
+func (s *Store) UserEmail(userID string) (string, error) {
+	var email sql.NullString
+	err := s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email.String, err
+}
+
+// UserEmailStatus returns the email address of a user and whether it has
+// been verified. Addresses from before verification existed haven't been.
+func (s *Store) UserEmailStatus(userID string) (string, bool, error) {
+	var email sql.NullString
+	var verified bool
+	err := s.db.QueryRow("SELECT email, email_verified FROM users WHERE id = ?", userID).Scan(&email, &verified)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return email.String, verified && email.String != "", err
+}
+
+// SetUserEmail changes the email address of a user, adding the user if
+// needed. The new address gets no mail until VerifyUserEmail.
+func (s *Store) SetUserEmail(userID, email string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO users (id, email, email_verified) VALUES (?, ?, 0)
+		ON CONFLICT (id) DO UPDATE SET email = excluded.email, email_verified = 0
+	`, userID, email)
+	return err
+}
+
+// VerifyUserEmail marks the email address of a user verified, if it is
+// still their address. It reports whether it was.
+func (s *Store) VerifyUserEmail(userID, email string) (bool, error) {
+	res, err := s.db.Exec("UPDATE users SET email_verified = 1 WHERE id = ? AND email = ? AND email != ''", userID, email)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// NotificationPrefs returns a user's notification preferences, or the
+// defaults if they never set any.
+func (s *Store) NotificationPrefs(userID string) (NotificationPrefs, error) {
+	p := NotificationPrefs{UserID: userID}
+	var channels string
+	err := s.db.QueryRow(`
+		SELECT enabled, weekday, hour, timezone, channels, alerts, alert_hours, week_start, day_start_hour,
+			locale, duration_format, daily_goal_minutes
+		FROM notification_preferences WHERE user_id = ?
+	`, userID).Scan(&p.Enabled, &p.Weekday, &p.Hour, &p.Timezone, &channels, &p.Alerts, &p.AlertHours,
+		&p.WeekStart, &p.DayStartHour, &p.Locale, &p.DurationFormat, &p.DailyGoalMinutes)
+	if err == sql.ErrNoRows {
+		return DefaultNotificationPrefs(userID), nil
+	}
+	p.Channels = splitChannels(channels)
+	return p, err
+}
+
+// SetNotificationPrefs replaces a user's notification preferences. When
+// DayStartHour changes, the user's daily summaries are rebuilt with the new
+// day boundaries.
+func (s *Store) SetNotificationPrefs(p NotificationPrefs) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dayStartHour int
+	err = tx.QueryRow("SELECT day_start_hour FROM notification_preferences WHERE user_id = ?", p.UserID).Scan(&dayStartHour)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO notification_preferences (user_id, enabled, weekday, hour, timezone, channels, alerts, alert_hours,
+			week_start, day_start_hour, locale, duration_format, daily_goal_minutes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled,
+			weekday = excluded.weekday, hour = excluded.hour,
+			timezone = excluded.timezone, channels = excluded.channels,
+			alerts = excluded.alerts, alert_hours = excluded.alert_hours,
+			week_start = excluded.week_start, day_start_hour = excluded.day_start_hour,
+			locale = excluded.locale, duration_format = excluded.duration_format,
+			daily_goal_minutes = excluded.daily_goal_minutes
+	`, p.UserID, p.Enabled, p.Weekday, p.Hour, p.Timezone, strings.Join(p.Channels, ","), p.Alerts, p.AlertHours,
+		p.WeekStart, p.DayStartHour, p.Locale, p.DurationFormat, p.DailyGoalMinutes); err != nil {
+		return err
+	}
+	if p.DayStartHour != dayStartHour {
+		if _, err := tx.Exec("DELETE FROM daily_summaries WHERE user_id = ?", p.UserID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(aggregateDailySummaries, "heartbeats", "WHERE h.user_id = ?"), p.UserID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Subscribers returns the users with a verified email address who have not
+// turned summaries off or have turned alerts on.
+func (s *Store) Subscribers() ([]Subscriber, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.email, COALESCE(n.enabled, 1), COALESCE(n.weekday, 0), COALESCE(n.hour, 0),
+			COALESCE(n.timezone, 'UTC'), COALESCE(n.channels, 'email'),
+			COALESCE(n.alerts, 0), COALESCE(n.alert_hours, 14),
+			COALESCE(n.week_start, 0), COALESCE(n.day_start_hour, 0), COALESCE(n.locale, 'en'),
+			COALESCE(n.duration_format, ''), COALESCE(n.daily_goal_minutes, 0)
+		FROM users u
+		LEFT JOIN notification_preferences n ON n.user_id = u.id
+		WHERE u.email IS NOT NULL AND u.email != '' AND u.email_verified = 1
+			AND (COALESCE(n.enabled, 1) = 1 OR n.alerts = 1)
+		ORDER BY u.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []Subscriber
+	for rows.Next() {
+		var sub Subscriber
+		var channels string
+		if err := rows.Scan(&sub.Prefs.UserID, &sub.Email, &sub.Prefs.Enabled, &sub.Prefs.Weekday,
+			&sub.Prefs.Hour, &sub.Prefs.Timezone, &channels, &sub.Prefs.Alerts, &sub.Prefs.AlertHours,
+			&sub.Prefs.WeekStart, &sub.Prefs.DayStartHour, &sub.Prefs.Locale,
+			&sub.Prefs.DurationFormat, &sub.Prefs.DailyGoalMinutes); err != nil {
+			return nil, err
+		}
+		sub.Prefs.Channels = splitChannels(channels)
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, rows.Err()
+}
+
+// Locale is how a user wants text written: the Locale and DurationFormat
+// of their NotificationPrefs.
+type Locale struct {
+	Tag            string
+	DurationFormat string
+}
+
+// Locales returns the locale of every user who chose one other than "en"
+// or a duration format.
+func (s *Store) Locales() (map[string]Locale, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, locale, duration_format FROM notification_preferences
+		WHERE locale != 'en' OR duration_format != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locales := make(map[string]Locale)
+	for rows.Next() {
+		var userID string
+		var l Locale
+		if err := rows.Scan(&userID, &l.Tag, &l.DurationFormat); err != nil {
+			return nil, err
+		}
+		locales[userID] = l
+	}
+	return locales, rows.Err()
+}
+
+func splitChannels(channels string) []string {
+	if channels == "" {
+		return []string{}
+	}
+	return strings.Split(channels, ",")
+}
+
+// EnqueueEmail adds a message to the outbox, to be sent from
+// e.CreatedAt on.
+func (s *Store) EnqueueEmail(e *Email) error {
+	e.Status = "pending"
+	e.NextAttemptAt = e.CreatedAt
+	return s.db.QueryRow(`
+		INSERT INTO outbox (recipient, subject, body, headers, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id
+	`, e.To, e.Subject, e.Body, strings.Join(e.Headers, "\n"), e.NextAttemptAt, e.CreatedAt).Scan(&e.ID)
+}
+
+// DueEmails returns up to limit pending messages whose next attempt is at
+// or before now, oldest first.
+func (s *Store) DueEmails(now int64, limit int) ([]Email, error) {
+	rows, err := s.db.Query(`
+		SELECT id, recipient, subject, body, headers, status, attempts, next_attempt_at,
+			COALESCE(last_error, ''), created_at
+		FROM outbox WHERE status = 'pending' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id LIMIT ?
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []Email
+	for rows.Next() {
+		var e Email
+		var headers string
+		if err := rows.Scan(&e.ID, &e.To, &e.Subject, &e.Body, &headers, &e.Status, &e.Attempts,
+			&e.NextAttemptAt, &e.LastError, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if headers != "" {
+			e.Headers = strings.Split(headers, "\n")
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// UpdateEmail records the outcome of an attempt to send e: its Status,
+// Attempts, NextAttemptAt and LastError. sentAt is 0 unless it was sent.
+func (s *Store) UpdateEmail(e Email, sentAt int64) error {
+	_, err := s.db.Exec(`
+		UPDATE outbox SET status = ?, attempts = ?, next_attempt_at = ?,
+			last_error = NULLIF(?, ''), sent_at = NULLIF(?, 0)
+		WHERE id = ?
+	`, e.Status, e.Attempts, e.NextAttemptAt, e.LastError, sentAt, e.ID)
+	return err
+}
@@ -0,0 +1,20 @@
+package store
+
+import "testing"
+
+// TestUnverifiedEmails checks that addresses stored before verification
+// existed get no mail until they are confirmed.
+func TestUnverifiedEmails(t *testing.T) {
+	_, s := newTestStore(t, `
+		CREATE TABLE users (id TEXT PRIMARY KEY, email TEXT);
+		INSERT INTO users (id, email) VALUES ('alice', 'alice@example.com')`)
+	if email, verified, err := s.UserEmailStatus("alice"); err != nil || email != "alice@example.com" || verified {
+		t.Fatalf("status = %q, %v, %v; want the address unverified", email, verified, err)
+	}
+	if ok, err := s.VerifyUserEmail("alice", "alice@example.com"); err != nil || !ok {
+		t.Fatalf("verify = %v, %v", ok, err)
+	}
+	if _, verified, err := s.UserEmailStatus("alice"); err != nil || !verified {
+		t.Fatalf("verified = %v, %v after confirming", verified, err)
+	}
+}
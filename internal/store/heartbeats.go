@@ -0,0 +1,328 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Heartbeat is a span of activity in one entity, as stored. Clients send
+// one of the versioned wire formats in the api package.
+type Heartbeat struct {
+	UserID      string
+	Project     string
+	ProjectRoot string
+	Language    string
+	// Entity is a file path, application or domain depending on EntityType;
+	// it is stored in the file_path column.
+	Entity     string
+	EntityType string
+	Category   string
+	Branch     string
+	// Machine is the host or container the heartbeat was sent from.
+	Machine      string
+	Duration     float64
+	Timestamp    int64
+	Dependencies []string
+	SessionID    string
+	Tags         []string
+}
+
+// ManualEntry is time logged by hand for work no editor saw, such as
+// meetings. It is stored as a heartbeat flagged as manual.
+type ManualEntry struct {
+	ID        int64    `json:"id"`
+	UserID    string   `json:"user_id"`
+	Project   string   `json:"project"`
+	Duration  float64  `json:"duration"`
+	Timestamp int64    `json:"timestamp"`
+	Note      string   `json:"note"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// SessionSummary is the time tracked during one focus session.
+type SessionSummary struct {
+	ID        string   `json:"id"`
+	Start     int64    `json:"start"`
+	End       int64    `json:"end"`
+	Duration  float64  `json:"duration"`
+	Projects  []Bucket `json:"projects"`
+	Languages []Bucket `json:"languages"`
+}
+
+// StoreHeartbeats writes heartbeats with their projects and tags in a single
+// transaction.
+func (s *Store) StoreHeartbeats(heartbeats []Heartbeat) error {
+	return s.storeHeartbeats(heartbeats, 0)
+}
+
+// StoreSampledHeartbeats writes heartbeats like StoreHeartbeats, but keeps
+// at most one heartbeat per file, language, category, branch and machine
+// in each window of every seconds: a heartbeat whose window already has one
+// adds its duration and tags to it instead. Totals stay the same while the
+// heartbeats of chatty plugins take a fraction of the space.
+func (s *Store) StoreSampledHeartbeats(heartbeats []Heartbeat, every time.Duration) error {
+	return s.storeHeartbeats(heartbeats, int64(every/time.Second))
+}
+
+func (s *Store) storeHeartbeats(heartbeats []Heartbeat, window int64) error {
+	// Months' tables are created in transactions of their own, first
+	months := make([]*partition, len(heartbeats))
+	for i, hb := range heartbeats {
+		var err error
+		if months[i], err = s.partition(hb.Timestamp); err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	addDaily := tx.Stmt(s.addDailySeconds)
+	for i, hb := range heartbeats {
+		month := months[i]
+		projectID, aggregateOnly, err := s.project(tx, hb.UserID, hb.Project, hb.ProjectRoot)
+		if err != nil {
+			return err
+		}
+		if aggregateOnly {
+			hb.Entity, hb.Branch, hb.Dependencies = "", "", nil
+		}
+
+		var heartbeatID, timestamp int64
+		if window > 0 {
+			start := hb.Timestamp - hb.Timestamp%window
+			err := tx.Stmt(month.findSample).QueryRow(hb.UserID, start, start+window, projectID,
+				hb.Entity, hb.Language, hb.Category, hb.Branch, hb.Machine).Scan(&heartbeatID, &timestamp)
+			if err == nil {
+				_, err = tx.Stmt(month.addDuration).Exec(hb.Duration, heartbeatID)
+			}
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		if heartbeatID == 0 {
+			if heartbeatID, err = nextHeartbeatID(tx); err != nil {
+				return err
+			}
+			if _, err := tx.Stmt(month.insert).Exec(heartbeatID, hb.UserID, projectID,
+				hb.Language, hb.Entity, hb.Duration, hb.Timestamp, strings.Join(hb.Dependencies, ","),
+				hb.SessionID, hb.EntityType, hb.Category, hb.Branch, hb.Machine, false, nil); err != nil {
+				return err
+			}
+			timestamp = hb.Timestamp
+		}
+		if err := s.tagHeartbeat(tx, hb.UserID, heartbeatID, hb.Tags); err != nil {
+			return err
+		}
+		// The duration counts towards the day of the heartbeat keeping it
+		if _, err := addDaily.Exec(hb.UserID, timestamp, projectID,
+			hb.Language, false, hb.Duration); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// StoreManualEntry writes a manual entry as a heartbeat flagged as manual,
+// filling in its ID.
+func (s *Store) StoreManualEntry(entry *ManualEntry) error {
+	month, err := s.partition(entry.Timestamp)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	projectID, err := s.projectID(tx, entry.UserID, entry.Project, "")
+	if err != nil {
+		return err
+	}
+	id, err := nextHeartbeatID(tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(month.insert).Exec(id, entry.UserID, projectID, "", "",
+		entry.Duration, entry.Timestamp, nil, nil, "file", "coding", nil, nil, true, entry.Note); err != nil {
+		return err
+	}
+	entry.ID = id
+	if err := s.tagHeartbeat(tx, entry.UserID, entry.ID, entry.Tags); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(s.addDailySeconds).Exec(entry.UserID, entry.Timestamp, projectID,
+		"", true, entry.Duration); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tagHeartbeat attaches tags to a heartbeat, creating them as needed.
+func (s *Store) tagHeartbeat(tx *sql.Tx, userID string, heartbeatID int64, tags []string) error {
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		_, err := tx.Exec("INSERT OR IGNORE INTO tags (user_id, name) VALUES (?, ?)", userID, tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO heartbeat_tags (heartbeat_id, tag_id)
+			SELECT ?, id FROM tags WHERE user_id = ? AND name = ?
+		`, heartbeatID, userID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagFilter builds a WHERE fragment restricting heartbeats aliased as h to
+// those carrying every one of the given tags.
+func tagFilter(tags []string) (string, []interface{}) {
+	var filter string
+	var args []interface{}
+	for _, tag := range tags {
+		filter += ` AND h.id IN (
+			SELECT ht.heartbeat_id FROM heartbeat_tags ht
+			JOIN tags t ON t.id = ht.tag_id WHERE t.name = ?)`
+		args = append(args, tag)
+	}
+	return filter, args
+}
+
+// ManualEntries lists a user's manual entries carrying all of tags, most
+// recent first.
+func (s *Store) ManualEntries(userID string, tags []string) ([]ManualEntry, error) {
+	filter, args := tagFilter(tags)
+	rows, err := s.db.Query(`
+		SELECT h.id, h.user_id, p.name, h.duration, h.timestamp, COALESCE(h.note, '')
+		FROM heartbeats h
+		JOIN projects p ON h.project_id = p.id
+		WHERE h.user_id = ? AND h.manual = 1`+filter+`
+		ORDER BY h.timestamp DESC
+	`, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ManualEntry{}
+	for rows.Next() {
+		var e ManualEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Project,
+			&e.Duration, &e.Timestamp, &e.Note); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// TagTotals lists a user's tags with the time tracked under each.
+func (s *Store) TagTotals(userID string) ([]Bucket, error) {
+	rows, err := s.db.Query(`
+		SELECT t.name, COALESCE(SUM(h.duration), 0)
+		FROM tags t
+		LEFT JOIN (
+			SELECT ht.tag_id, h.duration FROM heartbeats h
+			JOIN heartbeat_tags ht ON ht.heartbeat_id = h.id
+			WHERE h.user_id = ?1
+		) h ON h.tag_id = t.id
+		WHERE t.user_id = ?1
+		GROUP BY t.name
+		ORDER BY SUM(h.duration) DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Bucket{}
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Name, &b.Duration); err != nil {
+			return nil, err
+		}
+		tags = append(tags, b)
+	}
+	return tags, rows.Err()
+}
+
+// Sessions lists up to limit of a user's focus sessions with their project
+// and language breakdown, most recent first, counting only heartbeats that
+// carry all of tags.
+func (s *Store) Sessions(userID string, limit int, tags []string) ([]SessionSummary, error) {
+	filter, args := tagFilter(tags)
+	rows, err := s.db.Query(`
+		SELECT h.session_id, MIN(h.timestamp), MAX(h.timestamp), SUM(h.duration)
+		FROM heartbeats h
+		WHERE h.user_id = ? AND h.session_id != ''`+filter+`
+		GROUP BY h.session_id
+		ORDER BY MIN(h.timestamp) DESC
+		LIMIT ?
+	`, append(append([]interface{}{userID}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []SessionSummary{}
+	for rows.Next() {
+		var ss SessionSummary
+		if err := rows.Scan(&ss.ID, &ss.Start, &ss.End, &ss.Duration); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sessions = append(sessions, ss)
+	}
+	rows.Close()
+
+	for i := range sessions {
+		for _, breakdown := range []struct {
+			column  string
+			buckets *[]Bucket
+		}{
+			{"p.name", &sessions[i].Projects},
+			{"h.language", &sessions[i].Languages},
+		} {
+			buckets, err := s.sessionBreakdown(userID, sessions[i].ID, breakdown.column, tags)
+			if err != nil {
+				return nil, err
+			}
+			*breakdown.buckets = buckets
+		}
+	}
+	return sessions, nil
+}
+
+func (s *Store) sessionBreakdown(userID, sessionID, column string, tags []string) ([]Bucket, error) {
+	filter, args := tagFilter(tags)
+	rows, err := s.db.Query(`
+		SELECT `+column+`, SUM(h.duration)
+		FROM heartbeats h
+		JOIN projects p ON h.project_id = p.id
+		WHERE h.user_id = ? AND h.session_id = ?`+filter+`
+		GROUP BY `+column+`
+		ORDER BY SUM(h.duration) DESC
+	`, append([]interface{}{userID, sessionID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []Bucket{}
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Name, &b.Duration); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
@@ -0,0 +1,123 @@
+package store
+
+// Job statuses
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is work a request started in the background, such as a backfill,
+// with its progress: Processed of Size bytes of input read so far, Stored
+// records written and Rejected ones skipped as invalid. UserID is who
+// started it, empty for the server key. Times are unix seconds.
+type Job struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	UserID     string `json:"user_id"`
+	Status     string `json:"status"`
+	Size       int64  `json:"size"`
+	Processed  int64  `json:"processed"`
+	Stored     int64  `json:"stored"`
+	Rejected   int64  `json:"rejected"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+// TaskRun is the record of a scheduled server task: the scheduled time of
+// its last run in unix seconds, how long that took and how it failed, and
+// how often it ran and failed in total.
+type TaskRun struct {
+	Name       string `json:"name"`
+	LastRun    int64  `json:"last_run"`
+	DurationMS int64  `json:"duration_ms"`
+	LastError  string `json:"last_error,omitempty"`
+	Runs       int64  `json:"runs"`
+	Failures   int64  `json:"failures"`
+}
+
+// CreateJob stores a new job.
+func (s *Store) CreateJob(j Job) error {
+	_, err := s.db.Exec(`
+		INSERT INTO jobs (id, kind, user_id, status, size, processed, stored, rejected, error, created_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, j.ID, j.Kind, j.UserID, j.Status, j.Size, j.Processed, j.Stored, j.Rejected, j.Error, j.CreatedAt, j.FinishedAt)
+	return err
+}
+
+// UpdateJob records the progress and status of a job.
+func (s *Store) UpdateJob(j Job) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs SET status = ?, processed = ?, stored = ?, rejected = ?, error = ?, finished_at = ?
+		WHERE id = ?
+	`, j.Status, j.Processed, j.Stored, j.Rejected, j.Error, j.FinishedAt, j.ID)
+	return err
+}
+
+// Job finds a job by ID. It returns sql.ErrNoRows for unknown jobs.
+func (s *Store) Job(id string) (Job, error) {
+	var j Job
+	err := s.db.QueryRow(`
+		SELECT id, kind, user_id, status, size, processed, stored, rejected, error, created_at, finished_at
+		FROM jobs WHERE id = ?
+	`, id).Scan(&j.ID, &j.Kind, &j.UserID, &j.Status, &j.Size, &j.Processed, &j.Stored, &j.Rejected,
+		&j.Error, &j.CreatedAt, &j.FinishedAt)
+	return j, err
+}
+
+// FailRunningJobs marks the jobs still running as failed with reason, for
+// jobs a previous process didn't get to finish.
+func (s *Store) FailRunningJobs(reason string, now int64) error {
+	_, err := s.db.Exec("UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE status = ?",
+		JobFailed, reason, now, JobRunning)
+	return err
+}
+
+// RecordTaskRun records a run of a scheduled task, failed when errMsg is
+// not empty.
+func (s *Store) RecordTaskRun(name string, at, durationMS int64, errMsg string) error {
+	failed := 0
+	if errMsg != "" {
+		failed = 1
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO task_runs (name, last_run, duration_ms, last_error, runs, failures)
+		VALUES (?, ?, ?, ?, 1, ?)
+		ON CONFLICT (name) DO UPDATE SET last_run = excluded.last_run,
+			duration_ms = excluded.duration_ms, last_error = excluded.last_error,
+			runs = runs + 1, failures = failures + excluded.failures
+	`, name, at, durationMS, errMsg, failed)
+	return err
+}
+
+// TaskRun finds the record of a scheduled task. It returns sql.ErrNoRows
+// for tasks that never ran.
+func (s *Store) TaskRun(name string) (TaskRun, error) {
+	var t TaskRun
+	err := s.db.QueryRow(`
+		SELECT name, last_run, duration_ms, last_error, runs, failures FROM task_runs WHERE name = ?
+	`, name).Scan(&t.Name, &t.LastRun, &t.DurationMS, &t.LastError, &t.Runs, &t.Failures)
+	return t, err
+}
+
+// TaskRuns lists the records of every scheduled task that ran, by name.
+func (s *Store) TaskRuns() ([]TaskRun, error) {
+	rows, err := s.db.Query(`
+		SELECT name, last_run, duration_ms, last_error, runs, failures FROM task_runs ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []TaskRun{}
+	for rows.Next() {
+		var t TaskRun
+		if err := rows.Scan(&t.Name, &t.LastRun, &t.DurationMS, &t.LastError, &t.Runs, &t.Failures); err != nil {
+			return nil, err
+		}
+		runs = append(runs, t)
+	}
+	return runs, rows.Err()
+}
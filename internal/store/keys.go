@@ -0,0 +1,232 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// APIKey describes the key a request authenticated with. Keys in the
+// api_keys table belong to a user; the API_KEY from .env is the server key.
+// Scope limits what a key may do, one of the Scope constants.
+type APIKey struct {
+	ID         int64  `json:"id,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Scope      string `json:"scope"`
+	CreatedAt  int64  `json:"created_at,omitempty"`
+	LastUsedAt int64  `json:"last_used_at,omitempty"`
+}
+
+// API key scopes. Write keys are for editor plugins and can only send
+// heartbeats, read keys are for dashboards and can't change anything.
+const (
+	ScopeAll   = "all"
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// KeyUsage is where a user API key was used from: one per key and source IP,
+// with the country when the server knows it.
+type KeyUsage struct {
+	KeyID     int64  `json:"key_id"`
+	IP        string `json:"ip"`
+	Country   string `json:"country"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Requests  int64  `json:"requests"`
+}
+
+// KeyStats counts the requests made with a user API key and the ones that
+// failed, to find the machine whose plugin misbehaves. The counts are over
+// the days Days lists, those of the last 30 the key was used, oldest
+// first. ErrorRate is the share of requests answered with a 4xx or 5xx,
+// LastError the method, path and status of the latest of those, and
+// UserAgent that of the latest request. Times are unix seconds.
+type KeyStats struct {
+	KeyID        int64    `json:"key_id"`
+	Requests     int64    `json:"requests"`
+	ClientErrors int64    `json:"client_errors"`
+	ServerErrors int64    `json:"server_errors"`
+	ErrorRate    float64  `json:"error_rate"`
+	LastSeen     int64    `json:"last_seen"`
+	LastStatus   int      `json:"last_status"`
+	LastError    string   `json:"last_error,omitempty"`
+	LastErrorAt  int64    `json:"last_error_at,omitempty"`
+	UserAgent    string   `json:"user_agent"`
+	Days         []KeyDay `json:"days"`
+}
+
+// KeyDay counts the requests made with a user API key on a UTC day.
+type KeyDay struct {
+	Day          string `json:"day"`
+	Requests     int64  `json:"requests"`
+	ClientErrors int64  `json:"client_errors"`
+	ServerErrors int64  `json:"server_errors"`
+}
+
+// APIKeyByHash finds the user key stored under hash. It returns
+// sql.ErrNoRows for unknown keys.
+func (s *Store) APIKeyByHash(hash string) (APIKey, error) {
+	key := APIKey{Source: "database"}
+	var lastUsed sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT id, user_id, name, scope, created_at, last_used_at FROM api_keys WHERE key_hash = ?
+	`, hash).Scan(&key.ID, &key.UserID, &key.Name, &key.Scope, &key.CreatedAt, &lastUsed)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsedAt = lastUsed.Int64
+	return key, nil
+}
+
+// KeyRequests counts the requests made with a user API key on a UTC day
+// since they were last recorded, as RecordKeyUse adds them. LastError is
+// the method, path and status of the latest that failed, if any.
+type KeyRequests struct {
+	KeyID        int64
+	Day          string
+	Requests     int64
+	ClientErrors int64
+	ServerErrors int64
+	LastSeen     int64
+	LastStatus   int
+	LastError    string
+	LastErrorAt  int64
+	UserAgent    string
+}
+
+// RecordKeyUse adds the uses of user keys counted since the last call, by
+// IP and by day, to those recorded before in a single transaction, and
+// moves the keys' last use forward. An empty country keeps the one
+// recorded before.
+func (s *Store) RecordKeyUse(ips []KeyUsage, days []KeyRequests) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range ips {
+		if _, err := tx.Exec(`
+			INSERT INTO key_usage (key_id, ip, country, first_seen, last_seen, requests)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (key_id, ip) DO UPDATE SET last_seen = MAX(last_seen, excluded.last_seen),
+				requests = requests + excluded.requests,
+				country = CASE WHEN excluded.country = '' THEN country ELSE excluded.country END
+		`, u.KeyID, u.IP, u.Country, u.FirstSeen, u.LastSeen, u.Requests); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			UPDATE api_keys SET last_used_at = MAX(IFNULL(last_used_at, 0), ?) WHERE id = ?
+		`, u.LastSeen, u.KeyID); err != nil {
+			return err
+		}
+	}
+	for _, d := range days {
+		if _, err := tx.Exec(`
+			INSERT INTO key_requests (key_id, day, requests, client_errors, server_errors,
+				last_seen, last_status, last_error, last_error_at, user_agent)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (key_id, day) DO UPDATE SET requests = requests + excluded.requests,
+				client_errors = client_errors + excluded.client_errors,
+				server_errors = server_errors + excluded.server_errors,
+				last_seen = excluded.last_seen, last_status = excluded.last_status,
+				last_error = CASE WHEN excluded.last_error_at = 0 THEN last_error ELSE excluded.last_error END,
+				last_error_at = MAX(last_error_at, excluded.last_error_at),
+				user_agent = excluded.user_agent
+		`, d.KeyID, d.Day, d.Requests, d.ClientErrors, d.ServerErrors,
+			d.LastSeen, d.LastStatus, d.LastError, d.LastErrorAt, d.UserAgent); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// APIKeyByID finds a user key by its ID. It returns sql.ErrNoRows for
+// unknown keys.
+func (s *Store) APIKeyByID(id int64) (APIKey, error) {
+	key := APIKey{Source: "database"}
+	var lastUsed sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT id, user_id, name, scope, created_at, last_used_at FROM api_keys WHERE id = ?
+	`, id).Scan(&key.ID, &key.UserID, &key.Name, &key.Scope, &key.CreatedAt, &lastUsed)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsedAt = lastUsed.Int64
+	return key, nil
+}
+
+// KeyUsage returns where a user key was used from, most recently used first.
+func (s *Store) KeyUsage(keyID int64, limit int) ([]KeyUsage, error) {
+	rows, err := s.db.Query(`
+		SELECT key_id, ip, country, first_seen, last_seen, requests FROM key_usage
+		WHERE key_id = ? ORDER BY last_seen DESC, ip LIMIT ?
+	`, keyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []KeyUsage{}
+	for rows.Next() {
+		var u KeyUsage
+		if err := rows.Scan(&u.KeyID, &u.IP, &u.Country, &u.FirstSeen, &u.LastSeen, &u.Requests); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// KeyStats returns the request counts of a user key over the days since
+// since, which are empty when it wasn't used.
+func (s *Store) KeyStats(keyID int64, since time.Time) (KeyStats, error) {
+	stats := KeyStats{KeyID: keyID, Days: []KeyDay{}}
+	rows, err := s.db.Query(`
+		SELECT day, requests, client_errors, server_errors, last_seen, last_status,
+			last_error, last_error_at, user_agent
+		FROM key_requests WHERE key_id = ? AND day >= ? ORDER BY day
+	`, keyID, since.UTC().Format("2006-01-02"))
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d KeyDay
+		var lastSeen, lastErrorAt int64
+		var lastStatus int
+		var lastError, userAgent string
+		if err := rows.Scan(&d.Day, &d.Requests, &d.ClientErrors, &d.ServerErrors, &lastSeen, &lastStatus,
+			&lastError, &lastErrorAt, &userAgent); err != nil {
+			return stats, err
+		}
+		stats.Days = append(stats.Days, d)
+		stats.Requests += d.Requests
+		stats.ClientErrors += d.ClientErrors
+		stats.ServerErrors += d.ServerErrors
+		// Days come in order, so the latest overwrite
+		stats.LastSeen, stats.LastStatus, stats.UserAgent = lastSeen, lastStatus, userAgent
+		if lastErrorAt > 0 {
+			stats.LastError, stats.LastErrorAt = lastError, lastErrorAt
+		}
+	}
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.ClientErrors+stats.ServerErrors) / float64(stats.Requests)
+	}
+	return stats, rows.Err()
+}
+
+// CreateAPIKey stores a user key under its hash, filling in its ID.
+func (s *Store) CreateAPIKey(key *APIKey, hash string) error {
+	res, err := s.db.Exec(`
+		INSERT INTO api_keys (user_id, name, key_hash, scope, created_at) VALUES (?, ?, ?, ?, ?)
+	`, key.UserID, key.Name, hash, key.Scope, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+	key.ID, _ = res.LastInsertId()
+	return nil
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by Lock when another process holds the database's
+// lock.
+var ErrLocked = errors.New("database is in use by another server")
+
+// Lock takes an exclusive advisory lock on the SQLite database at path, in
+// a file next to it named after it with ".lock", so that two servers never
+// write the same database: they would both send every email and scheduled
+// webhook, and run migrations and pruning over each other. The lock is
+// released by the returned function or when the process exits, even when
+// it crashes, so a lock file left behind doesn't keep the server from
+// starting. Locks are per host; NFS and other network filesystems may not
+// honor them.
+func Lock(path string) (func() error, error) {
+	path, _, _ = strings.Cut(strings.TrimPrefix(path, "file:"), "?")
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		// The holder wrote its PID
+		data := make([]byte, 20)
+		n, _ := f.ReadAt(data, 0)
+		f.Close()
+		if err == errWouldBlock {
+			if pid, perr := strconv.Atoi(strings.TrimSpace(string(data[:n]))); perr == nil {
+				return nil, fmt.Errorf("%w (process %d)", ErrLocked, pid)
+			}
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() error {
+		unlockFile(f)
+		return f.Close()
+	}, nil
+}
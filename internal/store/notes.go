@@ -0,0 +1,62 @@
+package store
+
+import "database/sql"
+
+// Note explains a day or range of days in reports, such as a conference or
+// a vacation. From and To are UTC dates, both included.
+type Note struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Text   string `json:"text"`
+}
+
+// AddNote stores a note, filling in its ID.
+func (s *Store) AddNote(n *Note) error {
+	return s.db.QueryRow(`
+		INSERT INTO notes (user_id, from_day, to_day, text) VALUES (?, ?, ?, ?)
+		RETURNING id
+	`, n.UserID, n.From, n.To, n.Text).Scan(&n.ID)
+}
+
+// Notes returns a user's notes overlapping the UTC dates from to to, in
+// order of their first day.
+func (s *Store) Notes(userID, from, to string) ([]Note, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, from_day, to_day, text FROM notes
+		WHERE user_id = ? AND from_day <= ? AND to_day >= ?
+		ORDER BY from_day, id
+	`, userID, to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		var n Note
+		if err := rows.Scan(&n.ID, &n.UserID, &n.From, &n.To, &n.Text); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// DeleteNote deletes one of a user's notes, returning sql.ErrNoRows when
+// there is no such note.
+func (s *Store) DeleteNote(userID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM notes WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Heartbeats are kept in a table per month, heartbeats_YYYY_MM by the UTC
+// month of their timestamp, so that a month's table and indexes stay small
+// however long a server has been running. Queries over a range of time read
+// the months it covers, from heartbeatsIn, and others the heartbeats view,
+// the UNION ALL of every month, with SQLite pushing their WHERE into each
+// month's indexes. Timestamps must be in the window CheckTimestamp allows,
+// which bounds how many months there are. Writes go to the month's table: a
+// heartbeat is inserted in its month, updated by ID in the month of its
+// timestamp, and updates or deletes by a filter run on every month with
+// eachPartition. IDs are unique across months, taken from heartbeat_ids.
+
+// heartbeatColumns are the columns of every month's table, those of the
+// heartbeats table databases had before and in the same order. A column
+// added later goes at the end here, and in initDB's migrations for the
+// months that already exist.
+const heartbeatColumns = `
+	id INTEGER PRIMARY KEY, user_id TEXT, project_id INTEGER, language TEXT,
+	file_path TEXT, duration REAL, timestamp INTEGER, dependencies TEXT,
+	session_id TEXT, manual INTEGER NOT NULL DEFAULT 0, note TEXT,
+	entity_type TEXT NOT NULL DEFAULT 'file', category TEXT NOT NULL DEFAULT 'coding',
+	branch TEXT, machine TEXT`
+
+// heartbeatColumnNames are heartbeatColumns without their types.
+const heartbeatColumnNames = "id, user_id, project_id, language, file_path, duration, timestamp, " +
+	"dependencies, session_id, manual, note, entity_type, category, branch, machine"
+
+// partition is a month's heartbeats table with the statements writing it,
+// prepared once it is first written. Sampling looks for a heartbeat to add
+// to in the month alone, so a window spanning two months keeps one in each.
+type partition struct {
+	insert      *sql.Stmt
+	findSample  *sql.Stmt
+	addDuration *sql.Stmt
+}
+
+// partitionName is the table of the month timestamp falls in. Timestamps
+// before 1970 go with its first month and those after 9999 with its last.
+func partitionName(timestamp int64) string {
+	return "heartbeats_" + time.Unix(min(max(timestamp, 0), maxTimestamp), 0).UTC().Format("2006_01")
+}
+
+// maxTimestamp is the last second of 9999.
+const maxTimestamp = 253402300799
+
+// minTimestamp is the start of 2000, and maxAhead how far past the current
+// time a heartbeat may be.
+const (
+	minTimestamp = 946684800
+	maxAhead     = 24 * time.Hour
+)
+
+// ErrTimestamp is returned for heartbeats and manual entries from before
+// 2000 or more than a day ahead, which come from broken clocks and would
+// each add a month's table.
+var ErrTimestamp = errors.New("timestamp is before 2000 or more than a day ahead")
+
+// CheckTimestamp returns ErrTimestamp unless a heartbeat at timestamp may
+// be stored at now.
+func CheckTimestamp(timestamp int64, now time.Time) error {
+	if timestamp < minTimestamp || timestamp > now.Add(maxAhead).Unix() {
+		return ErrTimestamp
+	}
+	return nil
+}
+
+// createPartition creates a month's table and its indexes if they don't
+// exist yet.
+func createPartition(db execer, table string) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + table + ` (` + heartbeatColumns + `);
+		CREATE INDEX IF NOT EXISTS ` + table + `_user_time ON ` + table + ` (user_id, timestamp);
+		CREATE INDEX IF NOT EXISTS ` + table + `_time ON ` + table + ` (timestamp);`)
+	return err
+}
+
+// execer is what createPartition and the other schema changes need of a
+// database or transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// partitionTables lists the months' tables, oldest first.
+func partitionTables(db execer) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name GLOB 'heartbeats_[0-9][0-9][0-9][0-9]_[0-9][0-9]'
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// createView replaces the heartbeats view with one over every month's
+// table.
+func createView(db execer) error {
+	tables, err := partitionTables(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP VIEW IF EXISTS heartbeats; CREATE VIEW heartbeats AS " + unionAll(tables))
+	return err
+}
+
+// maxCompound is how many SELECTs SQLite takes in a UNION ALL.
+const maxCompound = 500
+
+// unionAll is the SELECT of every row of tables. Past maxCompound of them,
+// they are read in groups of as many from subqueries, which is enough for
+// every month CheckTimestamp allows.
+func unionAll(tables []string) string {
+	var selects []string
+	if len(tables) <= maxCompound {
+		for _, table := range tables {
+			selects = append(selects, "SELECT * FROM "+table)
+		}
+	} else {
+		for i := 0; i < len(tables); i += maxCompound {
+			selects = append(selects, "SELECT * FROM ("+unionAll(tables[i:min(i+maxCompound, len(tables))])+")")
+		}
+	}
+	return strings.Join(selects, " UNION ALL ")
+}
+
+// heartbeatsIn returns what to read the heartbeats with timestamps from
+// from up to to, excluded, from in place of the heartbeats view: the UNION
+// ALL of the months they fall in, so a query over a range of time doesn't
+// touch the others.
+func heartbeatsIn(db execer, from, to int64) (string, error) {
+	months, err := monthsIn(db, from, to)
+	if err != nil {
+		return "", err
+	}
+	if len(months) == 0 {
+		return "(SELECT * FROM heartbeats WHERE 0)", nil
+	}
+	return "(" + unionAll(months) + ")", nil
+}
+
+// monthsIn lists the months' tables holding timestamps from from up to to,
+// excluded, oldest first.
+func monthsIn(db execer, from, to int64) ([]string, error) {
+	tables, err := partitionTables(db)
+	if err != nil {
+		return nil, err
+	}
+	first, last := partitionName(from), partitionName(to-1)
+	var months []string
+	for _, table := range tables {
+		if table >= first && table <= last {
+			months = append(months, table)
+		}
+	}
+	return months, nil
+}
+
+// partitionHeartbeats moves the heartbeats of a database from before
+// monthly tables into them, keeping their IDs, and creates the heartbeats
+// view over the months. A new database gets the current month's table.
+func partitionHeartbeats(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS heartbeat_ids (last INTEGER NOT NULL);
+		INSERT INTO heartbeat_ids (last) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM heartbeat_ids)`); err != nil {
+		return err
+	}
+	var kind string
+	err = tx.QueryRow("SELECT type FROM sqlite_master WHERE name = 'heartbeats'").Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if kind == "table" {
+		if err := moveHeartbeats(tx); err != nil {
+			return err
+		}
+	}
+	tables, err := partitionTables(tx)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		if err := createPartition(tx, partitionName(time.Now().Unix())); err != nil {
+			return err
+		}
+	}
+	if err := createView(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveHeartbeats copies the heartbeats table into a table per month, then
+// drops it. heartbeat_ids carries on from its AUTOINCREMENT sequence.
+func moveHeartbeats(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT DISTINCT strftime('%Y_%m', MIN(MAX(IFNULL(timestamp, 0), 0), ?), 'unixepoch')
+		FROM heartbeats`, maxTimestamp)
+	if err != nil {
+		return err
+	}
+	var months []string
+	for rows.Next() {
+		var month string
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, month)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var copied int64
+	for _, month := range months {
+		start, err := time.Parse("2006_01", month)
+		if err != nil {
+			return fmt.Errorf("heartbeats of month %q: %v", month, err)
+		}
+		table := "heartbeats_" + month
+		if err := createPartition(tx, table); err != nil {
+			return err
+		}
+		// The first and last months take the timestamps partitionName
+		// clamps, and those missing, if any, go with the first
+		from, to := start.Unix(), start.AddDate(0, 1, 0).Unix()-1
+		first := from == 0
+		if first {
+			from = math.MinInt64
+		}
+		if to == maxTimestamp {
+			to = math.MaxInt64
+		}
+		res, err := tx.Exec(`
+			INSERT INTO `+table+` (`+heartbeatColumnNames+`)
+			SELECT `+heartbeatColumnNames+` FROM heartbeats
+			WHERE (timestamp >= ? AND timestamp <= ?) OR (? AND timestamp IS NULL)`,
+			from, to, first)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		copied += n
+	}
+	var total int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM heartbeats").Scan(&total); err != nil {
+		return err
+	}
+	if copied != total {
+		return fmt.Errorf("moved %d of %d heartbeats into monthly tables", copied, total)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE heartbeat_ids SET last = MAX(last, IFNULL((SELECT MAX(id) FROM heartbeats), 0),
+			IFNULL((SELECT seq FROM sqlite_sequence WHERE name = 'heartbeats'), 0))`); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		DROP TABLE heartbeats;
+		DELETE FROM sqlite_sequence WHERE name = 'heartbeats'`)
+	return err
+}
+
+// nextHeartbeatID takes the next heartbeat ID.
+func nextHeartbeatID(tx *sql.Tx) (int64, error) {
+	var id int64
+	err := tx.QueryRow("UPDATE heartbeat_ids SET last = last + 1 RETURNING last").Scan(&id)
+	return id, err
+}
+
+// partition returns the table of the month timestamp falls in, creating it
+// and adding it to the heartbeats view the first time. Timestamps outside
+// the window CheckTimestamp allows get ErrTimestamp.
+func (s *Store) partition(timestamp int64) (*partition, error) {
+	if err := CheckTimestamp(timestamp, time.Now()); err != nil {
+		return nil, err
+	}
+	table := partitionName(timestamp)
+	s.partitionsMu.Lock()
+	defer s.partitionsMu.Unlock()
+	if p, ok := s.partitions[table]; ok {
+		return p, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)",
+		table).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := createPartition(tx, table); err != nil {
+			return nil, err
+		}
+		if err := createView(tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	p := &partition{}
+	for _, stmt := range []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&p.insert, `
+			INSERT INTO ` + table + ` (id, user_id, project_id, language, file_path, duration, timestamp,
+				dependencies, session_id, entity_type, category, branch, machine, manual, note)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`},
+		{&p.findSample, `
+			SELECT id, timestamp FROM ` + table + `
+			WHERE user_id = ? AND timestamp >= ? AND timestamp < ? AND project_id = ?
+				AND file_path = ? AND language = ? AND IFNULL(category, '') = ?
+				AND IFNULL(branch, '') = ? AND IFNULL(machine, '') = ? AND manual = 0
+			LIMIT 1`},
+		{&p.addDuration, "UPDATE " + table + " SET duration = duration + ? WHERE id = ?"},
+	} {
+		prepared, err := s.db.Prepare(stmt.query)
+		if err != nil {
+			return nil, fmt.Errorf("statement preparation error: %v", err)
+		}
+		*stmt.dst = prepared
+	}
+	s.partitions[table] = p
+	return p, nil
+}
+
+// eachPartition runs an update or delete on the table of every month
+// holding timestamps from from up to to, excluded, with %[1]s in query
+// standing for the table, returning how many rows it changed in all of
+// them.
+func eachPartition(tx *sql.Tx, from, to int64, query string, args ...interface{}) (int64, error) {
+	tables, err := monthsIn(tx, from, to)
+	if err != nil {
+		return 0, err
+	}
+	var changed int64
+	for _, table := range tables {
+		res, err := tx.Exec(fmt.Sprintf(query, table), args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
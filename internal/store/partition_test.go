@@ -0,0 +1,103 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPartitions checks that heartbeats of a database from before monthly
+// tables move into them with their IDs, and that storing, reading and
+// changing heartbeats spans the months.
+func TestPartitions(t *testing.T) {
+	jan := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC).Unix()
+	feb := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC).Unix()
+	db, s := newTestStore(t, `
+		CREATE TABLE heartbeats (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, project_id INTEGER,
+			language TEXT, file_path TEXT, duration REAL, timestamp INTEGER);
+		CREATE INDEX heartbeats_user_time ON heartbeats (user_id, timestamp);
+		INSERT INTO heartbeats (id, user_id, project_id, language, file_path, duration, timestamp)
+		VALUES (1, 'alice', 1, 'Go', '/a.go', 60, ?1), (2, 'alice', 1, 'Go', '/a.go', 60, ?2),
+			(7, 'alice', 1, 'Go', '/a.go', 60, ?2);
+		DELETE FROM heartbeats WHERE id = 7;`, jan, feb)
+	tables, err := partitionTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"heartbeats_2024_01", "heartbeats_2024_02"}; strings.Join(tables, " ") != strings.Join(want, " ") {
+		t.Errorf("months %q, want %q", tables, want)
+	}
+	var ids string
+	if err := db.QueryRow("SELECT GROUP_CONCAT(id) FROM (SELECT id FROM heartbeats ORDER BY id)").Scan(&ids); err != nil || ids != "1,2" {
+		t.Errorf("moved heartbeats %q, %v", ids, err)
+	}
+
+	// IDs carry on after the last one ever taken, in whichever month
+	mar := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+	if err := s.StoreHeartbeats([]Heartbeat{
+		{UserID: "alice", Project: "p", Language: "Go", Entity: "/b.go", Duration: 30, Timestamp: jan, Tags: []string{"t"}},
+		{UserID: "alice", Project: "p", Language: "Go", Entity: "/b.go", Duration: 30, Timestamp: mar, Tags: []string{"t"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`
+		SELECT GROUP_CONCAT(id) FROM (SELECT id FROM heartbeats_2024_01 UNION ALL SELECT id FROM heartbeats_2024_03 ORDER BY id)
+	`).Scan(&ids); err != nil || ids != "1,8,9" {
+		t.Errorf("heartbeats of January and March %q, %v", ids, err)
+	}
+	totals, err := s.TagTotals("alice")
+	if err != nil || len(totals) != 1 || totals[0].Duration != 60 {
+		t.Errorf("tag totals %+v, %v", totals, err)
+	}
+	live, err := s.LiveToday("alice", time.Unix(mar, 0))
+	if err != nil || live.LastHeartbeat != mar || live.Project != "p" {
+		t.Errorf("live %+v, %v", live, err)
+	}
+
+	// The moved heartbeats are in the first project, p
+	edit, err := s.ReclassifyHeartbeats(HeartbeatFilter{UserID: "alice", Project: "p"}, Reclassification{Language: "Rust"}, "alice")
+	if err != nil || edit.Heartbeats != 4 {
+		t.Errorf("reclassified %d, %v", edit.Heartbeats, err)
+	}
+	n, err := s.DeleteHeartbeats(HeartbeatFilter{UserID: "alice",
+		From: time.Unix(jan, 0), To: time.Unix(feb, 0)})
+	if err != nil || n != 3 {
+		t.Errorf("deleted %d, %v", n, err)
+	}
+	if err := db.QueryRow("SELECT GROUP_CONCAT(id || language) FROM heartbeats").Scan(&ids); err != nil || ids != "9Rust" {
+		t.Errorf("heartbeats left %q, %v", ids, err)
+	}
+
+	// A range of time reads the months it covers alone
+	if from, err := heartbeatsIn(db, feb, mar+1); err != nil || from != "(SELECT * FROM heartbeats_2024_02 UNION ALL SELECT * FROM heartbeats_2024_03)" {
+		t.Errorf("heartbeats from February to March from %q, %v", from, err)
+	}
+	// and timestamps from broken clocks make no months
+	if err := s.StoreHeartbeats([]Heartbeat{{UserID: "alice", Project: "p", Timestamp: 1}}); err != ErrTimestamp {
+		t.Errorf("storing a heartbeat of 1970: %v", err)
+	}
+}
+
+// TestManyPartitions checks that the heartbeats view takes more months
+// than SQLite takes SELECTs in a UNION ALL.
+func TestManyPartitions(t *testing.T) {
+	db, _ := newTestStore(t, "")
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxCompound+100; i++ {
+		table := partitionName(start.AddDate(0, i, 0).Unix())
+		if err := createPartition(db, table); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO "+table+" (id, user_id, timestamp) VALUES (?, 'alice', 0)", i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createView(db); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM heartbeats").Scan(&n); err != nil || n != maxCompound+100 {
+		t.Errorf("%d heartbeats, %v", n, err)
+	}
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// Project is a user's project with its settings. Root is the directory the
+// client last saw it checked out in. KeystrokeTimeout, in seconds, is 0 to
+// use the client's default. Color is an "#rrggbb" color, or "" for none,
+// and HourlyRate is what a billable project's time is worth. Workspace
+// groups projects, such as a client's frontend and backend, for stats and
+// reports; "" is none. Archived projects keep their time but are left out
+// of stats and project lists unless asked for.
+type Project struct {
+	ID               int64   `json:"id"`
+	UserID           string  `json:"user_id"`
+	Name             string  `json:"name"`
+	Root             string  `json:"root"`
+	KeystrokeTimeout int     `json:"keystroke_timeout"`
+	Color            string  `json:"color"`
+	Description      string  `json:"description"`
+	Billable         bool    `json:"billable"`
+	HourlyRate       float64 `json:"hourly_rate"`
+	Workspace        string  `json:"workspace"`
+	Archived         bool    `json:"archived"`
+	// AggregateOnly projects keep only the time, language, category, tags
+	// and machine of heartbeats: no entities, branches, dependencies or
+	// root, for work under NDA.
+	AggregateOnly bool `json:"aggregate_only"`
+}
+
+// Workspace is a group of a user's projects, by name.
+type Workspace struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects"`
+}
+
+// ProjectTotal is the time a user spent in one project and language over a
+// period. Manual entries have no language and are totalled separately.
+type ProjectTotal struct {
+	UserID   string
+	Project  string
+	Language string
+	Manual   bool
+	Seconds  float64
+}
+
+// projectID gets or creates the project with the given name, moving it to
+// root when one is given. The projects' old path column, the first file
+// seen in them, is no longer written.
+func (s *Store) projectID(tx *sql.Tx, userID, name, root string) (int, error) {
+	projectID, _, err := s.project(tx, userID, name, root)
+	return projectID, err
+}
+
+// project is projectID also reporting whether the project is aggregate
+// only, whose root is left empty.
+func (s *Store) project(tx *sql.Tx, userID, name, root string) (int, bool, error) {
+	var projectID int
+	var aggregateOnly bool
+	err := tx.Stmt(s.findProject).QueryRow(userID, name).Scan(&projectID, &aggregateOnly)
+	if err == sql.ErrNoRows {
+		res, err := tx.Stmt(s.insertProject).Exec(userID, name, root)
+		if err != nil {
+			return 0, false, err
+		}
+		id, _ := res.LastInsertId()
+		return int(id), false, nil
+	}
+	if err == nil && root != "" && !aggregateOnly {
+		_, err = tx.Stmt(s.updateProjectRoot).Exec(root, projectID, root)
+	}
+	return projectID, aggregateOnly, err
+}
+
+// scrubAggregateOnly removes what aggregate only projects don't keep from
+// a user's heartbeats in them, for heartbeats moved there and projects
+// that just became aggregate only.
+func scrubAggregateOnly(tx *sql.Tx, userID string) error {
+	if _, err := tx.Exec(`
+		UPDATE projects SET root = '' WHERE user_id = ? AND aggregate_only = 1 AND root != ''
+	`, userID); err != nil {
+		return err
+	}
+	_, err := eachPartition(tx, math.MinInt64, math.MaxInt64, `
+		UPDATE %[1]s SET file_path = '', branch = '', dependencies = ''
+		WHERE user_id = ?1 AND project_id IN (SELECT id FROM projects WHERE user_id = ?1 AND aggregate_only = 1)
+			AND (file_path != '' OR branch != '' OR dependencies != '')
+	`, userID)
+	return err
+}
+
+// projectColumns are the columns scanned by scanProject.
+const projectColumns = "id, user_id, name, root, keystroke_timeout, color, description, billable, hourly_rate, " +
+	"workspace, archived, aggregate_only"
+
+func scanProject(row interface{ Scan(...interface{}) error }) (Project, error) {
+	var p Project
+	err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.Root, &p.KeystrokeTimeout, &p.Color, &p.Description,
+		&p.Billable, &p.HourlyRate, &p.Workspace, &p.Archived, &p.AggregateOnly)
+	return p, err
+}
+
+// Projects returns a user's projects by name, leaving out archived ones
+// unless withArchived.
+func (s *Store) Projects(userID string, withArchived bool) ([]Project, error) {
+	rows, err := s.db.Query(`
+		SELECT `+projectColumns+` FROM projects
+		WHERE user_id = ? AND (? OR archived = 0) ORDER BY name
+	`, userID, withArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// Project returns one of a user's projects, or sql.ErrNoRows.
+func (s *Store) Project(userID, name string) (Project, error) {
+	return scanProject(s.db.QueryRow(`
+		SELECT `+projectColumns+` FROM projects
+		WHERE user_id = ? AND name = ?
+	`, userID, name))
+}
+
+// UpdateProject saves the settings of the project p.ID. Making it
+// aggregate only removes the paths and branches of the heartbeats already
+// in it.
+func (s *Store) UpdateProject(p Project) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE projects SET keystroke_timeout = ?, color = ?, description = ?, billable = ?, hourly_rate = ?,
+			workspace = ?, aggregate_only = ?
+		WHERE id = ?
+	`, p.KeystrokeTimeout, p.Color, p.Description, p.Billable, p.HourlyRate, p.Workspace, p.AggregateOnly, p.ID)
+	if err != nil {
+		return err
+	}
+	if p.AggregateOnly {
+		if err := scrubAggregateOnly(tx, p.UserID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Workspaces returns a user's workspaces by name, with their unarchived
+// projects.
+func (s *Store) Workspaces(userID string) ([]Workspace, error) {
+	rows, err := s.db.Query(`
+		SELECT workspace, name FROM projects
+		WHERE user_id = ? AND workspace != '' AND archived = 0
+		ORDER BY workspace, name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var workspace, project string
+		if err := rows.Scan(&workspace, &project); err != nil {
+			return nil, err
+		}
+		if n := len(workspaces); n == 0 || workspaces[n-1].Name != workspace {
+			workspaces = append(workspaces, Workspace{Name: workspace})
+		}
+		w := &workspaces[len(workspaces)-1]
+		w.Projects = append(w.Projects, project)
+	}
+	return workspaces, rows.Err()
+}
+
+// ArchiveProject archives or, if !archived, unarchives one of a user's
+// projects. It returns sql.ErrNoRows for unknown projects.
+func (s *Store) ArchiveProject(userID, name string, archived bool) error {
+	res, err := s.db.Exec(`
+		UPDATE projects SET archived = ? WHERE user_id = ? AND name = ?
+	`, archived, userID, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// unarchived is a condition on a daily_summaries or heartbeats project_id
+// column leaving out the time of archived projects, or "" withArchived.
+func unarchived(column string, withArchived bool) string {
+	if withArchived {
+		return ""
+	}
+	return " AND " + column + " NOT IN (SELECT id FROM projects WHERE archived = 1)"
+}
+
+// describeProjects fills in the color and description of a user's project
+// buckets.
+func (s *Store) describeProjects(userID string, buckets []Bucket) error {
+	rows, err := s.db.Query(`
+		SELECT name, color, description FROM projects
+		WHERE user_id = ? AND (color != '' OR description != '')
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	described := make(map[string]Bucket)
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Name, &b.Color, &b.Description); err != nil {
+			return err
+		}
+		described[b.Name] = b
+	}
+	for i, b := range buckets {
+		buckets[i].Color, buckets[i].Description = described[b.Name].Color, described[b.Name].Description
+	}
+	return rows.Err()
+}
+
+// ProjectTotals sums the time each known user spent per project and
+// language on the days in [from, to).
+func (s *Store) ProjectTotals(from, to time.Time) ([]ProjectTotal, error) {
+	rows, err := s.db.Query(`
+		SELECT d.user_id, p.name, d.language, d.manual, SUM(d.seconds)
+		FROM daily_summaries d
+		JOIN users u ON d.user_id = u.id
+		JOIN projects p ON d.project_id = p.id
+		WHERE d.day >= ? AND d.day < ?
+		GROUP BY d.user_id, p.name, d.language, d.manual
+	`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []ProjectTotal
+	for rows.Next() {
+		var t ProjectTotal
+		if err := rows.Scan(&t.UserID, &t.Project, &t.Language, &t.Manual, &t.Seconds); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// ProjectSeconds sums all the time each user ever tracked per project,
+// manual entries included, leaving Language empty.
+func (s *Store) ProjectSeconds() ([]ProjectTotal, error) {
+	rows, err := s.db.Query(`
+		SELECT d.user_id, p.name, SUM(d.seconds)
+		FROM daily_summaries d
+		JOIN projects p ON d.project_id = p.id
+		GROUP BY d.user_id, p.name
+		ORDER BY d.user_id, p.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []ProjectTotal
+	for rows.Next() {
+		var t ProjectTotal
+		if err := rows.Scan(&t.UserID, &t.Project, &t.Seconds); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// DomainRule sets the category of a user's browsing time on a domain and
+// its subdomains, such as "researching" for go.dev.
+type DomainRule struct {
+	UserID   string `json:"user_id"`
+	Domain   string `json:"domain"`
+	Category string `json:"category"`
+}
+
+// Rule reclassifies a user's heartbeats: those matching every one of its
+// non-empty match fields get its non-empty set fields, and its tags on top
+// of their own. MatchPath is a pattern for the whole path in which * matches
+// any part of it, slashes included; MatchLanguage and MatchMachine are
+// compared without case.
+type Rule struct {
+	ID            int64    `json:"id"`
+	UserID        string   `json:"user_id"`
+	MatchPath     string   `json:"match_path,omitempty"`
+	MatchLanguage string   `json:"match_language,omitempty"`
+	MatchMachine  string   `json:"match_machine,omitempty"`
+	SetProject    string   `json:"set_project,omitempty"`
+	SetCategory   string   `json:"set_category,omitempty"`
+	SetTags       []string `json:"set_tags,omitempty"`
+}
+
+// AddRule stores a new rule, filling in its ID.
+func (s *Store) AddRule(r *Rule) error {
+	res, err := s.db.Exec(`
+		INSERT INTO rules (user_id, match_path, match_language, match_machine, set_project, set_category, set_tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, r.UserID, r.MatchPath, r.MatchLanguage, r.MatchMachine, r.SetProject, r.SetCategory, strings.Join(r.SetTags, ","))
+	if err != nil {
+		return err
+	}
+	r.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// Rules returns a user's rules in the order they were added, which is the
+// order they apply in.
+func (s *Store) Rules(userID string) ([]Rule, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, match_path, match_language, match_machine, set_project, set_category, set_tags
+		FROM rules WHERE user_id = ? ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []Rule{}
+	for rows.Next() {
+		var r Rule
+		var tags string
+		if err := rows.Scan(&r.ID, &r.UserID, &r.MatchPath, &r.MatchLanguage, &r.MatchMachine,
+			&r.SetProject, &r.SetCategory, &tags); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			r.SetTags = strings.Split(tags, ",")
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// DeleteRule deletes one of a user's rules, returning sql.ErrNoRows when
+// there is no such rule.
+func (s *Store) DeleteRule(userID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM rules WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetDomainRule stores a domain's category, replacing the user's earlier
+// rule for the domain.
+func (s *Store) SetDomainRule(r DomainRule) error {
+	_, err := s.db.Exec(`
+		INSERT INTO domain_rules (user_id, domain, category) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, domain) DO UPDATE SET category = excluded.category
+	`, r.UserID, r.Domain, r.Category)
+	return err
+}
+
+// DomainRules returns a user's domain rules in order of domain.
+func (s *Store) DomainRules(userID string) ([]DomainRule, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, domain, category FROM domain_rules WHERE user_id = ? ORDER BY domain
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []DomainRule{}
+	for rows.Next() {
+		var r DomainRule
+		if err := rows.Scan(&r.UserID, &r.Domain, &r.Category); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// DeleteDomainRule deletes a user's rule for a domain, returning
+// sql.ErrNoRows when there is none.
+func (s *Store) DeleteDomainRule(userID, domain string) error {
+	res, err := s.db.Exec("DELETE FROM domain_rules WHERE user_id = ? AND domain = ?", userID, domain)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import "database/sql"
+
+// Script is Lua source an admin registered to run over every heartbeat as
+// it comes in, in the order scripts were added.
+type Script struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// AddScript stores a new script, filling in its ID.
+func (s *Store) AddScript(sc *Script) error {
+	return s.db.QueryRow(`
+		INSERT INTO scripts (name, source, created_at) VALUES (?, ?, ?) RETURNING id
+	`, sc.Name, sc.Source, sc.CreatedAt).Scan(&sc.ID)
+}
+
+// Scripts returns the scripts in the order they were added, which is the
+// order they run in.
+func (s *Store) Scripts() ([]Script, error) {
+	rows, err := s.db.Query("SELECT id, name, source, created_at FROM scripts ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scripts := []Script{}
+	for rows.Next() {
+		var sc Script
+		if err := rows.Scan(&sc.ID, &sc.Name, &sc.Source, &sc.CreatedAt); err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, sc)
+	}
+	return scripts, rows.Err()
+}
+
+// DeleteScript deletes a script, returning sql.ErrNoRows when there is no
+// such script.
+func (s *Store) DeleteScript(id int64) error {
+	res, err := s.db.Exec("DELETE FROM scripts WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package store
+
+// SlackLink maps a Slack user, identified by workspace and user ID, to an
+// eztracker user.
+type SlackLink struct {
+	TeamID      string `json:"team_id"`
+	SlackUserID string `json:"slack_user_id"`
+	UserID      string `json:"user_id"`
+}
+
+// LinkSlackUser maps a Slack user to an eztracker user, replacing any
+// earlier link of that Slack user.
+func (s *Store) LinkSlackUser(l SlackLink) error {
+	_, err := s.db.Exec(`
+		INSERT INTO slack_users (team_id, slack_user_id, user_id) VALUES (?, ?, ?)
+		ON CONFLICT (team_id, slack_user_id) DO UPDATE SET user_id = excluded.user_id
+	`, l.TeamID, l.SlackUserID, l.UserID)
+	return err
+}
+
+// SlackUser returns the eztracker user a Slack user is linked to, or
+// sql.ErrNoRows.
+func (s *Store) SlackUser(teamID, slackUserID string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		SELECT user_id FROM slack_users WHERE team_id = ? AND slack_user_id = ?
+	`, teamID, slackUserID).Scan(&userID)
+	return userID, err
+}
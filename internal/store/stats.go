@@ -0,0 +1,426 @@
+package store
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bucket is the time tracked for one project, language, tag, etc. Buckets
+// of projects in stats and reports carry the project's Color and
+// Description, if set.
+type Bucket struct {
+	Name        string  `json:"name"`
+	Duration    float64 `json:"duration"`
+	Color       string  `json:"color,omitempty"`
+	Description string  `json:"description,omitempty"`
+}
+
+// LiveToday is a user's time today and their latest heartbeat, for status
+// bar widgets polling every minute. Active is left to the API, which knows
+// how long without heartbeats still counts.
+type LiveToday struct {
+	UserID        string  `json:"user_id"`
+	Seconds       float64 `json:"seconds"`
+	Project       string  `json:"project,omitempty"`
+	Language      string  `json:"language,omitempty"`
+	LastHeartbeat int64   `json:"last_heartbeat,omitempty"`
+	Active        bool    `json:"active"`
+}
+
+// Stats is the time a user tracked over a range of days, in seconds.
+type Stats struct {
+	From       string      `json:"from"`
+	To         string      `json:"to"`
+	Total      float64     `json:"total"`
+	Projects   []Bucket    `json:"projects"`
+	Workspaces []Bucket    `json:"workspaces"`
+	Languages  []Bucket    `json:"languages"`
+	Categories []Bucket    `json:"categories"`
+	Previous   *Comparison `json:"previous"`
+}
+
+// Report is the time a user tracked over a month or a year, in seconds,
+// with the total of every day of the month or month of the year.
+type Report struct {
+	Period     string        `json:"period"`
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Total      float64       `json:"total"`
+	DaysActive int           `json:"days_active"`
+	DaysOff    int           `json:"days_off"`
+	Periods    []Bucket      `json:"periods"`
+	Projects   []Bucket      `json:"projects"`
+	Workspaces []Bucket      `json:"workspaces"`
+	Languages  []Bucket      `json:"languages"`
+	Notes      []Note        `json:"notes"`
+	Review     *YearInReview `json:"review,omitempty"`
+}
+
+// YearInReview holds the highlights of a yearly report.
+type YearInReview struct {
+	BusiestDay    Bucket `json:"busiest_day"`
+	BusiestMonth  Bucket `json:"busiest_month"`
+	LongestStreak int    `json:"longest_streak"`
+	TopProject    string `json:"top_project"`
+	TopLanguage   string `json:"top_language"`
+}
+
+// reportTop is how many projects and languages a report lists.
+const reportTop = 10
+
+// Comparison is the period of the same length right before a Stats range,
+// with how much the time changed since, in seconds.
+type Comparison struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Total    float64  `json:"total"`
+	Delta    float64  `json:"delta"`
+	Projects []Change `json:"projects"`
+}
+
+// Change is how the time spent in a project changed from one period to the
+// next, in seconds.
+type Change struct {
+	Name     string  `json:"name"`
+	Previous float64 `json:"previous"`
+	Delta    float64 `json:"delta"`
+}
+
+// Changes compares the time per name in two periods, biggest gain first and
+// biggest loss last. Names in either period are included.
+func Changes(current, previous []Bucket) []Change {
+	index := make(map[string]int)
+	changes := []Change{}
+	for _, b := range previous {
+		index[b.Name] = len(changes)
+		changes = append(changes, Change{Name: b.Name, Previous: b.Duration, Delta: -b.Duration})
+	}
+	for _, b := range current {
+		i, ok := index[b.Name]
+		if !ok {
+			i = len(changes)
+			changes = append(changes, Change{Name: b.Name})
+		}
+		changes[i].Delta += b.Duration
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Delta != changes[j].Delta {
+			return changes[i].Delta > changes[j].Delta
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// LiveToday returns a user's time on the day of now, from the daily
+// summaries, and the project and language of their latest heartbeat from an
+// editor.
+// Both are single index lookups.
+func (s *Store) LiveToday(userID string, now time.Time) (LiveToday, error) {
+	today := LiveToday{UserID: userID}
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(seconds), 0) FROM daily_summaries
+		WHERE user_id = ?1 AND day = `+dayOf("?2", "?1"), userID, now.Unix()).Scan(&today.Seconds)
+	if err != nil {
+		return LiveToday{}, err
+	}
+	// Months are searched newest first, so it is found in the first month
+	// the user has heartbeats in
+	months, err := partitionTables(s.db)
+	if err != nil {
+		return LiveToday{}, err
+	}
+	err = sql.ErrNoRows
+	for i := len(months) - 1; i >= 0 && err == sql.ErrNoRows; i-- {
+		err = s.db.QueryRow(`
+			SELECT p.name, COALESCE(h.language, ''), h.timestamp FROM `+months[i]+` h
+			JOIN projects p ON p.id = h.project_id
+			WHERE h.user_id = ? AND h.manual = 0
+			ORDER BY h.timestamp DESC LIMIT 1
+		`, userID).Scan(&today.Project, &today.Language, &today.LastHeartbeat)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return LiveToday{}, err
+	}
+	return today, nil
+}
+
+// Stats sums the time a user tracked on the UTC days from from to to, both
+// included, with days starting at the user's DayStartHour. Manual entries
+// count towards projects but not languages. The time of archived projects
+// is left out unless withArchived.
+func (s *Store) Stats(userID string, from, to time.Time, withArchived bool) (Stats, error) {
+	stats := Stats{From: from.Format("2006-01-02"), To: to.Format("2006-01-02")}
+	for _, breakdown := range []struct {
+		query   string
+		buckets *[]Bucket
+	}{
+		{`SELECT p.name, SUM(d.seconds)
+			FROM daily_summaries d JOIN projects p ON p.id = d.project_id
+			WHERE d.user_id = ? AND d.day >= ? AND d.day <= ?` + unarchived("d.project_id", withArchived) + `
+			GROUP BY p.name ORDER BY SUM(d.seconds) DESC`, &stats.Projects},
+		{`SELECT p.workspace, SUM(d.seconds)
+			FROM daily_summaries d JOIN projects p ON p.id = d.project_id
+			WHERE d.user_id = ? AND d.day >= ? AND d.day <= ? AND p.workspace != ''` + unarchived("d.project_id", withArchived) + `
+			GROUP BY p.workspace ORDER BY SUM(d.seconds) DESC`, &stats.Workspaces},
+		{`SELECT d.language, SUM(d.seconds)
+			FROM daily_summaries d
+			WHERE d.user_id = ? AND d.day >= ? AND d.day <= ? AND d.language != ''` + unarchived("d.project_id", withArchived) + `
+			GROUP BY d.language ORDER BY SUM(d.seconds) DESC`, &stats.Languages},
+	} {
+		buckets, err := s.buckets(breakdown.query, userID, stats.From, stats.To)
+		if err != nil {
+			return Stats{}, err
+		}
+		*breakdown.buckets = buckets
+	}
+	for _, b := range stats.Projects {
+		stats.Total += b.Duration
+	}
+	if err := s.describeProjects(userID, stats.Projects); err != nil {
+		return Stats{}, err
+	}
+
+	// Daily summaries don't keep the category
+	start, end := from.UTC().Truncate(24*time.Hour).Unix(), to.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1).Unix()
+	heartbeats, err := heartbeatsIn(s.db, start, end+86400)
+	if err != nil {
+		return Stats{}, err
+	}
+	categories, err := s.buckets(`
+		SELECT COALESCE(category, 'coding'), SUM(duration)
+		FROM `+heartbeats+`
+		WHERE user_id = ?1 AND `+inDays("timestamp", "?1", "?2", "?3")+
+		unarchived("project_id", withArchived)+`
+		GROUP BY 1 ORDER BY SUM(duration) DESC`,
+		userID, start, end)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.Categories = categories
+
+	// The period before is as many days long, ending the day before from
+	first, _ := time.Parse("2006-01-02", stats.From)
+	last, _ := time.Parse("2006-01-02", stats.To)
+	days := int(last.Sub(first).Hours()/24) + 1
+	previousFrom, previousTo := first.AddDate(0, 0, -days), first.AddDate(0, 0, -1)
+	previous, err := s.buckets(`SELECT p.name, SUM(d.seconds)
+		FROM daily_summaries d JOIN projects p ON p.id = d.project_id
+		WHERE d.user_id = ? AND d.day >= ? AND d.day <= ?`+unarchived("d.project_id", withArchived)+`
+		GROUP BY p.name`, userID, previousFrom.Format("2006-01-02"), previousTo.Format("2006-01-02"))
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.Previous = &Comparison{
+		From:     previousFrom.Format("2006-01-02"),
+		To:       previousTo.Format("2006-01-02"),
+		Projects: Changes(stats.Projects, previous),
+	}
+	for _, b := range previous {
+		stats.Previous.Total += b.Duration
+	}
+	stats.Previous.Delta = stats.Total - stats.Previous.Total
+	return stats, nil
+}
+
+// MonthlyReport reports a user's time in the UTC month starting at month,
+// per day.
+func (s *Store) MonthlyReport(userID string, month time.Time) (Report, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, -1)
+	report, days, _, err := s.report(userID, from.Format("2006-01"), from, to)
+	if err != nil {
+		return Report{}, err
+	}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		report.Periods = append(report.Periods, Bucket{Name: day, Duration: days[day]})
+	}
+	return report, nil
+}
+
+// YearlyReport reports a user's time in a UTC year, per month, with the
+// year's highlights.
+func (s *Store) YearlyReport(userID string, year int) (Report, error) {
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, -1)
+	report, days, off, err := s.report(userID, from.Format("2006"), from, to)
+	if err != nil {
+		return Report{}, err
+	}
+
+	review := &YearInReview{}
+	months := make(map[string]float64)
+	streak := 0
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		months[d.Format("2006-01")] += days[day]
+		if days[day] > review.BusiestDay.Duration {
+			review.BusiestDay = Bucket{Name: day, Duration: days[day]}
+		}
+		switch {
+		case days[day] > 0:
+			streak++
+			review.LongestStreak = max(review.LongestStreak, streak)
+		case !off[day]:
+			streak = 0
+		}
+	}
+	for m := from; m.Year() == year; m = m.AddDate(0, 1, 0) {
+		month := Bucket{Name: m.Format("2006-01"), Duration: months[m.Format("2006-01")]}
+		report.Periods = append(report.Periods, month)
+		if month.Duration > review.BusiestMonth.Duration {
+			review.BusiestMonth = month
+		}
+	}
+	if len(report.Projects) > 0 {
+		review.TopProject = report.Projects[0].Name
+	}
+	if len(report.Languages) > 0 {
+		review.TopLanguage = report.Languages[0].Name
+	}
+	report.Review = review
+	return report, nil
+}
+
+// report fills in the totals of a report over the UTC days from to to and
+// returns the time per day and the days off, keyed by date. Reports look
+// back, so they include archived projects.
+func (s *Store) report(userID, period string, from, to time.Time) (Report, map[string]float64, map[string]bool, error) {
+	stats, err := s.Stats(userID, from, to, true)
+	if err != nil {
+		return Report{}, nil, nil, err
+	}
+	report := Report{
+		Period:     period,
+		From:       stats.From,
+		To:         stats.To,
+		Total:      stats.Total,
+		Periods:    []Bucket{},
+		Projects:   stats.Projects[:min(len(stats.Projects), reportTop)],
+		Workspaces: stats.Workspaces[:min(len(stats.Workspaces), reportTop)],
+		Languages:  stats.Languages[:min(len(stats.Languages), reportTop)],
+	}
+
+	days, err := s.DailyTotals(userID, from, to)
+	if err != nil {
+		return Report{}, nil, nil, err
+	}
+	if report.Notes, err = s.Notes(userID, stats.From, stats.To); err != nil {
+		return Report{}, nil, nil, err
+	}
+	off, err := s.DaysOff(userID, from, to)
+	if err != nil {
+		return Report{}, nil, nil, err
+	}
+	report.DaysOff = len(off)
+
+	for _, seconds := range days {
+		if seconds > 0 {
+			report.DaysActive++
+		}
+	}
+	return report, days, off, nil
+}
+
+// DailyTotals returns the time a user tracked on each of the UTC days from
+// from to to, keyed by date. Days without any are left out.
+func (s *Store) DailyTotals(userID string, from, to time.Time) (map[string]float64, error) {
+	perDay, err := s.buckets(`SELECT d.day, SUM(d.seconds)
+		FROM daily_summaries d
+		WHERE d.user_id = ? AND d.day >= ? AND d.day <= ?
+		GROUP BY d.day`, userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string]float64)
+	for _, b := range perDay {
+		days[b.Name] = b.Duration
+	}
+	return days, nil
+}
+
+// BestDay returns the most time a user tracked in a day before the UTC
+// date before, 0 if none.
+func (s *Store) BestDay(userID string, before time.Time) (float64, error) {
+	var best float64
+	err := s.db.QueryRow(`
+		SELECT COALESCE(MAX(total), 0) FROM (
+			SELECT SUM(seconds) AS total FROM daily_summaries
+			WHERE user_id = ? AND day < ?
+			GROUP BY day)
+	`, userID, before.Format("2006-01-02")).Scan(&best)
+	return best, err
+}
+
+// CategoryTotals sums the time per user and category in [from, to), with
+// the times shifted by each user's DayStartHour to match their days.
+func (s *Store) CategoryTotals(from, to time.Time) (map[string]map[string]float64, error) {
+	heartbeats, err := heartbeatsIn(s.db, from.Unix(), to.Unix()+86400)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`
+		SELECT h.user_id, COALESCE(h.category, 'coding'), SUM(h.duration)
+		FROM `+heartbeats+` h
+		WHERE `+inDays("h.timestamp", "h.user_id", "?1", "?2")+`
+		GROUP BY user_id, 2
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]map[string]float64)
+	for rows.Next() {
+		var userID, category string
+		var seconds float64
+		if err := rows.Scan(&userID, &category, &seconds); err != nil {
+			return nil, err
+		}
+		if totals[userID] == nil {
+			totals[userID] = make(map[string]float64)
+		}
+		totals[userID][category] = seconds
+	}
+	return totals, rows.Err()
+}
+
+// DependencyTotals sums the time per user and dependency in [from, to),
+// shifted like CategoryTotals, counting each heartbeat towards every
+// dependency detected in its project.
+func (s *Store) DependencyTotals(from, to time.Time) (map[string]map[string]float64, error) {
+	heartbeats, err := heartbeatsIn(s.db, from.Unix(), to.Unix()+86400)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`
+		SELECT h.user_id, h.dependencies, SUM(h.duration)
+		FROM `+heartbeats+` h
+		WHERE `+inDays("h.timestamp", "h.user_id", "?1", "?2")+`
+			AND h.dependencies != ''
+		GROUP BY h.user_id, h.dependencies
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]map[string]float64)
+	for rows.Next() {
+		var userID, deps string
+		var seconds float64
+		if err := rows.Scan(&userID, &deps, &seconds); err != nil {
+			return nil, err
+		}
+		if totals[userID] == nil {
+			totals[userID] = make(map[string]float64)
+		}
+		for _, dep := range strings.Split(deps, ",") {
+			totals[userID][dep] += seconds
+		}
+	}
+	return totals, rows.Err()
+}
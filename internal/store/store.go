@@ -0,0 +1,386 @@
+// Package store persists heartbeats, manual entries and API keys in SQLite and
+// answers the summary queries behind the API and the weekly emails.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Store struct {
+	db *sql.DB
+
+	// Statements on the heartbeat hot path, prepared once
+	findProject       *sql.Stmt
+	insertProject     *sql.Stmt
+	updateProjectRoot *sql.Stmt
+	addDailySeconds   *sql.Stmt
+
+	// Months' heartbeats tables written so far, by name
+	partitionsMu sync.Mutex
+	partitions   map[string]*partition
+}
+
+// Open opens the SQLite database at path, waiting on locks rather than
+// failing while another connection writes. Idle connections are kept up to
+// maxOpenConns so prepared statements stay warm.
+func Open(path string, maxOpenConns int) (*sql.DB, error) {
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000&_journal_mode=WAL"
+	}
+	return open(dsn, maxOpenConns)
+}
+
+// OpenReadOnly opens the SQLite database at path like Open, without
+// writing to it, such as a replica or backup that another process keeps up
+// to date.
+func OpenReadOnly(path string, maxOpenConns int) (*sql.DB, error) {
+	return open("file:"+path+"?mode=ro&_busy_timeout=5000", maxOpenConns)
+}
+
+// OpenMemory opens an empty database held in memory, which is gone once
+// it is closed, for tests and demos. It has a single connection, as each
+// connection to memory is a database of its own.
+func OpenMemory() (*sql.DB, error) {
+	return open(":memory:", 1)
+}
+
+func open(dsn string, maxOpenConns int) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if maxOpenConns <= 0 {
+		maxOpenConns = 8
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	db.SetConnMaxIdleTime(0)
+	return db, nil
+}
+
+// New brings the schema in db up to date and prepares the hot path
+// statements.
+func New(db *sql.DB) (*Store, error) {
+	if err := initDB(db); err != nil {
+		return nil, err
+	}
+	return prepare(db)
+}
+
+// NewReadOnly is New for a database opened with OpenReadOnly, whose schema
+// must already be up to date. Only its queries work.
+func NewReadOnly(db *sql.DB) (*Store, error) {
+	return prepare(db)
+}
+
+// prepare prepares the hot path statements on db.
+func prepare(db *sql.DB) (*Store, error) {
+	s := &Store{db: db, partitions: map[string]*partition{}}
+	for _, stmt := range []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&s.findProject, "SELECT id, aggregate_only FROM projects WHERE user_id = ? AND name = ?"},
+		{&s.insertProject, "INSERT INTO projects (user_id, name, root) VALUES (?, ?, ?)"},
+		{&s.updateProjectRoot, "UPDATE projects SET root = ? WHERE id = ? AND root != ?"},
+		{&s.addDailySeconds, `
+			INSERT INTO daily_summaries (user_id, day, project_id, language, manual, seconds)
+			VALUES (?1, ` + dayOf("?2", "?1") + `, ?3, ?4, ?5, ?6)
+			ON CONFLICT (user_id, day, project_id, language, manual)
+			DO UPDATE SET seconds = seconds + excluded.seconds`},
+	} {
+		prepared, err := db.Prepare(stmt.query)
+		if err != nil {
+			return nil, fmt.Errorf("statement preparation error: %v", err)
+		}
+		*stmt.dst = prepared
+	}
+	return s, nil
+}
+
+// initDB creates the schema and brings databases from older versions up to
+// date.
+func initDB(db *sql.DB) error {
+	// Create tables
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, email TEXT);
+		CREATE TABLE IF NOT EXISTS projects (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, path TEXT);
+		CREATE TABLE IF NOT EXISTS tags (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT,
+			UNIQUE (user_id, name));
+		CREATE TABLE IF NOT EXISTS heartbeat_tags (
+			heartbeat_id INTEGER, tag_id INTEGER, PRIMARY KEY (heartbeat_id, tag_id));
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT,
+			key_hash TEXT UNIQUE, created_at INTEGER, last_used_at INTEGER);
+		CREATE INDEX IF NOT EXISTS projects_user_name ON projects (user_id, name);
+		CREATE TABLE IF NOT EXISTS plugins (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, name TEXT, version TEXT,
+			machine TEXT, first_seen INTEGER, last_seen INTEGER,
+			UNIQUE (user_id, name, machine));
+		CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id TEXT PRIMARY KEY, enabled INTEGER NOT NULL DEFAULT 1,
+			weekday INTEGER NOT NULL DEFAULT 0, hour INTEGER NOT NULL DEFAULT 0,
+			timezone TEXT NOT NULL DEFAULT 'UTC', channels TEXT NOT NULL DEFAULT 'email');
+		CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, recipient TEXT, subject TEXT, body TEXT,
+			status TEXT NOT NULL DEFAULT 'pending', attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at INTEGER, last_error TEXT, created_at INTEGER, sent_at INTEGER);
+		CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (status, next_attempt_at);
+		CREATE TABLE IF NOT EXISTS slack_users (
+			team_id TEXT, slack_user_id TEXT, user_id TEXT,
+			PRIMARY KEY (team_id, slack_user_id));
+		CREATE TABLE IF NOT EXISTS notes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, from_day TEXT, to_day TEXT, text TEXT);
+		CREATE INDEX IF NOT EXISTS notes_user ON notes (user_id, from_day);
+		CREATE TABLE IF NOT EXISTS time_off (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, from_day TEXT, to_day TEXT, reason TEXT);
+		CREATE INDEX IF NOT EXISTS time_off_user ON time_off (user_id, from_day);
+		CREATE TABLE IF NOT EXISTS domain_rules (
+			user_id TEXT, domain TEXT, category TEXT, PRIMARY KEY (user_id, domain));
+		CREATE TABLE IF NOT EXISTS rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, match_path TEXT, match_language TEXT,
+			match_machine TEXT, set_project TEXT, set_category TEXT, set_tags TEXT);
+		CREATE INDEX IF NOT EXISTS rules_user ON rules (user_id);
+		CREATE TABLE IF NOT EXISTS heartbeat_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, from_day TEXT, to_day TEXT,
+			filter_project TEXT, path_prefix TEXT, project TEXT, language TEXT,
+			heartbeats INTEGER, edited_by TEXT, created_at INTEGER);
+		CREATE TABLE IF NOT EXISTS key_usage (
+			key_id INTEGER, ip TEXT, country TEXT NOT NULL DEFAULT '',
+			first_seen INTEGER, last_seen INTEGER, requests INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, ip));
+		CREATE TABLE IF NOT EXISTS key_requests (
+			key_id INTEGER, day TEXT, requests INTEGER NOT NULL DEFAULT 0,
+			client_errors INTEGER NOT NULL DEFAULT 0, server_errors INTEGER NOT NULL DEFAULT 0,
+			last_seen INTEGER, last_status INTEGER, last_error TEXT NOT NULL DEFAULT '',
+			last_error_at INTEGER NOT NULL DEFAULT 0, user_agent TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (key_id, day));
+		CREATE TABLE IF NOT EXISTS token_sessions (
+			id TEXT PRIMARY KEY, user_id TEXT, refresh_id TEXT,
+			created_at INTEGER, expires_at INTEGER, revoked INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY, kind TEXT, user_id TEXT, status TEXT,
+			size INTEGER NOT NULL DEFAULT 0, processed INTEGER NOT NULL DEFAULT 0,
+			stored INTEGER NOT NULL DEFAULT 0, rejected INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '', created_at INTEGER, finished_at INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE IF NOT EXISTS task_runs (
+			name TEXT PRIMARY KEY, last_run INTEGER, duration_ms INTEGER,
+			last_error TEXT NOT NULL DEFAULT '', runs INTEGER NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id TEXT, url TEXT, secret TEXT,
+			events TEXT, created_at INTEGER);
+		CREATE INDEX IF NOT EXISTS webhooks_user ON webhooks (user_id);
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			webhook_id INTEGER, event TEXT, day TEXT, delivered_at INTEGER,
+			PRIMARY KEY (webhook_id, event, day));
+		CREATE TABLE IF NOT EXISTS milestones (
+			user_id TEXT, event TEXT, day TEXT, created_at INTEGER,
+			PRIMARY KEY (user_id, event, day));
+		CREATE TABLE IF NOT EXISTS scripts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, source TEXT, created_at INTEGER);
+		CREATE TABLE IF NOT EXISTS daily_summaries (
+			user_id TEXT, day TEXT, project_id INTEGER, language TEXT,
+			manual INTEGER NOT NULL DEFAULT 0, seconds REAL NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, day, project_id, language, manual));
+	`)
+	if err != nil {
+		return fmt.Errorf("table creation error: %v", err)
+	}
+	for _, column := range []struct{ table, name, definition string }{
+		{"heartbeats", "dependencies", "TEXT"},
+		{"heartbeats", "session_id", "TEXT"},
+		{"heartbeats", "manual", "INTEGER NOT NULL DEFAULT 0"},
+		{"heartbeats", "note", "TEXT"},
+		{"heartbeats", "entity_type", "TEXT NOT NULL DEFAULT 'file'"},
+		{"heartbeats", "category", "TEXT NOT NULL DEFAULT 'coding'"},
+		{"heartbeats", "branch", "TEXT"},
+		{"heartbeats", "machine", "TEXT"},
+		{"projects", "keystroke_timeout", "INTEGER NOT NULL DEFAULT 0"},
+		{"projects", "root", "TEXT NOT NULL DEFAULT ''"},
+		{"projects", "color", "TEXT NOT NULL DEFAULT ''"},
+		{"projects", "billable", "INTEGER NOT NULL DEFAULT 0"},
+		{"projects", "hourly_rate", "REAL NOT NULL DEFAULT 0"},
+		{"projects", "description", "TEXT NOT NULL DEFAULT ''"},
+		{"projects", "archived", "INTEGER NOT NULL DEFAULT 0"},
+		{"projects", "workspace", "TEXT NOT NULL DEFAULT ''"},
+		{"projects", "aggregate_only", "INTEGER NOT NULL DEFAULT 0"},
+		{"notification_preferences", "alerts", "INTEGER NOT NULL DEFAULT 0"},
+		{"notification_preferences", "alert_hours", "INTEGER NOT NULL DEFAULT 14"},
+		{"api_keys", "scope", "TEXT NOT NULL DEFAULT 'all'"},
+		{"token_sessions", "scope", "TEXT NOT NULL DEFAULT 'all'"},
+		{"notification_preferences", "week_start", "INTEGER NOT NULL DEFAULT 0"},
+		{"notification_preferences", "day_start_hour", "INTEGER NOT NULL DEFAULT 0"},
+		{"notification_preferences", "locale", "TEXT NOT NULL DEFAULT 'en'"},
+		{"notification_preferences", "duration_format", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "email_verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"outbox", "headers", "TEXT NOT NULL DEFAULT ''"},
+		{"notification_preferences", "daily_goal_minutes", "INTEGER NOT NULL DEFAULT 0"},
+		{"webhook_deliveries", "body", "TEXT NOT NULL DEFAULT ''"},
+		{"webhook_deliveries", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumn(db, column.table, column.name, column.definition); err != nil {
+			return fmt.Errorf("table migration error: %v", err)
+		}
+	}
+	if err := partitionHeartbeats(db); err != nil {
+		return fmt.Errorf("heartbeats partitioning error: %v", err)
+	}
+
+	if err := backfillDailySummaries(db); err != nil {
+		return fmt.Errorf("daily summaries backfill error: %v", err)
+	}
+	return nil
+}
+
+// backfillDailySummaries builds daily_summaries from raw heartbeats when the
+// table is new, e.g. right after upgrading. Afterwards it is kept up to date
+// as heartbeats are stored.
+func backfillDailySummaries(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM daily_summaries)").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf(aggregateDailySummaries, "heartbeats", ""))
+	return err
+}
+
+// dayStart is the SQL for how many seconds after UTC midnight a user's days
+// start.
+func dayStart(userID string) string {
+	return "COALESCE((SELECT day_start_hour * 3600 FROM notification_preferences WHERE user_id = " + userID + "), 0)"
+}
+
+// dayOf is the SQL for the day a timestamp falls in for a user.
+func dayOf(timestamp, userID string) string {
+	return "date(" + timestamp + " - " + dayStart(userID) + ", 'unixepoch')"
+}
+
+// inDays is the SQL for a timestamp falling in [from, to) of a user's days,
+// shifted like dayOf. Indexes can't bound a shifted timestamp, so the
+// timestamp itself is bounded too, up to a day later, letting range scans
+// skip the rest of years of history.
+func inDays(timestamp, userID, from, to string) string {
+	shifted := timestamp + " - " + dayStart(userID)
+	return timestamp + " >= " + from + " AND " + timestamp + " < " + to + " + 86400 AND " +
+		shifted + " >= " + from + " AND " + shifted + " < " + to
+}
+
+// aggregateDailySummaries fills daily_summaries from the heartbeats read
+// from the first verb, the heartbeats view or heartbeatsIn, matching the
+// WHERE clause of the second.
+var aggregateDailySummaries = `
+	INSERT INTO daily_summaries (user_id, day, project_id, language, manual, seconds)
+	SELECT h.user_id, ` + dayOf("h.timestamp", "h.user_id") + `, h.project_id,
+		COALESCE(h.language, ''), h.manual, SUM(h.duration)
+	FROM %s h %s
+	GROUP BY 1, 2, 3, 4, 5`
+
+// addColumn adds a column introduced after the initial schema, ignoring
+// databases that already have it. Heartbeats get it in every month's table,
+// unless the database is from before they had one.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	tables := []string{table}
+	if table == "heartbeats" {
+		var kind string
+		err := db.QueryRow("SELECT type FROM sqlite_master WHERE name = 'heartbeats'").Scan(&kind)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if kind != "table" {
+			if tables, err = partitionTables(db); err != nil {
+				return err
+			}
+		}
+	}
+	for _, table := range tables {
+		_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
+// buckets runs a query selecting a name and a duration.
+func (s *Store) buckets(query string, args ...interface{}) ([]Bucket, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []Bucket{}
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Name, &b.Duration); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// Retention of what Prune removes: finished jobs, mail that was sent or
+// given up on, and the milestones, webhook deliveries and key request
+// counts of past days.
+const retention = 30 * 24 * time.Hour
+
+// Prune deletes expired dashboard sessions, and finished jobs, mail,
+// milestones, webhook deliveries and key request counts older than the
+// retention period.
+func (s *Store) Prune(now time.Time) error {
+	cutoff := now.Add(-retention).Unix()
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM token_sessions WHERE expires_at < ?", []interface{}{now.Unix()}},
+		{"DELETE FROM jobs WHERE status != ? AND finished_at < ?", []interface{}{JobRunning, cutoff}},
+		{"DELETE FROM outbox WHERE status != 'pending' AND created_at < ?", []interface{}{cutoff}},
+		{"DELETE FROM milestones WHERE created_at < ?", []interface{}{cutoff}},
+		{"DELETE FROM webhook_deliveries WHERE day < ?", []interface{}{now.Add(-retention).UTC().Format("2006-01-02")}},
+		{"DELETE FROM key_requests WHERE day < ?", []interface{}{now.Add(-retention).UTC().Format("2006-01-02")}},
+	} {
+		if _, err := s.db.Exec(stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("prune error: %v", err)
+		}
+	}
+	return nil
+}
+
+// Plugin is an editor plugin install that announced itself, one per user,
+// plugin name and machine.
+type Plugin struct {
+	ID        int64  `json:"id"`
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Machine   string `json:"machine"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+// RegisterPlugin records that a plugin install was seen, keeping the first
+// sighting and updating the version. It fills in ID and FirstSeen.
+func (s *Store) RegisterPlugin(p *Plugin) error {
+	return s.db.QueryRow(`
+		INSERT INTO plugins (user_id, name, version, machine, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name, machine)
+		DO UPDATE SET version = excluded.version, last_seen = excluded.last_seen
+		RETURNING id, first_seen
+	`, p.UserID, p.Name, p.Version, p.Machine, p.LastSeen, p.LastSeen).Scan(&p.ID, &p.FirstSeen)
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a store on a database file of its own, closed when
+// the test ends. setup runs on the database first with args, to start
+// from an older schema.
+func newTestStore(tb testing.TB, setup string, args ...interface{}) (*sql.DB, *Store) {
+	tb.Helper()
+	db, err := Open(filepath.Join(tb.TempDir(), "eztracker.sqlite"), 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if setup != "" {
+		if _, err := db.Exec(setup, args...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	s, err := New(db)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db, s
+}
+
+func BenchmarkStoreHeartbeats(b *testing.B) {
+	for _, batch := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "bench.sqlite"), 8)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			s, err := New(db)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			heartbeats := make([]Heartbeat, batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i += batch {
+				for j := range heartbeats {
+					heartbeats[j] = Heartbeat{
+						UserID:    fmt.Sprintf("user%d", (i+j)%4),
+						Project:   fmt.Sprintf("project%d", (i+j)%10),
+						Language:  "Go",
+						Entity:    fmt.Sprintf("/src/project%d/file%d.go", (i+j)%10, (i+j)%50),
+						Duration:  30,
+						Timestamp: time.Now().Unix() - int64(i+j),
+						Tags:      []string{"bench"},
+					}
+				}
+				if err := s.StoreHeartbeats(heartbeats); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestRangeScans checks that queries over a range of days search the
+// heartbeats index for the range rather than scanning all of a user's
+// history.
+func TestRangeScans(t *testing.T) {
+	db, _ := newTestStore(t, "")
+
+	for _, where := range []string{
+		"h.user_id = ?1 AND " + inDays("h.timestamp", "h.user_id", "?2", "?3"),
+		inDays("h.timestamp", "h.user_id", "?1", "?2"),
+	} {
+		rows, err := db.Query("EXPLAIN QUERY PLAN SELECT SUM(h.duration) FROM heartbeats h WHERE "+where, "alice", 0, 86400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "\n"), "timestamp>? AND timestamp<?") {
+			t.Errorf("%s: plan %q doesn't search a timestamp range", where, plan)
+		}
+	}
+}
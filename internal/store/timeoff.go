@@ -0,0 +1,86 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TimeOff is a range of days a user is out of office, such as a vacation.
+// Days off neither break nor extend streaks. From and To are UTC dates,
+// both included.
+type TimeOff struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// AddTimeOff stores a range of days off, filling in its ID.
+func (s *Store) AddTimeOff(t *TimeOff) error {
+	return s.db.QueryRow(`
+		INSERT INTO time_off (user_id, from_day, to_day, reason) VALUES (?, ?, ?, ?)
+		RETURNING id
+	`, t.UserID, t.From, t.To, t.Reason).Scan(&t.ID)
+}
+
+// TimeOff returns a user's days off overlapping the UTC dates from to to, in
+// order of their first day.
+func (s *Store) TimeOff(userID, from, to string) ([]TimeOff, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, from_day, to_day, reason FROM time_off
+		WHERE user_id = ? AND from_day <= ? AND to_day >= ?
+		ORDER BY from_day, id
+	`, userID, to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranges := []TimeOff{}
+	for rows.Next() {
+		var t TimeOff
+		if err := rows.Scan(&t.ID, &t.UserID, &t.From, &t.To, &t.Reason); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, t)
+	}
+	return ranges, rows.Err()
+}
+
+// DaysOff returns the UTC dates from from to to a user is out of office.
+func (s *Store) DaysOff(userID string, from, to time.Time) (map[string]bool, error) {
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	ranges, err := s.TimeOff(userID, first, last)
+	if err != nil {
+		return nil, err
+	}
+	off := make(map[string]bool)
+	for _, r := range ranges {
+		start, err := time.Parse("2006-01-02", max(r.From, first))
+		if err != nil {
+			return nil, err
+		}
+		for d := start; d.Format("2006-01-02") <= min(r.To, last); d = d.AddDate(0, 0, 1) {
+			off[d.Format("2006-01-02")] = true
+		}
+	}
+	return off, nil
+}
+
+// DeleteTimeOff deletes one of a user's ranges of days off, returning
+// sql.ErrNoRows when there is no such range.
+func (s *Store) DeleteTimeOff(userID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM time_off WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
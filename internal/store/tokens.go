@@ -0,0 +1,57 @@
+package store
+
+// TokenSession is a browser session authenticated with short-lived tokens.
+// RefreshID is the ID of the one refresh token that may still be used, so
+// a replayed old one is detected. Scope is that of the key that started
+// it. Times are unix seconds.
+type TokenSession struct {
+	ID        string
+	UserID    string
+	Scope     string
+	RefreshID string
+	CreatedAt int64
+	ExpiresAt int64
+	Revoked   bool
+}
+
+// CreateTokenSession stores a new token session.
+func (s *Store) CreateTokenSession(t TokenSession) error {
+	_, err := s.db.Exec(`
+		INSERT INTO token_sessions (id, user_id, scope, refresh_id, created_at, expires_at, revoked)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, t.ID, t.UserID, t.Scope, t.RefreshID, t.CreatedAt, t.ExpiresAt, t.Revoked)
+	return err
+}
+
+// TokenSession finds a token session by ID. It returns sql.ErrNoRows for
+// unknown sessions.
+func (s *Store) TokenSession(id string) (TokenSession, error) {
+	var t TokenSession
+	err := s.db.QueryRow(`
+		SELECT id, user_id, scope, refresh_id, created_at, expires_at, revoked
+		FROM token_sessions WHERE id = ?
+	`, id).Scan(&t.ID, &t.UserID, &t.Scope, &t.RefreshID, &t.CreatedAt, &t.ExpiresAt, &t.Revoked)
+	return t, err
+}
+
+// RotateRefresh replaces the refresh token of a live session, extending it
+// to expiresAt. It reports false, changing nothing, when the session is
+// revoked or oldID is not its current refresh token.
+func (s *Store) RotateRefresh(id, oldID, newID string, expiresAt int64) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE token_sessions SET refresh_id = ?, expires_at = ?
+		WHERE id = ? AND refresh_id = ? AND revoked = 0
+	`, newID, expiresAt, id, oldID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RevokeTokenSession ends a token session, so none of its tokens are
+// accepted any more.
+func (s *Store) RevokeTokenSession(id string) error {
+	_, err := s.db.Exec("UPDATE token_sessions SET revoked = 1 WHERE id = ?", id)
+	return err
+}
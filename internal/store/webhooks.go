@@ -0,0 +1,146 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Webhook is a URL a user's events, such as "goal.completed", are POSTed
+// to, signed with Secret. The secret is only shown when it is created.
+type Webhook struct {
+	ID        int64    `json:"id"`
+	UserID    string   `json:"user_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// AddWebhook stores a webhook, filling in its ID.
+func (s *Store) AddWebhook(w *Webhook) error {
+	return s.db.QueryRow(`
+		INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)
+		RETURNING id
+	`, w.UserID, w.URL, w.Secret, strings.Join(w.Events, ","), w.CreatedAt).Scan(&w.ID)
+}
+
+// Webhooks returns a user's webhooks with their secrets, or every user's
+// for "", in the order they were added.
+func (s *Store) Webhooks(userID string) ([]Webhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, url, secret, events, created_at FROM webhooks
+		WHERE ?1 = '' OR user_id = ?1
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, &events, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		w.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deletes one of a user's webhooks, returning sql.ErrNoRows
+// when there is no such webhook.
+func (s *Store) DeleteWebhook(userID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM webhooks WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = s.db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id)
+	return err
+}
+
+// WebhookDelivery is an event of a day queued for a webhook, with the URL
+// and secret to send its Body with.
+type WebhookDelivery struct {
+	WebhookID int64
+	URL       string
+	Secret    string
+	Event     string
+	Day       string
+	Body      string
+	Attempts  int
+}
+
+// EnqueueWebhookDelivery queues an event for a webhook, reporting false if
+// it was queued for that day before, so each is sent only once.
+func (s *Store) EnqueueWebhookDelivery(d WebhookDelivery) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT OR IGNORE INTO webhook_deliveries (webhook_id, event, day, body, delivered_at) VALUES (?, ?, ?, ?, 0)
+	`, d.WebhookID, d.Event, d.Day, d.Body)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PendingWebhookDeliveries returns the deliveries not made yet that were
+// tried fewer than maxAttempts times, oldest first.
+func (s *Store) PendingWebhookDeliveries(maxAttempts int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(`
+		SELECT d.webhook_id, w.url, w.secret, d.event, d.day, d.body, d.attempts
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.delivered_at = 0 AND d.attempts < ?
+		ORDER BY d.rowid
+	`, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.WebhookID, &d.URL, &d.Secret, &d.Event, &d.Day, &d.Body, &d.Attempts); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkWebhookDelivered records that a queued delivery was made, or, with
+// delivered false, that an attempt failed.
+func (s *Store) MarkWebhookDelivered(d WebhookDelivery, delivered bool, at time.Time) error {
+	query := "UPDATE webhook_deliveries SET attempts = attempts + 1 WHERE webhook_id = ? AND event = ? AND day = ?"
+	args := []interface{}{d.WebhookID, d.Event, d.Day}
+	if delivered {
+		query = "UPDATE webhook_deliveries SET attempts = attempts + 1, delivered_at = ? WHERE webhook_id = ? AND event = ? AND day = ?"
+		args = append([]interface{}{at.Unix()}, args...)
+	}
+	_, err := s.db.Exec(query, args...)
+	return err
+}
+
+// RecordMilestone records that a user reached a milestone, such as their
+// daily goal, on a day, reporting false if it was recorded before.
+func (s *Store) RecordMilestone(userID, event, day string, at time.Time) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT OR IGNORE INTO milestones (user_id, event, day, created_at) VALUES (?, ?, ?, ?)
+	`, userID, event, day, at.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
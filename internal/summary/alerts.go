@@ -0,0 +1,81 @@
+package summary
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/i18n"
+)
+
+// alertWeeks is how many weeks a weekday must have had tracked time for a
+// day without any to be unexpected.
+const alertWeeks = 4
+
+// Anomalies returns what is unusual about a day given the time tracked per
+// day, keyed by date, over the alertWeeks weeks before it: more than
+// alertHours tracked, which suggests a runaway plugin, or nothing tracked on
+// a weekday that always had time, unless the day is off. They are written
+// in l.
+func Anomalies(l *i18n.Locale, day time.Time, days map[string]float64, dayOff bool, alertHours int) []string {
+	date := day.Format("2006-01-02")
+	seconds := days[date]
+	if seconds > float64(alertHours)*3600 {
+		return []string{l.T("alert.runaway", date, l.Hours(seconds), alertHours)}
+	}
+	if seconds > 0 || dayOff {
+		return nil
+	}
+	for week := 1; week <= alertWeeks; week++ {
+		if days[day.AddDate(0, 0, -7*week).Format("2006-01-02")] <= 0 {
+			return nil
+		}
+	}
+	return []string{l.T("alert.missing", date, alertWeeks, l.Weekdays[day.Weekday()])}
+}
+
+// SendAlerts checks the day that just ended for every subscriber with alerts
+// on whose local day starts in the hour starting at now, at their
+// DayStartHour, and sends them what was unusual about it.
+func (r *Reporter) SendAlerts(now time.Time) error {
+	subscribers, err := r.store.Subscribers()
+	if err != nil {
+		return fmt.Errorf("subscribers query error: %v", err)
+	}
+	for _, sub := range subscribers {
+		if !sub.Prefs.Alerts || !hasChannel(sub.Prefs, "email") {
+			continue
+		}
+		loc, err := time.LoadLocation(sub.Prefs.Timezone)
+		if err != nil {
+			continue
+		}
+		local := now.In(loc)
+		if local.Hour() != sub.Prefs.DayStartHour {
+			continue
+		}
+		y, m, d := local.Date()
+		day := time.Date(y, m, d-1, 0, 0, 0, 0, time.UTC)
+
+		days, err := r.store.DailyTotals(sub.Prefs.UserID, day.AddDate(0, 0, -7*alertWeeks), day)
+		if err != nil {
+			return fmt.Errorf("daily totals query error: %v", err)
+		}
+		off, err := r.store.DaysOff(sub.Prefs.UserID, day, day)
+		if err != nil {
+			return fmt.Errorf("time off query error: %v", err)
+		}
+		l := i18n.For(sub.Prefs.Locale, sub.Prefs.DurationFormat)
+		anomalies := Anomalies(l, day, days, off[day.Format("2006-01-02")], sub.Prefs.AlertHours)
+		if len(anomalies) == 0 {
+			continue
+		}
+		body := fmt.Sprintf("%s\n%s\n", l.T("alert.intro"), strings.Join(anomalies, "\n"))
+		footer, headers := r.unsubscribe(l, sub.Prefs.UserID, "alerts")
+		if err := r.sender.Send(sub.Email, l.T("alert.subject"), body+footer, headers...); err != nil {
+			log.Println("Email error: ", err)
+		}
+	}
+	return nil
+}
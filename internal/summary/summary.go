@@ -0,0 +1,279 @@
+// Package summary builds the weekly activity summaries and emails them to
+// users.
+package summary
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/i18n"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Sender delivers a summary email with extra headers; *mailer.Outbox and
+// *mailer.Mailer satisfy it.
+type Sender interface {
+	Send(to, subject, body string, headers ...string) error
+}
+
+type Reporter struct {
+	store  *store.Store
+	sender Sender
+
+	// Unsubscribe returns a signed link turning a user's "summaries" or
+	// "alerts" off with one click, or "" if there is none. Emails carry it
+	// in their footer and List-Unsubscribe header when set.
+	Unsubscribe func(userID, list string) string
+
+	// Events, if set, gets a summary.generated event for each summary sent.
+	Events *events.Bus
+}
+
+func New(st *store.Store, sender Sender) *Reporter {
+	return &Reporter{store: st, sender: sender}
+}
+
+// Weekly returns the summary lines per user for the days in [from, to),
+// compared with as many days before. Days start at each user's DayStartHour,
+// and the lines are in their locale.
+func (r *Reporter) Weekly(from, to time.Time) (map[string][]string, error) {
+	totals, err := r.store.ProjectTotals(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("summary query error: %v", err)
+	}
+	locales, err := r.store.Locales()
+	if err != nil {
+		return nil, fmt.Errorf("locale query error: %v", err)
+	}
+	locale := func(userID string) *i18n.Locale {
+		return i18n.For(locales[userID].Tag, locales[userID].DurationFormat)
+	}
+
+	summaries := make(map[string][]string)
+	for _, t := range totals {
+		l := locale(t.UserID)
+		if t.Manual {
+			summaries[t.UserID] = append(summaries[t.UserID],
+				l.T("summary.manual", t.Project, l.Duration(t.Seconds)))
+			continue
+		}
+		summaries[t.UserID] = append(summaries[t.UserID],
+			l.T("summary.project", t.Project, t.Language, l.Duration(t.Seconds)))
+	}
+
+	previous, err := r.store.ProjectTotals(from.Add(-to.Sub(from)), from)
+	if err != nil {
+		return nil, fmt.Errorf("summary query error: %v", err)
+	}
+	for userID, lines := range comparisons(totals, previous, locale) {
+		if len(summaries[userID]) > 0 {
+			summaries[userID] = append(summaries[userID], lines...)
+		}
+	}
+
+	// Categories are only worth listing once there is more than coding
+	categories, err := r.store.CategoryTotals(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("category query error: %v", err)
+	}
+	for userID, durations := range categories {
+		if len(durations) < 2 {
+			continue
+		}
+		names := make([]string, 0, len(durations))
+		for name := range durations {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return durations[names[i]] > durations[names[j]]
+		})
+		l := locale(userID)
+		for _, name := range names {
+			summaries[userID] = append(summaries[userID],
+				l.T("summary.category", name, l.Duration(durations[name])))
+		}
+	}
+
+	depDurations, err := r.store.DependencyTotals(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("dependency query error: %v", err)
+	}
+	for userID, durations := range depDurations {
+		deps := make([]string, 0, len(durations))
+		for dep := range durations {
+			deps = append(deps, dep)
+		}
+		sort.Slice(deps, func(i, j int) bool {
+			return durations[deps[i]] > durations[deps[j]]
+		})
+		l := locale(userID)
+		for _, dep := range deps {
+			summaries[userID] = append(summaries[userID],
+				l.T("summary.dependency", dep, l.Duration(durations[dep])))
+		}
+	}
+	return summaries, nil
+}
+
+// comparisons returns per user the lines comparing the time per project
+// with the period before: the total and the projects that gained and lost
+// the most.
+func comparisons(current, previous []store.ProjectTotal, locale func(userID string) *i18n.Locale) map[string][]string {
+	buckets := func(totals []store.ProjectTotal) map[string][]store.Bucket {
+		byUser := make(map[string]map[string]float64)
+		for _, t := range totals {
+			if byUser[t.UserID] == nil {
+				byUser[t.UserID] = make(map[string]float64)
+			}
+			byUser[t.UserID][t.Project] += t.Seconds
+		}
+		result := make(map[string][]store.Bucket)
+		for userID, projects := range byUser {
+			for name, seconds := range projects {
+				result[userID] = append(result[userID], store.Bucket{Name: name, Duration: seconds})
+			}
+		}
+		return result
+	}
+	now, before := buckets(current), buckets(previous)
+
+	lines := make(map[string][]string)
+	for userID, projects := range now {
+		changes := store.Changes(projects, before[userID])
+		var total, delta float64
+		for _, c := range changes {
+			total += c.Previous + c.Delta
+			delta += c.Delta
+		}
+		l := locale(userID)
+		lines[userID] = append(lines[userID],
+			l.T("summary.total", l.Duration(total), l.SignedDuration(delta)))
+		if c := changes[0]; c.Delta > 0 {
+			lines[userID] = append(lines[userID], l.T("summary.gaining", c.Name, l.SignedDuration(c.Delta)))
+		}
+		if c := changes[len(changes)-1]; c.Delta < 0 {
+			lines[userID] = append(lines[userID], l.T("summary.losing", c.Name, l.SignedDuration(c.Delta)))
+		}
+	}
+	return lines
+}
+
+// Due reports whether a weekly summary should go out for p in the hour
+// starting at now. It is false for unknown timezones.
+func Due(p store.NotificationPrefs, now time.Time) bool {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	return p.Enabled && int(local.Weekday()) == p.Weekday && local.Hour() == p.Hour
+}
+
+// SendDue emails their summary to every subscriber whose preferred weekday
+// and hour is the hour starting at now. A summary covers the last full week
+// before the current day in the subscriber's timezone, with weeks starting
+// on their WeekStart.
+func (r *Reporter) SendDue(now time.Time) error {
+	subscribers, err := r.store.Subscribers()
+	if err != nil {
+		return fmt.Errorf("subscribers query error: %v", err)
+	}
+
+	// Subscribers in different timezones may be on different days
+	weeks := make(map[time.Time]map[string][]string)
+	for _, sub := range subscribers {
+		if !Due(sub.Prefs, now) || !hasChannel(sub.Prefs, "email") {
+			continue
+		}
+		loc, _ := time.LoadLocation(sub.Prefs.Timezone)
+		y, m, d := now.In(loc).Add(-time.Duration(sub.Prefs.DayStartHour) * time.Hour).Date()
+		to := sub.Prefs.WeekOf(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+		summaries, ok := weeks[to]
+		if !ok {
+			summaries, err = r.Weekly(to.AddDate(0, 0, -7), to)
+			if err != nil {
+				return err
+			}
+			weeks[to] = summaries
+		}
+
+		lines := summaries[sub.Prefs.UserID]
+		if len(lines) == 0 {
+			continue
+		}
+		l := i18n.For(sub.Prefs.Locale, sub.Prefs.DurationFormat)
+		best, err := r.mostProductive(l, sub.Prefs, to)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, best...)
+		body := fmt.Sprintf("%s\n%s\n", l.T("summary.intro"), strings.Join(lines, "\n"))
+		footer, headers := r.unsubscribe(l, sub.Prefs.UserID, "summaries")
+		if err := r.sender.Send(sub.Email, l.T("summary.subject"), body+footer, headers...); err != nil {
+			log.Println("Email error: ", err)
+			continue
+		}
+		r.Events.Publish(events.Event{Name: events.SummaryGenerated, UserID: sub.Prefs.UserID, Time: now, Data: body})
+	}
+	return nil
+}
+
+// unsubscribe returns the footer and headers letting a user turn list off
+// from an email, none without an Unsubscribe link. The List-Unsubscribe-Post
+// header tells mail clients the link works with one click (RFC 8058).
+func (r *Reporter) unsubscribe(l *i18n.Locale, userID, list string) (string, []string) {
+	if r.Unsubscribe == nil {
+		return "", nil
+	}
+	link := r.Unsubscribe(userID, list)
+	if link == "" {
+		return "", nil
+	}
+	return "\n" + l.T("email.unsubscribe", link) + "\n", []string{
+		"List-Unsubscribe: <" + link + ">",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+	}
+}
+
+// mostProductive returns the lines naming the weekday and the hour of the
+// week before to with the most time, from the same buckets as heatmaps. The
+// hour is written as when it starts in the subscriber's timezone.
+func (r *Reporter) mostProductive(l *i18n.Locale, p store.NotificationPrefs, to time.Time) ([]string, error) {
+	last := to.AddDate(0, 0, -1)
+	var lines []string
+	days, err := r.store.Aggregate(store.AggregateQuery{UserID: p.UserID, GroupBy: []string{"weekday"}, From: to.AddDate(0, 0, -7), To: last})
+	if err != nil {
+		return nil, fmt.Errorf("weekday query error: %v", err)
+	}
+	if len(days) > 0 {
+		weekday, _ := days[0].Keys["weekday"].(int64)
+		lines = append(lines, l.T("summary.best_day", l.Days[weekday%7], l.Duration(days[0].Duration)))
+	}
+	hours, err := r.store.Aggregate(store.AggregateQuery{UserID: p.UserID, GroupBy: []string{"hour"}, From: to.AddDate(0, 0, -7), To: last})
+	if err != nil {
+		return nil, fmt.Errorf("hour query error: %v", err)
+	}
+	if len(hours) > 0 {
+		hour, _ := hours[0].Keys["hour"].(int64)
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		start := time.Date(last.Year(), last.Month(), last.Day(), int(hour), 0, 0, 0, time.UTC).In(loc)
+		lines = append(lines, l.T("summary.best_hour", start.Format("15:04"), l.Duration(hours[0].Duration)))
+	}
+	return lines, nil
+}
+
+func hasChannel(p store.NotificationPrefs, channel string) bool {
+	for _, c := range p.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
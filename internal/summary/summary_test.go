@@ -0,0 +1,368 @@
+package summary
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/i18n"
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestDue(t *testing.T) {
+	// A Sunday
+	now := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		prefs store.NotificationPrefs
+		want  bool
+	}{
+		{"defaults", store.DefaultNotificationPrefs("u"), true},
+		{"disabled", store.NotificationPrefs{Timezone: "UTC"}, false},
+		{"other hour", store.NotificationPrefs{Enabled: true, Hour: 9, Timezone: "UTC"}, false},
+		{"other day", store.NotificationPrefs{Enabled: true, Weekday: 1, Timezone: "UTC"}, false},
+		{"timezone behind", store.NotificationPrefs{Enabled: true, Weekday: 6, Hour: 19, Timezone: "America/New_York"}, true},
+		{"timezone ahead", store.NotificationPrefs{Enabled: true, Hour: 9, Timezone: "Asia/Tokyo"}, true},
+		{"unknown timezone", store.NotificationPrefs{Enabled: true, Timezone: "Mars/Olympus"}, false},
+	} {
+		if got := Due(tc.prefs, now); got != tc.want {
+			t.Errorf("%s: Due = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+type sent struct {
+	to, body string
+	headers  []string
+}
+
+type fakeSender []sent
+
+func (f *fakeSender) Send(to, subject, body string, headers ...string) error {
+	*f = append(*f, sent{to, body, headers})
+	return nil
+}
+
+func TestSendDue(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	var heartbeats []store.Heartbeat
+	for _, user := range []string{"sunday", "monday9", "off", "noemail", "unverified"} {
+		heartbeats = append(heartbeats, store.Heartbeat{
+			UserID: user, Project: "p", Language: "Go", Entity: "/p/main.go",
+			Duration: 3600, Timestamp: monday.Unix(),
+		})
+	}
+	if err := st.StoreHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, email, email_verified) VALUES
+		('sunday', 'sunday@example.com', 1), ('monday9', 'monday9@example.com', 1),
+		('off', 'off@example.com', 1), ('noemail', '', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserEmail("unverified", "typo@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	prefs := store.DefaultNotificationPrefs("monday9")
+	prefs.Weekday, prefs.Hour = 1, 9
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+	prefs = store.DefaultNotificationPrefs("off")
+	prefs.Enabled = false
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	var sender fakeSender
+	r := New(st, &sender)
+	for _, tc := range []struct {
+		now  time.Time
+		want []string
+	}{
+		{time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), []string{"sunday@example.com"}},
+		{time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), []string{"monday9@example.com"}},
+		{time.Date(2024, 3, 11, 10, 0, 0, 0, time.UTC), nil},
+		// A week later the heartbeats are out of range
+		{time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC), nil},
+	} {
+		sender = nil
+		if err := r.SendDue(tc.now); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sender {
+			got = append(got, s.to)
+			if !strings.Contains(s.body, "Project: p, Language: Go, Time: 1 h\n") ||
+				!strings.Contains(s.body, "Most productive day: Monday, 1 h\nMost productive hour: 12:00, 1 h\n") {
+				t.Errorf("%v: body for %s = %q", tc.now, s.to, s.body)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v: sent to %v, want %v", tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestSendDuePeriods(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, email, email_verified) VALUES
+		('owl', 'owl@example.com', 1), ('lark', 'lark@example.com', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Late on Sunday night for someone whose days start at 4am
+	sundayNight := time.Date(2024, 3, 11, 2, 0, 0, 0, time.UTC)
+	var heartbeats []store.Heartbeat
+	for _, user := range []string{"owl", "lark"} {
+		heartbeats = append(heartbeats, store.Heartbeat{
+			UserID: user, Project: "p", Language: "Go", Entity: "/p/main.go",
+			Duration: 3600, Timestamp: sundayNight.Unix(),
+		})
+	}
+	if err := st.StoreHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"owl", "lark"} {
+		prefs := store.DefaultNotificationPrefs(user)
+		prefs.Weekday, prefs.Hour, prefs.WeekStart = 1, 9, 1
+		if user == "owl" {
+			prefs.DayStartHour = 4
+		}
+		if err := st.SetNotificationPrefs(prefs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sender fakeSender
+	if err := New(st, &sender).SendDue(time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender) != 1 || sender[0].to != "owl@example.com" {
+		t.Errorf("summaries sent %+v, want only owl's for the week from Monday to Sunday night", sender)
+	}
+
+	// Moving the day start back moves the time to Monday
+	prefs, err := st.NotificationPrefs("owl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs.DayStartHour = 0
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+	days, err := st.DailyTotals("owl", sundayNight.AddDate(0, 0, -1), sundayNight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days["2024-03-10"] != 0 || days["2024-03-11"] != 3600 {
+		t.Errorf("daily totals after resetting the day start = %v", days)
+	}
+}
+
+func TestWeeklyCategories(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	if err := st.StoreHeartbeats([]store.Heartbeat{
+		{UserID: "ci", Project: "p", Language: "Go", Entity: "/p/main.go", Category: "coding", Duration: 3600, Timestamp: day.Unix()},
+		{UserID: "ci", Project: "p", Entity: "CI", EntityType: "app", Category: "building", Duration: 1800, Timestamp: day.Unix()},
+		{UserID: "plain", Project: "p", Language: "Go", Entity: "/p/main.go", Category: "coding", Duration: 3600, Timestamp: day.Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := New(st, nil).Weekly(day.Truncate(24*time.Hour), day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(summaries["ci"], "\n")
+	if !strings.Contains(got, "Category: coding, Time: 1 h\nCategory: building, Time: 30 min") {
+		t.Errorf("summary with CI time:\n%s", got)
+	}
+	if got := strings.Join(summaries["plain"], "\n"); strings.Contains(got, "Category:") {
+		t.Errorf("summary with only coding lists categories:\n%s", got)
+	}
+}
+
+func TestWeeklyComparison(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, email, email_verified) VALUES ('u', 'u@example.com', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	lastWeek := from.AddDate(0, 0, -3)
+	if err := st.StoreHeartbeats([]store.Heartbeat{
+		{UserID: "u", Project: "docs", Language: "Markdown", Entity: "/docs/a.md", Duration: 7200, Timestamp: lastWeek.Unix()},
+		{UserID: "u", Project: "app", Language: "Go", Entity: "/app/main.go", Duration: 3600, Timestamp: lastWeek.Unix()},
+		{UserID: "u", Project: "app", Language: "Go", Entity: "/app/main.go", Duration: 5400, Timestamp: from.Unix()},
+		{UserID: "u", Project: "docs", Language: "Markdown", Entity: "/docs/a.md", Duration: 3600, Timestamp: from.Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := New(st, nil).Weekly(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(summaries["u"], "\n")
+	want := "Total: 2 h 30 min, -30 min vs last week\n" +
+		"Top gaining project: app, +30 min\n" +
+		"Top losing project: docs, -1 h"
+	if !strings.Contains(got, want) {
+		t.Errorf("summary:\n%s\nwant it to contain:\n%s", got, want)
+	}
+
+	// In the user's language
+	prefs := store.DefaultNotificationPrefs("u")
+	prefs.Locale = "fr"
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+	summaries, err = New(st, nil).Weekly(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Join(summaries["u"], "\n")
+	want = "Total : 2 h 30 min, -30 min par rapport à la semaine dernière\n" +
+		"Projet en plus forte hausse : app, +30 min"
+	if !strings.Contains(got, want) {
+		t.Errorf("French summary:\n%s\nwant it to contain:\n%s", got, want)
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+	// A Saturday
+	day := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	everySaturday := map[string]float64{}
+	for week := 1; week <= 4; week++ {
+		everySaturday[day.AddDate(0, 0, -7*week).Format("2006-01-02")] = 3600
+	}
+	for _, tc := range []struct {
+		name   string
+		days   map[string]float64
+		dayOff bool
+		want   string
+	}{
+		{"usual day", map[string]float64{"2024-03-09": 8 * 3600}, false, ""},
+		{"runaway plugin", map[string]float64{"2024-03-09": 15 * 3600}, false, "2024-03-09: 15.0 hours tracked, more than 14"},
+		{"nothing on a usual weekday", everySaturday, false, "2024-03-09: nothing tracked, though the last 4 Saturdays had time"},
+		{"nothing on a day off", everySaturday, true, ""},
+		{"nothing on an unusual weekday", map[string]float64{"2024-03-08": 3600}, false, ""},
+	} {
+		got := strings.Join(Anomalies(i18n.Get("en"), day, tc.days, tc.dayOff, 14), "\n")
+		if tc.want == "" && got != "" || !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s: anomalies %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSendAlerts(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	var heartbeats []store.Heartbeat
+	for _, user := range []string{"alerts", "quiet"} {
+		heartbeats = append(heartbeats, store.Heartbeat{
+			UserID: user, Project: "p", Language: "Go", Entity: "/p/main.go",
+			Duration: 16 * 3600, Timestamp: day.Unix(),
+		})
+	}
+	if err := st.StoreHeartbeats(heartbeats); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, email, email_verified) VALUES
+		('alerts', 'alerts@example.com', 1), ('quiet', 'quiet@example.com', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	prefs := store.DefaultNotificationPrefs("alerts")
+	prefs.Enabled, prefs.Alerts = false, true
+	if err := st.SetNotificationPrefs(prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	var sender fakeSender
+	r := New(st, &sender)
+	r.Unsubscribe = func(userID, list string) string {
+		return "https://eztracker.example.com/unsubscribe/" + userID + "/" + list
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		want []string
+	}{
+		{day.AddDate(0, 0, 1), []string{"alerts@example.com"}},
+		{day.AddDate(0, 0, 1).Add(time.Hour), nil},
+		{day.AddDate(0, 0, 2), nil},
+	} {
+		sender = nil
+		if err := r.SendAlerts(tc.now); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sender {
+			got = append(got, s.to)
+			if !strings.Contains(s.body, "2024-03-04: 16.0 hours tracked") ||
+				!strings.HasSuffix(s.body, "open https://eztracker.example.com/unsubscribe/alerts/alerts\n") {
+				t.Errorf("%v: body for %s = %q", tc.now, s.to, s.body)
+			}
+			if len(s.headers) != 2 || s.headers[0] != "List-Unsubscribe: <https://eztracker.example.com/unsubscribe/alerts/alerts>" {
+				t.Errorf("%v: headers for %s = %q", tc.now, s.to, s.headers)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v: sent to %v, want %v", tc.now, got, tc.want)
+		}
+	}
+
+	// Alerts alone don't bring back the weekly summary
+	sender = nil
+	if err := r.SendDue(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender) != 1 || sender[0].to != "quiet@example.com" {
+		t.Errorf("weekly summaries sent %+v, want only quiet's", sender)
+	}
+}
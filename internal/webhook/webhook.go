@@ -0,0 +1,138 @@
+// Package webhook POSTs users' milestones to the URLs they registered, so
+// reaching the day's goal can turn a light green or post to a chat: the
+// daily goal reached, a new record day and streaks of active days.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/milestones"
+	"github.com/kru/eztracker/internal/store"
+)
+
+// Events are the events a webhook may subscribe to, each sent at most once
+// per webhook and day.
+var Events = []string{events.GoalCompleted, events.DailyRecord, events.StreakMilestone}
+
+// maxAttempts is how often a delivery is tried, once a minute, before it
+// is given up on.
+const maxAttempts = 60
+
+// Event is the JSON body POSTed to a webhook: the milestone and when it was
+// sent.
+type Event struct {
+	milestones.Milestone
+	SentAt int64 `json:"sent_at"`
+}
+
+// Sign returns the X-Eztracker-Signature of a body sent to a webhook with
+// secret: "sha256=" and the hex HMAC-SHA256 of the body. Receivers should
+// compare it in constant time, and may reject old SentAt times.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notifier queues the milestones published on the bus for the webhooks
+// subscribed to them, and delivers them.
+type Notifier struct {
+	store  *store.Store
+	client *http.Client
+}
+
+// New returns a notifier for the webhooks in st, subscribed to the
+// milestones published on bus.
+func New(st *store.Store, bus *events.Bus) *Notifier {
+	n := &Notifier{store: st, client: &http.Client{Timeout: 10 * time.Second}}
+	for _, name := range Events {
+		bus.Subscribe(name, n.enqueue)
+	}
+	return n
+}
+
+// enqueue queues a milestone for the user's webhooks subscribed to it.
+func (n *Notifier) enqueue(e events.Event) {
+	m, ok := e.Data.(milestones.Milestone)
+	if !ok {
+		return
+	}
+	hooks, err := n.store.Webhooks(e.UserID)
+	if err != nil {
+		log.Println("Webhook error: ", err)
+		return
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		log.Println("Webhook error: ", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !slices.Contains(hook.Events, e.Name) {
+			continue
+		}
+		delivery := store.WebhookDelivery{WebhookID: hook.ID, Event: e.Name, Day: m.Day, Body: string(body)}
+		if _, err := n.store.EnqueueWebhookDelivery(delivery); err != nil {
+			log.Println("Webhook error: ", err)
+		}
+	}
+}
+
+// Run makes the queued deliveries, as a scheduled task. Failed deliveries
+// are tried again on the next run, up to maxAttempts times.
+func (n *Notifier) Run(now time.Time) error {
+	deliveries, err := n.store.PendingWebhookDeliveries(maxAttempts)
+	if err != nil {
+		return fmt.Errorf("webhook deliveries query error: %v", err)
+	}
+	for _, d := range deliveries {
+		err := n.deliver(d, now)
+		if err != nil {
+			log.Println("Webhook error: ", err)
+		}
+		if err := n.store.MarkWebhookDelivered(d, err == nil, now); err != nil {
+			return fmt.Errorf("webhook delivery error: %v", err)
+		}
+	}
+	return nil
+}
+
+// deliver POSTs a queued milestone to its webhook, signed with its secret.
+func (n *Notifier) deliver(d store.WebhookDelivery, now time.Time) error {
+	event := Event{SentAt: now.Unix()}
+	if err := json.Unmarshal([]byte(d.Body), &event.Milestone); err != nil {
+		return err
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Eztracker-Event", d.Event)
+	req.Header.Set("X-Eztracker-Signature", Sign(d.Secret, body))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook %d: %s %s", d.WebhookID, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
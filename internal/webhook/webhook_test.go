@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/internal/events"
+	"github.com/kru/eztracker/internal/milestones"
+	"github.com/kru/eztracker/internal/store"
+)
+
+func TestRun(t *testing.T) {
+	db, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	st, err := store.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type delivery struct {
+		event, signature string
+		body             []byte
+	}
+	var deliveries []delivery
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries = append(deliveries, delivery{r.Header.Get("X-Eztracker-Event"), r.Header.Get("X-Eztracker-Signature"), body})
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	records := store.Webhook{UserID: "alice", URL: srv.URL, Secret: "s3cret", Events: []string{events.DailyRecord}}
+	goals := store.Webhook{UserID: "alice", URL: srv.URL, Secret: "s3cret", Events: []string{events.GoalCompleted}}
+	for _, hook := range []*store.Webhook{&records, &goals} {
+		if err := st.AddWebhook(hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bus := events.New()
+	n := New(st, bus)
+	now := time.Date(2024, 3, 11, 18, 0, 0, 0, time.UTC)
+	record := milestones.Milestone{Event: events.DailyRecord, UserID: "alice", Day: "2024-03-11", Seconds: 7200, PreviousRecord: 3600}
+	bus.Publish(events.Event{Name: events.DailyRecord, UserID: "alice", Time: now, Data: record})
+	// Published twice, queued once
+	bus.Publish(events.Event{Name: events.DailyRecord, UserID: "alice", Time: now, Data: record})
+
+	// A failed delivery is tried again on the next run
+	if err := n.Run(now); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusNoContent
+	for i := 1; i <= 2; i++ {
+		if err := n.Run(now.Add(time.Duration(i) * time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("%d deliveries, want 2", len(deliveries))
+	}
+	last := deliveries[1]
+	var event Event
+	if err := json.Unmarshal(last.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if last.event != events.DailyRecord || last.signature != Sign("s3cret", last.body) ||
+		event.Milestone != record || event.SentAt != now.Add(time.Minute).Unix() {
+		t.Errorf("delivery %s %s: %s", last.event, last.signature, last.body)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The API key is kept in the OS keychain under this service and account:
+// the macOS Keychain, the Secret Service (GNOME Keyring, KWallet) through
+// secret-tool, or the Windows Credential Manager.
+const (
+	keychainService = "eztracker"
+	keychainAccount = "api_key"
+)
+
+// runKeychain stores the API key read from stdin in the OS keychain, so it
+// doesn't have to sit in the config file or the shell history.
+func runKeychain(args []string) int {
+	fs := flag.NewFlagSet("keychain", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if fs.Arg(0) != "set" {
+		fmt.Fprintln(os.Stderr, "Usage: eztracker keychain set < key")
+		return ExitCodeInvalidInput
+	}
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Print("API key: ")
+	}
+	key, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	key = strings.TrimSpace(key)
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "Error: no API key given")
+		return ExitCodeInvalidInput
+	}
+	if err := keychainSet(key); err != nil {
+		fmt.Fprintf(os.Stderr, "Error storing the API key: %v\n", err)
+		return ExitCodeGenericError
+	}
+	fmt.Println("Stored the API key in the keychain. Set api_key_source = keychain in [settings] and remove api_key.")
+	return ExitCodeSuccess
+}
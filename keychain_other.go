@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainGet reads the API key from the macOS Keychain or the Secret
+// Service.
+func keychainGet() (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keychainService, "account", keychainAccount)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", fmt.Errorf("no API key in the keychain")
+	}
+	return key, nil
+}
+
+// keychainSet stores the API key in the macOS Keychain or the Secret
+// Service, replacing the one there.
+func keychainSet(key string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "add-generic-password", "-U", "-s", keychainService, "-a", keychainAccount, "-w", key)
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label=eztracker API key",
+			"service", keychainService, "account", keychainAccount)
+		cmd.Stdin = strings.NewReader(key)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", cmd.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
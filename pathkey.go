@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/kru/eztracker/pkg/tracker"
+)
+
+// encryptedPath matches the paths a path key encrypted in any text, such as
+// the JSON of an API response.
+var encryptedPath = regexp.MustCompile(regexp.QuoteMeta(tracker.EncryptedPrefix) + `[A-Za-z0-9_-]+`)
+
+// runPathKey creates the key that encrypts file paths before they are
+// sent, and decrypts the paths the server returns with it.
+func runPathKey(args []string) int {
+	fs := flag.NewFlagSet("path-key", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: eztracker path-key new | decrypt [path...] < text")
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	switch fs.Arg(0) {
+	case "new":
+		key, err := tracker.NewPathKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitCodeGenericError
+		}
+		fmt.Println(key)
+		fmt.Fprintln(os.Stderr, "Set path_key to it in [settings] and keep a copy: paths sent with it can't be read without it.")
+		return ExitCodeSuccess
+	case "decrypt":
+		// Decrypting works without an API key
+		config, err := loadConfig()
+		if config.PathKey == nil {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+				return ExitCodeConfigParseError
+			}
+			fmt.Fprintln(os.Stderr, "Error: path_key is not set")
+			return ExitCodeConfigParseError
+		}
+		if fs.NArg() > 1 {
+			for _, entity := range fs.Args()[1:] {
+				path, err := config.PathKey.Decrypt(entity)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return ExitCodeInvalidInput
+				}
+				fmt.Println(path)
+			}
+			return ExitCodeSuccess
+		}
+		return decryptPaths(config.PathKey)
+	}
+	fs.Usage()
+	return ExitCodeInvalidInput
+}
+
+// decryptPaths copies stdin to stdout with the encrypted paths in it
+// decrypted, leaving those of another key as they are.
+func decryptPaths(key *tracker.PathKey) int {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for scanner.Scan() {
+		line := encryptedPath.ReplaceAllStringFunc(scanner.Text(), func(entity string) string {
+			if path, err := key.Decrypt(entity); err == nil {
+				return path
+			}
+			return entity
+		})
+		fmt.Fprintln(out, line)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return ExitCodeGenericError
+	}
+	return ExitCodeSuccess
+}
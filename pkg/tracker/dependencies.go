@@ -0,0 +1,110 @@
+package tracker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DetectDependencies walks up from the file's directory to the first folder
+// containing a known manifest (go.mod, package.json, requirements.txt) and
+// returns the dependency names declared there.
+func DetectDependencies(entity string) []string {
+	dir := filepath.Dir(normalize(entity))
+	for {
+		found := false
+		seen := make(map[string]bool)
+		for name, parse := range map[string]func([]byte) []string{
+			"go.mod":           parseGoMod,
+			"package.json":     parsePackageJSON,
+			"requirements.txt": parseRequirements,
+		} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			found = true
+			for _, dep := range parse(data) {
+				seen[dep] = true
+			}
+		}
+		if found {
+			deps := make([]string, 0, len(seen))
+			for dep := range seen {
+				deps = append(deps, dep)
+			}
+			sort.Strings(deps)
+			return deps
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+func parseGoMod(data []byte) []string {
+	var deps []string
+	inRequire := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch {
+		case line == "require (":
+			inRequire = true
+			continue
+		case inRequire && line == ")":
+			inRequire = false
+			continue
+		case strings.HasPrefix(line, "require "):
+			line = strings.TrimPrefix(line, "require ")
+		case !inRequire:
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			deps = append(deps, fields[0])
+		}
+	}
+	return deps
+}
+
+func parsePackageJSON(data []byte) []string {
+	var pkg struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil
+	}
+	var deps []string
+	for name := range pkg.Dependencies {
+		deps = append(deps, name)
+	}
+	for name := range pkg.DevDependencies {
+		deps = append(deps, name)
+	}
+	return deps
+}
+
+func parseRequirements(data []byte) []string {
+	var deps []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if i := strings.IndexAny(line, "=<>!~[;@ "); i >= 0 {
+			line = line[:i]
+		}
+		if line != "" {
+			deps = append(deps, strings.ToLower(line))
+		}
+	}
+	return deps
+}
@@ -0,0 +1,133 @@
+package tracker
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a single pattern from an .eztrackerignore file, following
+// gitignore syntax relative to the directory the file lives in.
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// IsIgnored reports whether entity matches the .eztrackerignore in the home
+// directory or in any directory between the file and the filesystem root.
+// Deeper files take precedence, and the last matching rule wins.
+func IsIgnored(entity string) bool {
+	entity, err := filepath.Abs(normalize(entity))
+	if err != nil {
+		return false
+	}
+
+	var dirs []string
+	for dir := filepath.Dir(entity); ; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append([]string{home}, dirs...)
+	}
+
+	var rules []ignoreRule
+	for _, dir := range dirs {
+		rules = append(rules, loadIgnoreRules(dir)...)
+	}
+
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(entity) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func loadIgnoreRules(dir string) []ignoreRule {
+	data, err := os.ReadFile(filepath.Join(dir, ".eztrackerignore"))
+	if err != nil {
+		return nil
+	}
+
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches checks the file itself and every parent directory below the rule's
+// base, since ignoring a directory ignores everything inside it.
+func (r ignoreRule) matches(entity string) bool {
+	rel, err := filepath.Rel(r.base, entity)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(segments); i++ {
+		if r.dirOnly && i == len(segments) {
+			break
+		}
+		if r.anchored {
+			if matchGlob(strings.Split(r.pattern, "/"), segments[:i]) {
+				return true
+			}
+		} else if ok, _ := path.Match(r.pattern, segments[i-1]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches path segments against pattern segments, where "**" spans
+// any number of directories.
+func matchGlob(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchGlob(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], segments[1:])
+}
@@ -0,0 +1,212 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fileNames are the languages of files known by name rather than
+// extension. Names followed by a dot and a suffix, such as Dockerfile.dev,
+// count too.
+var fileNames = map[string]string{
+	"Makefile": "Makefile", "makefile": "Makefile", "GNUmakefile": "Makefile",
+	"Dockerfile": "Dockerfile", "Containerfile": "Dockerfile",
+	"Jenkinsfile": "Groovy", "Vagrantfile": "Ruby", "Gemfile": "Ruby", "Rakefile": "Ruby",
+	"Brewfile": "Ruby", "Podfile": "Ruby", "Justfile": "Just", "justfile": "Just",
+	"CMakeLists.txt": "CMake", "BUILD": "Starlark", "WORKSPACE": "Starlark",
+	"Procfile": "Procfile", "Caddyfile": "Caddyfile",
+}
+
+// languageNames maps the names interpreters, vim filetypes and emacs
+// modes use to languages. Others are capitalized.
+var languageNames = map[string]string{
+	"sh": "Bash", "bash": "Bash", "dash": "Bash", "ksh": "Bash", "zsh": "Zsh", "fish": "Fish",
+	"python": "Python", "pypy": "Python", "node": "JavaScript", "nodejs": "JavaScript",
+	"javascript": "JavaScript", "js": "JavaScript", "deno": "TypeScript", "bun": "TypeScript",
+	"ts-node": "TypeScript", "typescript": "TypeScript", "ruby": "Ruby", "perl": "Perl",
+	"php": "PHP", "lua": "Lua", "rscript": "R", "r": "R", "awk": "Awk", "gawk": "Awk",
+	"tclsh": "Tcl", "make": "Makefile", "makefile": "Makefile", "dockerfile": "Dockerfile",
+	"yaml": "YAML", "json": "JSON", "toml": "TOML", "xml": "XML", "html": "HTML", "css": "CSS",
+	"sql": "SQL", "go": "Go", "c": "C", "cpp": "C++", "c++": "C++", "rust": "Rust",
+	"elisp": "Emacs Lisp", "emacs-lisp": "Emacs Lisp", "vim": "VimL", "markdown": "Markdown",
+	"conf": "INI", "dosini": "INI", "ini": "INI", "nginx": "Nginx", "groovy": "Groovy",
+}
+
+var (
+	// vimModeline reads the filetype of a vim modeline.
+	vimModeline = regexp.MustCompile(`(?:^|\s)(?:vi|vim|ex):.*?\b(?:ft|filetype|syntax)=([\w+-]+)`)
+	// makeRule is a target line, such as "build: deps".
+	makeRule = regexp.MustCompile(`^[\w./$()%-]+(?:\s+[\w./$()%-]+)*\s*::?(?:[^=]|$)`)
+	// makeAssignment is a variable assignment only make understands.
+	makeAssignment = regexp.MustCompile(`^(?:override\s+|export\s+)?[\w.-]+\s*(?::=|::=|\?=|\+=)`)
+	// dockerInstruction is an instruction of a Dockerfile.
+	dockerInstruction = regexp.MustCompile(`^(?i:FROM|RUN|COPY|ADD|CMD|ENTRYPOINT|WORKDIR|ENV|EXPOSE|ARG|USER|LABEL)\s`)
+)
+
+// sniffSize is how much of a file DetectLanguage reads.
+const sniffSize = 8 << 10
+
+// DetectLanguage guesses the language of a file without an extension,
+// which editors often send without one: from its name, such as Makefile or
+// Dockerfile.dev, else from its content, by a #! line, a vim or emacs
+// modeline in its first or last five lines, or what Makefiles, Dockerfiles,
+// PHP and HTML start with. It returns "" when unsure, and for files with an
+// extension, which plugins know best.
+func DetectLanguage(entity string) string {
+	entity = normalize(entity)
+	base := filepath.Base(entity)
+	name, _, _ := strings.Cut(base, ".")
+	if language, ok := fileNames[base]; ok {
+		return language
+	}
+	if language, ok := fileNames[name]; ok {
+		return language
+	}
+	if filepath.Ext(base) != "" && !strings.HasPrefix(base, ".") {
+		return ""
+	}
+
+	f, err := os.Open(entity)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head, err := io.ReadAll(io.LimitReader(f, sniffSize))
+	if err != nil || bytes.IndexByte(head, 0) >= 0 {
+		// Binaries have no language
+		return ""
+	}
+	return sniffLanguage(head)
+}
+
+// sniffLanguage guesses the language of the start of a file.
+func sniffLanguage(head []byte) string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	if interpreter, ok := interpreter(lines[0]); ok {
+		return languageName(strings.TrimRight(interpreter, "0123456789."))
+	}
+	modelines := lines
+	if len(lines) > 10 {
+		modelines = append(lines[:5:5], lines[len(lines)-5:]...)
+	}
+	for _, line := range modelines {
+		if m := vimModeline.FindStringSubmatch(line); m != nil {
+			return languageName(m[1])
+		}
+		if mode := emacsMode(line); mode != "" {
+			return languageName(mode)
+		}
+	}
+
+	first := strings.TrimSpace(string(head))
+	switch {
+	case strings.HasPrefix(first, "<?php"):
+		return "PHP"
+	case strings.HasPrefix(strings.ToLower(first), "<!doctype html"), strings.HasPrefix(strings.ToLower(first), "<html"):
+		return "HTML"
+	case strings.HasPrefix(first, "<?xml"):
+		return "XML"
+	}
+
+	var rules, recipes, assignments, instructions, from int
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "\t") && i > 0:
+			recipes++
+		case strings.HasPrefix(trimmed, ".PHONY:"), strings.HasPrefix(trimmed, "include "), strings.HasPrefix(trimmed, "-include "):
+			rules++
+		case makeAssignment.MatchString(trimmed):
+			assignments++
+		case makeRule.MatchString(trimmed):
+			rules++
+		}
+		if dockerInstruction.MatchString(trimmed) {
+			instructions++
+			if strings.HasPrefix(strings.ToUpper(trimmed), "FROM ") {
+				from++
+			}
+		}
+	}
+	switch {
+	case from > 0 && instructions >= 2:
+		return "Dockerfile"
+	case rules > 0 && recipes > 0, rules+assignments >= 2 && assignments > 0:
+		return "Makefile"
+	}
+	return ""
+}
+
+// interpreter reads the program a #! line runs, looking past env and its
+// options and variables.
+func interpreter(line string) (string, bool) {
+	command, ok := strings.CutPrefix(line, "#!")
+	if !ok {
+		return "", false
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", false
+	}
+	program := path.Base(fields[0])
+	if program != "env" {
+		return program, true
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+			return path.Base(field), true
+		}
+	}
+	return "", false
+}
+
+// emacsMode reads the mode of an emacs "-*- mode: python -*-" or
+// "-*- python -*-" line.
+func emacsMode(line string) string {
+	_, rest, ok := strings.Cut(line, "-*-")
+	if !ok {
+		return ""
+	}
+	vars, _, ok := strings.Cut(rest, "-*-")
+	if !ok {
+		return ""
+	}
+	if !strings.Contains(vars, ":") {
+		return strings.TrimSpace(vars)
+	}
+	for _, v := range strings.Split(vars, ";") {
+		name, value, _ := strings.Cut(v, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "mode") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// languageName maps an interpreter, filetype or mode name to a language.
+func languageName(name string) string {
+	if language, ok := languageNames[strings.ToLower(name)]; ok {
+		return language
+	}
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,24 @@
+package tracker
+
+import "os"
+
+// DetectMachine names the machine heartbeats are sent from, for the
+// server's machine dimension. Over SSH, and in dev containers that the
+// editor's remote server runs inside, the CLI runs on the remote side, so
+// the host name already is the remote box. Containers get random host
+// names though: GitHub Codespaces and Gitpod workspaces are named after
+// the workspace instead, and EZTRACKER_MACHINE, e.g. set in
+// devcontainer.json's containerEnv, overrides any of them.
+func DetectMachine() string {
+	host, _ := os.Hostname()
+	return detectMachine(os.Getenv, host)
+}
+
+func detectMachine(getenv func(string) string, host string) string {
+	for _, name := range []string{"EZTRACKER_MACHINE", "CODESPACE_NAME", "GITPOD_WORKSPACE_ID"} {
+		if value := getenv(name); value != "" {
+			return value
+		}
+	}
+	return host
+}
@@ -0,0 +1,23 @@
+package tracker
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPathPrefix marks Windows extended-length paths, which editors send
+// for paths longer than MAX_PATH; \\?\UNC\server\share is a share's form.
+const longPathPrefix = `\\?\`
+
+// normalize turns a Windows extended-length path into its usual form, so it
+// compares equal to the home directory and other paths. Elsewhere paths are
+// returned as they are.
+func normalize(entity string) string {
+	if filepath.Separator != '\\' || !strings.HasPrefix(entity, longPathPrefix) {
+		return entity
+	}
+	if share, ok := strings.CutPrefix(entity, longPathPrefix+`UNC\`); ok {
+		return `\\` + share
+	}
+	return strings.TrimPrefix(entity, longPathPrefix)
+}
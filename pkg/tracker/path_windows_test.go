@@ -0,0 +1,37 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProjectForWindows(t *testing.T) {
+	for entity, want := range map[string]string{
+		`C:\src\eztracker\main.go`:               "eztracker",
+		`C:/src/eztracker/main.go`:               "eztracker",
+		`C:\main.go`:                             "unknown",
+		`\\server\share\eztracker\main.go`:       "eztracker",
+		`\\server\share\main.go`:                 "unknown",
+		`\\?\C:\src\eztracker\main.go`:           "eztracker",
+		`\\?\UNC\server\share\eztracker\main.go`: "eztracker",
+		`\\?\UNC\server\share\main.go`:           "unknown",
+		`main.go`:                                "unknown",
+	} {
+		if got := ProjectFor(entity); got != want {
+			t.Errorf("ProjectFor(%q) = %q, want %q", entity, got, want)
+		}
+	}
+}
+
+func TestIsIgnoredLongPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("USERPROFILE", t.TempDir())
+	if err := os.WriteFile(filepath.Join(dir, ".eztrackerignore"), []byte("secret/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entity := filepath.Join(dir, "secret", "keys.txt")
+	if !IsIgnored(entity) || !IsIgnored(longPathPrefix+entity) {
+		t.Errorf("%s is not ignored in both its forms", entity)
+	}
+}
@@ -0,0 +1,105 @@
+package tracker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EncryptedPrefix starts the file paths a PathKey encrypted, followed by
+// the unpadded base64url of a 12 byte nonce and the AES-256-GCM ciphertext
+// of the path.
+const EncryptedPrefix = "enc:v1:"
+
+// PathKey encrypts file paths before they leave the machine, for users who
+// don't want the server's operator to read them. The key is 32 random
+// bytes, written as 64 hex digits, that only the user holds: the server
+// stores the ciphertext and can't decrypt it.
+//
+// Encryption is deterministic, the nonce being an HMAC of the path, so the
+// same file always gives the same ciphertext and the server can still count
+// time per file. The encryption and nonce keys are HMAC-SHA256s of the
+// "eztracker path encryption" and "eztracker path nonce" labels keyed with
+// the user's key.
+type PathKey struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewPathKey returns a random key as 64 hex digits.
+func NewPathKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ParsePathKey reads a key of 64 hex digits.
+func ParsePathKey(s string) (*PathKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("path key must be 64 hex digits")
+	}
+	block, err := aes.NewCipher(derive(key, "eztracker path encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PathKey{aead: aead, nonceKey: derive(key, "eztracker path nonce")}, nil
+}
+
+// derive returns the subkey of key for label.
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Encrypt returns a path encrypted, starting with EncryptedPrefix. Paths
+// that already are, and empty ones, are returned as they are.
+func (k *PathKey) Encrypt(path string) string {
+	if path == "" || IsEncrypted(path) {
+		return path
+	}
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write([]byte(path))
+	nonce := mac.Sum(nil)[:k.aead.NonceSize()]
+	sealed := k.aead.Seal(nonce, nonce, []byte(path), nil)
+	return EncryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// Decrypt returns the path an entity was encrypted from, and entities that
+// aren't encrypted as they are. It fails for paths encrypted with another
+// key.
+func (k *PathKey) Decrypt(entity string) (string, error) {
+	encoded, ok := strings.CutPrefix(entity, EncryptedPrefix)
+	if !ok {
+		return entity, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted path %q", entity)
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	path, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("encrypted path doesn't match the path key")
+	}
+	return string(path), nil
+}
+
+// IsEncrypted reports whether an entity is an encrypted path.
+func IsEncrypted(entity string) bool {
+	return strings.HasPrefix(entity, EncryptedPrefix)
+}
@@ -0,0 +1,196 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+// Heartbeats the server could not be reached for wait in QueueFile, one JSON
+// object per line, and are sent before the next heartbeat. Every heartbeat
+// is also kept in HistoryFile for offline stats.
+const (
+	QueueFile   = "queue.jsonl"
+	HistoryFile = "history.jsonl"
+
+	// historyMaxSize is the size at which the history is pruned down to
+	// historyDays.
+	historyMaxSize = 1 << 20
+	historyDays    = 14
+
+	// flushBatchSize is how many queued heartbeats are sent per request.
+	flushBatchSize = 100
+)
+
+// Queue is the offline queue and local history in a state directory, shared
+// with the CLI when Dir is its state directory so heartbeats queued by either
+// are sent by the next one to reach the server.
+type Queue struct {
+	Dir string
+
+	// OnDrop, if set, is called for queued heartbeats the server rejected
+	// and that are dropped.
+	OnDrop func(hb client.Heartbeat, err error)
+}
+
+// appendJSONLines appends heartbeats to a file in the state directory.
+func (q *Queue) appendJSONLines(name string, heartbeats ...client.Heartbeat) error {
+	if err := os.MkdirAll(q.Dir, 0o700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, hb := range heartbeats {
+		line, err := json.Marshal(hb)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	f, err := os.OpenFile(filepath.Join(q.Dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+// readJSONLines reads the heartbeats in a file, skipping lines that don't
+// parse, such as one cut short by a crash.
+func readJSONLines(path string) ([]client.Heartbeat, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var heartbeats []client.Heartbeat
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var hb client.Heartbeat
+		if len(line) > 0 && json.Unmarshal(line, &hb) == nil {
+			heartbeats = append(heartbeats, hb)
+		}
+	}
+	return heartbeats, nil
+}
+
+// Enqueue keeps heartbeats to send once the server is reachable again.
+func (q *Queue) Enqueue(heartbeats ...client.Heartbeat) error {
+	return q.appendJSONLines(QueueFile, heartbeats...)
+}
+
+// Pending returns the queued heartbeats, none if there is no queue.
+func (q *Queue) Pending() ([]client.Heartbeat, error) {
+	heartbeats, err := readJSONLines(filepath.Join(q.Dir, QueueFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return heartbeats, err
+}
+
+// Flush sends the queued heartbeats in batches, gzipped as the client's
+// GzipThreshold says, or one by one to servers without batches. The queue
+// is moved aside first so concurrent flushes don't send it twice; what
+// could not be sent is queued again. Only network errors and maintenance
+// are returned, as rejected heartbeats would be rejected again.
+func (q *Queue) Flush(c *client.Client) error {
+	sending := filepath.Join(q.Dir, fmt.Sprintf("%s.%d", QueueFile, os.Getpid()))
+	if err := os.Rename(filepath.Join(q.Dir, QueueFile), sending); err != nil {
+		return nil
+	}
+	defer os.Remove(sending)
+	queued, err := readJSONLines(sending)
+	if err != nil {
+		return nil
+	}
+
+	for start := 0; start < len(queued); start += flushBatchSize {
+		batch := queued[start:min(start+flushBatchSize, len(queued))]
+		result, err := c.SendHeartbeatBatch(batch)
+		var srvErr *client.Error
+		if errors.As(err, &srvErr) && srvErr.StatusCode == http.StatusNotFound {
+			return q.flushEach(c, queued[start:])
+		}
+		if client.Retryable(err) {
+			if qerr := q.Enqueue(queued[start:]...); qerr != nil {
+				return fmt.Errorf("%w, and requeueing failed: %v", err, qerr)
+			}
+			return err
+		}
+		if q.OnDrop == nil {
+			continue
+		}
+		if err != nil {
+			for _, hb := range batch {
+				q.OnDrop(hb, err)
+			}
+		}
+		for _, rejected := range result.Rejected {
+			if rejected.Index >= 0 && rejected.Index < len(batch) {
+				q.OnDrop(batch[rejected.Index], errors.New(rejected.Error))
+			}
+		}
+	}
+	return nil
+}
+
+// flushEach sends queued heartbeats one by one, for servers without
+// batches.
+func (q *Queue) flushEach(c *client.Client, queued []client.Heartbeat) error {
+	for i, hb := range queued {
+		err := c.SendHeartbeats([]client.Heartbeat{hb})
+		if client.Retryable(err) {
+			if qerr := q.Enqueue(queued[i:]...); qerr != nil {
+				return fmt.Errorf("%w, and requeueing failed: %v", err, qerr)
+			}
+			return err
+		}
+		if err != nil && q.OnDrop != nil {
+			q.OnDrop(hb, err)
+		}
+	}
+	return nil
+}
+
+// RecordHistory keeps a heartbeat for offline stats, pruning the history
+// to the last historyDays once it grows past historyMaxSize.
+func (q *Queue) RecordHistory(hb client.Heartbeat) error {
+	if err := q.appendJSONLines(HistoryFile, hb); err != nil {
+		return err
+	}
+	path := filepath.Join(q.Dir, HistoryFile)
+	if info, err := os.Stat(path); err != nil || info.Size() < historyMaxSize {
+		return nil
+	}
+	heartbeats, err := readJSONLines(path)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -historyDays).Unix()
+	var buf bytes.Buffer
+	for _, hb := range heartbeats {
+		if hb.Timestamp >= cutoff {
+			line, _ := json.Marshal(hb)
+			buf.Write(append(line, '\n'))
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// History returns the heartbeats recorded by RecordHistory, oldest first.
+func (q *Queue) History() ([]client.Heartbeat, error) {
+	heartbeats, err := readJSONLines(filepath.Join(q.Dir, HistoryFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return heartbeats, err
+}
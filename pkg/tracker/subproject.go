@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// projectMarker names the project the files below its directory belong to,
+// for sub-projects of a monorepo without a manifest or ones named
+// differently. An empty one names it after the directory.
+const projectMarker = ".eztracker-project"
+
+// manifests are the package manifests that make their directory a
+// sub-project of a monorepo, each with how to read the package's name.
+var manifests = []struct {
+	file string
+	name func([]byte) string
+}{
+	{"package.json", packageJSONName},
+	{"go.mod", goModName},
+	{"Cargo.toml", cargoName},
+}
+
+// subProject returns the name and directory of the sub-project a file is
+// in: the nearest directory up from it with a .eztracker-project, or one
+// below the root of its checkout with a manifest naming a package. ok is
+// false when neither is found before the root, so the manifest of an
+// ordinary repository doesn't rename it.
+func subProject(entity string) (name, dir string, ok bool) {
+	start := filepath.Dir(normalize(entity))
+	root, inCheckout := checkoutRoot(start)
+	for dir := start; ; {
+		if data, err := os.ReadFile(filepath.Join(dir, projectMarker)); err == nil {
+			name, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+			if name = strings.TrimSpace(name); name == "" {
+				name = filepath.Base(dir)
+			}
+			return name, dir, true
+		}
+		if inCheckout && dir == root {
+			return "", "", false
+		}
+		if inCheckout {
+			for _, manifest := range manifests {
+				data, err := os.ReadFile(filepath.Join(dir, manifest.file))
+				if err != nil {
+					continue
+				}
+				if name := manifest.name(data); name != "" {
+					return name, dir, true
+				}
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+func packageJSONName(data []byte) string {
+	var pkg struct {
+		Name string `json:"name"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return ""
+	}
+	return pkg.Name
+}
+
+// goModName is the last element of the module path, the one before a
+// major version suffix such as /v2.
+func goModName(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		module, ok := strings.CutPrefix(strings.TrimSpace(line), "module ")
+		if !ok {
+			continue
+		}
+		module = strings.Trim(strings.TrimSpace(module), `"`)
+		name := path.Base(module)
+		if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+			name = path.Base(path.Dir(module))
+		}
+		return name
+	}
+	return ""
+}
+
+// cargoName is the name in a Cargo.toml's [package] section; workspace
+// manifests have none.
+func cargoName(data []byte) string {
+	section := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if section == "[package]" && ok && strings.TrimSpace(key) == "name" {
+			return strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+// Package tracker is what the eztracker CLI does with editor events, for Go
+// tools that want to track time without exec'ing it: building heartbeats
+// with the project and dependencies detected from the file, honoring
+// .eztrackerignore, merging chatty heartbeats and queueing them while the
+// server can't be reached.
+//
+//	t := &tracker.Tracker{
+//		Client: client.New("http://localhost:8080", apiKey),
+//		UserID: "me",
+//		Queue:  &tracker.Queue{Dir: filepath.Join(home, ".local", "state", "eztracker")},
+//	}
+//	hb := tracker.Heartbeat{Entity: path, Timestamp: now, Language: "Go", Duration: 30}
+//	if !tracker.IsIgnored(hb.Entity) {
+//		err = t.Send(t.Build(hb))
+//	}
+//
+// The exported API is stable; new behavior is added with new fields that
+// default to the old one.
+package tracker
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+// Heartbeat is an editor event as plugins report it to the CLI, with the
+// timestamp in fractional epoch seconds.
+type Heartbeat struct {
+	Entity            string   `json:"entity"`
+	Timestamp         float64  `json:"timestamp"`
+	Language          string   `json:"language,omitempty"`
+	AlternateLanguage string   `json:"alternate_language,omitempty"`
+	IsWrite           bool     `json:"is_write"`
+	Plugin            string   `json:"plugin"`
+	Duration          float64  `json:"duration"`
+	Category          string   `json:"category,omitempty"`
+	Tags              []string `json:"tags,omitempty"`
+
+	// EntityType is "file", the default, "app" or "domain". Only files
+	// have their project, language and dependencies detected.
+	EntityType string `json:"entity_type,omitempty"`
+	// Project, if set, is used instead of the one detected from a file's
+	// path. Apps and domains without one count towards "unknown".
+	Project string `json:"project,omitempty"`
+}
+
+// Tracker turns editor heartbeats into server ones and sends them.
+type Tracker struct {
+	Client *client.Client
+	UserID string
+
+	// Queue, if set, keeps heartbeats while the server can't be reached
+	// and a local history of everything sent.
+	Queue *Queue
+
+	// DetectDependencies adds the dependencies declared in the nearest
+	// manifest to each heartbeat.
+	DetectDependencies bool
+
+	// DetectLanguage guesses the language of files without an extension
+	// that the editor sent none for, with DetectLanguage.
+	DetectLanguage bool
+
+	// Machine, if set, is the machine each heartbeat is attributed to,
+	// usually DetectMachine's.
+	Machine string
+
+	// PathKey, if set, encrypts the path and project root of files, after
+	// everything else was detected from them.
+	PathKey *PathKey
+}
+
+// IsFile reports whether a heartbeat is for a file rather than an app or a
+// domain.
+func (hb Heartbeat) IsFile() bool {
+	return hb.EntityType == "" || hb.EntityType == "file"
+}
+
+// entityType returns the heartbeat's entity type, "file" when unset.
+func (hb Heartbeat) entityType() string {
+	if hb.IsFile() {
+		return "file"
+	}
+	return hb.EntityType
+}
+
+// project returns the heartbeat's project, the one detected from the path
+// for files.
+func (hb Heartbeat) project() string {
+	switch {
+	case hb.Project != "":
+		return hb.Project
+	case hb.IsFile():
+		return ProjectFor(hb.Entity)
+	default:
+		return "unknown"
+	}
+}
+
+// Build returns the server heartbeat for hb, with its project and project
+// root detected from the path and the alternate language used when the
+// language is unknown, or else, with DetectLanguage, a guessed one. Apps
+// and domains only get the alternate language. With a PathKey, the project
+// name is still sent in the clear.
+func (t *Tracker) Build(hb Heartbeat) client.Heartbeat {
+	serverHB := client.Heartbeat{
+		UserID:     t.UserID,
+		Project:    hb.project(),
+		Language:   hb.Language,
+		Entity:     hb.Entity,
+		EntityType: hb.EntityType,
+		Category:   hb.Category,
+		Machine:    t.Machine,
+		Duration:   hb.Duration,
+		Timestamp:  int64(hb.Timestamp),
+		Tags:       hb.Tags,
+	}
+	if hb.AlternateLanguage != "" && hb.Language == "" {
+		serverHB.Language = hb.AlternateLanguage
+	}
+	if !hb.IsFile() {
+		return serverHB
+	}
+	serverHB.ProjectRoot = ProjectRoot(hb.Entity)
+	if t.DetectLanguage && serverHB.Language == "" {
+		serverHB.Language = DetectLanguage(hb.Entity)
+	}
+	if t.DetectDependencies {
+		serverHB.Dependencies = DetectDependencies(hb.Entity)
+	}
+	if t.PathKey != nil {
+		serverHB.Entity = t.PathKey.Encrypt(serverHB.Entity)
+		serverHB.ProjectRoot = t.PathKey.Encrypt(serverHB.ProjectRoot)
+	}
+	return serverHB
+}
+
+// Send sends a heartbeat after whatever is queued. With a Queue, the
+// heartbeat is recorded in the history and queued when the server can't be
+// reached or is down for maintenance; the error is still returned.
+func (t *Tracker) Send(hb client.Heartbeat) error {
+	if t.Queue == nil {
+		return t.Client.SendHeartbeats([]client.Heartbeat{hb})
+	}
+	t.Queue.RecordHistory(hb)
+	err := t.Queue.Flush(t.Client)
+	if err == nil {
+		err = t.Client.SendHeartbeats([]client.Heartbeat{hb})
+	}
+	if client.Retryable(err) {
+		if qerr := t.Queue.Enqueue(hb); qerr != nil {
+			return fmt.Errorf("%w, and queueing failed: %v", err, qerr)
+		}
+	}
+	return err
+}
+
+// ProjectFor extracts the project name from a file path: the sub-project
+// of a monorepo the file is in, else the file's directory. Files at the
+// root of a filesystem, drive or share have no project and get "unknown".
+func ProjectFor(entity string) string {
+	if name, _, ok := subProject(entity); ok {
+		return name
+	}
+	dir := filepath.Dir(normalize(entity))
+	name := filepath.Base(dir)
+	if name == "." || name == string(filepath.Separator) {
+		return "unknown"
+	}
+	return name
+}
+
+// vcsMarkers are the directories at the root of a checkout.
+var vcsMarkers = []string{".git", ".hg", ".svn"}
+
+// ProjectRoot returns the directory of the monorepo sub-project a file is
+// in, else the root of its checkout, the nearest directory up from it with
+// a .git, .hg or .svn, or the file's directory outside of one.
+func ProjectRoot(entity string) string {
+	if _, dir, ok := subProject(entity); ok {
+		return dir
+	}
+	start := filepath.Dir(normalize(entity))
+	if root, ok := checkoutRoot(start); ok {
+		return root
+	}
+	return start
+}
+
+// checkoutRoot returns the nearest directory up from dir with a .git, .hg
+// or .svn, false outside of a checkout.
+func checkoutRoot(dir string) (string, bool) {
+	for {
+		for _, marker := range vcsMarkers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return dir, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Merge folds heartbeats for the same entity, language, category and tags
+// that follow each other within the keystroke timeout of their project into
+// one, so chatty editors send a fraction of the requests. Each heartbeat
+// covers [Timestamp, Timestamp+Duration]; a merged heartbeat starts at the
+// first and lasts the time its parts cover, so duplicates and overlaps are
+// only counted once and gaps are not counted. The result is in time order.
+func Merge(heartbeats []Heartbeat, keystrokeTimeout func(project string) time.Duration) []Heartbeat {
+	sorted := make([]Heartbeat, len(heartbeats))
+	copy(sorted, heartbeats)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+
+	var merged []Heartbeat
+	open := make(map[string]int)    // key to index in merged
+	end := make(map[string]float64) // key to end of the time covered
+	for _, hb := range sorted {
+		project := hb.project()
+		key := strings.Join([]string{hb.Entity, hb.entityType(), project, hb.Language, hb.AlternateLanguage,
+			hb.Category, strings.Join(hb.Tags, ",")}, "\x00")
+		i, ok := open[key]
+		timeout := keystrokeTimeout(project)
+		if !ok || hb.Timestamp > end[key]+timeout.Seconds() {
+			open[key] = len(merged)
+			end[key] = hb.Timestamp + hb.Duration
+			merged = append(merged, hb)
+			continue
+		}
+		if hbEnd := hb.Timestamp + hb.Duration; hbEnd > end[key] {
+			merged[i].Duration += hbEnd - math.Max(hb.Timestamp, end[key])
+			end[key] = hbEnd
+		}
+		merged[i].IsWrite = merged[i].IsWrite || hb.IsWrite
+	}
+	return merged
+}
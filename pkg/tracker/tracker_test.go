@@ -0,0 +1,271 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+func TestMerge(t *testing.T) {
+	timeout := func(project string) time.Duration {
+		if project == "slow" {
+			return time.Hour
+		}
+		return time.Minute
+	}
+	merged := Merge([]Heartbeat{
+		{Entity: "/src/fast/a.go", Timestamp: 100, Duration: 30},
+		{Entity: "/src/fast/a.go", Timestamp: 120, Duration: 30, IsWrite: true}, // overlaps
+		{Entity: "/src/fast/a.go", Timestamp: 1000, Duration: 10},               // past the timeout
+		{Entity: "/src/slow/b.go", Timestamp: 100, Duration: 10},
+		{Entity: "/src/slow/b.go", Timestamp: 1000, Duration: 10},
+	}, timeout)
+
+	want := []Heartbeat{
+		{Entity: "/src/fast/a.go", Timestamp: 100, Duration: 50, IsWrite: true},
+		{Entity: "/src/slow/b.go", Timestamp: 100, Duration: 20},
+		{Entity: "/src/fast/a.go", Timestamp: 1000, Duration: 10},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("Merge = %+v, want %+v", merged, want)
+	}
+}
+
+func TestBuildApps(t *testing.T) {
+	tr := &Tracker{UserID: "u1", DetectLanguage: true}
+	got := tr.Build(Heartbeat{Entity: "Slack", EntityType: "app", Project: "meetings", Timestamp: 100, Duration: 30})
+	want := client.Heartbeat{UserID: "u1", Project: "meetings", Entity: "Slack", EntityType: "app",
+		Timestamp: 100, Duration: 30}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build = %+v, want %+v", got, want)
+	}
+	if got := tr.Build(Heartbeat{Entity: "github.com", EntityType: "domain"}); got.Project != "unknown" {
+		t.Errorf("Build project of a domain = %q, want unknown", got.Project)
+	}
+
+	// Heartbeats for the same app in different projects are kept apart
+	merged := Merge([]Heartbeat{
+		{Entity: "Slack", EntityType: "app", Project: "meetings", Timestamp: 100, Duration: 30},
+		{Entity: "Slack", EntityType: "app", Project: "support", Timestamp: 110, Duration: 30},
+		{Entity: "Slack", EntityType: "app", Project: "meetings", Timestamp: 120, Duration: 30},
+	}, func(string) time.Duration { return time.Minute })
+	if len(merged) != 2 || merged[0].Duration != 50 || merged[1].Project != "support" {
+		t.Errorf("Merge = %+v, want meetings for 50s and support", merged)
+	}
+}
+
+func TestProjectFor(t *testing.T) {
+	for entity, want := range map[string]string{
+		"/src/eztracker/main.go": "eztracker",
+		"eztracker/main.go":      "eztracker",
+		"/main.go":               "unknown",
+		"main.go":                "unknown",
+	} {
+		if got := ProjectFor(entity); got != want {
+			t.Errorf("ProjectFor(%q) = %q, want %q", entity, got, want)
+		}
+	}
+}
+
+func TestDetectMachine(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, "laptop"},
+		{map[string]string{"SSH_CONNECTION": "10.0.0.2 52100 10.0.0.5 22"}, "laptop"},
+		{map[string]string{"CODESPACE_NAME": "kru-eztracker-x7g9"}, "kru-eztracker-x7g9"},
+		{map[string]string{"GITPOD_WORKSPACE_ID": "kru-eztracker-8xk2"}, "kru-eztracker-8xk2"},
+		{map[string]string{"CODESPACE_NAME": "kru-eztracker-x7g9", "EZTRACKER_MACHINE": "dev"}, "dev"},
+	} {
+		getenv := func(name string) string { return tc.env[name] }
+		if got := detectMachine(getenv, "laptop"); got != tc.want {
+			t.Errorf("detectMachine(%v) = %q, want %q", tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestProjectRoot(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(repo, "cmd", "server"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	loose := t.TempDir()
+	for entity, want := range map[string]string{
+		filepath.Join(repo, "main.go"):                  repo,
+		filepath.Join(repo, "cmd", "server", "main.go"): repo,
+		filepath.Join(loose, "notes.md"):                loose,
+	} {
+		if got := ProjectRoot(entity); got != want {
+			t.Errorf("ProjectRoot(%q) = %q, want %q", entity, got, want)
+		}
+	}
+}
+
+func TestSendQueuesOffline(t *testing.T) {
+	// A closed server looks like being offline
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	tr := &Tracker{Client: client.New(url, "key"), UserID: "me", Queue: &Queue{Dir: t.TempDir()}}
+	hb := tr.Build(Heartbeat{Entity: "/src/eztracker/main.go", Timestamp: 100, AlternateLanguage: "Go", Duration: 30})
+	if hb.Project != "eztracker" || hb.Language != "Go" || hb.UserID != "me" {
+		t.Errorf("Build = %+v", hb)
+	}
+	if err := tr.Send(hb); err == nil {
+		t.Fatal("sending to a closed server succeeded")
+	}
+	if pending, err := tr.Queue.Pending(); err != nil || len(pending) != 1 {
+		t.Fatalf("pending = %+v, %v", pending, err)
+	}
+
+	received := 0
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer srv.Close()
+	tr.Client = client.New(srv.URL, "key")
+	if err := tr.Send(hb); err != nil {
+		t.Fatal(err)
+	}
+	if received != 2 {
+		t.Errorf("server received %d heartbeats, want the queued one and the new one", received)
+	}
+	if pending, _ := tr.Queue.Pending(); len(pending) != 0 {
+		t.Errorf("pending after reconnecting = %+v", pending)
+	}
+	if history, _ := tr.Queue.History(); len(history) != 2 {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestSubProjects(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "monorepo")
+	for file, content := range map[string]string{
+		".git/HEAD":                          "ref: refs/heads/main\n",
+		"package.json":                       `{"name": "monorepo", "private": true}`,
+		"packages/app-a/package.json":        `{"name": "@acme/app-a"}`,
+		"packages/app-b/.eztracker-project":  "billing\n",
+		"packages/app-b/package.json":        `{"name": "@acme/app-b"}`,
+		"packages/shared/.eztracker-project": "",
+		"services/api/go.mod":                "module example.com/monorepo/services/api/v2\n\ngo 1.22\n",
+		"crates/parser/Cargo.toml":           "[package]\nname = \"parser\"\nversion = \"0.1.0\"\n",
+		"crates/Cargo.toml":                  "[workspace]\nmembers = [\"parser\"]\n",
+	} {
+		path := filepath.Join(repo, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]struct{ project, root string }{
+		"packages/app-a/src/components/Button.tsx": {"@acme/app-a", "packages/app-a"},
+		"packages/app-b/src/index.ts":              {"billing", "packages/app-b"},
+		"packages/shared/util.ts":                  {"shared", "packages/shared"},
+		"services/api/internal/handler.go":         {"api", "services/api"},
+		"crates/parser/src/lib.rs":                 {"parser", "crates/parser"},
+		// Outside of sub-projects, and where only the whole repository
+		// has a manifest
+		"crates/README.md":   {"crates", ""},
+		"scripts/release.sh": {"scripts", ""},
+		"packages/README.md": {"packages", ""},
+	} {
+		entity := filepath.Join(repo, filepath.FromSlash(file))
+		root := filepath.Join(repo, filepath.FromSlash(want.root))
+		if got := ProjectFor(entity); got != want.project {
+			t.Errorf("ProjectFor(%q) = %q, want %q", file, got, want.project)
+		}
+		if got := ProjectRoot(entity); got != root {
+			t.Errorf("ProjectRoot(%q) = %q, want %q", file, got, root)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	dir := t.TempDir()
+	for name, tc := range map[string]struct{ content, want string }{
+		"Makefile":       {"", "Makefile"},
+		"Dockerfile.dev": {"", "Dockerfile"},
+		"Jenkinsfile":    {"", "Groovy"},
+		"deploy":         {"#!/bin/bash\nset -e\n", "Bash"},
+		"manage":         {"#!/usr/bin/env python3\nimport sys\n", "Python"},
+		"serve":          {"#!/usr/bin/env -S deno run --allow-net\n", "TypeScript"},
+		"release":        {"#!/usr/bin/env ruby\n", "Ruby"},
+		"vimmed":         {"local x = 1\n-- vim: set ft=lua:\n", "Lua"},
+		"emacsed":        {";; -*- mode: emacs-lisp; lexical-binding: t -*-\n", "Emacs Lisp"},
+		"coding-only":    {"# -*- coding: utf-8 -*-\nhello\n", ""},
+		"rules":          {"CFLAGS ?= -O2\n\nbuild: main.o\n\t$(CC) $(CFLAGS) -o app main.o\n", "Makefile"},
+		"common":         {"# Shared settings\nGOFLAGS := -trimpath\nBIN ?= bin\n", "Makefile"},
+		"base":           {"# syntax=docker/dockerfile:1\nFROM golang:1.22\nRUN go build ./...\n", "Dockerfile"},
+		"index":          {"<?php echo 'hi';\n", "PHP"},
+		"page":           {"<!DOCTYPE html>\n<html></html>\n", "HTML"},
+		"notes":          {"Remember: buy milk\n", ""},
+		"binary":         {"\x7fELF\x00\x01", ""},
+		"script.unknown": {"#!/bin/sh\n", ""},
+	} {
+		entity := filepath.Join(dir, name)
+		if err := os.WriteFile(entity, []byte(tc.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := DetectLanguage(entity); got != tc.want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", name, got, tc.want)
+		}
+	}
+	if got := DetectLanguage(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("DetectLanguage of a missing file = %q", got)
+	}
+}
+
+func TestPathKey(t *testing.T) {
+	secret, err := NewPathKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePathKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePathKey("abcd"); err == nil {
+		t.Error("ParsePathKey accepted a short key")
+	}
+
+	tr := &Tracker{UserID: "u1", PathKey: key}
+	hb := tr.Build(Heartbeat{Entity: "/src/eztracker/main.go", Language: "Go", Timestamp: 100, Duration: 30})
+	if !IsEncrypted(hb.Entity) || !IsEncrypted(hb.ProjectRoot) || hb.Project != "eztracker" {
+		t.Errorf("Build = %+v, want the entity and project root encrypted", hb)
+	}
+	// The same path encrypts the same, so the server can group by file
+	if again := tr.Build(Heartbeat{Entity: "/src/eztracker/main.go"}); again.Entity != hb.Entity {
+		t.Errorf("Encrypt gave %s then %s", hb.Entity, again.Entity)
+	}
+	if path, err := key.Decrypt(hb.Entity); err != nil || path != "/src/eztracker/main.go" {
+		t.Errorf("Decrypt = %q, %v", path, err)
+	}
+	if path, err := key.Decrypt("Slack"); err != nil || path != "Slack" {
+		t.Errorf("Decrypt of a plain entity = %q, %v", path, err)
+	}
+	if app := tr.Build(Heartbeat{Entity: "Slack", EntityType: "app"}); app.Entity != "Slack" {
+		t.Errorf("Build encrypted app %q", app.Entity)
+	}
+
+	other, _ := NewPathKey()
+	otherKey, _ := ParsePathKey(other)
+	if _, err := otherKey.Decrypt(hb.Entity); err == nil {
+		t.Error("Decrypt with another key succeeded")
+	}
+	if _, err := key.Decrypt(EncryptedPrefix + "!!"); err == nil {
+		t.Error("Decrypt of a malformed path succeeded")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseProxy checks the proxy setting: an http, https or socks5 URL, with
+// the proxy's credentials as user info if it needs them.
+func parseProxy(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q", value)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy %q, want an http, https or socks5 URL", value)
+}
+
+// httpClient returns the HTTP client the CLI talks to the server with. It
+// goes through the proxy setting, except for hosts in NO_PROXY, or else
+// through the proxy in HTTP_PROXY or HTTPS_PROXY.
+func httpClient(config Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy, err := parseProxy(config.Proxy); err == nil {
+		noProxy := os.Getenv("NO_PROXY")
+		if noProxy == "" {
+			noProxy = os.Getenv("no_proxy")
+		}
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			if bypassProxy(r.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxy, nil
+		}
+	}
+	transport.TLSClientConfig = config.TLS
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// bypassProxy reports whether host is in noProxy, a comma separated list
+// of hosts where "example.com" also covers its subdomains and "*" covers
+// every host.
+func bypassProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if entry == "" {
+			continue
+		}
+		// Ports are ignored, entries cover every port of a host
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(strings.Trim(entry, "[]"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
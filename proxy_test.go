@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestBypassProxy(t *testing.T) {
+	for _, tc := range []struct {
+		host, noProxy string
+		want          bool
+	}{
+		{"tracker.example.com", "", false},
+		{"tracker.example.com", "*", true},
+		{"tracker.example.com", "example.com", true},
+		{"tracker.example.com", ".example.com", true},
+		{"notexample.com", "example.com", false},
+		{"tracker.example.com", "other.com, tracker.example.com:8080", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"::1", "[::1]:8080", true},
+		{"::1", "::1", true},
+	} {
+		if got := bypassProxy(tc.host, tc.noProxy); got != tc.want {
+			t.Errorf("bypassProxy(%q, %q) = %v, want %v", tc.host, tc.noProxy, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kru/eztracker/client"
+	"github.com/kru/eztracker/internal/durationfmt"
+)
+
+// statuslineCache is the server's last answer to statusline, shared by the
+// status bars of every terminal.
+type statuslineCache struct {
+	FetchedAt int64            `json:"fetched_at"`
+	Today     client.LiveToday `json:"today"`
+}
+
+func statuslineFile() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "statusline.json"), nil
+}
+
+// runStatusline prints today's time and, while coding, the project and
+// language on one line for tmux or Polybar, as in "2h41m • eztracker • Go".
+// The server's answer is reused for --max-age, so status bars refreshing
+// every few seconds ask it once a minute at most, and shown even when the
+// server can't be reached.
+func runStatusline(args []string) int {
+	fs := flag.NewFlagSet("statusline", flag.ContinueOnError)
+	maxAge := fs.Duration("max-age", time.Minute, "How long to reuse the server's last answer")
+	separator := fs.String("separator", " • ", "Separator between the parts of the line")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	config := mustLoadConfig()
+
+	today, err := cachedLiveToday(config, *maxAge)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error fetching today's time: %v\n", err)
+		return exitCodeFor(err)
+	}
+	_, paused := pausedUntil()
+	fmt.Println(statusline(today, config.DurationFormat, *separator, paused))
+	return ExitCodeSuccess
+}
+
+// cachedLiveToday returns the server's answer for today, reusing the last
+// one for maxAge, or for as long as the server can't be reached.
+func cachedLiveToday(config Config, maxAge time.Duration) (client.LiveToday, error) {
+	path, err := statuslineFile()
+	if err != nil {
+		return client.LiveToday{}, err
+	}
+	var cached statuslineCache
+	data, err := os.ReadFile(path)
+	haveCache := err == nil && json.Unmarshal(data, &cached) == nil
+
+	now := time.Now()
+	if age := now.Sub(time.Unix(cached.FetchedAt, 0)); haveCache && age >= 0 && age < maxAge {
+		return cached.Today, nil
+	}
+	// "current" is the API key's own user
+	user := config.UserID
+	if user == "" {
+		user = "current"
+	}
+	today, err := newClient(config).LiveToday(user)
+	if err != nil {
+		if !haveCache {
+			return client.LiveToday{}, err
+		}
+		if config.Debug {
+			fmt.Fprintf(os.Stderr, "Debug: Showing the last answer, fetching today's time failed: %v\n", err)
+		}
+		return cached.Today, nil
+	}
+	cached = statuslineCache{FetchedAt: now.Unix(), Today: today}
+	if data, err := json.Marshal(cached); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+			os.WriteFile(path, data, 0o600)
+		}
+	}
+	return today, nil
+}
+
+// statusline formats today's time followed by what is being worked on.
+func statusline(today client.LiveToday, style durationfmt.Style, separator string, paused bool) string {
+	parts := []string{compactDuration(today.Seconds, style)}
+	switch {
+	case paused:
+		parts = append(parts, "paused")
+	case today.Active:
+		for _, part := range []string{today.Project, today.Language} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// compactDuration writes seconds compactly, unless another duration format
+// than the default is configured.
+func compactDuration(seconds float64, style durationfmt.Style) string {
+	if style != "" && style != durationfmt.Human {
+		return durationfmt.Format(seconds, style)
+	}
+	return durationfmt.Compact(seconds)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kru/eztracker/client"
+)
+
+// todayCache is the server's last answer to --today, for the day it was
+// fetched on.
+type todayCache struct {
+	Day       string       `json:"day"`
+	FetchedAt int64        `json:"fetched_at"`
+	Stats     client.Stats `json:"stats"`
+}
+
+func todayFile() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "today.json"), nil
+}
+
+// cachedTodaySummary returns today's summary, reusing the server's last
+// answer for maxAge, or for as long as the server can't be reached, as
+// long as it was for today. Status bars calling the CLI every few seconds
+// then only ask the server once in a while. A maxAge of 0 always asks the
+// server, and fails when it can't be reached.
+func cachedTodaySummary(config Config, maxAge time.Duration) (client.Stats, error) {
+	path, err := todayFile()
+	if err != nil {
+		return newClient(config).TodaySummary(config.UserID)
+	}
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	var cached todayCache
+	data, err := os.ReadFile(path)
+	haveCache := maxAge > 0 && err == nil && json.Unmarshal(data, &cached) == nil && cached.Day == day
+
+	if age := now.Sub(time.Unix(cached.FetchedAt, 0)); haveCache && age >= 0 && age < maxAge {
+		return cached.Stats, nil
+	}
+	stats, err := newClient(config).TodaySummary(config.UserID)
+	if err != nil {
+		if !haveCache {
+			return client.Stats{}, err
+		}
+		if config.Debug {
+			fmt.Fprintf(os.Stderr, "Debug: Showing the last answer, fetching today's summary failed: %v\n", err)
+		}
+		return cached.Stats, nil
+	}
+	cached = todayCache{Day: day, FetchedAt: now.Unix(), Stats: stats}
+	if data, err := json.Marshal(cached); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+			os.WriteFile(path, data, 0o600)
+		}
+	}
+	return stats, nil
+}
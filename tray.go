@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runTray prints a menu bar item in the plugin format of xbar and SwiftBar
+// on macOS and Argos on GNOME: today's time in the bar, and a menu with
+// what is being worked on and pause and resume controls that run this
+// CLI. It stands in for a tray app of its own, which would need a GUI
+// toolkit. Plugins are run on an interval set in their file name, such as
+// eztracker.1m.sh; the server is asked at most once a minute like with
+// statusline.
+func runTray(args []string) int {
+	fs := flag.NewFlagSet("tray", flag.ContinueOnError)
+	maxAge := fs.Duration("max-age", time.Minute, "How long to reuse the server's last answer")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	config := mustLoadConfig()
+	self, err := os.Executable()
+	if err != nil {
+		self = "eztracker"
+	}
+
+	today, err := cachedLiveToday(config, *maxAge)
+	if err != nil {
+		// The menu bar shows what is printed, so failures go there too
+		fmt.Println("⏱ ?")
+		fmt.Println("---")
+		fmt.Printf("%s | color=red\n", trayText(err.Error()))
+		return ExitCodeSuccess
+	}
+	until, paused := pausedUntil()
+	icon := "⏱"
+	if paused {
+		icon = "⏸"
+	}
+	fmt.Println(icon + " " + compactDuration(today.Seconds, config.DurationFormat))
+	fmt.Println("---")
+	switch {
+	case paused:
+		fmt.Println(trayText("Paused " + describePause(until)))
+	case today.Active:
+		fmt.Println(trayText("Working on " + strings.TrimSuffix(today.Project+" in "+today.Language, " in ")))
+	default:
+		fmt.Println("Idle")
+	}
+	fmt.Println("---")
+	action := func(title string, args ...string) {
+		fmt.Printf("%s | bash=%q", title, self)
+		for i, arg := range args {
+			fmt.Printf(" param%d=%s", i+1, arg)
+		}
+		fmt.Println(" terminal=false refresh=true")
+	}
+	if paused {
+		action("Resume tracking", "resume")
+	} else {
+		action("Pause for 30 minutes", "pause", "30m")
+		action("Pause for an hour", "pause", "1h")
+		action("Pause until resumed", "pause")
+	}
+	return ExitCodeSuccess
+}
+
+// trayText keeps text from being read as the plugin format's parameters,
+// which follow a "|".
+func trayText(s string) string {
+	return strings.ReplaceAll(s, "|", "¦")
+}